@@ -0,0 +1,234 @@
+// Package admin serves an HTTP API for operating a long-running integrator: starting runs, checking
+// their progress, managing failed transactions and viewing the effective configuration.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/integrator/copier"
+	"github.com/intervention-engine/integrator/txlog"
+)
+
+// Server serves the admin API.  Every request must present the bearer token, if one is set.
+// Servers that rely on client certificates instead should be served with TLS that requires them
+// (see transport.NewServerTLSConfig).
+type Server struct {
+	Runner *copier.Runner
+	TxLog  txlog.AdminManager
+	// Config is the effective configuration reported by the API.  Its secrets must already be
+	// redacted.
+	Config interface{}
+	// Token is the bearer token clients must present (default: none)
+	Token string
+	mux   *http.ServeMux
+}
+
+func NewServer(runner *copier.Runner, txLog txlog.AdminManager, token string) *Server {
+	s := &Server{
+		Runner: runner,
+		TxLog:  txLog,
+		Token:  token,
+		mux:    http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/runs", s.serveRuns)
+	s.mux.HandleFunc("/runs/current", s.serveCurrentRun)
+	s.mux.HandleFunc("/failures", s.serveFailures)
+	s.mux.HandleFunc("/failures/retry", s.serveRetry)
+	s.mux.HandleFunc("/config", s.serveConfig)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" {
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="integrator"`)
+			http.Error(w, "A valid bearer token is required", http.StatusUnauthorized)
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// serveRuns lists the current and recent runs, or starts a run of every source, or the one named
+// by the source parameter, for every EE number, or the one given by the ee parameter
+func (s *Server) serveRuns(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		runs := s.Runner.Recent()
+		if runs == nil {
+			runs = []*copier.Run{}
+		}
+		writeJSON(w, http.StatusOK, runs)
+	case "POST":
+		var sources []*copier.Source
+		if name := r.FormValue("source"); name != "" {
+			src := s.Runner.Source(name)
+			if src == nil {
+				http.Error(w, fmt.Sprintf("Source %s isn't configured", name), http.StatusBadRequest)
+				return
+			}
+			sources = []*copier.Source{src}
+		}
+		var ees []string
+		if ee := r.FormValue("ee"); ee != "" {
+			ees = []string{ee}
+		}
+		run, err := s.Runner.Start("admin", sources, ees)
+		if err == copier.ErrRunInProgress {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, run)
+	default:
+		methodNotAllowed(w, "GET, POST")
+	}
+}
+
+// serveCurrentRun reports the progress of the run in progress
+func (s *Server) serveCurrentRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	run := s.Runner.Current()
+	if run == nil {
+		http.Error(w, "No run is in progress", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+// serveFailures lists the failed transactions, optionally only those dated on or after the since
+// parameter, or only those that are dead-lettered
+func (s *Server) serveFailures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	since, err := parseTime(r.FormValue("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := s.TxLog.FindFailures(r.Context(), since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.FormValue("dead-lettered") == "true" {
+		var deadLettered []*txlog.Entry
+		for _, e := range entries {
+			if e.DeadLetter {
+				deadLettered = append(deadLettered, e)
+			}
+		}
+		entries = deadLettered
+	}
+	writeEntries(w, entries)
+}
+
+// serveRetry releases the failed transactions for the documentID parameters (optionally only from
+// the source parameter's source), or every failed transaction if the all parameter is true, so
+// they're attempted on the next run
+func (s *Server) serveRetry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	r.ParseForm()
+	docIDs := r.Form["documentID"]
+	all := r.Form.Get("all") == "true"
+	if len(docIDs) == 0 && !all {
+		http.Error(w, "Either documentID or all=true is required", http.StatusBadRequest)
+		return
+	} else if len(docIDs) > 0 && all {
+		http.Error(w, "Only one of documentID and all=true may be given", http.StatusBadRequest)
+		return
+	}
+
+	var entries []*txlog.Entry
+	if all {
+		var err error
+		if entries, err = s.TxLog.FindFailures(r.Context(), time.Time{}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, docID := range docIDs {
+		found, err := s.TxLog.FindEntriesByDocumentID(r.Context(), docID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, found...)
+	}
+	if _, ok := r.Form["source"]; ok {
+		var kept []*txlog.Entry
+		for _, e := range entries {
+			if e.Source == r.Form.Get("source") {
+				kept = append(kept, e)
+			}
+		}
+		entries = kept
+	}
+
+	released, err := txlog.ReleaseEntries(r.Context(), s.TxLog, entries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeEntries(w, released)
+}
+
+// serveConfig reports the effective configuration
+func (s *Server) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Config)
+}
+
+// parseTime parses a date (e.g., "2016-06-01", taken to be local) or an RFC 3339 time.  An empty
+// value is the zero time.
+func parseTime(val string) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", val, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s is not a valid value for a date (e.g., \"2016-06-01\" or \"2016-06-01T12:00:00Z\")", val)
+	}
+	return t, nil
+}
+
+// writeEntries writes the entries as JSON, sorted by date
+func writeEntries(w http.ResponseWriter, entries []*txlog.Entry) {
+	txlog.SortByDate(entries)
+	w.Header().Set("Content-Type", "application/json")
+	txlog.WriteJSON(w, entries)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
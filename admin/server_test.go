@@ -0,0 +1,226 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/intervention-engine/integrator/copier"
+	"github.com/intervention-engine/integrator/hie"
+	"github.com/intervention-engine/integrator/testkit"
+	"github.com/intervention-engine/integrator/txlog"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestServerSuite(t *testing.T) {
+	suite.Run(t, new(ServerSuite))
+}
+
+type ServerSuite struct {
+	suite.Suite
+	Scenario *testkit.Scenario
+	Admin    *Server
+	Server   *httptest.Server
+}
+
+func (suite *ServerSuite) SetupTest() {
+	suite.Scenario = testkit.NewScenario(suite.T())
+	suite.Scenario.GivenPatient("123", testkit.NewFakeDocument("1.1", time.Date(2016, time.June, 1, 0, 0, 0, 0, time.UTC)))
+	suite.Scenario.GivenPatient("456", testkit.NewFakeDocument("2.1", time.Date(2016, time.June, 2, 0, 0, 0, 0, time.UTC)))
+	sources := []*copier.Source{{Name: "north", Client: hie.NewHttpClient(suite.Scenario.HieURL())}}
+	runner := copier.NewRunner(suite.Scenario.Copier, sources, []string{"123", "456"}, suite.Scenario.Formats...)
+	suite.Admin = NewServer(runner, suite.Scenario.TxLog, "s3cret")
+	suite.Server = httptest.NewServer(suite.Admin)
+}
+
+func (suite *ServerSuite) TearDownTest() {
+	suite.Server.Close()
+	suite.Scenario.Close()
+}
+
+func (suite *ServerSuite) TestRequiresToken() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	resp, err := http.Get(suite.Server.URL + "/runs")
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(`Bearer realm="integrator"`, resp.Header.Get("WWW-Authenticate"))
+
+	suite.Admin.Token = "other"
+	resp = suite.do("GET", "/runs", nil)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	// The token must be sent as a bearer token
+	suite.Admin.Token = "s3cret"
+	req, err := http.NewRequest("GET", suite.Server.URL+"/runs", nil)
+	require.NoError(err)
+	req.Header.Set("Authorization", "s3cret")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	// Servers that rely on client certificates don't need a token
+	suite.Admin.Token = ""
+	resp = suite.do("GET", "/runs", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+}
+
+func (suite *ServerSuite) TestTriggerRun() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var run copier.Run
+	resp := suite.do("POST", "/runs?ee=456", &run)
+	require.Equal(http.StatusAccepted, resp.StatusCode)
+	assert.Equal("admin", run.Trigger)
+	assert.Equal([]string{"north"}, run.Sources)
+	assert.Equal(1, run.EEs)
+	suite.waitForRun()
+
+	var runs []*copier.Run
+	resp = suite.do("GET", "/runs", &runs)
+	require.Equal(http.StatusOK, resp.StatusCode)
+	require.Len(runs, 1)
+	assert.Equal(run.ID, runs[0].ID)
+	assert.Equal(1, runs[0].Completed)
+	assert.NotNil(runs[0].Finished)
+	assert.True(suite.Scenario.ThenIngested("2.1"))
+
+	// Without an EE number, every EE number is copied
+	resp = suite.do("POST", "/runs", &run)
+	require.Equal(http.StatusAccepted, resp.StatusCode)
+	assert.Equal(2, run.EEs)
+	suite.waitForRun()
+	assert.True(suite.Scenario.ThenIngested("1.1"))
+}
+
+func (suite *ServerSuite) TestTriggerRunErrors() {
+	assert := suite.Assert()
+
+	resp := suite.do("POST", "/runs?source=west", nil)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	resp = suite.do("DELETE", "/runs", nil)
+	assert.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal("GET, POST", resp.Header.Get("Allow"))
+
+	resp = suite.do("GET", "/runs/current", nil)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func (suite *ServerSuite) TestFailuresAndRetry() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Scenario.Ingest.FailNext(400)
+	_, err := suite.Admin.Runner.Run("cron", nil, []string{"123"})
+	require.NoError(err)
+
+	var entries []*failure
+	resp := suite.do("GET", "/failures?dead-lettered=true", &entries)
+	require.Equal(http.StatusOK, resp.StatusCode)
+	require.Len(entries, 1)
+	assert.Equal("1.1", entries[0].DocumentID)
+	assert.Equal(txlog.FailureIngestRejected, entries[0].FailureReason)
+
+	resp = suite.do("GET", "/failures?since=2100-01-01", &entries)
+	require.Equal(http.StatusOK, resp.StatusCode)
+	assert.Empty(entries)
+	resp = suite.do("GET", "/failures?since=yesterday", nil)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	resp = suite.do("POST", "/failures/retry", nil)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	resp = suite.do("POST", "/failures/retry?documentID=1.1&source=south", &entries)
+	require.Equal(http.StatusOK, resp.StatusCode)
+	assert.Empty(entries)
+	resp = suite.do("POST", "/failures/retry?documentID=1.1", &entries)
+	require.Equal(http.StatusOK, resp.StatusCode)
+	require.Len(entries, 1)
+	assert.False(entries[0].DeadLetter)
+
+	resp = suite.do("GET", "/failures?dead-lettered=true", &entries)
+	require.Equal(http.StatusOK, resp.StatusCode)
+	assert.Empty(entries)
+
+	// The released document is copied on the next run
+	_, err = suite.Admin.Runner.Run("cron", nil, []string{"123"})
+	require.NoError(err)
+	assert.True(suite.Scenario.ThenIngested("1.1"))
+}
+
+func (suite *ServerSuite) TestRetryAllFailed() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Scenario.Ingest.FailNext(400, 400)
+	_, err := suite.Admin.Runner.Run("cron", nil, nil)
+	require.NoError(err)
+
+	var entries []*failure
+	resp := suite.do("POST", "/failures/retry?all=true&documentID=1.1", nil)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	resp = suite.do("POST", "/failures/retry?all=true", &entries)
+	require.Equal(http.StatusOK, resp.StatusCode)
+	require.Len(entries, 2)
+	assert.Equal("1.1", entries[0].DocumentID)
+	assert.Equal("2.1", entries[1].DocumentID)
+}
+
+func (suite *ServerSuite) TestConfig() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Admin.Config = map[string]interface{}{"settings": map[string]string{"HIE_PASSWORD": "REDACTED"}}
+	var config map[string]map[string]string
+	resp := suite.do("GET", "/config", &config)
+	require.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("REDACTED", config["settings"]["HIE_PASSWORD"])
+}
+
+// failure holds the parts of a failed transaction the tests check.  Entries are decoded into it,
+// since an entry's JSON can't be decoded into a txlog.Entry: the embedded query response entry's
+// UnmarshalJSON would only decode its own fields.
+type failure struct {
+	DocumentID    string              `json:"documentID"`
+	FailureReason txlog.FailureReason `json:"failureReason"`
+	DeadLetter    bool                `json:"deadLetter"`
+}
+
+// do sends a request with the server's token, decoding the JSON response into v if it's given
+func (suite *ServerSuite) do(method, path string, v interface{}) *http.Response {
+	require := suite.Require()
+
+	req, err := http.NewRequest(method, suite.Server.URL+path, nil)
+	require.NoError(err)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(err)
+	defer resp.Body.Close()
+	if v != nil && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		require.NoError(json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp
+}
+
+// waitForRun waits for the run in progress to finish, checking its progress is reported meanwhile
+func (suite *ServerSuite) waitForRun() {
+	for {
+		var run copier.Run
+		resp := suite.do("GET", "/runs/current", &run)
+		if resp.StatusCode == http.StatusNotFound {
+			return
+		}
+		suite.Require().Equal(http.StatusOK, resp.StatusCode)
+		time.Sleep(5 * time.Millisecond)
+	}
+}
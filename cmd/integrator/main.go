@@ -0,0 +1,638 @@
+// Command integrator copies CDA documents from an HIE to the Intervention Engine's ingest endpoint.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+
+	"gopkg.in/mgo.v2"
+
+	"github.com/intervention-engine/integrator/admin"
+	"github.com/intervention-engine/integrator/config"
+	"github.com/intervention-engine/integrator/copier"
+	"github.com/intervention-engine/integrator/hie"
+	"github.com/intervention-engine/integrator/ingest"
+	"github.com/intervention-engine/integrator/testkit"
+	"github.com/intervention-engine/integrator/transport"
+	"github.com/intervention-engine/integrator/txlog"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			replay(os.Args[2:])
+			return
+		case "mock-hie":
+			mockHie(os.Args[2:])
+			return
+		case "generate":
+			generate(os.Args[2:])
+			return
+		case "benchmark":
+			benchmark(os.Args[2:])
+			return
+		case "history":
+			history(os.Args[2:])
+			return
+		case "failures":
+			failures(os.Args[2:])
+			return
+		case "show":
+			show(os.Args[2:])
+			return
+		case "retry":
+			retry(os.Args[2:])
+			return
+		case "forget":
+			forget(os.Args[2:])
+			return
+		case "dead-letter":
+			deadLetter(os.Args[2:])
+			return
+		case "adopt-unnamed-source":
+			adoptUnnamedSource(os.Args[2:])
+			return
+		}
+	}
+
+	hieFlag := flag.String("hie", "", "HIE API Endpoint URL (env: HIE_URL).  For XDS.b HIEs, this is the Document Registry URL.  For FHIR HIEs, this is the FHIR base URL.  For file HIEs, this is the path to the drop folder.")
+	sourcesFlag := flag.String("sources", "", "Path to a JSON file configuring several named HIE sources, each with its own URL, credentials, formats and schedule (env: HIE_SOURCES, default: a single HIE configured by the other HIE flags)")
+	hieTypeFlag := flag.String("hie-type", "", "Type of HIE API: \"json\", \"xds\", \"fhir\" or \"file\" (env: HIE_TYPE, default: \"json\")")
+	xdsRepositoryFlag := flag.String("xds-repository", "", "XDS.b Document Repository URL (env: XDS_REPOSITORY_URL, default: the HIE URL)")
+	xdsAuthorityFlag := flag.String("xds-authority", "", "Assigning authority OID for EE numbers used as XDS.b patient IDs (env: XDS_ASSIGNING_AUTHORITY).  Required for XDS.b.")
+	xdsCommunityFlag := flag.String("xds-community", "", "XDS.b home community ID to send with retrieve requests (env: XDS_HOME_COMMUNITY_ID, default: none)")
+	xdsLookbackFlag := flag.String("xds-lookback", "", "How far back each XDS.b query reaches before the last one, to find documents registered late with an earlier creation time (env: XDS_LOOKBACK, default: 168h)")
+	fhirSystemFlag := flag.String("fhir-identifier-system", "", "Identifier system URI for EE numbers on the FHIR HIE's Patient resources (env: FHIR_IDENTIFIER_SYSTEM, default: none)")
+	fileArchiveFlag := flag.String("file-archive-dir", "", "Folder to move a file HIE's documents to once they've been ingested (env: FILE_ARCHIVE_DIR, default: leave them in place)")
+	fileErrorFlag := flag.String("file-error-dir", "", "Folder to move a file HIE's documents to when they fail to be ingested (env: FILE_ERROR_DIR, default: leave them in place)")
+	protocolFlag := flag.String("hie-protocol", "", "Path to a JSON file describing a JSON HIE's query URL template, parameter names, date formats and timezone (env: HIE_PROTOCOL, default: the original integrator protocol)")
+	strictFlag := flag.Bool("strict-validation", false, "Flag to indicate if JSON HIE query responses with any schema violation should be rejected, rather than skipping malformed entries (env: HIE_STRICT_VALIDATION, default: false)")
+	hieAuthFlags := config.RegisterAuthFlags("", "HIE_", "HIE")
+	ingestFlag := flag.String("ingest", "", "Ingest API Endpoint URL (env: INGEST_URL)")
+	ingestAuthFlags := config.RegisterAuthFlags("ingest-", "INGEST_", "the ingest service")
+	ingestTypeFlag := flag.String("ingest-type", "", "Type of ingest API: \"ccda\" to post raw documents or \"fhir\" to post FHIR transaction bundles (env: INGEST_TYPE, default: \"ccda\")")
+	ingestFhirSystemFlag := flag.String("ingest-fhir-identifier-system", "", "Identifier system URI for EE numbers on the FHIR ingest server's Patient resources (env: INGEST_FHIR_IDENTIFIER_SYSTEM, default: none)")
+	eeFlag := flag.String("ee", "", "EE number to copy data for (env: EE).  User must supply 'ee' OR 'eeFile'.")
+	eeFileFlag := flag.String("eeFile", "", "Path to a file with an EE number on each line (env: EE_FILE).  User must supply 'ee' OR 'eeFile'.")
+	formatsFlag := flag.String("formats", "", "Comma-separate list of supported document formats (env: FORMATS, default: \"XML^HL7^231^CCD^C32,XML^HL7^231^CCD^V1.1\")")
+	tlsCertFlag := flag.String("tls-cert", "", "Path to a PEM client certificate for mutual TLS with the HIE (env: HIE_TLS_CERT, default: none)")
+	tlsKeyFlag := flag.String("tls-key", "", "Path to the PEM private key for the HIE client certificate (env: HIE_TLS_KEY, default: none)")
+	tlsCAFlag := flag.String("tls-ca", "", "Path to a PEM bundle of CA certificates to trust for the HIE instead of the system roots (env: HIE_TLS_CA, default: none)")
+	tlsMinVersionFlag := flag.String("tls-min-version", "", "Minimum TLS version to use with the HIE: \"1.0\", \"1.1\" or \"1.2\" (env: HIE_TLS_MIN_VERSION, default: Go's default)")
+	tlsRenegotiateFlag := flag.Bool("tls-renegotiate", false, "Flag to indicate if the HIE may request TLS renegotiation (env: HIE_TLS_RENEGOTIATE, default: false)")
+	curlFlag := flag.Bool("curl", false, "Deprecated: use tls-renegotiate instead (env: USE_CURL).  Enables TLS renegotiation, which is what the system CUrl command was used for.")
+	retriesFlag := flag.String("retries", "", "Number of times to retry HIE and ingest requests that fail for transient reasons (env: HTTP_RETRIES, default: 3)")
+	retryBackoffFlag := flag.String("retry-backoff", "", "Delay before the first retry, doubling for each retry after that (env: HTTP_RETRY_BACKOFF, default: \"1s\")")
+	retryMaxBackoffFlag := flag.String("retry-max-backoff", "", "Maximum delay between retries.  Requests aren't retried if the server asks for a longer delay. (env: HTTP_RETRY_MAX_BACKOFF, default: \"30s\")")
+	requestTimeoutFlag := flag.String("request-timeout", "", "Maximum time for each HIE or ingest request, including reading the response (env: HTTP_REQUEST_TIMEOUT, default: \"2m\")")
+	maxRunTimeFlag := flag.String("max-run-time", "", "Maximum time for a run to copy all EE numbers' records.  Documents not copied in time are retried on the next run. (env: INTEGRATOR_MAX_RUN_TIME, default: no limit)")
+	ingestIdempotentFlag := flag.Bool("ingest-idempotent", false, "Flag to indicate that the ingest service safely handles duplicate uploads, so uploads may be retried after any transient failure (env: INGEST_IDEMPOTENT, default: false)")
+	queryWindowFlag := flag.String("query-window", "", "Split HIE queries into date windows of this length (e.g., \"8760h\" for a year), checkpointing progress after each one (env: QUERY_WINDOW, default: a single query)")
+	maxAttemptsFlag := flag.String("max-attempts", "", "Number of times a document is attempted before it's dead-lettered and skipped until an operator releases it (env: MAX_ATTEMPTS, default: no limit).  Documents the ingest service rejects, or the HIE no longer has, are dead-lettered right away.")
+	attemptBackoffFlag := flag.String("attempt-backoff", "", "Delay before attempting a failed document again, doubling after each further failure (env: ATTEMPT_BACKOFF, default: attempted again on every run)")
+	attemptMaxBackoffFlag := flag.String("attempt-max-backoff", "", "Maximum delay before attempting a failed document again (env: ATTEMPT_MAX_BACKOFF, default: \"24h\")")
+	verifyFlag := flag.String("verify", "", "How to check downloaded documents against the hash and size reported by the HIE: \"off\", \"lenient\" (only size mismatches fail) or \"strict\" (env: VERIFY_DOCUMENTS, default: \"lenient\")")
+	mongoFlag := flag.String("mongo", "", "MongoDB address (env: MONGO_URL, default: \"mongodb://localhost:27017\")")
+	copyDirFlag := flag.String("copy-dir", "", "Path to a folder where HIE records should be copied locally (env: COPY_DIR, default: none)")
+	cronFlag := flag.String("cron", "", "Cron expression indicating when the integrator tool should run to refresh data (env: INTEGRATOR_CRON, example: \"0 0 20 * * *\").  Sources with a cron expression of their own use it instead.  If cron is not supplied, \"now\" must be set.")
+	nowFlag := flag.Bool("now", false, "Flag to indicate if the integrator should run immediately (env: INTEGRATOR_NOW, default: false).  If used without cron, integrator will run once and then exit.  If now is not set, \"cron\" must be supplied.")
+	recordFlag := flag.String("record-cassettes", "", "Path to a folder to record every HIE and ingest exchange to, with credentials redacted, so they can be played back later (env: CASSETTE_RECORD_DIR, default: none)")
+	playFlag := flag.String("play-cassettes", "", "Path to a folder of recorded exchanges to answer HIE and ingest requests from, instead of sending them (env: CASSETTE_PLAY_DIR, default: none)")
+	redactFlag := flag.String("cassette-redact", "", "Comma-separated list of PHI fields to mask in recorded exchanges, by query parameter, JSON field or XML element name, e.g. \"ee,given,family,birthTime\" (env: CASSETTE_REDACT, default: only credentials are masked).  The EE numbers being copied are always masked in URLs.")
+	adminAddrFlag := flag.String("admin-addr", "", "Address to serve the admin API on while running on a schedule, e.g. \":8443\" (env: ADMIN_ADDR, default: no admin API).  Requires admin-token, admin-tls-client-ca or both.")
+	adminTokenFlag := flag.String("admin-token", "", "Bearer token that admin API clients must present (env: ADMIN_TOKEN, default: none)")
+	adminTLSCertFlag := flag.String("admin-tls-cert", "", "Path to a PEM certificate to serve the admin API over HTTPS with (env: ADMIN_TLS_CERT, default: serve over HTTP)")
+	adminTLSKeyFlag := flag.String("admin-tls-key", "", "Path to the PEM private key for the admin API certificate (env: ADMIN_TLS_KEY, default: none)")
+	adminClientCAFlag := flag.String("admin-tls-client-ca", "", "Path to a PEM bundle of CA certificates that admin API clients' certificates must be signed by (env: ADMIN_TLS_CLIENT_CA, default: client certificates aren't required)")
+	logFileFlag := flag.String("logdir", "", "Path to a directory for integrator logs to be written to.")
+	flag.Parse()
+
+	lfpath := config.Value(logFileFlag, "INTEGRATOR_LOG_DIR", "")
+	if lfpath != "" {
+		err := os.Mkdir(lfpath, 0755)
+		if err != nil && !os.IsExist(err) {
+			fmt.Println("Error creating log directory:" + err.Error())
+		}
+		lf, err := os.OpenFile(lfpath+"/integrator.log", os.O_RDWR|os.O_APPEND, 0755)
+		if os.IsNotExist(err) {
+			lf, err = os.Create(lfpath + "/integrator.log")
+		}
+		if err != nil {
+			fmt.Println("Unable to create ie log file:" + err.Error())
+		} else {
+			log.SetOutput(lf)
+		}
+	}
+
+	ingestURL := config.RequiredValue(ingestFlag, "INGEST_URL", "Ingest URL")
+	if strings.HasPrefix(ingestURL, ":") {
+		ingestURL = "http://localhost" + ingestURL
+	}
+
+	ee := config.Value(eeFlag, "EE", "")
+	eeFile := config.Value(eeFileFlag, "EE_FILE", "")
+	if ee == "" && eeFile == "" {
+		fmt.Fprintln(os.Stderr, "EE or EE File must be passed in as an argument or environment variable.")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	var err error
+	var eeSlice []string
+	if ee != "" {
+		eeSlice = []string{ee}
+	} else {
+		eeSlice, err = config.ParseEEFile(eeFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't get EE numbers from ee file:", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	formats := config.Value(formatsFlag, "FORMATS", "XML^HL7^231^CCD^C32,XML^HL7^231^CCD^V1.1")
+	fmtSlice := strings.Split(formats, ",")
+
+	retryPolicy := transport.NewRetryPolicy(
+		config.IntValue(retriesFlag, "HTTP_RETRIES", 3),
+		config.DurationValue(retryBackoffFlag, "HTTP_RETRY_BACKOFF", time.Second),
+		config.DurationValue(retryMaxBackoffFlag, "HTTP_RETRY_MAX_BACKOFF", 30*time.Second),
+	)
+
+	requestTimeout := config.DurationValue(requestTimeoutFlag, "HTTP_REQUEST_TIMEOUT", 2*time.Minute)
+	maxRunTime := config.DurationValue(maxRunTimeFlag, "INTEGRATOR_MAX_RUN_TIME", 0)
+
+	verifyMode, err := copier.ParseVerifyMode(config.Value(verifyFlag, "VERIFY_DOCUMENTS", "lenient"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	var sourceConfigs []*config.SourceConfig
+	if sourcesFile := config.Value(sourcesFlag, "HIE_SOURCES", ""); sourcesFile != "" {
+		sourceConfigs, err = config.LoadSourceConfigs(sourcesFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	} else {
+		hieURL := config.RequiredValue(hieFlag, "HIE_URL", "HIE URL")
+		hieType := config.Value(hieTypeFlag, "HIE_TYPE", "json")
+		tlsOpts := transport.TLSOptions{
+			CertFile:    config.Value(tlsCertFlag, "HIE_TLS_CERT", ""),
+			KeyFile:     config.Value(tlsKeyFlag, "HIE_TLS_KEY", ""),
+			CAFile:      config.Value(tlsCAFlag, "HIE_TLS_CA", ""),
+			MinVersion:  config.Value(tlsMinVersionFlag, "HIE_TLS_MIN_VERSION", ""),
+			Renegotiate: config.BoolValue(tlsRenegotiateFlag, "HIE_TLS_RENEGOTIATE"),
+		}
+		if config.BoolValue(curlFlag, "USE_CURL") {
+			fmt.Fprintln(os.Stderr, "The curl flag is deprecated and CUrl is no longer used.  Enabling TLS renegotiation instead.")
+			tlsOpts.Renegotiate = true
+		}
+		sourceConfig := &config.SourceConfig{
+			Type:                 hieType,
+			URL:                  hieURL,
+			Auth:                 hieAuthFlags.Options(),
+			TLS:                  tlsOpts,
+			Protocol:             config.Value(protocolFlag, "HIE_PROTOCOL", ""),
+			StrictValidation:     config.BoolValue(strictFlag, "HIE_STRICT_VALIDATION"),
+			XdsRepository:        config.Value(xdsRepositoryFlag, "XDS_REPOSITORY_URL", ""),
+			XdsCommunity:         config.Value(xdsCommunityFlag, "XDS_HOME_COMMUNITY_ID", ""),
+			XdsLookback:          config.Value(xdsLookbackFlag, "XDS_LOOKBACK", ""),
+			FhirIdentifierSystem: config.Value(fhirSystemFlag, "FHIR_IDENTIFIER_SYSTEM", ""),
+			ArchiveDir:           config.Value(fileArchiveFlag, "FILE_ARCHIVE_DIR", ""),
+			ErrorDir:             config.Value(fileErrorFlag, "FILE_ERROR_DIR", ""),
+		}
+		switch hieType {
+		case "json", "fhir", "file":
+		case "xds":
+			sourceConfig.XdsAuthority = config.RequiredValue(xdsAuthorityFlag, "XDS_ASSIGNING_AUTHORITY", "XDS assigning authority")
+		default:
+			fmt.Fprintf(os.Stderr, "%s is not a supported HIE type.\n", hieType)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+		sourceConfigs = []*config.SourceConfig{sourceConfig}
+	}
+
+	mongo := config.Value(mongoFlag, "MONGO_URL", "mongodb://localhost:27017")
+	if strings.HasPrefix(mongo, ":") {
+		mongo = "mongodb://localhost" + mongo
+	}
+	copyDir := config.Value(copyDirFlag, "COPY_DIR", "")
+
+	cronSpec := config.Value(cronFlag, "INTEGRATOR_CRON", "")
+	now := config.BoolValue(nowFlag, "INTEGRATOR_NOW")
+	scheduled := cronSpec != ""
+	for _, c := range sourceConfigs {
+		scheduled = scheduled || c.Cron != ""
+	}
+	if !scheduled && !now {
+		fmt.Fprintln(os.Stderr, "Cron and/or the now flag must be specified")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	session, err := mgo.Dial(mongo)
+	if err != nil {
+		panic("Can't connect to the database")
+	}
+	defer session.Close()
+	db := session.DB("integrator")
+
+	txLogManager, err := txlog.NewMgoManager(db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error configuring the log manager:", err.Error())
+		os.Exit(1)
+	}
+
+	var sources []*copier.Source
+	for _, c := range sourceConfigs {
+		src, err := c.NewSource(requestTimeout, retryPolicy)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		sources = append(sources, src)
+	}
+
+	ingestHttpClient := transport.NewHttpClient(nil)
+	ingestHttpClient.Timeout = requestTimeout
+	ingestAuth, err := transport.NewAuthenticator(ingestAuthFlags.Options(), ingestHttpClient)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error configuring ingest authentication:", err.Error())
+		os.Exit(1)
+	}
+
+	ingestClient := newIngestClient(config.Value(ingestTypeFlag, "INGEST_TYPE", "ccda"), ingestURL, config.Value(ingestFhirSystemFlag, "INGEST_FHIR_IDENTIFIER_SYSTEM", ""),
+		ingestAuth, ingestHttpClient, retryPolicy, config.BoolValue(ingestIdempotentFlag, "INGEST_IDEMPOTENT"))
+
+	// Each source and the ingest service get their own cassette
+	recordDir := config.Value(recordFlag, "CASSETTE_RECORD_DIR", "")
+	playDir := config.Value(playFlag, "CASSETTE_PLAY_DIR", "")
+	if recordDir != "" && playDir != "" {
+		fmt.Fprintln(os.Stderr, "Cassettes can be recorded or played, but not both at once.")
+		os.Exit(1)
+	}
+	if cassetteDir := recordDir + playDir; cassetteDir != "" {
+		var fields []string
+		if redact := config.Value(redactFlag, "CASSETTE_REDACT", ""); redact != "" {
+			fields = strings.Split(redact, ",")
+		}
+		redactor := transport.NewRedactor(fields...)
+		redactor.Values = eeSlice
+		clients := map[string]*http.Client{"ingest": ingestHttpClient}
+		for _, src := range sources {
+			if hieClient, ok := src.Client.(*hie.HttpClient); ok {
+				name := "hie"
+				if src.Name != "" {
+					name += "-" + src.Name
+				}
+				clients[name] = hieClient.Client
+			}
+		}
+		for name, client := range clients {
+			if err := transport.UseCassette(client, filepath.Join(cassetteDir, name), playDir != "", redactor); err != nil {
+				fmt.Fprintln(os.Stderr, "Error configuring cassettes:", err.Error())
+				os.Exit(1)
+			}
+		}
+	}
+
+	var dataCopier *copier.DataCopier
+	if copyDir == "" {
+		dataCopier, err = copier.NewDataCopier(sources[0].Client, ingestClient, txLogManager)
+	} else {
+		dataCopier, err = copier.NewDataCopierWithLocalCopies(sources[0].Client, ingestClient, txLogManager, copyDir)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error configuring the data copier:", err.Error())
+		os.Exit(1)
+	}
+	dataCopier.Sources = sources
+	dataCopier.Verify = verifyMode
+	dataCopier.QueryWindow = config.DurationValue(queryWindowFlag, "QUERY_WINDOW", 0)
+	dataCopier.MaxAttempts = config.IntValue(maxAttemptsFlag, "MAX_ATTEMPTS", 0)
+	dataCopier.AttemptBackoff = config.DurationValue(attemptBackoffFlag, "ATTEMPT_BACKOFF", 0)
+	dataCopier.MaxAttemptBackoff = config.DurationValue(attemptMaxBackoffFlag, "ATTEMPT_MAX_BACKOFF", 24*time.Hour)
+
+	runner := copier.NewRunner(dataCopier, sources, eeSlice, fmtSlice...)
+	runner.MaxRunTime = maxRunTime
+
+	// Sources without a schedule of their own run on the integrator's schedule
+	schedules := make(map[string][]*copier.Source)
+	var specs []string
+	for i, c := range sourceConfigs {
+		spec := c.Cron
+		if spec == "" {
+			spec = cronSpec
+		}
+		if spec == "" {
+			continue
+		}
+		if _, ok := schedules[spec]; !ok {
+			specs = append(specs, spec)
+		}
+		schedules[spec] = append(schedules[spec], sources[i])
+	}
+	// The admin API is only served while running on a schedule, and is started before any initial
+	// run so that run's progress can be followed
+	if len(specs) > 0 {
+		if adminAddr := config.Value(adminAddrFlag, "ADMIN_ADDR", ""); adminAddr != "" {
+			adminServer := admin.NewServer(runner, txLogManager, config.Value(adminTokenFlag, "ADMIN_TOKEN", ""))
+			redactedSources := make([]*config.SourceConfig, len(sourceConfigs))
+			for i, c := range sourceConfigs {
+				redactedSources[i] = c.Redacted()
+			}
+			tlsOpts := transport.ServerTLSOptions{
+				CertFile:     config.Value(adminTLSCertFlag, "ADMIN_TLS_CERT", ""),
+				KeyFile:      config.Value(adminTLSKeyFlag, "ADMIN_TLS_KEY", ""),
+				ClientCAFile: config.Value(adminClientCAFlag, "ADMIN_TLS_CLIENT_CA", ""),
+			}
+			adminServer.Config = map[string]interface{}{
+				"settings": config.Effective(),
+				"sources":  redactedSources,
+			}
+			serveAdmin(adminAddr, adminServer, tlsOpts)
+		}
+	}
+
+	if now {
+		if _, err := runner.Run("now", sources, nil); err != nil {
+			fmt.Fprintln(os.Stderr, "Error running now:", err.Error())
+		}
+	}
+
+	if len(specs) > 0 {
+		c := cron.New()
+		for _, spec := range specs {
+			scheduledSources := schedules[spec]
+			err = c.AddFunc(spec, func() {
+				// Scheduled runs wait for any run in progress, so overlapping schedules aren't lost
+				if _, err := runner.Queue("cron", scheduledSources, nil); err != nil {
+					fmt.Fprintln(os.Stderr, "Skipping scheduled run:", err.Error())
+				}
+			})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Can't setup cron job for integrator. Specified spec:", spec)
+				os.Exit(1)
+			}
+		}
+		c.Start()
+		defer c.Stop()
+		select {} // this causes the program to block rather than just exit right away
+	}
+}
+
+// serveAdmin serves the admin API in the background, exiting if it isn't protected by a bearer
+// token or client certificates, or can't be served
+func serveAdmin(addr string, adminServer *admin.Server, tlsOpts transport.ServerTLSOptions) {
+	if adminServer.Token == "" && tlsOpts.ClientCAFile == "" {
+		fmt.Fprintln(os.Stderr, "The admin API must be protected by an admin token, client certificates or both.")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	server := &http.Server{Addr: addr, Handler: adminServer}
+	if tlsOpts.CertFile != "" || tlsOpts.KeyFile != "" || tlsOpts.ClientCAFile != "" {
+		tlsConfig, err := transport.NewServerTLSConfig(tlsOpts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error configuring admin API TLS:", err.Error())
+			os.Exit(1)
+		}
+		server.TLSConfig = tlsConfig
+	}
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		fmt.Fprintln(os.Stderr, "Error serving the admin API:", err.Error())
+		os.Exit(1)
+	}()
+}
+
+// replay posts the documents in a local copy directory to the ingest service again
+func replay(args []string) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0]+" replay", flag.ExitOnError)
+	copyDirFlag := flag.String("copy-dir", "", "Path to the folder of local copies to replay (env: COPY_DIR)")
+	ingestFlag := flag.String("ingest", "", "Ingest API Endpoint URL (env: INGEST_URL)")
+	ingestAuthFlags := config.RegisterAuthFlags("ingest-", "INGEST_", "the ingest service")
+	ingestTypeFlag := flag.String("ingest-type", "", "Type of ingest API: \"ccda\" to post raw documents or \"fhir\" to post FHIR transaction bundles (env: INGEST_TYPE, default: \"ccda\")")
+	ingestFhirSystemFlag := flag.String("ingest-fhir-identifier-system", "", "Identifier system URI for EE numbers on the FHIR ingest server's Patient resources (env: INGEST_FHIR_IDENTIFIER_SYSTEM, default: none)")
+	eeFlag := flag.String("ee", "", "EE number to replay documents for (env: EE, default: all EE numbers)")
+	eeFileFlag := flag.String("eeFile", "", "Path to a file with an EE number on each line to replay documents for (env: EE_FILE, default: all EE numbers)")
+	sourceFlag := flag.String("source", "", "Comma-separated list of sources to replay documents from (env: REPLAY_SOURCES, default: all sources)")
+	docIDFlag := flag.String("doc-id", "", "Glob pattern for the IDs of documents to replay, e.g. \"1.2.3.*\" (env: REPLAY_DOCUMENT_ID, default: all documents)")
+	sinceFlag := flag.String("since", "", "Only replay documents copied on or after this date, e.g. \"2016-06-01\" or \"2016-06-01T12:00:00Z\" (env: REPLAY_SINCE, default: no limit)")
+	untilFlag := flag.String("until", "", "Only replay documents copied on or before this date (env: REPLAY_UNTIL, default: no limit)")
+	concurrencyFlag := flag.String("concurrency", "", "Number of documents to post at once (env: REPLAY_CONCURRENCY, default: 4)")
+	retriesFlag := flag.String("retries", "", "Number of times to retry ingest requests that fail for transient reasons (env: HTTP_RETRIES, default: 3)")
+	requestTimeoutFlag := flag.String("request-timeout", "", "Maximum time for each ingest request (env: HTTP_REQUEST_TIMEOUT, default: \"2m\")")
+	ingestIdempotentFlag := flag.Bool("ingest-idempotent", false, "Flag to indicate that the ingest service safely handles duplicate uploads, so uploads may be retried after any transient failure (env: INGEST_IDEMPOTENT, default: false)")
+	flag.CommandLine.Parse(args)
+
+	copyDir := config.RequiredValue(copyDirFlag, "COPY_DIR", "Copy directory")
+	ingestURL := config.RequiredValue(ingestFlag, "INGEST_URL", "Ingest URL")
+	if strings.HasPrefix(ingestURL, ":") {
+		ingestURL = "http://localhost" + ingestURL
+	}
+
+	ingestHttpClient := transport.NewHttpClient(nil)
+	ingestHttpClient.Timeout = config.DurationValue(requestTimeoutFlag, "HTTP_REQUEST_TIMEOUT", 2*time.Minute)
+	ingestAuth, err := transport.NewAuthenticator(ingestAuthFlags.Options(), ingestHttpClient)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error configuring ingest authentication:", err.Error())
+		os.Exit(1)
+	}
+	retryPolicy := transport.NewRetryPolicy(config.IntValue(retriesFlag, "HTTP_RETRIES", 3), time.Second, 30*time.Second)
+	ingestClient := newIngestClient(config.Value(ingestTypeFlag, "INGEST_TYPE", "ccda"), ingestURL, config.Value(ingestFhirSystemFlag, "INGEST_FHIR_IDENTIFIER_SYSTEM", ""),
+		ingestAuth, ingestHttpClient, retryPolicy, config.BoolValue(ingestIdempotentFlag, "INGEST_IDEMPOTENT"))
+
+	replayer, err := copier.NewReplayer(ingestClient, copyDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error configuring the replay:", err.Error())
+		os.Exit(1)
+	}
+	if ee := config.Value(eeFlag, "EE", ""); ee != "" {
+		replayer.EEs = []string{ee}
+	} else if eeFile := config.Value(eeFileFlag, "EE_FILE", ""); eeFile != "" {
+		if replayer.EEs, err = config.ParseEEFile(eeFile); err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't get EE numbers from ee file:", err.Error())
+			os.Exit(1)
+		}
+	}
+	if sources := config.Value(sourceFlag, "REPLAY_SOURCES", ""); sources != "" {
+		replayer.Sources = strings.Split(sources, ",")
+	}
+	replayer.DocumentIDPattern = config.Value(docIDFlag, "REPLAY_DOCUMENT_ID", "")
+	replayer.Since = config.TimeValue(sinceFlag, "REPLAY_SINCE")
+	replayer.Until = config.TimeValue(untilFlag, "REPLAY_UNTIL")
+	replayer.Concurrency = config.IntValue(concurrencyFlag, "REPLAY_CONCURRENCY", 4)
+
+	start := time.Now()
+	report, err := replayer.Replay(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error replaying documents:", err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Replayed %d of %d documents in %s\n", report.Replayed, report.Found, time.Since(start))
+	if len(report.Failures) > 0 {
+		fmt.Fprintf(os.Stderr, "%d documents failed to replay:\n", len(report.Failures))
+		for _, f := range report.Failures {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", f.Path, f.Err)
+		}
+		os.Exit(1)
+	}
+}
+
+// newIngestClient creates the client for the configured type of ingest API, exiting if the type
+// isn't supported
+func newIngestClient(ingestType, ingestURL, fhirSystem string, auth transport.Authenticator, client *http.Client, retry *transport.RetryPolicy, idempotent bool) ingest.Client {
+	switch ingestType {
+	case "ccda":
+		c := ingest.NewAuthHttpClient(ingestURL, auth)
+		c.Client = client
+		c.Retry = retry
+		c.Idempotent = idempotent
+		return c
+	case "fhir":
+		c := ingest.NewAuthFhirClient(ingestURL, fhirSystem, auth)
+		c.Client = client
+		c.Retry = retry
+		c.Idempotent = idempotent
+		return c
+	}
+	fmt.Fprintf(os.Stderr, "%s is not a supported ingest type.\n", ingestType)
+	flag.PrintDefaults()
+	os.Exit(1)
+	return nil
+}
+
+// mockHie serves a mock HIE from a fixtures directory, for local development and demos
+func mockHie(args []string) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0]+" mock-hie", flag.ExitOnError)
+	fixturesFlag := flag.String("fixtures", "", "Path to the folder of query responses (<ee>.json) and documents (documents/<documentID>.xml) to serve (env: MOCK_HIE_FIXTURES)")
+	addrFlag := flag.String("addr", "", "Address to listen on (env: MOCK_HIE_ADDR, default: \":8081\")")
+	faultsFlag := flag.String("faults", "", "Path to a JSON file of faults to script, such as errors, slow responses and malformed entries (env: MOCK_HIE_FAULTS, default: none)")
+	protocolFlag := flag.String("hie-protocol", "", "Path to a JSON file describing the HIE protocol's parameter names, date formats and timezone (env: HIE_PROTOCOL, default: the original integrator protocol)")
+	flag.CommandLine.Parse(args)
+
+	server, err := testkit.NewMockHieServer(config.RequiredValue(fixturesFlag, "MOCK_HIE_FIXTURES", "Fixtures directory"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error configuring the mock HIE:", err.Error())
+		os.Exit(1)
+	}
+	if faults := config.Value(faultsFlag, "MOCK_HIE_FAULTS", ""); faults != "" {
+		if server.Faults, err = testkit.LoadMockHieFaults(faults); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+	if protocol := config.Value(protocolFlag, "HIE_PROTOCOL", ""); protocol != "" {
+		if server.Protocol, err = hie.LoadProtocol(protocol); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	addr := config.Value(addrFlag, "MOCK_HIE_ADDR", ":8081")
+	host := addr
+	if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+	fmt.Printf("Serving a mock HIE from %s.  Run the integrator with -hie http://%s/query\n", server.Dir, host)
+	if err := http.ListenAndServe(addr, server); err != nil {
+		fmt.Fprintln(os.Stderr, "Error serving the mock HIE:", err.Error())
+		os.Exit(1)
+	}
+}
+
+// generate writes synthetic patients and documents for the mock HIE or a file HIE
+func generate(args []string) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0]+" generate", flag.ExitOnError)
+	outFlag := flag.String("out", "", "Path to the folder to write the patients' documents and EE file (ee.txt) to (env: GENERATE_DIR)")
+	patientsFlag := flag.String("patients", "", "Number of patients to generate (env: GENERATE_PATIENTS, default: 10)")
+	documentsFlag := flag.String("documents", "", "Number of documents to generate for each patient (env: GENERATE_DOCUMENTS, default: 5)")
+	layoutFlag := flag.String("layout", "", "Layout to write: \"mock-hie\" for the mock-hie command or \"file\" for a file HIE's drop folder (env: GENERATE_LAYOUT, default: \"mock-hie\")")
+	formatsFlag := flag.String("formats", "", "Comma-separated list of document formats to generate, in turn (env: FORMATS, default: \"XML^HL7^231^CCD^C32,XML^HL7^231^CCD^V1.1\")")
+	sinceFlag := flag.String("since", "", "Earliest document creation time, e.g. \"2016-06-01\" or \"2016-06-01T12:00:00Z\" (env: GENERATE_SINCE, default: a year ago)")
+	untilFlag := flag.String("until", "", "Latest document creation time (env: GENERATE_UNTIL, default: now)")
+	seedFlag := flag.String("seed", "", "Seed for the random data, so the same data can be generated again (env: GENERATE_SEED, default: 1)")
+	flag.CommandLine.Parse(args)
+
+	out := config.RequiredValue(outFlag, "GENERATE_DIR", "Output directory")
+	generator := testkit.NewGenerator(config.IntValue(patientsFlag, "GENERATE_PATIENTS", 10), config.IntValue(documentsFlag, "GENERATE_DOCUMENTS", 5))
+	generator.Layout = config.Value(layoutFlag, "GENERATE_LAYOUT", "mock-hie")
+	generator.Formats = strings.Split(config.Value(formatsFlag, "FORMATS", "XML^HL7^231^CCD^C32,XML^HL7^231^CCD^V1.1"), ",")
+	if since := config.TimeValue(sinceFlag, "GENERATE_SINCE"); !since.IsZero() {
+		generator.Start = since
+	}
+	if until := config.TimeValue(untilFlag, "GENERATE_UNTIL"); !until.IsZero() {
+		generator.End = until
+	}
+	generator.Seed = int64(config.IntValue(seedFlag, "GENERATE_SEED", 1))
+
+	ees, err := generator.Generate(out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error generating documents:", err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Generated %d documents for each of %d patients in %s\n", generator.DocumentsPerPatient, len(ees), out)
+}
+
+// benchmark measures the data copier's throughput and latency against a fake HIE and ingest service
+func benchmark(args []string) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0]+" benchmark", flag.ExitOnError)
+	eesFlag := flag.String("ees", "", "Number of EE numbers to copy documents for (env: BENCHMARK_EES, default: 1000)")
+	documentsFlag := flag.String("documents", "", "Number of documents the HIE lists for each EE number (env: BENCHMARK_DOCUMENTS, default: 5)")
+	documentSizeFlag := flag.String("document-size", "", "Size of each document in bytes (env: BENCHMARK_DOCUMENT_SIZE, default: 30000)")
+	hieLatencyFlag := flag.String("hie-latency", "", "Latency added to each HIE request, e.g. \"200ms\" (env: BENCHMARK_HIE_LATENCY, default: none)")
+	ingestLatencyFlag := flag.String("ingest-latency", "", "Latency added to each ingest request (env: BENCHMARK_INGEST_LATENCY, default: none)")
+	hieErrorRateFlag := flag.String("hie-error-rate", "", "Fraction of HIE requests that fail, e.g. \"0.01\" (env: BENCHMARK_HIE_ERROR_RATE, default: 0)")
+	ingestErrorRateFlag := flag.String("ingest-error-rate", "", "Fraction of ingest requests that fail (env: BENCHMARK_INGEST_ERROR_RATE, default: 0)")
+	maxRunTimeFlag := flag.String("max-run-time", "", "Stop the benchmark after this long and report on the EE numbers copied so far (env: BENCHMARK_MAX_RUN_TIME, default: no limit)")
+	jsonFlag := flag.Bool("json", false, "Flag to indicate if the report should be written as JSON, e.g. to compare runs in CI (env: BENCHMARK_JSON, default: false)")
+	flag.CommandLine.Parse(args)
+
+	b := testkit.NewBenchmark(config.IntValue(eesFlag, "BENCHMARK_EES", 1000), config.IntValue(documentsFlag, "BENCHMARK_DOCUMENTS", 5))
+	b.DocumentSize = config.IntValue(documentSizeFlag, "BENCHMARK_DOCUMENT_SIZE", 30000)
+	b.HieLatency = config.DurationValue(hieLatencyFlag, "BENCHMARK_HIE_LATENCY", 0)
+	b.IngestLatency = config.DurationValue(ingestLatencyFlag, "BENCHMARK_INGEST_LATENCY", 0)
+	b.HieErrorRate = config.FloatValue(hieErrorRateFlag, "BENCHMARK_HIE_ERROR_RATE", 0)
+	b.IngestErrorRate = config.FloatValue(ingestErrorRateFlag, "BENCHMARK_INGEST_ERROR_RATE", 0)
+
+	// The benchmark's own logging would slow it down and bury the report
+	log.SetOutput(ioutil.Discard)
+
+	ctx := context.Background()
+	if maxRunTime := config.DurationValue(maxRunTimeFlag, "BENCHMARK_MAX_RUN_TIME", 0); maxRunTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxRunTime)
+		defer cancel()
+	}
+	report, err := b.Run(ctx)
+	if err != nil && report == nil {
+		fmt.Fprintln(os.Stderr, "Error running the benchmark:", err.Error())
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Benchmark stopped after %d of %d EE numbers: %s\n", report.EEs, b.EEs, err)
+	}
+	if config.BoolValue(jsonFlag, "BENCHMARK_JSON") {
+		json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		report.WriteTo(os.Stdout)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+
+	"github.com/intervention-engine/integrator/config"
+	"github.com/intervention-engine/integrator/txlog"
+)
+
+// operatorFlags are the flags shared by the commands that inspect and manage the transaction log
+type operatorFlags struct {
+	mongo  *string
+	json   *bool
+	source *string
+}
+
+// newOperatorFlags replaces the command line flags with the given command's, which take the
+// arguments described by usage after the flags
+func newOperatorFlags(name, usage string, withSource bool) *operatorFlags {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0]+" "+name, flag.ExitOnError)
+	flag.CommandLine.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] %s\n", os.Args[0], name, usage)
+		flag.PrintDefaults()
+	}
+	f := &operatorFlags{
+		mongo: flag.String("mongo", "", "MongoDB address (env: MONGO_URL, default: \"mongodb://localhost:27017\")"),
+		json:  flag.Bool("json", false, "Flag to write JSON instead of a table (default: false)"),
+	}
+	if withSource {
+		f.source = flag.String("source", "", "Name of the source the document was copied from, for documents copied from more than one (default: every source)")
+	}
+	return f
+}
+
+// open connects to the transaction log, exiting if it can't
+func (f *operatorFlags) open() (*txlog.MgoManager, *mgo.Session) {
+	mongo := config.Value(f.mongo, "MONGO_URL", "mongodb://localhost:27017")
+	if strings.HasPrefix(mongo, ":") {
+		mongo = "mongodb://localhost" + mongo
+	}
+	session, err := mgo.Dial(mongo)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can't connect to the database:", err.Error())
+		os.Exit(1)
+	}
+	txLogManager, err := txlog.NewMgoManager(session.DB("integrator"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error configuring the log manager:", err.Error())
+		os.Exit(1)
+	}
+	return txLogManager, session
+}
+
+// bySource keeps the entries from the source given by the source flag, if it was set.  The flag
+// is checked for being set, rather than empty, since the unnamed source's name is empty.
+func (f *operatorFlags) bySource(entries []*txlog.Entry) []*txlog.Entry {
+	set := false
+	flag.CommandLine.Visit(func(fl *flag.Flag) { set = set || fl.Name == "source" })
+	if !set {
+		return entries
+	}
+	var kept []*txlog.Entry
+	for _, e := range entries {
+		if e.Source == *f.source {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// write writes the entries as JSON or a table, sorted by date
+func (f *operatorFlags) write(entries []*txlog.Entry, details bool) {
+	txlog.SortByDate(entries)
+	var err error
+	if *f.json {
+		err = txlog.WriteJSON(os.Stdout, entries)
+	} else if details {
+		err = txlog.WriteDetails(os.Stdout, entries)
+	} else {
+		err = txlog.WriteTable(os.Stdout, entries)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing transactions:", err.Error())
+		os.Exit(1)
+	}
+}
+
+// arg returns the command's only argument, exiting with the usage if there isn't exactly one
+func arg() string {
+	if flag.NArg() != 1 {
+		flag.CommandLine.Usage()
+		os.Exit(2)
+	}
+	return flag.Arg(0)
+}
+
+// exitOnError exits if the transaction log couldn't be queried or updated
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error accessing the transaction log:", err.Error())
+		os.Exit(1)
+	}
+}
+
+// history lists every document copied, or attempted, for an EE number
+func history(args []string) {
+	f := newOperatorFlags("history", "<ee>", false)
+	flag.CommandLine.Parse(args)
+	ee := arg()
+
+	txLogManager, session := f.open()
+	defer session.Close()
+	entries, err := txLogManager.FindEntriesByEE(context.Background(), ee)
+	exitOnError(err)
+	f.write(entries, false)
+}
+
+// failures lists the documents that failed to be copied and haven't been copied since
+func failures(args []string) {
+	f := newOperatorFlags("failures", "", false)
+	sinceFlag := flag.String("since", "", "Only list failures dated on or after this date, e.g. \"2016-06-01\" or \"2016-06-01T12:00:00Z\" (env: FAILURES_SINCE, default: no limit)")
+	deadLetteredFlag := flag.Bool("dead-lettered", false, "Flag to only list dead-lettered failures (default: false)")
+	flag.CommandLine.Parse(args)
+	if flag.NArg() > 0 {
+		flag.CommandLine.Usage()
+		os.Exit(2)
+	}
+
+	txLogManager, session := f.open()
+	defer session.Close()
+	entries, err := txLogManager.FindFailures(context.Background(), config.TimeValue(sinceFlag, "FAILURES_SINCE"))
+	exitOnError(err)
+	if *deadLetteredFlag {
+		var deadLettered []*txlog.Entry
+		for _, e := range entries {
+			if e.DeadLetter {
+				deadLettered = append(deadLettered, e)
+			}
+		}
+		entries = deadLettered
+	}
+	f.write(entries, false)
+}
+
+// show shows everything the transaction log records about a document
+func show(args []string) {
+	f := newOperatorFlags("show", "<documentID>", true)
+	flag.CommandLine.Parse(args)
+	docID := arg()
+
+	txLogManager, session := f.open()
+	defer session.Close()
+	entries, err := txLogManager.FindEntriesByDocumentID(context.Background(), docID)
+	exitOnError(err)
+	entries = f.bySource(entries)
+	if len(entries) == 0 {
+		fmt.Fprintf(os.Stderr, "The transaction log has no record of document %s.\n", docID)
+		os.Exit(1)
+	}
+	f.write(entries, true)
+}
+
+// retry releases failed documents from the dead-letter state or their backoff, so they're
+// attempted on the next run
+func retry(args []string) {
+	f := newOperatorFlags("retry", "<documentID> | -all-failed", true)
+	allFailedFlag := flag.Bool("all-failed", false, "Flag to retry every failed document instead of a single one (default: false)")
+	flag.CommandLine.Parse(args)
+
+	docID := ""
+	if !*allFailedFlag {
+		docID = arg()
+	} else if flag.NArg() > 0 {
+		flag.CommandLine.Usage()
+		os.Exit(2)
+	}
+
+	txLogManager, session := f.open()
+	defer session.Close()
+	ctx := context.Background()
+	var entries []*txlog.Entry
+	var err error
+	if *allFailedFlag {
+		entries, err = txLogManager.FindFailures(ctx, time.Time{})
+	} else {
+		entries, err = txLogManager.FindEntriesByDocumentID(ctx, docID)
+	}
+	exitOnError(err)
+	entries = f.bySource(entries)
+	if docID != "" && len(entries) == 0 {
+		fmt.Fprintf(os.Stderr, "The transaction log has no record of document %s.\n", docID)
+		os.Exit(1)
+	}
+	released, err := txlog.ReleaseEntries(ctx, txLogManager, entries)
+	exitOnError(err)
+	f.write(released, false)
+	fmt.Fprintf(os.Stderr, "%d documents will be attempted on the next run.\n", len(released))
+}
+
+// forget removes a document from the transaction log, so it's no longer retried or reported.  It's
+// only copied again if a later query returns it.
+func forget(args []string) {
+	f := newOperatorFlags("forget", "<documentID>", true)
+	flag.CommandLine.Parse(args)
+	docID := arg()
+
+	txLogManager, session := f.open()
+	defer session.Close()
+	ctx := context.Background()
+	entries, err := txLogManager.FindEntriesByDocumentID(ctx, docID)
+	exitOnError(err)
+	entries = f.bySource(entries)
+	if len(entries) == 0 {
+		fmt.Fprintf(os.Stderr, "The transaction log has no record of document %s.\n", docID)
+		os.Exit(1)
+	} else if len(entries) > 1 {
+		fmt.Fprintf(os.Stderr, "Document %s was copied from more than one source.  Choose one with the source flag.\n", docID)
+		os.Exit(1)
+	}
+	exitOnError(txLogManager.RemoveEntry(ctx, entries[0].Source, entries[0].DocumentID))
+	f.write(entries, false)
+	fmt.Fprintf(os.Stderr, "Forgot document %s.\n", docID)
+}
+
+// deadLetter manages dead-lettered documents.  Its only action, release, lets them be attempted on
+// the next run.
+func deadLetter(args []string) {
+	if len(args) == 0 || args[0] != "release" {
+		fmt.Fprintf(os.Stderr, "Usage: %s dead-letter release [flags] [documentID...]\n", os.Args[0])
+		os.Exit(2)
+	}
+	f := newOperatorFlags("dead-letter release", "[documentID...]", false)
+	reasonFlag := flag.String("reason", "", "Only release documents that failed for this reason, e.g. \"ingest-rejected\" (default: any reason)")
+	flag.CommandLine.Parse(args[1:])
+
+	txLogManager, session := f.open()
+	defer session.Close()
+	ctx := context.Background()
+	entries, err := txLogManager.FindFailures(ctx, time.Time{})
+	exitOnError(err)
+	docIDs := make(map[string]bool)
+	for _, docID := range flag.Args() {
+		docIDs[docID] = true
+	}
+	var deadLettered []*txlog.Entry
+	for _, e := range entries {
+		if e.DeadLetter && (*reasonFlag == "" || string(e.FailureReason) == *reasonFlag) && (len(docIDs) == 0 || docIDs[e.DocumentID]) {
+			deadLettered = append(deadLettered, e)
+		}
+	}
+	released, err := txlog.ReleaseEntries(ctx, txLogManager, deadLettered)
+	exitOnError(err)
+	f.write(released, false)
+	fmt.Fprintf(os.Stderr, "Released %d dead-lettered documents to be attempted on the next run.\n", len(released))
+}
+
+// adoptUnnamedSource moves the history of a single HIE configured without a sources file to a named
+// source, so that a deployment switching to named sources doesn't copy its documents again.  The
+// transactions that were dropped because the source already had its own are listed.
+func adoptUnnamedSource(args []string) {
+	f := newOperatorFlags("adopt-unnamed-source", "<source>", false)
+	flag.CommandLine.Parse(args)
+	source := arg()
+
+	txLogManager, session := f.open()
+	defer session.Close()
+	moved, dropped, err := txLogManager.AdoptUnnamedSource(context.Background(), source)
+	exitOnError(err)
+	f.write(dropped, false)
+	fmt.Fprintf(os.Stderr, "Moved %d transactions recorded without a source to source %s.\n", moved, source)
+	if len(dropped) > 0 {
+		fmt.Fprintf(os.Stderr, "Dropped %d transactions recorded without a source for documents source %s already had.\n", len(dropped), source)
+	}
+}
@@ -0,0 +1,246 @@
+// Package config reads the integrator's settings from command line flags and environment variables.
+// A flag takes precedence over its environment variable, which takes precedence over the default.
+// Invalid values are reported along with the flags' usage, and the command exits.
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intervention-engine/integrator/transport"
+)
+
+// ParseEEFile reads the EE numbers to copy from a file, one per line.  Blank lines and lines
+// starting with "#" are skipped.
+func ParseEEFile(eeFile string) ([]string, error) {
+	f, err := os.Open(eeFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ees []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			ees = append(ees, line)
+		}
+	}
+	return ees, scanner.Err()
+}
+
+// effective holds the value each setting that's been read resolved to, by environment variable
+var effective = struct {
+	sync.Mutex
+	values map[string]string
+}{values: make(map[string]string)}
+
+// record notes the value a setting resolved to, so it can be reported by Effective
+func record(envVar, val string) {
+	effective.Lock()
+	defer effective.Unlock()
+	effective.values[envVar] = val
+}
+
+// Effective returns the value that each setting read so far resolved to, by environment variable,
+// with passwords, secrets and tokens redacted
+func Effective() map[string]string {
+	effective.Lock()
+	defer effective.Unlock()
+	values := make(map[string]string, len(effective.values))
+	for envVar, val := range effective.values {
+		values[envVar] = redact(envVar, val)
+	}
+	return values
+}
+
+// redact hides a setting's value if it's a secret, and hides the password in a URL's user info
+func redact(envVar, val string) string {
+	if val == "" {
+		return val
+	}
+	for _, suffix := range []string{"PASSWORD", "SECRET", "_TOKEN"} {
+		if strings.HasSuffix(envVar, suffix) {
+			return "REDACTED"
+		}
+	}
+	return redactURL(val)
+}
+
+// redactURL hides the password in a URL's user info, such as a MongoDB URL with credentials.
+// Anything that isn't a URL with a password is returned as is.
+func redactURL(val string) string {
+	u, err := url.Parse(val)
+	if err != nil || u.User == nil {
+		return val
+	}
+	if _, ok := u.User.Password(); !ok {
+		return val
+	}
+	u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	return u.String()
+}
+
+// Value returns the flag's value, or else the environment variable's, or else the default
+func Value(parsedFlag *string, envVar string, defaultVal string) string {
+	val := *parsedFlag
+	if val == "" {
+		val = os.Getenv(envVar)
+		if val == "" {
+			val = defaultVal
+		}
+	}
+	record(envVar, val)
+	return val
+}
+
+// BoolValue returns true if the flag is set or the environment variable is a true value
+func BoolValue(parsedFlag *bool, envVar string) bool {
+	val := *parsedFlag
+	if !val && os.Getenv(envVar) != "" {
+		switch os.Getenv(envVar) {
+		case "true", "TRUE", "YES", "yes", "ON", "on", "1":
+			val = true
+		case "false", "FALSE", "NO", "no", "OFF", "off", "0":
+			val = false
+		default:
+			fmt.Fprintf(os.Stderr, "%s is not a valid value for a boolean.\n", os.Getenv(envVar))
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
+	record(envVar, strconv.FormatBool(val))
+	return val
+}
+
+// IntValue parses a non-negative integer
+func IntValue(parsedFlag *string, envVar string, defaultVal int) int {
+	val := Value(parsedFlag, envVar, "")
+	if val == "" {
+		record(envVar, strconv.Itoa(defaultVal))
+		return defaultVal
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil || i < 0 {
+		fmt.Fprintf(os.Stderr, "%s is not a valid value for a non-negative integer.\n", val)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	return i
+}
+
+// FloatValue parses a non-negative number
+func FloatValue(parsedFlag *string, envVar string, defaultVal float64) float64 {
+	val := Value(parsedFlag, envVar, "")
+	if val == "" {
+		record(envVar, strconv.FormatFloat(defaultVal, 'f', -1, 64))
+		return defaultVal
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil || f < 0 {
+		fmt.Fprintf(os.Stderr, "%s is not a valid value for a non-negative number.\n", val)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	return f
+}
+
+// DurationValue parses a non-negative duration (e.g., "500ms" or "2m")
+func DurationValue(parsedFlag *string, envVar string, defaultVal time.Duration) time.Duration {
+	val := Value(parsedFlag, envVar, "")
+	if val == "" {
+		record(envVar, defaultVal.String())
+		return defaultVal
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		fmt.Fprintf(os.Stderr, "%s is not a valid value for a duration (e.g., \"500ms\" or \"2m\").\n", val)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	return d
+}
+
+// TimeValue parses a date (e.g., "2016-06-01", taken to be local) or an RFC 3339 time
+func TimeValue(parsedFlag *string, envVar string) time.Time {
+	val := Value(parsedFlag, envVar, "")
+	if val == "" {
+		return time.Time{}
+	}
+	if t, err := time.ParseInLocation("2006-01-02", val, time.Local); err == nil {
+		return t
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s is not a valid value for a date (e.g., \"2016-06-01\" or \"2016-06-01T12:00:00Z\").\n", val)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	return t
+}
+
+// RequiredValue returns the flag's value or else the environment variable's, exiting if neither
+// is set
+func RequiredValue(parsedFlag *string, envVar string, name string) string {
+	val := Value(parsedFlag, envVar, "")
+	if val == "" {
+		fmt.Fprintf(os.Stderr, "%s must be passed in as an argument or environment variable.\n", name)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	return val
+}
+
+// AuthFlags holds the flags that configure how the integrator authenticates to a service
+type AuthFlags struct {
+	envPrefix    string
+	mode         *string
+	user         *string
+	password     *string
+	tokenURL     *string
+	clientID     *string
+	clientSecret *string
+	scope        *string
+	privateKey   *string
+	keyID        *string
+}
+
+// RegisterAuthFlags registers the flags that configure authentication to a service, named with the
+// flag prefix and read from environment variables with the env prefix
+func RegisterAuthFlags(flagPrefix, envPrefix, service string) *AuthFlags {
+	return &AuthFlags{
+		envPrefix:    envPrefix,
+		mode:         flag.String(flagPrefix+"auth", "", fmt.Sprintf("Authentication to use for %s: \"none\", \"basic\", \"client-credentials\" or \"smart\" (env: %sAUTH, default: \"basic\" if a user is supplied, otherwise \"none\")", service, envPrefix)),
+		user:         flag.String(flagPrefix+"user", "", fmt.Sprintf("User account name to use for authentication to %s (env: %sUSER)", service, envPrefix)),
+		password:     flag.String(flagPrefix+"password", "", fmt.Sprintf("Password to use for authentication to %s (env: %sPASSWORD)", service, envPrefix)),
+		tokenURL:     flag.String(flagPrefix+"token-url", "", fmt.Sprintf("OAuth2 token endpoint URL for %s (env: %sTOKEN_URL).  Required for client-credentials and smart auth.", service, envPrefix)),
+		clientID:     flag.String(flagPrefix+"client-id", "", fmt.Sprintf("OAuth2 client ID for %s (env: %sCLIENT_ID).  Required for client-credentials and smart auth.", service, envPrefix)),
+		clientSecret: flag.String(flagPrefix+"client-secret", "", fmt.Sprintf("OAuth2 client secret for %s (env: %sCLIENT_SECRET).  Required for client-credentials auth.", service, envPrefix)),
+		scope:        flag.String(flagPrefix+"scope", "", fmt.Sprintf("OAuth2 scopes to request for %s (env: %sSCOPE, default: none)", service, envPrefix)),
+		privateKey:   flag.String(flagPrefix+"private-key", "", fmt.Sprintf("Path to the PEM private key used to sign SMART Backend Services assertions for %s (env: %sPRIVATE_KEY).  Required for smart auth.", service, envPrefix)),
+		keyID:        flag.String(flagPrefix+"key-id", "", fmt.Sprintf("Key ID (kid) of the SMART Backend Services private key for %s (env: %sKEY_ID, default: none)", service, envPrefix)),
+	}
+}
+
+// Options returns the authentication options described by the flags (and environment)
+func (a *AuthFlags) Options() transport.AuthOptions {
+	return transport.AuthOptions{
+		Mode:         Value(a.mode, a.envPrefix+"AUTH", ""),
+		User:         Value(a.user, a.envPrefix+"USER", ""),
+		Password:     Value(a.password, a.envPrefix+"PASSWORD", ""),
+		TokenURL:     Value(a.tokenURL, a.envPrefix+"TOKEN_URL", ""),
+		ClientID:     Value(a.clientID, a.envPrefix+"CLIENT_ID", ""),
+		ClientSecret: Value(a.clientSecret, a.envPrefix+"CLIENT_SECRET", ""),
+		Scope:        Value(a.scope, a.envPrefix+"SCOPE", ""),
+		PrivateKey:   Value(a.privateKey, a.envPrefix+"PRIVATE_KEY", ""),
+		KeyID:        Value(a.keyID, a.envPrefix+"KEY_ID", ""),
+	}
+}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/integrator/copier"
+	"github.com/intervention-engine/integrator/hie"
+	"github.com/intervention-engine/integrator/transport"
+)
+
+// SourceConfig describes an HIE source and how to connect to it.  Several sources can be
+// configured in a JSON file (see LoadSourceConfigs).
+type SourceConfig struct {
+	Name string `json:"name"`
+	// Type is the HIE's API: "json", "xds", "fhir" or "file" (default: "json")
+	Type string `json:"type"`
+	// URL is the HIE API endpoint.  For XDS.b HIEs, this is the Document Registry URL.  For FHIR
+	// HIEs, this is the FHIR base URL.  For file HIEs, this is the path to the drop folder.
+	URL     string                `json:"url"`
+	Auth    transport.AuthOptions `json:"auth"`
+	TLS     transport.TLSOptions  `json:"tls"`
+	Formats []string              `json:"formats"`
+	// Cron is when to copy from the source (default: the integrator's cron expression)
+	Cron string `json:"cron"`
+	// Protocol is the path to a JSON HIE protocol file, and StrictValidation rejects query responses
+	// with any schema violation (JSON HIEs only)
+	Protocol         string `json:"protocol"`
+	StrictValidation bool   `json:"strictValidation"`
+	// XdsRepository (default: the URL), XdsAuthority and XdsCommunity configure XDS.b HIEs
+	XdsRepository string `json:"xdsRepository"`
+	XdsAuthority  string `json:"xdsAuthority"`
+	XdsCommunity  string `json:"xdsCommunity"`
+	// XdsLookback is how far back each XDS.b query reaches before the last one, as a duration such
+	// as "72h", so that documents registered late with an earlier creationTime are found (default: "168h")
+	XdsLookback string `json:"xdsLookback"`
+	// FhirIdentifierSystem is the system URI of the EE identifiers on a FHIR HIE's Patient resources
+	FhirIdentifierSystem string `json:"fhirIdentifierSystem"`
+	// ArchiveDir and ErrorDir are the folders that a file HIE's documents are moved to after they're
+	// ingested or fail to be (default: they're left in place)
+	ArchiveDir string `json:"archiveDir"`
+	ErrorDir   string `json:"errorDir"`
+}
+
+// LoadSourceConfigs reads a JSON array of source configurations.  References to environment
+// variables in the form "${HIE_A_PASSWORD}" are expanded in the sources' URLs, credentials and key
+// files so that secrets can be kept out of the file.  Any other "$" is left as it is.
+func LoadSourceConfigs(path string) ([]*SourceConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []*SourceConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("Invalid sources in %s: %s", path, err)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("No sources are configured in %s", path)
+	}
+	names := make(map[string]bool)
+	for i, c := range configs {
+		c.expandEnv()
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid source %d in %s: %s", i, path, err)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("Source %s is configured more than once in %s", c.Name, path)
+		}
+		names[c.Name] = true
+	}
+	return configs, nil
+}
+
+// envReference matches a "${VAR}" reference to an environment variable
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv expands the environment variable references in the source's URLs, credentials and key
+// files
+func (c *SourceConfig) expandEnv() {
+	fields := []*string{&c.URL, &c.XdsRepository, &c.Auth.User, &c.Auth.Password, &c.Auth.TokenURL,
+		&c.Auth.ClientID, &c.Auth.ClientSecret, &c.Auth.PrivateKey, &c.TLS.CertFile, &c.TLS.KeyFile, &c.TLS.CAFile}
+	for _, f := range fields {
+		*f = envReference.ReplaceAllStringFunc(*f, func(ref string) string {
+			return os.Getenv(envReference.FindStringSubmatch(ref)[1])
+		})
+	}
+}
+
+// Validate checks that a named source is fully configured
+func (c *SourceConfig) Validate() error {
+	if c.Name == "" {
+		return errors.New("A name is required")
+	} else if strings.Contains(c.Name, "/") {
+		return fmt.Errorf("Source name %s must not contain a '/'", c.Name)
+	} else if c.URL == "" {
+		return fmt.Errorf("A URL is required for source %s", c.Name)
+	}
+	switch c.Type {
+	case "", "json", "fhir", "file":
+	case "xds":
+		if c.XdsAuthority == "" {
+			return fmt.Errorf("An XDS assigning authority is required for source %s", c.Name)
+		}
+		if _, err := c.xdsLookback(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s is not a supported HIE type", c.Type)
+	}
+	return nil
+}
+
+// DefaultXdsLookback is how far back XDS.b queries reach when the source doesn't configure it
+const DefaultXdsLookback = 7 * 24 * time.Hour
+
+// xdsLookback parses the source's XDS.b lookback
+func (c *SourceConfig) xdsLookback() (time.Duration, error) {
+	if c.XdsLookback == "" {
+		return DefaultXdsLookback, nil
+	}
+	lookback, err := time.ParseDuration(c.XdsLookback)
+	if err != nil || lookback < 0 {
+		return 0, fmt.Errorf("Invalid XDS lookback %s for source %s", c.XdsLookback, c.Name)
+	}
+	return lookback, nil
+}
+
+// Redacted returns a copy of the source's configuration with its password, client secret and any
+// password in its URL redacted, so that it can be reported
+func (c *SourceConfig) Redacted() *SourceConfig {
+	r := *c
+	r.URL = redactURL(c.URL)
+	r.Auth.Password = redact("PASSWORD", c.Auth.Password)
+	r.Auth.ClientSecret = redact("CLIENT_SECRET", c.Auth.ClientSecret)
+	return &r
+}
+
+// NewSource connects to the source as configured.  Requests to the HIE are limited to the given
+// timeout and retried according to the policy.
+func (c *SourceConfig) NewSource(requestTimeout time.Duration, retry *transport.RetryPolicy) (*copier.Source, error) {
+	tlsConfig, err := transport.NewTLSConfig(c.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("Error configuring HIE TLS: %s", err)
+	}
+	client := transport.NewHttpClient(tlsConfig)
+	client.Timeout = requestTimeout
+	auth, err := transport.NewAuthenticator(c.Auth, client)
+	if err != nil {
+		return nil, fmt.Errorf("Error configuring HIE authentication: %s", err)
+	}
+
+	src := &copier.Source{Name: c.Name, Formats: c.Formats}
+	switch c.Type {
+	case "", "json":
+		httpClient := hie.NewAuthHttpClient(c.URL, auth)
+		httpClient.Client = client
+		httpClient.Retry = retry
+		httpClient.StrictValidation = c.StrictValidation
+		if c.Protocol != "" {
+			if httpClient.Protocol, err = hie.LoadProtocol(c.Protocol); err != nil {
+				return nil, err
+			}
+		}
+		src.Client = httpClient
+	case "xds":
+		xdsClient := hie.NewXdsClient(c.URL, c.XdsRepository, c.XdsAuthority)
+		xdsClient.HomeCommunityID = c.XdsCommunity
+		xdsClient.Auth = auth
+		xdsClient.Client = client
+		xdsClient.Retry = retry
+		if xdsClient.Lookback, err = c.xdsLookback(); err != nil {
+			return nil, err
+		}
+		src.Client = xdsClient
+	case "fhir":
+		fhirClient := hie.NewFhirClient(c.URL, c.FhirIdentifierSystem)
+		fhirClient.Auth = auth
+		fhirClient.Client = client
+		fhirClient.Retry = retry
+		src.Client = fhirClient
+	case "file":
+		fileClient := hie.NewFileClient(c.URL)
+		fileClient.ArchiveDir = c.ArchiveDir
+		fileClient.ErrorDir = c.ErrorDir
+		src.Client = fileClient
+	default:
+		return nil, fmt.Errorf("%s is not a supported HIE type", c.Type)
+	}
+	return src, nil
+}
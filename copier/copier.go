@@ -0,0 +1,603 @@
+// Package copier copies a patient's documents from an HIE to the ingest endpoint, recording each
+// transfer in the transaction log.
+package copier
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/integrator/hie"
+	"github.com/intervention-engine/integrator/ingest"
+	"github.com/intervention-engine/integrator/transport"
+	"github.com/intervention-engine/integrator/txlog"
+)
+
+// Source is an HIE that documents are copied from
+type Source struct {
+	// Name identifies the source.  Transaction log entries and checkpoints are namespaced by it, so
+	// that document IDs from different HIEs can't collide.  The unnamed source's entries aren't
+	// namespaced, which keeps logs written by single-HIE deployments valid.
+	Name   string
+	Client hie.Client
+	// Formats are the document formats to copy from the source (default: the formats passed to
+	// the data copier)
+	Formats []string
+}
+
+type DataCopier struct {
+	// Sources are the HIEs that documents are copied from.  The constructors configure a single
+	// unnamed source with the given HIE client.
+	Sources      []*Source
+	ingestClient ingest.Client
+	txLogMgr     txlog.Manager
+	pathToCopies string
+	// Verify indicates how downloaded documents are checked against their advertised hash and size
+	// before they're ingested (default: VerifyLenient)
+	Verify VerifyMode
+	// QueryWindow, if set, splits queries into windows of this length, walked from oldest to newest,
+	// with progress checkpointed after each one.  This keeps the initial sync of a long history from
+	// timing out.
+	QueryWindow time.Duration
+	// MaxAttempts, if set, is the number of times a document is attempted before it's dead-lettered.
+	// Documents that fail permanently (see FailureReason.Permanent) are dead-lettered right away.
+	MaxAttempts int
+	// AttemptBackoff, if set, is how long to wait before attempting a failed document again.  It
+	// doubles after each further failure, up to MaxAttemptBackoff (if set).  Without it, failed
+	// documents are attempted again on every run.
+	AttemptBackoff    time.Duration
+	MaxAttemptBackoff time.Duration
+}
+
+func NewDataCopier(hieClient hie.Client, ingestClient ingest.Client, txLogMgr txlog.Manager) (*DataCopier, error) {
+	if hieClient == nil {
+		return nil, errors.New("HIE Client must be configured")
+	} else if ingestClient == nil {
+		return nil, errors.New("Ingest Client must be configured")
+	} else if txLogMgr == nil {
+		return nil, errors.New("Transaction Log Manager must be configured")
+	}
+	return &DataCopier{
+		Sources:      []*Source{{Client: hieClient}},
+		ingestClient: ingestClient,
+		txLogMgr:     txLogMgr,
+		pathToCopies: "",
+		Verify:       VerifyLenient,
+	}, nil
+}
+
+func NewDataCopierWithLocalCopies(hieClient hie.Client, ingestClient ingest.Client, txLogMgr txlog.Manager, pathToCopies string) (*DataCopier, error) {
+	if hieClient == nil {
+		return nil, errors.New("HIE Client must be configured")
+	} else if ingestClient == nil {
+		return nil, errors.New("Ingest Client must be configured")
+	} else if txLogMgr == nil {
+		return nil, errors.New("Transaction Log Manager must be configured")
+	} else if pathToCopies == "" {
+		return nil, errors.New("A path to store copies must be provided")
+	}
+
+	if err := os.MkdirAll(pathToCopies, 0777); err != nil {
+		return nil, err
+	}
+
+	return &DataCopier{
+		Sources:      []*Source{{Client: hieClient}},
+		ingestClient: ingestClient,
+		txLogMgr:     txLogMgr,
+		pathToCopies: pathToCopies,
+		Verify:       VerifyLenient,
+	}, nil
+}
+
+// CopyRecords copies the documents for an EE number from each source to the ingest service, copying
+// the given formats from sources that don't have formats of their own.  An error copying from one
+// source doesn't stop the others from being copied; the first error is returned.
+func (d *DataCopier) CopyRecords(ctx context.Context, mrn string, formats ...string) error {
+	var firstErr error
+	for _, src := range d.Sources {
+		err := d.CopySourceRecords(ctx, src, mrn, formats...)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return firstErr
+}
+
+// CopySourceRecords copies the documents for an EE number from one source to the ingest service.
+// If the context is cancelled (or times out) partway through, documents that haven't been copied
+// yet are logged as failures so that they're retried on the next run.
+func (d *DataCopier) CopySourceRecords(ctx context.Context, src *Source, mrn string, formats ...string) error {
+	if len(src.Formats) > 0 {
+		formats = src.Formats
+	}
+	if src.Name != "" {
+		log.Printf("Copying records for %s from %s\n", mrn, src.Name)
+	}
+	log.Printf("Getting transaction history for %s\n", mrn)
+	entries, err := d.txLogMgr.FindEntriesByEE(ctx, mrn)
+	if err != nil {
+		log.Printf("Error getting transaction history: %s\n", err)
+		return err
+	}
+	var history []*txlog.Entry
+	for _, e := range entries {
+		if e.Source == src.Name {
+			history = append(history, e)
+		}
+	}
+	log.Printf("Retrieved transaction history with %d entries\n", len(history))
+
+	// First, take another shot at previous failed attempts that are due
+	now := time.Now()
+	for _, h := range history {
+		if h.FailureCount > 0 {
+			if h.DeadLetter {
+				log.Printf("Skipping dead-lettered doc %s\n", h.DocumentID)
+				continue
+			} else if now.Before(h.NextAttemptAt) {
+				log.Printf("Skipping doc %s until its next attempt at %s\n", h.DocumentID, h.NextAttemptAt.Format(time.RFC3339))
+				continue
+			}
+			if ctx.Err() != nil {
+				log.Printf("Stopping retries of previous failed copy attempts: %s\n", ctx.Err())
+				return ctx.Err()
+			}
+			if malformed(h) {
+				// There's nothing to download, so it stays dead-lettered until a query returns it intact
+				log.Printf("Keeping malformed doc %s dead-lettered until a query returns it intact\n", h.DocumentID)
+				d.fail(h, txlog.FailureInvalidEntry, errors.New(h.Error))
+			} else {
+				log.Printf("Retrying previous failed copy attempt of doc %s\n", h.DocumentID)
+				if err := d.copy(ctx, src, h); err != nil {
+					log.Printf("Failed to download document <%s> on attempt #%d: %s\n", h.DocumentID, h.FailureCount, err)
+				}
+			}
+			if err := d.store(ctx, h); err != nil {
+				log.Printf("Failed to store log for document <%s>: %s\n", h.DocumentID, err)
+			}
+		}
+	}
+
+	// Pick up where the last run left off: partway through a paged query, or at the end of the last
+	// window it covered (in case it was interrupted before any documents were found in the windows)
+	_, paged := src.Client.(hie.PagedClient)
+	var cp *txlog.Checkpoint
+	if paged || d.QueryWindow > 0 {
+		cp, err = d.txLogMgr.FindCheckpoint(ctx, src.Name, mrn)
+		if err != nil {
+			log.Printf("Error getting query checkpoint: %s\n", err)
+			return err
+		}
+		if cp == nil {
+			cp = &txlog.Checkpoint{Source: src.Name, EE: mrn}
+		}
+		if cp.Page != "" {
+			log.Printf("Resuming interrupted query at page %s\n", cp.Page)
+			resp, err := d.queryPages(ctx, src, mrn, cp.PageStart, cp.PageEnd, cp.Page, cp, &history, formats)
+			if err != nil || !resp.Status {
+				return err
+			}
+		}
+	}
+
+	// Now determine the start date for the query to the HIE
+	start := time.Date(1900, time.January, 1, 0, 0, 0, 0, time.Local)
+	for _, h := range history {
+		if !h.Date.Before(start) {
+			// Add one second since the date is inclusive in the last query
+			start = h.Date.Add(1 * time.Second)
+		}
+	}
+	if cp != nil && !cp.Through.Before(start) {
+		start = cp.Through.Add(1 * time.Second)
+	}
+
+	if d.QueryWindow <= 0 {
+		// Query for the document list
+		resp, err := d.queryPages(ctx, src, mrn, start, nil, "", cp, &history, formats)
+		if err != nil || !resp.Status {
+			return err
+		}
+		return ctx.Err()
+	}
+
+	// Walk the windows from oldest to newest.  The last window is left open-ended.
+	for {
+		var end *time.Time
+		if windowEnd := start.Add(d.QueryWindow - time.Second); windowEnd.Before(time.Now()) {
+			end = &windowEnd
+		}
+		resp, err := d.queryPages(ctx, src, mrn, start, end, "", cp, &history, formats)
+		if err != nil || !resp.Status {
+			return err
+		}
+
+		through := resp.Query.EndDateTime
+		if through.IsZero() && end != nil {
+			through = *end
+		}
+		if !through.IsZero() {
+			cp.Through = through
+			if err := d.storeCheckpoint(ctx, *cp); err != nil {
+				log.Printf("Failed to store query checkpoint through %s: %s\n", through, err)
+				return err
+			}
+		}
+		if end == nil {
+			return nil
+		}
+		start = end.Add(1 * time.Second)
+	}
+}
+
+// queryPages queries the HIE for an EE number's documents in the given date range (where a nil end
+// leaves it open-ended), starting at the given page, and copies the results one page at a time.  If
+// there's a checkpoint, the next page is recorded in it after each page is copied, so an interrupted
+// query can be resumed.  It returns the last page's response, and stops early if the context is done.
+func (d *DataCopier) queryPages(ctx context.Context, src *Source, mrn string, start time.Time, end *time.Time, page string, cp *txlog.Checkpoint, history *[]*txlog.Entry, formats []string) (*hie.QueryResponse, error) {
+	seen := make(map[string]bool)
+	for {
+		resp, err := d.query(ctx, src, mrn, start, end, page)
+		if err != nil || !resp.Status {
+			return resp, err
+		}
+		*history = append(*history, d.copyResults(ctx, src, resp, *history, formats)...)
+
+		if cp != nil && (resp.NextPage != "" || cp.Page != "") {
+			cp.Page, cp.PageStart, cp.PageEnd = resp.NextPage, start, end
+			if resp.NextPage == "" {
+				cp.PageStart, cp.PageEnd = time.Time{}, nil
+			}
+			if err := d.storeCheckpoint(ctx, *cp); err != nil {
+				log.Printf("Failed to store query checkpoint at page %s: %s\n", resp.NextPage, err)
+				return resp, err
+			}
+		}
+		if resp.NextPage == "" || ctx.Err() != nil {
+			return resp, ctx.Err()
+		}
+		if seen[resp.NextPage] {
+			return resp, fmt.Errorf("HIE returned a paging loop at %s", resp.NextPage)
+		}
+		seen[resp.NextPage] = true
+		page = resp.NextPage
+	}
+}
+
+// query queries the HIE for one page of an EE number's documents in the given date range.  HIE
+// clients that don't support paging always return every result on the first page.  Unsuccessful
+// queries are logged and returned without an error.
+func (d *DataCopier) query(ctx context.Context, src *Source, mrn string, start time.Time, end *time.Time, page string) (*hie.QueryResponse, error) {
+	if page != "" {
+		log.Printf("Querying page %s of records\n", page)
+	} else if end == nil {
+		log.Printf("Querying records starting at %s\n", start)
+	} else {
+		log.Printf("Querying records from %s to %s\n", start, *end)
+	}
+	var resp *hie.QueryResponse
+	var err error
+	if pc, ok := src.Client.(hie.PagedClient); ok {
+		resp, err = pc.QueryRecordsPage(ctx, mrn, &start, end, page)
+	} else {
+		resp, err = src.Client.QueryRecords(ctx, mrn, &start, end)
+	}
+	if err != nil {
+		log.Printf("Failed to query documents for ee %s since %s: %s\n", mrn, start.Format(time.UnixDate), err)
+		return nil, err
+	}
+
+	if !resp.Status {
+		log.Printf("Unsuccessful query: %s\n", resp.Error)
+	}
+	return resp, nil
+}
+
+// copyResults copies the supported documents in a successful query response that haven't been
+// attempted before, and records the malformed entries that identify their documents as failed.  It
+// returns the transaction log entries for the documents it attempted.
+func (d *DataCopier) copyResults(ctx context.Context, src *Source, resp *hie.QueryResponse, history []*txlog.Entry, formats []string) []*txlog.Entry {
+	var attempted []*txlog.Entry
+	log.Printf("Query returned %d results\n", len(resp.Result))
+	for _, invalid := range resp.Invalid {
+		log.Printf("Skipping malformed result: %s\n", invalid.Error())
+		if invalid.DocumentID == "" || inHistory(invalid.DocumentID, history) {
+			continue
+		}
+		// Record it as failed, since the next query will start after it
+		t := &txlog.Entry{
+			QueryResponseEntry: hie.QueryResponseEntry{DocumentID: invalid.DocumentID},
+			Source:             src.Name,
+			EE:                 resp.Query.EE,
+			Date:               resp.Query.EndDateTime,
+		}
+		d.fail(t, txlog.FailureInvalidEntry, invalid)
+		if err := d.store(ctx, t); err != nil {
+			log.Printf("Failed to store log for document <%s>: %s\n", invalid.DocumentID, err)
+		}
+		attempted = append(attempted, t)
+	}
+	for _, result := range resp.Result {
+		log.Printf("Processing document %s\n", result.DocumentID)
+		if !supportedFormat(result.DocumentType, formats...) {
+			log.Printf("Skipping due to unsupported format: %s\n", result.DocumentType)
+			continue
+		}
+		t := historyEntry(result.DocumentID, history)
+		switch {
+		case t == nil:
+			// It's supported and we've never tried it before.  Attempt to copy it.
+			t = &txlog.Entry{
+				QueryResponseEntry: result,
+				Source:             src.Name,
+				EE:                 resp.Query.EE,
+				Date:               resp.Query.EndDateTime,
+			}
+		case malformed(t):
+			// It was malformed when it was found before, but now it can be attempted
+			log.Printf("Replacing malformed entry in history\n")
+			t.QueryResponseEntry = result
+			t.Date = resp.Query.EndDateTime
+			t.DeadLetter = false
+		default:
+			log.Printf("Skipping due to being in history\n")
+			continue
+		}
+		if ctx.Err() != nil {
+			// Log it as failed so it's retried, since the next query will start after it
+			log.Printf("Deferring document <%s> to the next run: %s\n", result.DocumentID, ctx.Err())
+			deferCopy(t, ctx.Err())
+		} else if err := d.copy(ctx, src, t); err != nil {
+			log.Printf("Failed to download document <%s> on initial attempt: %s\n", result.DocumentID, err)
+		}
+		log.Printf("Storing transaction results\n")
+		if err := d.store(ctx, t); err != nil {
+			log.Printf("Failed to store log for document <%s>: %s\n", result.DocumentID, err)
+		}
+		log.Printf("Successfully stored transaction\n")
+		attempted = append(attempted, t)
+	}
+	return attempted
+}
+
+// storeTimeout limits how long storing a transaction can take once the run's context is done
+const storeTimeout = 30 * time.Second
+
+// store stores the transaction log entry.  If the run has been cancelled, the entry is still stored
+// (with a short timeout of its own) so the outcome of the last attempt isn't lost.
+func (d *DataCopier) store(ctx context.Context, t *txlog.Entry) error {
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+	}
+	return d.txLogMgr.StoreEntry(ctx, t)
+}
+
+// storeCheckpoint stores a copy of the checkpoint.  Like store, it still stores it if the run has
+// been cancelled.
+func (d *DataCopier) storeCheckpoint(ctx context.Context, cp txlog.Checkpoint) error {
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+	}
+	return d.txLogMgr.StoreCheckpoint(ctx, &cp)
+}
+
+func supportedFormat(fmt string, supportedFmts ...string) bool {
+	for _, supportFmt := range supportedFmts {
+		if fmt == supportFmt {
+			return true
+		}
+	}
+	return false
+}
+
+func inHistory(documentID string, history []*txlog.Entry) bool {
+	return historyEntry(documentID, history) != nil
+}
+
+func historyEntry(documentID string, history []*txlog.Entry) *txlog.Entry {
+	for _, h := range history {
+		if documentID == h.DocumentID {
+			return h
+		}
+	}
+	return nil
+}
+
+// malformed reports whether the entry was recorded from a malformed query response entry, so it
+// has nothing to download
+func malformed(t *txlog.Entry) bool {
+	return t.FailureReason == txlog.FailureInvalidEntry && t.RetrieveURL == ""
+}
+
+// copy downloads the document and uploads it to the ingest service, recording the outcome on the
+// entry.  Clients that act on the outcome are told about it.
+func (d *DataCopier) copy(ctx context.Context, src *Source, t *txlog.Entry) error {
+	err := d.transfer(ctx, src, t)
+	if fc, ok := src.Client.(hie.FinishingClient); ok {
+		if fErr := fc.FinishRecord(ctx, t.RetrieveURL, err); fErr != nil {
+			log.Printf("Failed to finish document <%s>: %s\n", t.DocumentID, fErr)
+		}
+	}
+	return err
+}
+
+func (d *DataCopier) transfer(ctx context.Context, src *Source, t *txlog.Entry) error {
+	log.Printf("Downloading %s\n", t.RetrieveURL)
+	rc, ct, err := src.Client.DownloadRecord(ctx, t.RetrieveURL)
+	if err != nil {
+		log.Printf("Failed download: %s\n", err.Error())
+		return d.fail(t, classifyDownload(err), err)
+	}
+	if d.Verify != VerifyOff || d.pathToCopies != "" {
+		// We must read out the data into a buffer first
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			log.Printf("Failed download: %s\n", err.Error())
+			return d.fail(t, classifyDownload(err), err)
+		}
+		if err := VerifyDocument(&t.QueryResponseEntry, data, d.Verify); err != nil {
+			log.Printf("Failed verification: %s\n", err.Error())
+			return d.fail(t, classifyDownload(err), err)
+		}
+		if d.pathToCopies != "" {
+			d.storeCopy(t, data)
+		}
+		// Then we must reset the rc reader so the data can be uploaded
+		rc = ioutil.NopCloser(bytes.NewBuffer(data))
+	}
+	log.Printf("Uploading to ingest service w/ content type %s\n", ct)
+	var result *ingest.Result
+	if dc, ok := d.ingestClient.(ingest.DocumentClient); ok {
+		result, err = dc.IngestDocument(ctx, t.EE, &t.QueryResponseEntry, ct, rc)
+	} else {
+		result, err = d.ingestClient.Ingest(ctx, ct, rc)
+	}
+	if err != nil {
+		log.Printf("Failed upload: %s\n", err.Error())
+		return d.fail(t, classifyIngest(err), err)
+	}
+	if len(result.Created) > 0 {
+		log.Printf("Ingest service created %s\n", strings.Join(result.Created, ", "))
+	}
+	for _, w := range result.Warnings {
+		log.Printf("Ingest service warning for document <%s>: %s\n", t.DocumentID, w)
+	}
+	t.Ingest = result
+	t.Error = ""
+	t.FailureReason = ""
+	t.FailureCount = 0
+	t.NextAttemptAt = time.Time{}
+	t.DeadLetter = false
+	log.Printf("Successful upload\n")
+	return nil
+}
+
+func (d *DataCopier) storeCopy(t *txlog.Entry, data []byte) {
+	eePath := path.Join(d.pathToCopies, t.Source, t.EE)
+	if err := os.MkdirAll(eePath, 0777); err != nil {
+		log.Printf("Warning: Couldn't create dir %s to store copy\n", eePath)
+		return
+	}
+	filePath := path.Join(eePath, t.DocumentID+".xml")
+	log.Printf("Copying to %s\n", filePath)
+	if err := ioutil.WriteFile(filePath, data, 0644); err != nil {
+		log.Printf("Warning: Couldn't copy to %s\n", filePath)
+	}
+}
+
+// fail records a failed copy attempt on the entry and returns the error.  The entry is
+// dead-lettered if the failure is permanent or it has used up its attempts, and is otherwise
+// scheduled for another attempt after the backoff.
+func (d *DataCopier) fail(t *txlog.Entry, reason txlog.FailureReason, err error) error {
+	t.Error = err.Error()
+	t.FailureReason = reason
+	t.FailureCount++
+	t.NextAttemptAt = time.Time{}
+	if reason.Permanent() || (d.MaxAttempts > 0 && t.FailureCount >= d.MaxAttempts) {
+		log.Printf("Dead-lettering document <%s> after %d failed attempts (%s)\n", t.DocumentID, t.FailureCount, reasonOrUnknown(reason))
+		t.DeadLetter = true
+	} else if d.AttemptBackoff > 0 {
+		t.NextAttemptAt = time.Now().Add(d.attemptBackoff(t.FailureCount))
+	}
+	return err
+}
+
+// deferCopy records that a document wasn't attempted because the run ended, so that it's attempted
+// on the next run.  It's never dead-lettered for this.
+func deferCopy(t *txlog.Entry, err error) {
+	t.Error = err.Error()
+	t.FailureReason = ""
+	t.FailureCount++
+}
+
+// attemptBackoff returns the delay before attempting a document again after the given number of
+// failures
+func (d *DataCopier) attemptBackoff(failures int) time.Duration {
+	backoff := d.AttemptBackoff
+	for i := 1; i < failures && (d.MaxAttemptBackoff <= 0 || backoff < d.MaxAttemptBackoff); i++ {
+		backoff *= 2
+	}
+	if d.MaxAttemptBackoff > 0 && backoff > d.MaxAttemptBackoff {
+		backoff = d.MaxAttemptBackoff
+	}
+	return backoff
+}
+
+func reasonOrUnknown(reason txlog.FailureReason) string {
+	if reason == "" {
+		return "unclassified"
+	}
+	return string(reason)
+}
+
+// classifyDownload works out why downloading (or verifying) a document from the HIE failed
+func classifyDownload(err error) txlog.FailureReason {
+	switch e := err.(type) {
+	case *VerificationError:
+		return e.Reason
+	case *transport.AuthError:
+		return txlog.FailureAuth
+	case *transport.StatusError:
+		switch e.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return txlog.FailureAuth
+		case http.StatusNotFound, http.StatusGone:
+			return txlog.FailureHieNotFound
+		}
+		return ""
+	}
+	if os.IsNotExist(err) {
+		// The file HIE's document is gone
+		return txlog.FailureHieNotFound
+	} else if isNetworkError(err) {
+		return txlog.FailureNetwork
+	}
+	return ""
+}
+
+// classifyIngest works out why posting a document to the ingest service failed
+func classifyIngest(err error) txlog.FailureReason {
+	switch e := err.(type) {
+	case *transport.AuthError:
+		return txlog.FailureAuth
+	case *transport.StatusError:
+		switch {
+		case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+			return txlog.FailureAuth
+		case e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500:
+			return txlog.FailureIngestUnavailable
+		case e.StatusCode >= 400:
+			return txlog.FailureIngestRejected
+		}
+		return ""
+	}
+	if isNetworkError(err) {
+		return txlog.FailureNetwork
+	}
+	return ""
+}
+
+// isNetworkError reports whether the error came from the connection rather than the server's
+// response.  url.Errors, which wrap every failure to send a request, are net.Errors.
+func isNetworkError(err error) bool {
+	_, ok := err.(net.Error)
+	return ok
+}
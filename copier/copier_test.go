@@ -0,0 +1,1213 @@
+package copier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/intervention-engine/integrator/hie"
+	"github.com/intervention-engine/integrator/ingest"
+	"github.com/intervention-engine/integrator/transport"
+	"github.com/intervention-engine/integrator/txlog"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestDataCopierSuite(t *testing.T) {
+	suite.Run(t, new(DataCopierSuite))
+}
+
+type DataCopierSuite struct {
+	suite.Suite
+	hieClient    *MockHieClient
+	ingestClient *MockIngestClient
+	txLogMgr     *MockTransactionLogManager
+}
+
+type MockHieClient struct {
+	QueryRecordsFnIndex   int
+	QueryRecordsFns       []func(string, *time.Time, *time.Time) (*hie.QueryResponse, error)
+	DownloadRecordFnIndex int
+	DownloadRecordFns     []func(string) (io.ReadCloser, string, error)
+}
+
+func (m *MockHieClient) QueryRecords(ctx context.Context, mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+	i := m.QueryRecordsFnIndex
+	m.QueryRecordsFnIndex++
+	return m.QueryRecordsFns[i](mrn, start, end)
+}
+
+func (m *MockHieClient) DownloadRecord(ctx context.Context, url string) (content io.ReadCloser, contentType string, err error) {
+	i := m.DownloadRecordFnIndex
+	m.DownloadRecordFnIndex++
+	return m.DownloadRecordFns[i](url)
+}
+
+// MockPagedHieClient is a MockHieClient that returns query results a page at a time
+type MockPagedHieClient struct {
+	MockHieClient
+	QueryRecordsPageFnIndex int
+	QueryRecordsPageFns     []func(string, *time.Time, *time.Time, string) (*hie.QueryResponse, error)
+}
+
+func (m *MockPagedHieClient) QueryRecordsPage(ctx context.Context, mrn string, start *time.Time, end *time.Time, page string) (*hie.QueryResponse, error) {
+	i := m.QueryRecordsPageFnIndex
+	m.QueryRecordsPageFnIndex++
+	return m.QueryRecordsPageFns[i](mrn, start, end, page)
+}
+
+type MockIngestClient struct {
+	IngestFnIndex int
+	IngestFns     []func(string, io.ReadCloser) error
+	// Result, if set, is returned for successful uploads instead of a plain 200 OK
+	Result *ingest.Result
+}
+
+func (m *MockIngestClient) Ingest(ctx context.Context, contentType string, reader io.ReadCloser) (*ingest.Result, error) {
+	i := m.IngestFnIndex
+	m.IngestFnIndex++
+	if err := m.IngestFns[i](contentType, reader); err != nil {
+		return nil, err
+	}
+	if m.Result != nil {
+		return m.Result, nil
+	}
+	return &ingest.Result{Status: 200}, nil
+}
+
+// MockDocumentIngestClient is a MockIngestClient that records the EE numbers and entries it's given
+type MockDocumentIngestClient struct {
+	MockIngestClient
+	EEs     []string
+	Entries []*hie.QueryResponseEntry
+}
+
+func (m *MockDocumentIngestClient) IngestDocument(ctx context.Context, ee string, entry *hie.QueryResponseEntry, contentType string, reader io.ReadCloser) (*ingest.Result, error) {
+	m.EEs = append(m.EEs, ee)
+	m.Entries = append(m.Entries, entry)
+	return m.Ingest(ctx, contentType, reader)
+}
+
+type MockTransactionLogManager struct {
+	FindEntriesFnIndex     int
+	FindEntriesFns         []func(string) ([]*txlog.Entry, error)
+	StoreEntryFnIndex      int
+	StoreEntryFns          []func(*txlog.Entry) error
+	FindCheckpointFnIndex  int
+	FindCheckpointFns      []func(string, string) (*txlog.Checkpoint, error)
+	StoreCheckpointFnIndex int
+	StoreCheckpointFns     []func(*txlog.Checkpoint) error
+}
+
+func (m *MockTransactionLogManager) FindEntriesByEE(ctx context.Context, ee string) (entries []*txlog.Entry, err error) {
+	i := m.FindEntriesFnIndex
+	m.FindEntriesFnIndex++
+	return m.FindEntriesFns[i](ee)
+}
+
+func (m *MockTransactionLogManager) StoreEntry(ctx context.Context, entry *txlog.Entry) error {
+	i := m.StoreEntryFnIndex
+	m.StoreEntryFnIndex++
+	return m.StoreEntryFns[i](entry)
+}
+
+func (m *MockTransactionLogManager) FindCheckpoint(ctx context.Context, source, ee string) (*txlog.Checkpoint, error) {
+	i := m.FindCheckpointFnIndex
+	m.FindCheckpointFnIndex++
+	return m.FindCheckpointFns[i](source, ee)
+}
+
+func (m *MockTransactionLogManager) StoreCheckpoint(ctx context.Context, cp *txlog.Checkpoint) error {
+	i := m.StoreCheckpointFnIndex
+	m.StoreCheckpointFnIndex++
+	return m.StoreCheckpointFns[i](cp)
+}
+
+func (suite *DataCopierSuite) SetupTest() {
+	suite.hieClient = &MockHieClient{}
+	suite.ingestClient = &MockIngestClient{}
+	suite.txLogMgr = &MockTransactionLogManager{}
+}
+
+func (suite *DataCopierSuite) TestSuccessfulOperation() {
+	require := suite.Require()
+	suite.SetupMocksForSuccess("")
+	dataCopier, err := NewDataCopier(suite.hieClient, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	// The mock documents don't match the sizes the fixture advertises
+	dataCopier.Verify = VerifyOff
+	err = dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32")
+	require.NoError(err)
+}
+
+func (suite *DataCopierSuite) TestSuccessfulOperationWithLocalCopies() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	tempDir, err := ioutil.TempDir("", "dc_test")
+	require.NoError(err)
+	suite.SetupMocksForSuccess(tempDir)
+	dataCopier, err := NewDataCopierWithLocalCopies(suite.hieClient, suite.ingestClient, suite.txLogMgr, tempDir)
+	require.NoError(err)
+	// The mock documents don't match the sizes the fixture advertises
+	dataCopier.Verify = VerifyOff
+	err = dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32")
+	require.NoError(err)
+	for _, num := range []string{"1", "2", "3"} {
+		data, err := ioutil.ReadFile(path.Join(tempDir, "123456789", "1.1.1.1.1."+num+".xml"))
+		require.NoError(err)
+		assert.Equal("<foo>"+num+"</foo>", string(data))
+	}
+	os.RemoveAll(tempDir)
+}
+
+func (suite *DataCopierSuite) TestDocumentClientGetsMetadata() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.SetupMocksForSuccess("")
+	ingestClient := &MockDocumentIngestClient{MockIngestClient: *suite.ingestClient}
+	dataCopier, err := NewDataCopier(suite.hieClient, ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	// The mock documents don't match the sizes the fixture advertises
+	dataCopier.Verify = VerifyOff
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+	assert.Equal([]string{"123456789", "123456789", "123456789"}, ingestClient.EEs)
+	require.Len(ingestClient.Entries, 3)
+	for i, entry := range ingestClient.Entries {
+		assert.Equal(fmt.Sprintf("1.1.1.1.1.%d", i+1), entry.DocumentID)
+		assert.Equal(fmt.Sprintf("http://test.foo.net/document/1.1.1.1.1.%d", i+1), entry.RetrieveURL)
+	}
+}
+
+func (suite *DataCopierSuite) SetupMocksForSuccess(localCopyPath string) {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// Setup all the mocks
+	qStart := time.Date(2010, time.January, 1, 0, 0, 0, 0, time.Local)
+	suite.hieClient.QueryRecordsFns = append(suite.hieClient.QueryRecordsFns, func(mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+		assert.Equal("123456789", mrn)
+		assert.Equal(&qStart, start)
+		assert.Nil(end)
+		b, err := ioutil.ReadFile("../fixtures/response_success.json")
+		require.NoError(err)
+		var r hie.QueryResponse
+		json.Unmarshal(b, &r)
+		return &r, nil
+	})
+	suite.hieClient.DownloadRecordFns = append(suite.hieClient.DownloadRecordFns, func(url string) (io.ReadCloser, string, error) {
+		assert.Equal("http://test.foo.net/document/1.1.1.1.1.1", url)
+		rc := ioutil.NopCloser(bytes.NewBufferString("<foo>1</foo>"))
+		return rc, "text/xml", nil
+	}, func(url string) (io.ReadCloser, string, error) {
+		assert.Equal("http://test.foo.net/document/1.1.1.1.1.2", url)
+		rc := ioutil.NopCloser(bytes.NewBufferString("<foo>2</foo>"))
+		return rc, "text/xml", nil
+	}, func(url string) (io.ReadCloser, string, error) {
+		assert.Equal("http://test.foo.net/document/1.1.1.1.1.3", url)
+		rc := ioutil.NopCloser(bytes.NewBufferString("<foo>3</foo>"))
+		return rc, "text/xml", nil
+	})
+	suite.ingestClient.IngestFns = append(suite.ingestClient.IngestFns, func(contentType string, reader io.ReadCloser) error {
+		assert.Equal("text/xml", contentType)
+		defer reader.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(reader)
+		assert.Equal("<foo>1</foo>", buf.String())
+		return nil
+	}, func(contentType string, reader io.ReadCloser) error {
+		assert.Equal("text/xml", contentType)
+		defer reader.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(reader)
+		assert.Equal("<foo>2</foo>", buf.String())
+		return nil
+	}, func(contentType string, reader io.ReadCloser) error {
+		assert.Equal("text/xml", contentType)
+		defer reader.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(reader)
+		assert.Equal("<foo>3</foo>", buf.String())
+		return nil
+	})
+	suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		assert.Equal("123456789", ee)
+		return []*txlog.Entry{
+			&txlog.Entry{
+				QueryResponseEntry: hie.QueryResponseEntry{
+					RetrieveURL:  "http://test.foo.net/document/1.1.1.1.1.0",
+					CreationTime: time.Date(2007, time.March, 12, 9, 0, 0, 0, time.Local),
+					Title:        "Test Continuity of Care",
+					DocumentType: "XML^HL7^231^CCD^C32",
+					Hash:         "1827364537281930473627184544327894736482",
+					Size:         92834,
+				},
+				EE:   "123456789",
+				Date: time.Date(2009, time.December, 31, 23, 59, 59, 0, time.Local),
+			},
+		}, nil
+	})
+	qEnd := time.Date(2016, time.June, 8, 23, 59, 59, 0, time.Local)
+	suite.txLogMgr.StoreEntryFns = append(suite.txLogMgr.StoreEntryFns, func(entry *txlog.Entry) error {
+		b, err := ioutil.ReadFile("../fixtures/response_success.json")
+		require.NoError(err)
+		var r hie.QueryResponse
+		json.Unmarshal(b, &r)
+		assert.Equal(&txlog.Entry{
+			QueryResponseEntry: r.Result[0],
+			EE:                 "123456789",
+			Date:               qEnd,
+			Ingest:             &ingest.Result{Status: 200},
+		}, entry)
+		return nil
+	}, func(entry *txlog.Entry) error {
+		b, err := ioutil.ReadFile("../fixtures/response_success.json")
+		require.NoError(err)
+		var r hie.QueryResponse
+		json.Unmarshal(b, &r)
+		assert.Equal(&txlog.Entry{
+			QueryResponseEntry: r.Result[1],
+			EE:                 "123456789",
+			Date:               qEnd,
+			Ingest:             &ingest.Result{Status: 200},
+		}, entry)
+		return nil
+	}, func(entry *txlog.Entry) error {
+		b, err := ioutil.ReadFile("../fixtures/response_success.json")
+		require.NoError(err)
+		var r hie.QueryResponse
+		json.Unmarshal(b, &r)
+		assert.Equal(&txlog.Entry{
+			QueryResponseEntry: r.Result[2],
+			EE:                 "123456789",
+			Date:               qEnd,
+			Ingest:             &ingest.Result{Status: 200},
+		}, entry)
+		return nil
+	})
+}
+
+func (suite *DataCopierSuite) TestVerificationFailureIsRecorded() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	entry := hie.QueryResponseEntry{
+		RetrieveURL:  "http://test.foo.net/document/1.1.1.1.1.1",
+		DocumentType: "XML^HL7^231^CCD^C32",
+		DocumentID:   "1.1.1.1.1.1",
+		Hash:         "587BBFE3E61FAC149D55BE7E70CA6AB8D15A40B1",
+		Size:         12,
+	}
+	suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		return []*txlog.Entry{}, nil
+	})
+	suite.hieClient.QueryRecordsFns = append(suite.hieClient.QueryRecordsFns, func(mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+		return &hie.QueryResponse{Status: true, Result: []hie.QueryResponseEntry{entry}, Query: hie.QueryRequest{EE: mrn}}, nil
+	})
+	suite.hieClient.DownloadRecordFns = append(suite.hieClient.DownloadRecordFns, func(url string) (io.ReadCloser, string, error) {
+		// Same size, different content
+		return ioutil.NopCloser(bytes.NewBufferString("<foo>2</foo>")), "text/xml", nil
+	})
+	var stored *txlog.Entry
+	suite.txLogMgr.StoreEntryFns = append(suite.txLogMgr.StoreEntryFns, func(entry *txlog.Entry) error {
+		stored = entry
+		return nil
+	})
+
+	dataCopier, err := NewDataCopier(suite.hieClient, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	dataCopier.Verify = VerifyStrict
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+
+	require.NotNil(stored)
+	assert.Equal(txlog.FailureHashMismatch, stored.FailureReason)
+	assert.Equal(1, stored.FailureCount)
+	assert.Contains(stored.Error, "587BBFE3E61FAC149D55BE7E70CA6AB8D15A40B1")
+	assert.Equal(0, suite.ingestClient.IngestFnIndex)
+}
+
+func (suite *DataCopierSuite) TestIngestResultIsRecorded() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	entry := hie.QueryResponseEntry{
+		RetrieveURL:  "http://test.foo.net/document/1.1.1.1.1.1",
+		DocumentType: "XML^HL7^231^CCD^C32",
+		DocumentID:   "1.1.1.1.1.1",
+	}
+	suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		return []*txlog.Entry{}, nil
+	})
+	suite.hieClient.QueryRecordsFns = append(suite.hieClient.QueryRecordsFns, func(mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+		return &hie.QueryResponse{Status: true, Result: []hie.QueryResponseEntry{entry}, Query: hie.QueryRequest{EE: mrn}}, nil
+	})
+	suite.hieClient.DownloadRecordFns = append(suite.hieClient.DownloadRecordFns, func(url string) (io.ReadCloser, string, error) {
+		return ioutil.NopCloser(bytes.NewBufferString("<foo>1</foo>")), "text/xml", nil
+	})
+	suite.ingestClient.IngestFns = append(suite.ingestClient.IngestFns, func(contentType string, reader io.ReadCloser) error {
+		reader.Close()
+		return nil
+	})
+	suite.ingestClient.Result = &ingest.Result{
+		Status:   201,
+		Location: "http://ie.example.org/Patient/p1",
+		Created:  []string{"Patient/p1", "Encounter/e1"},
+		Warnings: []string{"warning: Unknown section was skipped"},
+	}
+	var stored *txlog.Entry
+	suite.txLogMgr.StoreEntryFns = append(suite.txLogMgr.StoreEntryFns, func(entry *txlog.Entry) error {
+		stored = entry
+		return nil
+	})
+
+	dataCopier, err := NewDataCopier(suite.hieClient, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+
+	require.NotNil(stored)
+	assert.Empty(stored.Error)
+	assert.Equal(suite.ingestClient.Result, stored.Ingest)
+}
+
+func (suite *DataCopierSuite) TestVerificationFailureIsRetried() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	failed := &txlog.Entry{
+		QueryResponseEntry: hie.QueryResponseEntry{
+			RetrieveURL:  "http://test.foo.net/document/1.1.1.1.1.1",
+			DocumentType: "XML^HL7^231^CCD^C32",
+			DocumentID:   "1.1.1.1.1.1",
+			Hash:         "587BBFE3E61FAC149D55BE7E70CA6AB8D15A40B1",
+			Size:         12,
+		},
+		EE:            "123456789",
+		Error:         "Downloaded document failed verification (size-mismatch): expected 12 bytes, got 8 bytes",
+		FailureReason: txlog.FailureSizeMismatch,
+		FailureCount:  1,
+		Date:          time.Date(2016, time.June, 8, 23, 59, 59, 0, time.Local),
+	}
+	suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		return []*txlog.Entry{failed}, nil
+	})
+	suite.hieClient.DownloadRecordFns = append(suite.hieClient.DownloadRecordFns, func(url string) (io.ReadCloser, string, error) {
+		return ioutil.NopCloser(bytes.NewBufferString("<foo>1</foo>")), "text/xml", nil
+	})
+	suite.ingestClient.IngestFns = append(suite.ingestClient.IngestFns, func(contentType string, reader io.ReadCloser) error {
+		defer reader.Close()
+		data, err := ioutil.ReadAll(reader)
+		require.NoError(err)
+		assert.Equal("<foo>1</foo>", string(data))
+		return nil
+	})
+	suite.txLogMgr.StoreEntryFns = append(suite.txLogMgr.StoreEntryFns, func(entry *txlog.Entry) error {
+		assert.Equal("", entry.Error)
+		assert.Equal(txlog.FailureReason(""), entry.FailureReason)
+		assert.Equal(0, entry.FailureCount)
+		return nil
+	})
+	suite.hieClient.QueryRecordsFns = append(suite.hieClient.QueryRecordsFns, func(mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+		return &hie.QueryResponse{Status: true, Query: hie.QueryRequest{EE: mrn}}, nil
+	})
+
+	dataCopier, err := NewDataCopier(suite.hieClient, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	dataCopier.Verify = VerifyStrict
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+	assert.Equal(1, suite.txLogMgr.StoreEntryFnIndex)
+}
+
+// failedEntry returns a transaction log entry for a document that failed to be copied
+func failedEntry(failures int) *txlog.Entry {
+	return &txlog.Entry{
+		QueryResponseEntry: hie.QueryResponseEntry{
+			RetrieveURL:  "http://test.foo.net/document/1.1.1.1.1.1",
+			DocumentType: "XML^HL7^231^CCD^C32",
+			DocumentID:   "1.1.1.1.1.1",
+		},
+		EE:            "123456789",
+		Error:         "Failed to post content.  Received 503: 503 Service Unavailable",
+		FailureReason: txlog.FailureIngestUnavailable,
+		FailureCount:  failures,
+		Date:          time.Date(2016, time.June, 8, 23, 59, 59, 0, time.Local),
+	}
+}
+
+func (suite *DataCopierSuite) TestRetriesAreCappedAndBackedOff() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		return []*txlog.Entry{failedEntry(1), failedEntry(2)}, nil
+	}, func(ee string) ([]*txlog.Entry, error) {
+		return []*txlog.Entry{failedEntry(1)}, nil
+	})
+	for i := 0; i < 3; i++ {
+		suite.hieClient.DownloadRecordFns = append(suite.hieClient.DownloadRecordFns, func(url string) (io.ReadCloser, string, error) {
+			return nil, "", transport.NewStatusError(http.StatusServiceUnavailable, "Non-OK response from source server: 503")
+		})
+	}
+	for i := 0; i < 2; i++ {
+		suite.hieClient.QueryRecordsFns = append(suite.hieClient.QueryRecordsFns, func(mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+			return &hie.QueryResponse{Status: true, Query: hie.QueryRequest{EE: mrn}}, nil
+		})
+	}
+	var stored []*txlog.Entry
+	for i := 0; i < 3; i++ {
+		suite.txLogMgr.StoreEntryFns = append(suite.txLogMgr.StoreEntryFns, func(entry *txlog.Entry) error {
+			stored = append(stored, entry)
+			return nil
+		})
+	}
+
+	dataCopier, err := NewDataCopier(suite.hieClient, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	dataCopier.MaxAttempts = 3
+	dataCopier.AttemptBackoff = time.Hour
+	dataCopier.MaxAttemptBackoff = 90 * time.Minute
+
+	// The second failure is backed off; the third uses up the attempts
+	before := time.Now()
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+	require.Len(stored, 2)
+	assert.Equal(2, stored[0].FailureCount)
+	assert.Equal(txlog.FailureReason(""), stored[0].FailureReason)
+	assert.False(stored[0].DeadLetter)
+	assert.False(stored[0].NextAttemptAt.Before(before.Add(90 * time.Minute)))
+	assert.True(stored[0].NextAttemptAt.Before(time.Now().Add(91 * time.Minute)))
+	assert.Equal(3, stored[1].FailureCount)
+	assert.True(stored[1].DeadLetter)
+	assert.True(stored[1].NextAttemptAt.IsZero())
+
+	// Without a cap or a backoff, failures are retried on every run
+	dataCopier.MaxAttempts = 0
+	dataCopier.AttemptBackoff = 0
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+	require.Len(stored, 3)
+	assert.Equal(2, stored[2].FailureCount)
+	assert.False(stored[2].DeadLetter)
+	assert.True(stored[2].NextAttemptAt.IsZero())
+}
+
+func (suite *DataCopierSuite) TestDeadLetteredAndBackedOffDocumentsAreSkipped() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	deadLettered := failedEntry(3)
+	deadLettered.DeadLetter = true
+	backedOff := failedEntry(1)
+	backedOff.DocumentID = "1.1.1.1.1.2"
+	backedOff.NextAttemptAt = time.Now().Add(time.Hour)
+	suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		return []*txlog.Entry{deadLettered, backedOff}, nil
+	})
+	suite.hieClient.QueryRecordsFns = append(suite.hieClient.QueryRecordsFns, func(mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+		return &hie.QueryResponse{Status: true, Query: hie.QueryRequest{EE: mrn}}, nil
+	})
+
+	dataCopier, err := NewDataCopier(suite.hieClient, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+	assert.Equal(0, suite.hieClient.DownloadRecordFnIndex)
+	assert.Equal(0, suite.txLogMgr.StoreEntryFnIndex)
+}
+
+func (suite *DataCopierSuite) TestRejectedDocumentsAreDeadLettered() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		return []*txlog.Entry{failedEntry(1)}, nil
+	})
+	suite.hieClient.DownloadRecordFns = append(suite.hieClient.DownloadRecordFns, func(url string) (io.ReadCloser, string, error) {
+		return ioutil.NopCloser(bytes.NewBufferString("<foo>1</foo>")), "text/xml", nil
+	})
+	suite.ingestClient.IngestFns = append(suite.ingestClient.IngestFns, func(contentType string, reader io.ReadCloser) error {
+		reader.Close()
+		return transport.NewStatusError(http.StatusBadRequest, "Failed to post content.  Received 400: 400 Bad Request")
+	})
+	var stored *txlog.Entry
+	suite.txLogMgr.StoreEntryFns = append(suite.txLogMgr.StoreEntryFns, func(entry *txlog.Entry) error {
+		stored = entry
+		return nil
+	})
+	suite.hieClient.QueryRecordsFns = append(suite.hieClient.QueryRecordsFns, func(mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+		return &hie.QueryResponse{Status: true, Query: hie.QueryRequest{EE: mrn}}, nil
+	})
+
+	dataCopier, err := NewDataCopier(suite.hieClient, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+	require.NotNil(stored)
+	assert.Equal(txlog.FailureIngestRejected, stored.FailureReason)
+	assert.Equal(2, stored.FailureCount)
+	assert.True(stored.DeadLetter)
+}
+
+func (suite *DataCopierSuite) TestMalformedEntriesAreRecorded() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		return []*txlog.Entry{}, nil
+	})
+	var stored []*txlog.Entry
+	suite.txLogMgr.StoreEntryFns = append(suite.txLogMgr.StoreEntryFns, func(entry *txlog.Entry) error {
+		stored = append(stored, entry)
+		return nil
+	})
+	end := time.Date(2016, time.June, 8, 23, 59, 59, 0, time.Local)
+	suite.hieClient.QueryRecordsFns = append(suite.hieClient.QueryRecordsFns, func(mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+		f, err := os.Open("../fixtures/response_malformed.json")
+		require.NoError(err)
+		defer f.Close()
+		resp, err := hie.DecodeQueryResponse(f, false)
+		require.NoError(err)
+		// Leave out the valid entries, which aren't what's being tested
+		resp.Result = nil
+		return resp, nil
+	})
+
+	dataCopier, err := NewDataCopier(suite.hieClient, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+
+	// Only the malformed entry with a document ID can be recorded
+	require.Len(stored, 1)
+	assert.Equal("1.1.1.1.1.2", stored[0].DocumentID)
+	assert.Equal("123456789", stored[0].EE)
+	assert.True(end.Equal(stored[0].Date))
+	assert.Equal(txlog.FailureInvalidEntry, stored[0].FailureReason)
+	assert.Contains(stored[0].Error, "result[1].retrieveURL is required")
+	assert.Equal(1, stored[0].FailureCount)
+	assert.True(stored[0].DeadLetter)
+	assert.Equal(0, suite.hieClient.DownloadRecordFnIndex)
+}
+
+func (suite *DataCopierSuite) TestReleasedMalformedEntryIsNotDownloaded() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// An operator released a malformed entry, but there's still nothing to download
+	released := &txlog.Entry{
+		QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "1.1.1.1.1.2"},
+		EE:                 "123456789",
+		Error:              "Invalid entry 1 (document 1.1.1.1.1.2): result[1].retrieveURL is required",
+		FailureReason:      txlog.FailureInvalidEntry,
+		FailureCount:       1,
+		Date:               time.Date(2016, time.June, 8, 23, 59, 59, 0, time.Local),
+	}
+	suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		return []*txlog.Entry{released}, nil
+	})
+	var stored []*txlog.Entry
+	suite.txLogMgr.StoreEntryFns = append(suite.txLogMgr.StoreEntryFns, func(entry *txlog.Entry) error {
+		stored = append(stored, entry)
+		return nil
+	})
+	suite.hieClient.QueryRecordsFns = append(suite.hieClient.QueryRecordsFns, func(mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+		return &hie.QueryResponse{Status: true, Query: hie.QueryRequest{EE: mrn}}, nil
+	})
+
+	dataCopier, err := NewDataCopier(suite.hieClient, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+
+	// It goes back to the dead-letter state without being downloaded
+	require.Len(stored, 1)
+	assert.Equal(txlog.FailureInvalidEntry, stored[0].FailureReason)
+	assert.Equal(released.Error, stored[0].Error)
+	assert.Equal(2, stored[0].FailureCount)
+	assert.True(stored[0].DeadLetter)
+	assert.Equal(0, suite.hieClient.DownloadRecordFnIndex)
+}
+
+func (suite *DataCopierSuite) TestMalformedEntryIsCopiedWhenReturnedIntact() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	malformed := &txlog.Entry{
+		QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "1.1.1.1.1.2"},
+		EE:                 "123456789",
+		Error:              "Invalid entry 1 (document 1.1.1.1.1.2): result[1].retrieveURL is required",
+		FailureReason:      txlog.FailureInvalidEntry,
+		FailureCount:       1,
+		DeadLetter:         true,
+		Date:               time.Date(2016, time.June, 8, 23, 59, 59, 0, time.Local),
+	}
+	suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		return []*txlog.Entry{malformed}, nil
+	})
+	var stored []*txlog.Entry
+	suite.txLogMgr.StoreEntryFns = append(suite.txLogMgr.StoreEntryFns, func(entry *txlog.Entry) error {
+		stored = append(stored, entry)
+		return nil
+	})
+	queried := time.Date(2016, time.June, 9, 23, 59, 59, 0, time.Local)
+	suite.hieClient.QueryRecordsFns = append(suite.hieClient.QueryRecordsFns, func(mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+		return &hie.QueryResponse{
+			Status: true,
+			Query:  hie.QueryRequest{EE: mrn, EndDateTime: queried},
+			Result: []hie.QueryResponseEntry{{
+				DocumentID:   "1.1.1.1.1.2",
+				DocumentType: "XML^HL7^231^CCD^C32",
+				RetrieveURL:  "http://hie.example.org/documents/2",
+			}},
+		}, nil
+	})
+	suite.hieClient.DownloadRecordFns = append(suite.hieClient.DownloadRecordFns, func(url string) (io.ReadCloser, string, error) {
+		assert.Equal("http://hie.example.org/documents/2", url)
+		return ioutil.NopCloser(bytes.NewBufferString("<document/>")), "text/xml", nil
+	})
+	suite.ingestClient.IngestFns = append(suite.ingestClient.IngestFns, func(contentType string, reader io.ReadCloser) error {
+		reader.Close()
+		return nil
+	})
+
+	dataCopier, err := NewDataCopier(suite.hieClient, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+
+	// The query's intact entry replaces the malformed one, and is copied
+	require.Len(stored, 1)
+	assert.Equal("http://hie.example.org/documents/2", stored[0].RetrieveURL)
+	assert.False(stored[0].Failed())
+	assert.False(stored[0].DeadLetter)
+	assert.True(queried.Equal(stored[0].Date))
+	assert.Equal(1, suite.hieClient.DownloadRecordFnIndex)
+}
+
+func (suite *DataCopierSuite) TestFailuresAreClassified() {
+	assert := suite.Assert()
+
+	dialErr := &url.Error{Op: "Get", URL: "http://hie.example.org", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+	assert.Equal(txlog.FailureNetwork, classifyDownload(dialErr))
+	assert.Equal(txlog.FailureNetwork, classifyIngest(dialErr))
+	assert.Equal(txlog.FailureAuth, classifyDownload(&transport.AuthError{Err: errors.New("Failed to obtain access token")}))
+	assert.Equal(txlog.FailureAuth, classifyIngest(&transport.AuthError{Err: errors.New("Failed to obtain access token")}))
+	assert.Equal(txlog.FailureAuth, classifyDownload(transport.NewStatusError(http.StatusUnauthorized, "401")))
+	assert.Equal(txlog.FailureAuth, classifyIngest(transport.NewStatusError(http.StatusForbidden, "403")))
+	assert.Equal(txlog.FailureHieNotFound, classifyDownload(transport.NewStatusError(http.StatusNotFound, "404")))
+	assert.Equal(txlog.FailureHieNotFound, classifyDownload(&os.PathError{Op: "open", Path: "/drop/1.xml", Err: os.ErrNotExist}))
+	assert.Equal(txlog.FailureReason(""), classifyDownload(transport.NewStatusError(http.StatusInternalServerError, "500")))
+	assert.Equal(txlog.FailureHashMismatch, classifyDownload(&VerificationError{Reason: txlog.FailureHashMismatch}))
+	assert.Equal(txlog.FailureIngestRejected, classifyIngest(transport.NewStatusError(http.StatusBadRequest, "400")))
+	assert.Equal(txlog.FailureIngestRejected, classifyIngest(transport.NewStatusError(http.StatusUnprocessableEntity, "422")))
+	assert.Equal(txlog.FailureIngestUnavailable, classifyIngest(transport.NewStatusError(http.StatusServiceUnavailable, "503")))
+	assert.Equal(txlog.FailureIngestUnavailable, classifyIngest(transport.NewStatusError(http.StatusTooManyRequests, "429")))
+	assert.Equal(txlog.FailureReason(""), classifyIngest(errors.New("Failed to read the document")))
+}
+
+func (suite *DataCopierSuite) TestCancelledRunDefersDocuments() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		return []*txlog.Entry{}, nil
+	})
+	suite.hieClient.QueryRecordsFns = append(suite.hieClient.QueryRecordsFns, func(mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+		b, err := ioutil.ReadFile("../fixtures/response_success.json")
+		require.NoError(err)
+		var r hie.QueryResponse
+		require.NoError(json.Unmarshal(b, &r))
+		return &r, nil
+	})
+	suite.hieClient.DownloadRecordFns = append(suite.hieClient.DownloadRecordFns, func(url string) (io.ReadCloser, string, error) {
+		return ioutil.NopCloser(bytes.NewBufferString("<foo>1</foo>")), "text/xml", nil
+	})
+	suite.ingestClient.IngestFns = append(suite.ingestClient.IngestFns, func(contentType string, reader io.ReadCloser) error {
+		// The run is cancelled while the first document is being uploaded
+		cancel()
+		return nil
+	})
+	var stored []*txlog.Entry
+	for i := 0; i < 3; i++ {
+		suite.txLogMgr.StoreEntryFns = append(suite.txLogMgr.StoreEntryFns, func(entry *txlog.Entry) error {
+			stored = append(stored, entry)
+			return nil
+		})
+	}
+
+	dataCopier, err := NewDataCopier(suite.hieClient, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	// The mock documents don't match the sizes the fixture advertises
+	dataCopier.Verify = VerifyOff
+	err = dataCopier.CopyRecords(ctx, "123456789", "XML^HL7^231^CCD^C32")
+	assert.Equal(context.Canceled, err)
+
+	// All three are logged, but only the first was copied
+	require.Len(stored, 3)
+	assert.Equal(0, stored[0].FailureCount)
+	for _, entry := range stored[1:] {
+		assert.Equal(1, entry.FailureCount)
+		assert.Equal(context.Canceled.Error(), entry.Error)
+	}
+	assert.Equal(1, suite.hieClient.DownloadRecordFnIndex)
+}
+
+func (suite *DataCopierSuite) SetupWindowedQueries(starts []time.Time, ends []*time.Time, failOn int) {
+	assert := suite.Assert()
+
+	for i := range starts {
+		i := i
+		suite.hieClient.QueryRecordsFns = append(suite.hieClient.QueryRecordsFns, func(mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+			assert.Equal(starts[i], *start)
+			assert.Equal(ends[i], end)
+			if i == failOn {
+				return nil, errors.New("HIE timed out")
+			}
+			resp := &hie.QueryResponse{Status: true, Query: hie.QueryRequest{EE: mrn, StartDateTime: *start, EndDateTime: time.Now()}}
+			if end != nil {
+				resp.Query.EndDateTime = *end
+			}
+			return resp, nil
+		})
+	}
+}
+
+func (suite *DataCopierSuite) TestWindowedQueries() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	window := 50 * 365 * 24 * time.Hour
+	start := time.Date(1900, time.January, 1, 0, 0, 0, 0, time.Local)
+	end1 := start.Add(window - time.Second)
+	end2 := end1.Add(window)
+	starts := []time.Time{start, end1.Add(time.Second), end2.Add(time.Second)}
+	suite.SetupWindowedQueries(starts, []*time.Time{&end1, &end2, nil}, -1)
+
+	// The second window has a document in it
+	suite.hieClient.QueryRecordsFns[1] = func(mrn string, s *time.Time, e *time.Time) (*hie.QueryResponse, error) {
+		assert.Equal(starts[1], *s)
+		return &hie.QueryResponse{
+			Status: true,
+			Result: []hie.QueryResponseEntry{{
+				RetrieveURL:  "http://test.foo.net/document/1.1.1.1.1.1",
+				DocumentType: "XML^HL7^231^CCD^C32",
+				DocumentID:   "1.1.1.1.1.1",
+			}},
+			Query: hie.QueryRequest{EE: mrn, EndDateTime: *e},
+		}, nil
+	}
+	suite.hieClient.DownloadRecordFns = append(suite.hieClient.DownloadRecordFns, func(url string) (io.ReadCloser, string, error) {
+		return ioutil.NopCloser(bytes.NewBufferString("<foo>1</foo>")), "text/xml", nil
+	})
+	suite.ingestClient.IngestFns = append(suite.ingestClient.IngestFns, func(contentType string, reader io.ReadCloser) error {
+		return reader.Close()
+	})
+	suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		return []*txlog.Entry{}, nil
+	})
+	suite.txLogMgr.StoreEntryFns = append(suite.txLogMgr.StoreEntryFns, func(entry *txlog.Entry) error {
+		assert.Equal("1.1.1.1.1.1", entry.DocumentID)
+		assert.Equal(end2, entry.Date)
+		return nil
+	})
+	suite.txLogMgr.FindCheckpointFns = append(suite.txLogMgr.FindCheckpointFns, func(source, ee string) (*txlog.Checkpoint, error) {
+		return nil, nil
+	})
+	var checkpoints []*txlog.Checkpoint
+	for i := 0; i < 3; i++ {
+		suite.txLogMgr.StoreCheckpointFns = append(suite.txLogMgr.StoreCheckpointFns, func(cp *txlog.Checkpoint) error {
+			checkpoints = append(checkpoints, cp)
+			return nil
+		})
+	}
+
+	dataCopier, err := NewDataCopier(suite.hieClient, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	dataCopier.QueryWindow = window
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+
+	assert.Equal(3, suite.hieClient.QueryRecordsFnIndex)
+	require.Len(checkpoints, 3)
+	assert.Equal(&txlog.Checkpoint{EE: "123456789", Through: end1}, checkpoints[0])
+	assert.Equal(&txlog.Checkpoint{EE: "123456789", Through: end2}, checkpoints[1])
+	assert.True(checkpoints[2].Through.After(end2))
+}
+
+func (suite *DataCopierSuite) TestWindowedQueriesResumeFromCheckpoint() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	window := 365 * 24 * time.Hour
+	through := time.Now().Add(-(window + window/2)).Truncate(time.Second)
+	end := through.Add(window)
+	suite.SetupWindowedQueries([]time.Time{through.Add(time.Second), end.Add(time.Second)}, []*time.Time{&end, nil}, 1)
+
+	suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		// The checkpoint is more recent than the last document
+		return []*txlog.Entry{{
+			QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "1.1.1.1.1.1"},
+			EE:                 ee,
+			Date:               through.Add(-window),
+		}}, nil
+	})
+	suite.txLogMgr.FindCheckpointFns = append(suite.txLogMgr.FindCheckpointFns, func(source, ee string) (*txlog.Checkpoint, error) {
+		return &txlog.Checkpoint{EE: ee, Through: through}, nil
+	})
+	suite.txLogMgr.StoreCheckpointFns = append(suite.txLogMgr.StoreCheckpointFns, func(cp *txlog.Checkpoint) error {
+		assert.Equal(&txlog.Checkpoint{EE: "123456789", Through: end}, cp)
+		return nil
+	})
+
+	dataCopier, err := NewDataCopier(suite.hieClient, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	dataCopier.QueryWindow = window
+	// The second window fails, so the checkpoint is left at the end of the first
+	err = dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32")
+	assert.EqualError(err, "HIE timed out")
+	assert.Equal(2, suite.hieClient.QueryRecordsFnIndex)
+	assert.Equal(1, suite.txLogMgr.StoreCheckpointFnIndex)
+}
+
+// SetupPagedQueries mocks a paged HIE that returns one document per page, with each page (but
+// the last) naming the next page.  Every document is downloaded and ingested.
+func (suite *DataCopierSuite) SetupPagedQueries(client *MockPagedHieClient, start time.Time, end time.Time, pages ...string) {
+	assert := suite.Assert()
+
+	for i := range pages {
+		page, next := pages[i], ""
+		if i+1 < len(pages) {
+			next = pages[i+1]
+		}
+		client.QueryRecordsPageFns = append(client.QueryRecordsPageFns, func(mrn string, s *time.Time, e *time.Time, p string) (*hie.QueryResponse, error) {
+			assert.Equal(start, *s)
+			assert.Nil(e)
+			assert.Equal(page, p)
+			return &hie.QueryResponse{
+				Status: true,
+				Result: []hie.QueryResponseEntry{{
+					RetrieveURL:  "http://test.foo.net/document/" + page,
+					DocumentType: "XML^HL7^231^CCD^C32",
+					DocumentID:   "doc" + page,
+				}},
+				Query:    hie.QueryRequest{EE: mrn, EndDateTime: end},
+				NextPage: next,
+			}, nil
+		})
+		client.DownloadRecordFns = append(client.DownloadRecordFns, func(url string) (io.ReadCloser, string, error) {
+			assert.Equal("http://test.foo.net/document/"+page, url)
+			return ioutil.NopCloser(bytes.NewBufferString("<foo/>")), "text/xml", nil
+		})
+		suite.ingestClient.IngestFns = append(suite.ingestClient.IngestFns, func(contentType string, reader io.ReadCloser) error {
+			return reader.Close()
+		})
+		suite.txLogMgr.StoreEntryFns = append(suite.txLogMgr.StoreEntryFns, func(entry *txlog.Entry) error {
+			assert.Equal("doc"+page, entry.DocumentID)
+			assert.Equal(end, entry.Date)
+			return nil
+		})
+	}
+}
+
+func (suite *DataCopierSuite) TestPagedQueries() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	client := &MockPagedHieClient{}
+	start := time.Date(1900, time.January, 1, 0, 0, 0, 0, time.Local)
+	end := time.Date(2016, time.June, 8, 23, 59, 59, 0, time.Local)
+	suite.SetupPagedQueries(client, start, end, "", "p2", "p3")
+	suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		return []*txlog.Entry{}, nil
+	})
+	suite.txLogMgr.FindCheckpointFns = append(suite.txLogMgr.FindCheckpointFns, func(source, ee string) (*txlog.Checkpoint, error) {
+		return nil, nil
+	})
+	var checkpoints []*txlog.Checkpoint
+	for i := 0; i < 3; i++ {
+		suite.txLogMgr.StoreCheckpointFns = append(suite.txLogMgr.StoreCheckpointFns, func(cp *txlog.Checkpoint) error {
+			checkpoints = append(checkpoints, cp)
+			return nil
+		})
+	}
+
+	dataCopier, err := NewDataCopier(client, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+
+	// Pages are fetched one at a time, never all at once
+	assert.Equal(3, client.QueryRecordsPageFnIndex)
+	assert.Equal(0, client.QueryRecordsFnIndex)
+	assert.Equal(3, suite.txLogMgr.StoreEntryFnIndex)
+	// The next page is recorded after each page, and cleared after the last
+	assert.Equal([]*txlog.Checkpoint{
+		{EE: "123456789", Page: "p2", PageStart: start},
+		{EE: "123456789", Page: "p3", PageStart: start},
+		{EE: "123456789"},
+	}, checkpoints)
+}
+
+func (suite *DataCopierSuite) TestPagedQueriesStopWhenContextIsDone() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	client := &MockPagedHieClient{}
+	start := time.Date(1900, time.January, 1, 0, 0, 0, 0, time.Local)
+	end := time.Date(2016, time.June, 8, 23, 59, 59, 0, time.Local)
+	suite.SetupPagedQueries(client, start, end, "", "p2")
+	ctx, cancel := context.WithCancel(context.Background())
+	suite.ingestClient.IngestFns[0] = func(contentType string, reader io.ReadCloser) error {
+		cancel()
+		return reader.Close()
+	}
+	suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		return []*txlog.Entry{}, nil
+	})
+	suite.txLogMgr.FindCheckpointFns = append(suite.txLogMgr.FindCheckpointFns, func(source, ee string) (*txlog.Checkpoint, error) {
+		return nil, nil
+	})
+	suite.txLogMgr.StoreCheckpointFns = append(suite.txLogMgr.StoreCheckpointFns, func(cp *txlog.Checkpoint) error {
+		assert.Equal(&txlog.Checkpoint{EE: "123456789", Page: "p2", PageStart: start}, cp)
+		return nil
+	})
+
+	dataCopier, err := NewDataCopier(client, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	err = dataCopier.CopyRecords(ctx, "123456789", "XML^HL7^231^CCD^C32")
+	assert.Equal(context.Canceled, err)
+	// The first page was finished and the second is left for the next run
+	assert.Equal(1, client.QueryRecordsPageFnIndex)
+	assert.Equal(1, suite.txLogMgr.StoreCheckpointFnIndex)
+}
+
+func (suite *DataCopierSuite) TestPagedQueriesResumeFromCheckpoint() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	client := &MockPagedHieClient{}
+	pageStart := time.Date(2010, time.January, 1, 0, 0, 0, 0, time.Local)
+	end := time.Date(2016, time.June, 8, 23, 59, 59, 0, time.Local)
+	suite.SetupPagedQueries(client, pageStart, end, "p3")
+	// After the interrupted query is finished, a new query starts after it
+	client.QueryRecordsPageFns = append(client.QueryRecordsPageFns, func(mrn string, s *time.Time, e *time.Time, p string) (*hie.QueryResponse, error) {
+		assert.Equal(end.Add(time.Second), *s)
+		assert.Equal("", p)
+		return &hie.QueryResponse{Status: true, Query: hie.QueryRequest{EE: mrn, EndDateTime: time.Now()}}, nil
+	})
+	suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		return []*txlog.Entry{{
+			QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "doc"},
+			EE:                 ee,
+			Date:               end,
+		}}, nil
+	})
+	suite.txLogMgr.FindCheckpointFns = append(suite.txLogMgr.FindCheckpointFns, func(source, ee string) (*txlog.Checkpoint, error) {
+		return &txlog.Checkpoint{EE: ee, Page: "p3", PageStart: pageStart}, nil
+	})
+	suite.txLogMgr.StoreCheckpointFns = append(suite.txLogMgr.StoreCheckpointFns, func(cp *txlog.Checkpoint) error {
+		assert.Equal(&txlog.Checkpoint{EE: "123456789"}, cp)
+		return nil
+	})
+
+	dataCopier, err := NewDataCopier(client, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+	assert.Equal(2, client.QueryRecordsPageFnIndex)
+	assert.Equal(1, suite.txLogMgr.StoreEntryFnIndex)
+	assert.Equal(1, suite.txLogMgr.StoreCheckpointFnIndex)
+}
+
+func (suite *DataCopierSuite) TestMultipleSources() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// Both HIEs have a document with the same ID, but it's only been copied from the first
+	hieA, hieB := &MockHieClient{}, &MockHieClient{}
+	result := func(mrn string, docType string) *hie.QueryResponse {
+		return &hie.QueryResponse{
+			Status: true,
+			Result: []hie.QueryResponseEntry{{
+				RetrieveURL:  "http://test.foo.net/document/1.1.1.1.1.1",
+				DocumentType: docType,
+				DocumentID:   "1.1.1.1.1.1",
+			}},
+			Query: hie.QueryRequest{EE: mrn, EndDateTime: time.Now()},
+		}
+	}
+	hieA.QueryRecordsFns = append(hieA.QueryRecordsFns, func(mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+		return result(mrn, "XML^HL7^231^CCD^C32"), nil
+	})
+	hieB.QueryRecordsFns = append(hieB.QueryRecordsFns, func(mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+		return result(mrn, "C-CDA"), nil
+	})
+	hieB.DownloadRecordFns = append(hieB.DownloadRecordFns, func(url string) (io.ReadCloser, string, error) {
+		return ioutil.NopCloser(bytes.NewBufferString("<foo/>")), "text/xml", nil
+	})
+	suite.ingestClient.IngestFns = append(suite.ingestClient.IngestFns, func(contentType string, reader io.ReadCloser) error {
+		return reader.Close()
+	})
+	for i := 0; i < 2; i++ {
+		suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+			return []*txlog.Entry{{
+				QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "1.1.1.1.1.1"},
+				Source:             "hie-a",
+				EE:                 ee,
+				Date:               time.Date(2016, time.June, 8, 23, 59, 59, 0, time.Local),
+			}}, nil
+		})
+	}
+	suite.txLogMgr.StoreEntryFns = append(suite.txLogMgr.StoreEntryFns, func(entry *txlog.Entry) error {
+		assert.Equal("hie-b", entry.Source)
+		assert.Equal("1.1.1.1.1.1", entry.DocumentID)
+		assert.Equal(0, entry.FailureCount)
+		return nil
+	})
+
+	dataCopier, err := NewDataCopier(hieA, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	dataCopier.Sources = []*Source{
+		{Name: "hie-a", Client: hieA},
+		{Name: "hie-b", Client: hieB, Formats: []string{"C-CDA"}},
+	}
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+	assert.Equal(1, hieA.QueryRecordsFnIndex)
+	assert.Equal(0, hieA.DownloadRecordFnIndex)
+	assert.Equal(1, hieB.DownloadRecordFnIndex)
+	assert.Equal(1, suite.txLogMgr.StoreEntryFnIndex)
+}
+
+func (suite *DataCopierSuite) TestSourceErrorsDoNotStopOtherSources() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	hieA, hieB := &MockHieClient{}, &MockHieClient{}
+	hieA.QueryRecordsFns = append(hieA.QueryRecordsFns, func(mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+		return nil, errors.New("HIE A is down")
+	})
+	hieB.QueryRecordsFns = append(hieB.QueryRecordsFns, func(mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+		return &hie.QueryResponse{Status: true, Query: hie.QueryRequest{EE: mrn, EndDateTime: time.Now()}}, nil
+	})
+	for i := 0; i < 2; i++ {
+		suite.txLogMgr.FindEntriesFns = append(suite.txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+			return []*txlog.Entry{}, nil
+		})
+	}
+
+	dataCopier, err := NewDataCopier(hieA, suite.ingestClient, suite.txLogMgr)
+	require.NoError(err)
+	dataCopier.Sources = []*Source{{Name: "hie-a", Client: hieA}, {Name: "hie-b", Client: hieB}}
+	err = dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32")
+	assert.EqualError(err, "HIE A is down")
+	assert.Equal(1, hieB.QueryRecordsFnIndex)
+}
+
+func (suite *DataCopierSuite) TestFileSourceArchivesIngestedDocuments() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	tempDir := suite.SetupDropFolder()
+	defer os.RemoveAll(tempDir)
+	exists := func(elem ...string) bool {
+		_, err := os.Stat(filepath.Join(append([]string{tempDir}, elem...)...))
+		return err == nil
+	}
+
+	fileClient := hie.NewFileClient(filepath.Join(tempDir, "drop"))
+	fileClient.ArchiveDir = filepath.Join(tempDir, "archive")
+	fileClient.ErrorDir = filepath.Join(tempDir, "error")
+	ingestClient := &MockIngestClient{}
+	txLogMgr := &MockTransactionLogManager{}
+	ingestClient.IngestFns = append(ingestClient.IngestFns, func(contentType string, reader io.ReadCloser) error {
+		defer reader.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(reader)
+		assert.Contains(buf.String(), "ccd-1")
+		return nil
+	}, func(contentType string, reader io.ReadCloser) error {
+		reader.Close()
+		return errors.New("Ingest rejected the document")
+	})
+	txLogMgr.FindEntriesFns = append(txLogMgr.FindEntriesFns, func(ee string) ([]*txlog.Entry, error) {
+		return []*txlog.Entry{}, nil
+	})
+	for i := 0; i < 2; i++ {
+		txLogMgr.StoreEntryFns = append(txLogMgr.StoreEntryFns, func(entry *txlog.Entry) error {
+			return nil
+		})
+	}
+
+	dataCopier, err := NewDataCopier(fileClient, ingestClient, txLogMgr)
+	require.NoError(err)
+	dataCopier.Verify = VerifyStrict
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+	assert.True(exists("archive", "123456789", "ccd1.xml"))
+	assert.True(exists("error", "123456789", "note.xml"))
+	// The other document isn't in a supported format, so it's left alone
+	assert.True(exists("drop", "123456789", "ccd2.xml"))
+}
+
+func (suite *DataCopierSuite) TestFileSourceCopiesUnidentifiedDocuments() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	tempDir := suite.SetupDropFolder()
+	defer os.RemoveAll(tempDir)
+	ingestClient := &MockIngestClient{}
+	for i := 0; i < 2; i++ {
+		ingestClient.IngestFns = append(ingestClient.IngestFns, func(contentType string, reader io.ReadCloser) error {
+			return reader.Close()
+		})
+	}
+	txLogMgr := txlog.NewMemoryManager()
+
+	fileClient := hie.NewFileClient(filepath.Join(tempDir, "drop"))
+	copies := filepath.Join(tempDir, "copies")
+	dataCopier, err := NewDataCopierWithLocalCopies(fileClient, ingestClient, txLogMgr, copies)
+	require.NoError(err)
+	dataCopier.Verify = VerifyOff
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+
+	// The document without an id is copied alongside the others, under its file name
+	entries, err := txLogMgr.FindEntriesByEE(context.Background(), "123456789")
+	require.NoError(err)
+	var docIDs []string
+	for _, e := range entries {
+		assert.False(e.Failed())
+		docIDs = append(docIDs, e.DocumentID)
+	}
+	assert.Contains(docIDs, "note")
+	expected, err := ioutil.ReadFile("../fixtures/drop_folder/123456789/note.xml")
+	require.NoError(err)
+	data, err := ioutil.ReadFile(filepath.Join(copies, "123456789", "note.xml"))
+	require.NoError(err)
+	assert.Equal(expected, data)
+}
+
+// SetupDropFolder copies the drop folder fixture to a temporary directory, since documents are
+// moved out of it, and returns the directory.  The drop folder is its "drop" subdirectory.
+func (suite *DataCopierSuite) SetupDropFolder() string {
+	require := suite.Require()
+
+	tempDir, err := ioutil.TempDir("", "data_copier_test")
+	require.NoError(err)
+	eeDir := filepath.Join(tempDir, "drop", "123456789")
+	require.NoError(os.MkdirAll(eeDir, 0777))
+	files, err := ioutil.ReadDir("../fixtures/drop_folder/123456789")
+	require.NoError(err)
+	for _, fi := range files {
+		data, err := ioutil.ReadFile(filepath.Join("../fixtures/drop_folder/123456789", fi.Name()))
+		require.NoError(err)
+		require.NoError(ioutil.WriteFile(filepath.Join(eeDir, fi.Name()), data, 0644))
+	}
+	return tempDir
+}
@@ -0,0 +1,223 @@
+package copier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intervention-engine/integrator/hie"
+	"github.com/intervention-engine/integrator/ingest"
+)
+
+// Replayer posts the documents in a local copy directory (see NewDataCopierWithLocalCopies) to the
+// ingest service again, e.g., after IE's database has been rebuilt.  It doesn't contact the HIE and
+// doesn't read or write the transaction history.  Copies are stored as <copy-dir>/<ee>/<id>.xml, or
+// as <copy-dir>/<source>/<ee>/<id>.xml for named sources.
+type Replayer struct {
+	ingestClient ingest.Client
+	copyDir      string
+	// EEs, Sources and DocumentIDPattern (a path.Match pattern) limit which documents are replayed
+	// (default: all of them)
+	EEs               []string
+	Sources           []string
+	DocumentIDPattern string
+	// Since and Until limit the documents replayed to those copied in that period (by the copy's
+	// modification time).  Zero times don't limit it.
+	Since time.Time
+	Until time.Time
+	// Concurrency is the number of documents posted at once (default: 1)
+	Concurrency int
+	// ProgressInterval is how often progress is logged (default: every 10 seconds)
+	ProgressInterval time.Duration
+}
+
+// ReplayReport summarizes a replay
+type ReplayReport struct {
+	// Found is the number of documents that matched the filters
+	Found    int
+	Replayed int
+	Failures []ReplayFailure
+}
+
+// ReplayFailure records a document that couldn't be replayed
+type ReplayFailure struct {
+	Path string
+	Err  error
+}
+
+// replayDocument is a copy to be replayed
+type replayDocument struct {
+	path       string
+	source     string
+	ee         string
+	documentID string
+}
+
+func NewReplayer(ingestClient ingest.Client, copyDir string) (*Replayer, error) {
+	if ingestClient == nil {
+		return nil, errors.New("Ingest Client must be configured")
+	} else if copyDir == "" {
+		return nil, errors.New("A path to the stored copies must be provided")
+	}
+	if fi, err := os.Stat(copyDir); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", copyDir)
+	}
+	return &Replayer{
+		ingestClient: ingestClient,
+		copyDir:      copyDir,
+	}, nil
+}
+
+// Replay posts every matching document to the ingest service.  Failures to post a document are
+// listed in the report rather than stopping the replay.  If the context is done, documents that
+// haven't been posted yet are skipped and the context's error is returned.
+func (r *Replayer) Replay(ctx context.Context) (*ReplayReport, error) {
+	if r.DocumentIDPattern != "" {
+		if _, err := path.Match(r.DocumentIDPattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid document ID pattern %s: %s", r.DocumentIDPattern, err)
+		}
+	}
+	docs, err := r.find()
+	if err != nil {
+		return nil, err
+	}
+	report := &ReplayReport{Found: len(docs)}
+	log.Printf("Replaying %d documents from %s\n", len(docs), r.copyDir)
+
+	concurrency := r.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	interval := r.ProgressInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	var mu sync.Mutex
+	lastProgress := time.Now()
+	queue := make(chan replayDocument)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for doc := range queue {
+				err := r.post(ctx, doc)
+				mu.Lock()
+				if err != nil {
+					log.Printf("Failed to replay %s: %s\n", doc.path, err)
+					report.Failures = append(report.Failures, ReplayFailure{Path: doc.path, Err: err})
+				} else {
+					report.Replayed++
+				}
+				if time.Since(lastProgress) >= interval {
+					log.Printf("Replayed %d of %d documents (%d failed)\n", report.Replayed, report.Found, len(report.Failures))
+					lastProgress = time.Now()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, doc := range docs {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case queue <- doc:
+		case <-ctx.Done():
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	log.Printf("Replayed %d of %d documents (%d failed)\n", report.Replayed, report.Found, len(report.Failures))
+	return report, ctx.Err()
+}
+
+func (r *Replayer) post(ctx context.Context, doc replayDocument) error {
+	f, err := os.Open(doc.path)
+	if err != nil {
+		return err
+	}
+	// The ingest client closes the file
+	if dc, ok := r.ingestClient.(ingest.DocumentClient); ok {
+		_, err = dc.IngestDocument(ctx, doc.ee, &hie.QueryResponseEntry{DocumentID: doc.documentID}, "text/xml", f)
+		return err
+	}
+	_, err = r.ingestClient.Ingest(ctx, "text/xml", f)
+	return err
+}
+
+// find walks the copy directory for the documents that match the filters
+func (r *Replayer) find() ([]replayDocument, error) {
+	var docs []replayDocument
+	err := filepath.Walk(r.copyDir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || strings.ToLower(filepath.Ext(file)) != ".xml" {
+			return nil
+		}
+		rel, err := filepath.Rel(r.copyDir, file)
+		if err != nil {
+			return err
+		}
+		doc := replayDocument{path: file}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		switch len(parts) {
+		case 2:
+			doc.ee = parts[0]
+		case 3:
+			doc.source, doc.ee = parts[0], parts[1]
+		default:
+			// Not a copy
+			return nil
+		}
+		doc.documentID = strings.TrimSuffix(parts[len(parts)-1], filepath.Ext(file))
+		if r.matches(doc, fi) {
+			docs = append(docs, doc)
+		}
+		return nil
+	})
+	return docs, err
+}
+
+func (r *Replayer) matches(doc replayDocument, fi os.FileInfo) bool {
+	if len(r.EEs) > 0 && !containsString(r.EEs, doc.ee) {
+		return false
+	}
+	if len(r.Sources) > 0 && !containsString(r.Sources, doc.source) {
+		return false
+	}
+	if r.DocumentIDPattern != "" {
+		if ok, _ := path.Match(r.DocumentIDPattern, doc.documentID); !ok {
+			return false
+		}
+	}
+	if !r.Since.IsZero() && fi.ModTime().Before(r.Since) {
+		return false
+	}
+	if !r.Until.IsZero() && fi.ModTime().After(r.Until) {
+		return false
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
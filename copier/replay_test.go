@@ -0,0 +1,180 @@
+package copier
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/intervention-engine/integrator/ingest"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestReplaySuite(t *testing.T) {
+	suite.Run(t, new(ReplaySuite))
+}
+
+type ReplaySuite struct {
+	suite.Suite
+	CopyDir  string
+	Ingest   *RecordingIngestClient
+	Replayer *Replayer
+}
+
+// RecordingIngestClient records the documents it's sent, and can be safely used concurrently
+type RecordingIngestClient struct {
+	mu        sync.Mutex
+	Documents []string
+	// Fail, if set, rejects documents with this content
+	Fail string
+}
+
+func (c *RecordingIngestClient) Ingest(ctx context.Context, contentType string, reader io.ReadCloser) (*ingest.Result, error) {
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if string(data) == c.Fail {
+		return nil, errors.New("Ingest rejected the document")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Documents = append(c.Documents, string(data))
+	return &ingest.Result{Status: 200}, nil
+}
+
+func (c *RecordingIngestClient) sorted() []string {
+	docs := append([]string{}, c.Documents...)
+	sort.Strings(docs)
+	return docs
+}
+
+func (suite *ReplaySuite) SetupTest() {
+	require := suite.Require()
+
+	var err error
+	suite.CopyDir, err = ioutil.TempDir("", "replay_test")
+	require.NoError(err)
+	old := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.Local)
+	for _, copy := range []struct {
+		path    string
+		modTime time.Time
+	}{
+		{"111/1.2.3.1.xml", old},
+		{"111/1.2.3.2.xml", time.Now()},
+		{"222/1.2.4.1.xml", time.Now()},
+		{"hie-b/111/1.2.3.1.xml", time.Now()},
+	} {
+		file := filepath.Join(suite.CopyDir, filepath.FromSlash(copy.path))
+		require.NoError(os.MkdirAll(filepath.Dir(file), 0777))
+		require.NoError(ioutil.WriteFile(file, []byte(copy.path), 0644))
+		require.NoError(os.Chtimes(file, copy.modTime, copy.modTime))
+	}
+	// Anything that isn't a copy is ignored
+	require.NoError(ioutil.WriteFile(filepath.Join(suite.CopyDir, "notes.xml"), []byte("notes"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(suite.CopyDir, "111", "readme.txt"), []byte("readme"), 0644))
+
+	suite.Ingest = &RecordingIngestClient{}
+	suite.Replayer, err = NewReplayer(suite.Ingest, suite.CopyDir)
+	require.NoError(err)
+}
+
+func (suite *ReplaySuite) TearDownTest() {
+	os.RemoveAll(suite.CopyDir)
+}
+
+func (suite *ReplaySuite) TestReplayEverything() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Replayer.Concurrency = 3
+	report, err := suite.Replayer.Replay(context.Background())
+	require.NoError(err)
+	assert.Equal(4, report.Found)
+	assert.Equal(4, report.Replayed)
+	assert.Empty(report.Failures)
+	assert.Equal([]string{"111/1.2.3.1.xml", "111/1.2.3.2.xml", "222/1.2.4.1.xml", "hie-b/111/1.2.3.1.xml"}, suite.Ingest.sorted())
+}
+
+func (suite *ReplaySuite) TestReplayFilters() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Replayer.EEs = []string{"111"}
+	suite.Replayer.Sources = []string{""}
+	_, err := suite.Replayer.Replay(context.Background())
+	require.NoError(err)
+	assert.Equal([]string{"111/1.2.3.1.xml", "111/1.2.3.2.xml"}, suite.Ingest.sorted())
+
+	suite.Ingest.Documents = nil
+	suite.Replayer.Sources = nil
+	suite.Replayer.DocumentIDPattern = "1.2.3.1"
+	_, err = suite.Replayer.Replay(context.Background())
+	require.NoError(err)
+	assert.Equal([]string{"111/1.2.3.1.xml", "hie-b/111/1.2.3.1.xml"}, suite.Ingest.sorted())
+
+	suite.Ingest.Documents = nil
+	suite.Replayer.EEs = nil
+	suite.Replayer.DocumentIDPattern = "1.2.*"
+	suite.Replayer.Since = time.Now().Add(-time.Hour)
+	_, err = suite.Replayer.Replay(context.Background())
+	require.NoError(err)
+	assert.Equal([]string{"111/1.2.3.2.xml", "222/1.2.4.1.xml", "hie-b/111/1.2.3.1.xml"}, suite.Ingest.sorted())
+
+	suite.Ingest.Documents = nil
+	suite.Replayer.Since = time.Time{}
+	suite.Replayer.Until = time.Date(2016, time.June, 1, 0, 0, 0, 0, time.Local)
+	_, err = suite.Replayer.Replay(context.Background())
+	require.NoError(err)
+	assert.Equal([]string{"111/1.2.3.1.xml"}, suite.Ingest.sorted())
+
+	suite.Replayer.DocumentIDPattern = "[1.2"
+	_, err = suite.Replayer.Replay(context.Background())
+	assert.Error(err)
+}
+
+func (suite *ReplaySuite) TestFailuresAreReported() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Ingest.Fail = "222/1.2.4.1.xml"
+	report, err := suite.Replayer.Replay(context.Background())
+	require.NoError(err)
+	assert.Equal(4, report.Found)
+	assert.Equal(3, report.Replayed)
+	require.Len(report.Failures, 1)
+	assert.Equal(filepath.Join(suite.CopyDir, "222", "1.2.4.1.xml"), report.Failures[0].Path)
+	assert.EqualError(report.Failures[0].Err, "Ingest rejected the document")
+}
+
+func (suite *ReplaySuite) TestStopsWhenContextIsDone() {
+	assert := suite.Assert()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err := suite.Replayer.Replay(ctx)
+	assert.Equal(context.Canceled, err)
+	assert.Equal(4, report.Found)
+	assert.Empty(suite.Ingest.Documents)
+}
+
+func (suite *ReplaySuite) TestInvalidCopyDir() {
+	assert := suite.Assert()
+
+	_, err := NewReplayer(suite.Ingest, filepath.Join(suite.CopyDir, "missing"))
+	assert.Error(err)
+	_, err = NewReplayer(suite.Ingest, "")
+	assert.Error(err)
+	_, err = NewReplayer(nil, suite.CopyDir)
+	assert.Error(err)
+}
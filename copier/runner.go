@@ -0,0 +1,279 @@
+package copier
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRunInProgress is returned when a run is started while another is still in progress
+var ErrRunInProgress = errors.New("A run is already in progress")
+
+// ErrRunQueued is returned when a run is queued while the same run is already waiting to start
+var ErrRunQueued = errors.New("The same run is already queued")
+
+// Runner copies every EE number's records from the sources in runs, and keeps track of the current
+// and recent runs so their progress can be reported.  Only one run is in progress at a time, so a
+// run that's started while another is in progress is refused, and a run that's queued waits for it
+// to finish.
+type Runner struct {
+	Copier  *DataCopier
+	Sources []*Source
+	EEs     []string
+	Formats []string
+	// MaxRunTime limits how long a run has to copy all EE numbers' records.  Documents that aren't
+	// copied in time are retried on the next run. (default: no limit)
+	MaxRunTime time.Duration
+	// History is the number of finished runs to remember (default: 20)
+	History int
+
+	mu       sync.Mutex
+	finished *sync.Cond
+	queued   map[string]bool
+	lastID   int
+	current  *Run
+	recent   []*Run
+}
+
+// Run records a run's progress
+type Run struct {
+	ID int `json:"id"`
+	// Trigger is what started the run, such as "cron", "now" or "admin"
+	Trigger string   `json:"trigger"`
+	Sources []string `json:"sources"`
+	// EEs is the number of EE numbers to copy records for, Completed is the number whose records
+	// have been copied (or attempted), and CurrentEE is the one being copied
+	EEs       int    `json:"ees"`
+	Completed int    `json:"completed"`
+	CurrentEE string `json:"currentEE,omitempty"`
+	// Skipped is the number of EE numbers whose records weren't copied because the run exceeded
+	// the maximum run time
+	Skipped  int        `json:"skipped,omitempty"`
+	Errors   []RunError `json:"errors,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// RunError records an EE number's records failing to be copied from a source
+type RunError struct {
+	EE     string `json:"ee"`
+	Source string `json:"source,omitempty"`
+	Error  string `json:"error"`
+}
+
+func NewRunner(dataCopier *DataCopier, sources []*Source, ees []string, formats ...string) *Runner {
+	return &Runner{
+		Copier:  dataCopier,
+		Sources: sources,
+		EEs:     ees,
+		Formats: formats,
+		History: 20,
+	}
+}
+
+// Source returns the source with the given name, or nil if there isn't one
+func (r *Runner) Source(name string) *Source {
+	for _, src := range r.Sources {
+		if src.Name == name {
+			return src
+		}
+	}
+	return nil
+}
+
+// Run copies the EE numbers' records from the sources and waits for the run to finish.  If no
+// sources or EE numbers are given, the runner's are used.  The finished run is returned.
+func (r *Runner) Run(trigger string, sources []*Source, ees []string) (*Run, error) {
+	run, sources, ees, err := r.begin(trigger, sources, ees)
+	if err != nil {
+		return nil, err
+	}
+	r.run(run, sources, ees)
+	return r.snapshot(run), nil
+}
+
+// Queue runs like Run does, but if another run is in progress, it waits for that run to finish
+// rather than being refused.  Scheduled runs are queued, so they aren't lost when they overlap
+// other runs.  A run that's queued while the same run (for the same sources and EE numbers) is
+// already waiting is refused, since the waiting run will copy everything it would, and so that
+// slow runs don't pile up scheduled runs behind them.
+func (r *Runner) Queue(trigger string, sources []*Source, ees []string) (*Run, error) {
+	sources, ees = r.defaults(sources, ees)
+	key := runKey(sources, ees)
+
+	r.mu.Lock()
+	if r.queued[key] {
+		r.mu.Unlock()
+		return nil, ErrRunQueued
+	}
+	if r.queued == nil {
+		r.queued = make(map[string]bool)
+	}
+	r.queued[key] = true
+	for r.current != nil {
+		r.wait()
+	}
+	delete(r.queued, key)
+	run := r.start(trigger, sources, ees)
+	r.mu.Unlock()
+
+	r.run(run, sources, ees)
+	return r.snapshot(run), nil
+}
+
+// Start starts a run like Run does, but returns without waiting for it to finish
+func (r *Runner) Start(trigger string, sources []*Source, ees []string) (*Run, error) {
+	run, sources, ees, err := r.begin(trigger, sources, ees)
+	if err != nil {
+		return nil, err
+	}
+	started := r.snapshot(run)
+	go r.run(run, sources, ees)
+	return started, nil
+}
+
+// Current returns the run in progress, or nil if there isn't one
+func (r *Runner) Current() *Run {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current == nil {
+		return nil
+	}
+	return copyRun(r.current)
+}
+
+// Recent returns the run in progress and the finished runs that are remembered, newest first
+func (r *Runner) Recent() []*Run {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var runs []*Run
+	if r.current != nil {
+		runs = append(runs, copyRun(r.current))
+	}
+	for i := len(r.recent) - 1; i >= 0; i-- {
+		runs = append(runs, copyRun(r.recent[i]))
+	}
+	return runs
+}
+
+// begin records the start of a run, unless another is in progress
+func (r *Runner) begin(trigger string, sources []*Source, ees []string) (*Run, []*Source, []string, error) {
+	sources, ees = r.defaults(sources, ees)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current != nil {
+		return nil, nil, nil, ErrRunInProgress
+	}
+	return r.start(trigger, sources, ees), sources, ees, nil
+}
+
+// defaults replaces missing sources and EE numbers with the runner's
+func (r *Runner) defaults(sources []*Source, ees []string) ([]*Source, []string) {
+	if len(sources) == 0 {
+		sources = r.Sources
+	}
+	if len(ees) == 0 {
+		ees = r.EEs
+	}
+	return sources, ees
+}
+
+// start records the start of a run.  The lock must be held, and no run may be in progress.
+func (r *Runner) start(trigger string, sources []*Source, ees []string) *Run {
+	r.lastID++
+	run := &Run{ID: r.lastID, Trigger: trigger, EEs: len(ees), Started: time.Now()}
+	for _, src := range sources {
+		run.Sources = append(run.Sources, src.Name)
+	}
+	r.current = run
+	return run
+}
+
+// wait waits for the run in progress to finish.  The lock must be held.
+func (r *Runner) wait() {
+	if r.finished == nil {
+		r.finished = sync.NewCond(&r.mu)
+	}
+	r.finished.Wait()
+}
+
+// runKey identifies the sources and EE numbers a run copies
+func runKey(sources []*Source, ees []string) string {
+	names := make([]string, len(sources))
+	for i, src := range sources {
+		names[i] = src.Name
+	}
+	return strings.Join(names, ",") + "|" + strings.Join(ees, ",")
+}
+
+func (r *Runner) run(run *Run, sources []*Source, ees []string) {
+	ctx := context.Background()
+	if r.MaxRunTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.MaxRunTime)
+		defer cancel()
+	}
+	for i, ee := range ees {
+		if ctx.Err() != nil {
+			log.Printf("Run exceeded the maximum run time.  Records for %d EE numbers were not copied.\n", len(ees)-i)
+			r.update(func() { run.Skipped = len(ees) - i })
+			break
+		}
+		r.update(func() { run.CurrentEE = ee })
+		for _, src := range sources {
+			if err := r.Copier.CopySourceRecords(ctx, src, ee, r.Formats...); err != nil {
+				if src.Name != "" {
+					log.Printf("Error copying data for ee %s from %s: %s\n", ee, src.Name, err.Error())
+				} else {
+					log.Printf("Error copying data for ee %s: %s\n", ee, err.Error())
+				}
+				r.update(func() { run.Errors = append(run.Errors, RunError{EE: ee, Source: src.Name, Error: err.Error()}) })
+			}
+		}
+		r.update(func() { run.Completed++ })
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	finished := time.Now()
+	run.Finished = &finished
+	run.CurrentEE = ""
+	r.current = nil
+	r.recent = append(r.recent, run)
+	if len(r.recent) > r.History {
+		r.recent = r.recent[len(r.recent)-r.History:]
+	}
+	if r.finished != nil {
+		r.finished.Broadcast()
+	}
+}
+
+// update changes the run's progress while holding the lock, so that it can be reported safely
+func (r *Runner) update(change func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	change()
+}
+
+func (r *Runner) snapshot(run *Run) *Run {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return copyRun(run)
+}
+
+// copyRun copies a run, so that it can be reported while its progress is updated.  The lock must
+// be held.
+func copyRun(run *Run) *Run {
+	c := *run
+	c.Sources = append([]string(nil), run.Sources...)
+	c.Errors = append([]RunError(nil), run.Errors...)
+	if run.Finished != nil {
+		finished := *run.Finished
+		c.Finished = &finished
+	}
+	return &c
+}
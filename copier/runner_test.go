@@ -0,0 +1,206 @@
+package copier
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/intervention-engine/integrator/hie"
+	"github.com/intervention-engine/integrator/txlog"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestRunnerSuite(t *testing.T) {
+	suite.Run(t, new(RunnerSuite))
+}
+
+type RunnerSuite struct {
+	suite.Suite
+	HIE    *runnerHieClient
+	Runner *Runner
+}
+
+// runnerHieClient finds no documents, or fails for the EE numbers it's told to.  If Release is
+// set, each query waits until it can receive from it, and each query takes at least the Delay.
+type runnerHieClient struct {
+	Release chan bool
+	Delay   time.Duration
+	Failing map[string]bool
+	mu      sync.Mutex
+	Queried []string
+}
+
+func (c *runnerHieClient) QueryRecords(ctx context.Context, mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+	if c.Release != nil {
+		<-c.Release
+	}
+	time.Sleep(c.Delay)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Queried = append(c.Queried, mrn)
+	if c.Failing[mrn] {
+		return nil, errors.New("HIE unavailable")
+	}
+	return &hie.QueryResponse{Status: true}, nil
+}
+
+func (c *runnerHieClient) DownloadRecord(ctx context.Context, url string) (io.ReadCloser, string, error) {
+	return nil, "", errors.New("No documents should be downloaded")
+}
+
+func (suite *RunnerSuite) SetupTest() {
+	require := suite.Require()
+
+	suite.HIE = &runnerHieClient{Failing: map[string]bool{}}
+	dataCopier, err := NewDataCopier(suite.HIE, &MockIngestClient{}, txlog.NewMemoryManager())
+	require.NoError(err)
+	sources := []*Source{{Name: "north", Client: suite.HIE}, {Name: "south", Client: suite.HIE}}
+	suite.Runner = NewRunner(dataCopier, sources, []string{"1", "2", "3"}, "XML^HL7^231^CCD^C32")
+}
+
+func (suite *RunnerSuite) TearDownTest() {
+	suite.HIE = nil
+	suite.Runner = nil
+}
+
+func (suite *RunnerSuite) TestRun() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.HIE.Failing["2"] = true
+	run, err := suite.Runner.Run("now", nil, nil)
+	require.NoError(err)
+	assert.Equal(1, run.ID)
+	assert.Equal("now", run.Trigger)
+	assert.Equal([]string{"north", "south"}, run.Sources)
+	assert.Equal(3, run.EEs)
+	assert.Equal(3, run.Completed)
+	assert.Equal("", run.CurrentEE)
+	require.NotNil(run.Finished)
+	assert.Equal([]RunError{
+		{EE: "2", Source: "north", Error: "HIE unavailable"},
+		{EE: "2", Source: "south", Error: "HIE unavailable"},
+	}, run.Errors)
+	assert.Equal([]string{"1", "1", "2", "2", "3", "3"}, suite.HIE.Queried)
+	assert.Nil(suite.Runner.Current())
+}
+
+func (suite *RunnerSuite) TestRunOneSourceAndEE() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	src := suite.Runner.Source("south")
+	require.NotNil(src)
+	assert.Nil(suite.Runner.Source("west"))
+	run, err := suite.Runner.Run("admin", []*Source{src}, []string{"9"})
+	require.NoError(err)
+	assert.Equal([]string{"south"}, run.Sources)
+	assert.Equal(1, run.EEs)
+	assert.Equal([]string{"9"}, suite.HIE.Queried)
+}
+
+func (suite *RunnerSuite) TestProgressAndOneRunAtATime() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.HIE.Release = make(chan bool)
+	run, err := suite.Runner.Start("admin", nil, nil)
+	require.NoError(err)
+	assert.Nil(run.Finished)
+
+	// Once the first EE number's records have been copied, the run's progress is reported
+	suite.HIE.Release <- true
+	suite.HIE.Release <- true
+	current := suite.Runner.Current()
+	require.NotNil(current)
+	assert.Equal(run.ID, current.ID)
+	assert.Contains([]string{"1", "2"}, current.CurrentEE)
+
+	_, err = suite.Runner.Run("cron", nil, nil)
+	assert.Equal(ErrRunInProgress, err)
+
+	for i := 0; i < 4; i++ {
+		suite.HIE.Release <- true
+	}
+	for suite.Runner.Current() != nil {
+		time.Sleep(time.Millisecond)
+	}
+	runs := suite.Runner.Recent()
+	require.Len(runs, 1)
+	assert.Equal(3, runs[0].Completed)
+	assert.NotNil(runs[0].Finished)
+}
+
+func (suite *RunnerSuite) TestQueuedRunsWait() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.HIE.Release = make(chan bool)
+	_, err := suite.Runner.Start("admin", nil, []string{"1"})
+	require.NoError(err)
+
+	// A queued run waits for the run in progress, rather than being refused
+	queued := make(chan *Run)
+	go func() {
+		run, err := suite.Runner.Queue("cron", []*Source{suite.Runner.Source("north")}, nil)
+		assert.NoError(err)
+		queued <- run
+	}()
+	for {
+		suite.Runner.mu.Lock()
+		waiting := len(suite.Runner.queued)
+		suite.Runner.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The same run isn't queued twice
+	_, err = suite.Runner.Queue("cron", []*Source{suite.Runner.Source("north")}, []string{"1", "2", "3"})
+	assert.Equal(ErrRunQueued, err)
+
+	for i := 0; i < 5; i++ {
+		suite.HIE.Release <- true
+	}
+	run := <-queued
+	require.NotNil(run)
+	assert.Equal(2, run.ID)
+	assert.Equal("cron", run.Trigger)
+	assert.Equal([]string{"north"}, run.Sources)
+	assert.Equal(3, run.Completed)
+	assert.Len(suite.Runner.Recent(), 2)
+}
+
+func (suite *RunnerSuite) TestRecentRunsAreLimited() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Runner.History = 2
+	for i := 0; i < 3; i++ {
+		_, err := suite.Runner.Run("cron", nil, []string{"1"})
+		require.NoError(err)
+	}
+	runs := suite.Runner.Recent()
+	require.Len(runs, 2)
+	assert.Equal(3, runs[0].ID)
+	assert.Equal(2, runs[1].ID)
+}
+
+func (suite *RunnerSuite) TestMaxRunTime() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// The first EE number's records take longer than the run has
+	suite.HIE.Delay = 30 * time.Millisecond
+	suite.Runner.MaxRunTime = 50 * time.Millisecond
+	run, err := suite.Runner.Run("now", nil, nil)
+	require.NoError(err)
+	assert.Equal(1, run.Completed)
+	assert.Equal(2, run.Skipped)
+}
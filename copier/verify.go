@@ -0,0 +1,95 @@
+package copier
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/intervention-engine/integrator/hie"
+	"github.com/intervention-engine/integrator/txlog"
+)
+
+// VerifyMode indicates how strictly downloaded documents are checked against the hash and size
+// that the HIE advertised for them
+type VerifyMode int
+
+const (
+	// VerifyOff skips verification
+	VerifyOff VerifyMode = iota
+	// VerifyLenient fails documents whose size doesn't match, but only warns about hash mismatches
+	// (since some HIEs compute the hash over something other than the bytes they serve)
+	VerifyLenient
+	// VerifyStrict fails documents whose size or hash doesn't match
+	VerifyStrict
+)
+
+// ParseVerifyMode parses "off", "lenient" or "strict"
+func ParseVerifyMode(mode string) (VerifyMode, error) {
+	switch mode {
+	case "off":
+		return VerifyOff, nil
+	case "lenient":
+		return VerifyLenient, nil
+	case "strict":
+		return VerifyStrict, nil
+	}
+	return VerifyOff, fmt.Errorf("%s is not a supported verification mode", mode)
+}
+
+func (m VerifyMode) String() string {
+	switch m {
+	case VerifyOff:
+		return "off"
+	case VerifyLenient:
+		return "lenient"
+	case VerifyStrict:
+		return "strict"
+	}
+	return fmt.Sprintf("VerifyMode(%d)", int(m))
+}
+
+// VerificationError indicates that a downloaded document didn't match the hash or size that the HIE
+// advertised for it
+type VerificationError struct {
+	Reason   txlog.FailureReason
+	Expected string
+	Actual   string
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("Downloaded document failed verification (%s): expected %s, got %s", e.Reason, e.Expected, e.Actual)
+}
+
+// VerifyDocument checks the downloaded data against the entry's advertised size and SHA-1 hash.
+// Entries without a size or hash are not checked for it.
+func VerifyDocument(entry *hie.QueryResponseEntry, data []byte, mode VerifyMode) error {
+	if mode == VerifyOff {
+		return nil
+	}
+	if entry.Size > 0 && entry.Size != len(data) {
+		return &VerificationError{
+			Reason:   txlog.FailureSizeMismatch,
+			Expected: fmt.Sprintf("%d bytes", entry.Size),
+			Actual:   fmt.Sprintf("%d bytes", len(data)),
+		}
+	}
+	if entry.Hash != "" {
+		sum := sha1.Sum(data)
+		actual := strings.ToUpper(hex.EncodeToString(sum[:]))
+		if !strings.EqualFold(entry.Hash, actual) {
+			err := &VerificationError{
+				Reason:   txlog.FailureHashMismatch,
+				Expected: "SHA-1 " + strings.ToUpper(entry.Hash),
+				Actual:   "SHA-1 " + actual,
+			}
+			if mode == VerifyLenient {
+				log.Printf("Warning: %s\n", err)
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package copier
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/intervention-engine/integrator/hie"
+	"github.com/intervention-engine/integrator/txlog"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestVerifySuite(t *testing.T) {
+	suite.Run(t, new(VerifySuite))
+}
+
+type VerifySuite struct {
+	suite.Suite
+	Entry *hie.QueryResponseEntry
+	Data  []byte
+}
+
+func (suite *VerifySuite) SetupTest() {
+	suite.Data = []byte("<foo>1</foo>")
+	suite.Entry = &hie.QueryResponseEntry{
+		DocumentID: "1.1.1.1.1.1",
+		Hash:       "587BBFE3E61FAC149D55BE7E70CA6AB8D15A40B1",
+		Size:       12,
+	}
+}
+
+func (suite *VerifySuite) TestParseVerifyMode() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	for _, mode := range []VerifyMode{VerifyOff, VerifyLenient, VerifyStrict} {
+		parsed, err := ParseVerifyMode(mode.String())
+		require.NoError(err)
+		assert.Equal(mode, parsed)
+	}
+	_, err := ParseVerifyMode("paranoid")
+	assert.Error(err)
+}
+
+func (suite *VerifySuite) TestMatchingDocument() {
+	assert := suite.Assert()
+
+	assert.NoError(VerifyDocument(suite.Entry, suite.Data, VerifyStrict))
+	assert.NoError(VerifyDocument(suite.Entry, suite.Data, VerifyLenient))
+
+	// Hash comparisons aren't case sensitive
+	suite.Entry.Hash = "587bbfe3e61fac149d55be7e70ca6ab8d15a40b1"
+	assert.NoError(VerifyDocument(suite.Entry, suite.Data, VerifyStrict))
+}
+
+func (suite *VerifySuite) TestSizeMismatch() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	truncated := suite.Data[:8]
+	err := VerifyDocument(suite.Entry, truncated, VerifyLenient)
+	require.Error(err)
+	vErr, ok := err.(*VerificationError)
+	require.True(ok)
+	assert.Equal(txlog.FailureSizeMismatch, vErr.Reason)
+	assert.Equal("12 bytes", vErr.Expected)
+	assert.Equal("8 bytes", vErr.Actual)
+
+	assert.Error(VerifyDocument(suite.Entry, truncated, VerifyStrict))
+	assert.NoError(VerifyDocument(suite.Entry, truncated, VerifyOff))
+}
+
+func (suite *VerifySuite) TestHashMismatch() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	corrupted := []byte("<foo>2</foo>")
+	err := VerifyDocument(suite.Entry, corrupted, VerifyStrict)
+	require.Error(err)
+	vErr, ok := err.(*VerificationError)
+	require.True(ok)
+	assert.Equal(txlog.FailureHashMismatch, vErr.Reason)
+
+	assert.NoError(VerifyDocument(suite.Entry, corrupted, VerifyLenient))
+	assert.NoError(VerifyDocument(suite.Entry, corrupted, VerifyOff))
+}
+
+func (suite *VerifySuite) TestUnadvertisedHashAndSize() {
+	assert := suite.Assert()
+
+	suite.Entry.Hash = ""
+	suite.Entry.Size = 0
+	assert.NoError(VerifyDocument(suite.Entry, suite.Data, VerifyStrict))
+}
@@ -0,0 +1,229 @@
+// Package hie provides clients for querying an HIE for a patient's documents and downloading them,
+// over the JSON query API, FHIR, IHE XDS.b or a drop folder.
+package hie
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/integrator/transport"
+)
+
+type Client interface {
+	QueryRecords(ctx context.Context, mrn string, start *time.Time, end *time.Time) (*QueryResponse, error)
+	DownloadRecord(ctx context.Context, url string) (content io.ReadCloser, contentType string, err error)
+}
+
+// PagedClient is implemented by HIE clients that can return query results a page at a time, so
+// that large result sets don't have to be held in memory all at once
+type PagedClient interface {
+	Client
+	// QueryRecordsPage queries for one page of results.  An empty page requests the first page, and
+	// the response's NextPage names the page after it (or is empty if it's the last page).
+	QueryRecordsPage(ctx context.Context, mrn string, start *time.Time, end *time.Time, page string) (*QueryResponse, error)
+}
+
+// FinishingClient is implemented by HIE clients that act on the outcome of copying each
+// document (e.g., by archiving it)
+type FinishingClient interface {
+	Client
+	// FinishRecord is called after each attempt to copy the document at the URL.  The error is nil
+	// if the document was ingested.
+	FinishRecord(ctx context.Context, url string, err error) error
+}
+
+type HttpClient struct {
+	BaseURL string
+	Auth    transport.Authenticator
+	Client  *http.Client
+	Retry   *transport.RetryPolicy
+	// StrictValidation rejects query responses with any schema violation rather than skipping
+	// malformed entries
+	StrictValidation bool
+	// Protocol describes the HIE's query conventions (default: DefaultProtocol())
+	Protocol *Protocol
+}
+
+func NewHttpClient(baseURL string) *HttpClient {
+	return &HttpClient{
+		BaseURL: baseURL,
+	}
+}
+
+func NewBasicAuthHttpClient(baseURL, user, password string) *HttpClient {
+	return &HttpClient{
+		BaseURL: baseURL,
+		Auth:    transport.NewBasicAuthenticator(user, password),
+	}
+}
+
+func NewAuthHttpClient(baseURL string, auth transport.Authenticator) *HttpClient {
+	return &HttpClient{
+		BaseURL: baseURL,
+		Auth:    auth,
+	}
+}
+
+// QueryRecords queries the HIE for an EE number's documents.  If the HIE pages its responses, every
+// page is fetched and the results are combined into one response.
+func (c *HttpClient) QueryRecords(ctx context.Context, mrn string, start *time.Time, end *time.Time) (*QueryResponse, error) {
+	qr, err := c.QueryRecordsPage(ctx, mrn, start, end, "")
+	seen := make(map[string]bool)
+	for err == nil && qr.NextPage != "" {
+		if seen[qr.NextPage] {
+			return nil, fmt.Errorf("HIE returned a paging loop at %s", qr.NextPage)
+		}
+		seen[qr.NextPage] = true
+
+		page, pErr := c.QueryRecordsPage(ctx, mrn, start, end, qr.NextPage)
+		if pErr != nil || !page.Status {
+			return page, pErr
+		}
+		offset := len(qr.Result) + len(qr.Invalid)
+		for _, invalid := range page.Invalid {
+			invalid.Index += offset
+			qr.Invalid = append(qr.Invalid, invalid)
+		}
+		qr.Result = append(qr.Result, page.Result...)
+		qr.NextPage = page.NextPage
+	}
+	return qr, err
+}
+
+// QueryRecordsPage queries the HIE for one page of an EE number's documents.  An empty page
+// requests the first page.
+func (c *HttpClient) QueryRecordsPage(ctx context.Context, mrn string, start *time.Time, end *time.Time, page string) (*QueryResponse, error) {
+	p := c.protocol()
+	qURL := p.QueryURL(c.BaseURL, mrn, start, end, page)
+	resp, err := c.Retry.Do(ctx, "query for "+mrn, true, func() (*http.Response, error) {
+		return transport.DoAuthenticated(ctx, c.Client, c.Auth, func() (*http.Request, error) {
+			return http.NewRequest("GET", qURL, nil)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = transport.NewStatusError(resp.StatusCode, "Non-OK response from source server: %d (%s)", resp.StatusCode, resp.Status)
+	}
+
+	qr, dErr := p.DecodeQueryResponse(resp.Body, c.StrictValidation)
+	if dErr != nil {
+		return nil, dErr
+	}
+	qr.NextPage = p.nextPage(page, qr)
+
+	return qr, err
+}
+
+func (c *HttpClient) DownloadRecord(ctx context.Context, url string) (content io.ReadCloser, contentType string, err error) {
+	resp, err := c.Retry.Do(ctx, "download of "+url, true, func() (*http.Response, error) {
+		return transport.DoAuthenticated(ctx, c.Client, c.Auth, func() (*http.Request, error) {
+			return http.NewRequest("GET", url, nil)
+		})
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	// If the status code is an error, we don't have a doc -- we have a JSON response with an error.
+	// Parse it and return the error.
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		qr, err := c.protocol().DecodeQueryResponse(resp.Body, false)
+		if err != nil {
+			return nil, "", &transport.StatusError{StatusCode: resp.StatusCode, Message: err.Error()}
+		}
+		return nil, "", &transport.StatusError{StatusCode: resp.StatusCode, Message: qr.Error}
+	}
+
+	// Request was successful, so just pass along the body and content type
+	return resp.Body, resp.Header.Get("Content-Type"), nil
+}
+
+func (c *HttpClient) protocol() *Protocol {
+	if c.Protocol == nil {
+		return DefaultProtocol()
+	}
+	return c.Protocol
+}
+
+// QueryResponse represents the response for a query to the HIE
+type QueryResponse struct {
+	Status bool                 `json:"status"`
+	Result []QueryResponseEntry `json:"result"`
+	Error  string               `json:"error"`
+	Query  QueryRequest         `json:"query"`
+	// Invalid lists the entries that were left out of Result because they were malformed
+	Invalid []EntryError `json:"-"`
+	// NextPage identifies the next page of results when the HIE pages its responses.  It's empty on
+	// the last page.
+	NextPage string `json:"-"`
+}
+
+// UnmarshalJSON validates the response, skipping malformed entries (see DecodeQueryResponse)
+func (q *QueryResponse) UnmarshalJSON(data []byte) error {
+	qr, err := decodeQueryResponse(data, DefaultProtocol(), false)
+	if err != nil {
+		return err
+	}
+	*q = *qr
+	return nil
+}
+
+// QueryResponseEntry represents an entry in the query response
+type QueryResponseEntry struct {
+	RetrieveURL  string    `json:"retrieveURL"`
+	CreationTime time.Time `json:"creationTime"`
+	Title        string    `json:"title"`
+	DocumentType string    `json:"documentType"`
+	DocumentID   string    `json:"documentID"`
+	Hash         string    `json:"hash"`
+	Size         int       `json:"size"`
+}
+
+// UnmarshalJSON validates each field and handles the incoming date formats
+func (q *QueryResponseEntry) UnmarshalJSON(data []byte) error {
+	entry, errs := decodeQueryResponseEntry("", data, DefaultProtocol(), false)
+	if len(errs) > 0 {
+		return ValidationError(errs)
+	}
+	*q = entry
+	return nil
+}
+
+// QueryRequest represents the details of the query sent to the HIE
+type QueryRequest struct {
+	Env                   string    `json:"env"`
+	Host                  string    `json:"host"`
+	EE                    string    `json:"ee"`
+	StartDateTime         time.Time `json:"startDateTime"`
+	EndDateTime           time.Time `json:"endDateTime"`
+	QueryStartDateTime    time.Time `json:"queryStartDateTime"`
+	QueryCompleteDateTime time.Time `json:"queryCompleteEndDateTime"`
+}
+
+// UnmarshalJSON validates each field and handles the incoming date formats
+func (q *QueryRequest) UnmarshalJSON(data []byte) error {
+	req, errs := decodeQueryRequest("", data, DefaultProtocol(), false)
+	if len(errs) > 0 {
+		return ValidationError(errs)
+	}
+	*q = req
+	return nil
+}
+
+func lenientParse(dtfmt, dt string) (time.Time, error) {
+	t, err := time.Parse(dtfmt, dt)
+	if err != nil && strings.Contains(dtfmt, "0Z") {
+		dtfmt = strings.Replace(dtfmt, "0Z", "Z", 1)
+		return lenientParse(dtfmt, dt)
+	}
+	return t, err
+}
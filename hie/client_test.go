@@ -1,7 +1,8 @@
-package main
+package hie
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"io/ioutil"
@@ -14,6 +15,8 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/suite"
+
+	"github.com/intervention-engine/integrator/transport"
 )
 
 // In order for 'go test' to run this suite, we need to create
@@ -24,25 +27,27 @@ func TestHIEClientSuite(t *testing.T) {
 
 type HIEClientSuite struct {
 	suite.Suite
-	Client      *HttpHieClient
+	Client      *HttpClient
 	Server      *httptest.Server
 	LastRequest *url.URL
+	LastAuth    string
 	Respond400  bool
 }
 
 func (suite *HIEClientSuite) SetupTest() {
 	require := suite.Require()
 
-	querySuccess, err := os.Open("./fixtures/response_success.json")
+	querySuccess, err := os.Open("../fixtures/response_success.json")
 	require.NoError(err)
-	queryFailure, err := os.Open("./fixtures/response_error.json")
+	queryFailure, err := os.Open("../fixtures/response_error.json")
 	require.NoError(err)
-	documentSuccess, err := os.Open("./fixtures/document.xml")
+	documentSuccess, err := os.Open("../fixtures/document.xml")
 	require.NoError(err)
-	documentFailure, err := os.Open("./fixtures/document_error.json")
+	documentFailure, err := os.Open("../fixtures/document_error.json")
 	require.NoError(err)
 	suite.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		suite.LastRequest = r.URL
+		suite.LastAuth = r.Header.Get("Authorization")
 		if strings.Contains(r.URL.Path, "/docs/") {
 			if suite.Respond400 {
 				w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -63,7 +68,7 @@ func (suite *HIEClientSuite) SetupTest() {
 		}
 	}))
 
-	suite.Client = NewHttpHieClient(suite.Server.URL)
+	suite.Client = NewHttpClient(suite.Server.URL)
 }
 
 func (suite *HIEClientSuite) TearDownTest() {
@@ -71,6 +76,7 @@ func (suite *HIEClientSuite) TearDownTest() {
 		suite.Server.Close()
 	}
 	suite.LastRequest = nil
+	suite.LastAuth = ""
 	suite.Respond400 = false
 }
 
@@ -78,7 +84,7 @@ func (suite *HIEClientSuite) TestUnmarshalSuccessfulResponse() {
 	assert := suite.Assert()
 	require := suite.Require()
 
-	b, err := ioutil.ReadFile("./fixtures/response_success.json")
+	b, err := ioutil.ReadFile("../fixtures/response_success.json")
 	require.NoError(err)
 
 	var r QueryResponse
@@ -127,7 +133,7 @@ func (suite *HIEClientSuite) TestUnmarshalSuccessfulError() {
 	assert := suite.Assert()
 	require := suite.Require()
 
-	b, err := ioutil.ReadFile("./fixtures/response_error.json")
+	b, err := ioutil.ReadFile("../fixtures/response_error.json")
 	require.NoError(err)
 
 	var r QueryResponse
@@ -150,7 +156,7 @@ func (suite *HIEClientSuite) TestQueryRecordsNoDates() {
 	assert := suite.Assert()
 	require := suite.Require()
 
-	resp, err := suite.Client.QueryRecords("123", nil, nil)
+	resp, err := suite.Client.QueryRecords(context.Background(), "123", nil, nil)
 	require.NoError(err)
 	req := suite.LastRequest
 	params := req.Query()
@@ -170,7 +176,7 @@ func (suite *HIEClientSuite) TestQueryRecordsWithStartDate() {
 	require := suite.Require()
 
 	start := time.Date(2016, time.May, 1, 10, 20, 30, 0, time.Local)
-	resp, err := suite.Client.QueryRecords("123", &start, nil)
+	resp, err := suite.Client.QueryRecords(context.Background(), "123", &start, nil)
 	require.NoError(err)
 	req := suite.LastRequest
 	params := req.Query()
@@ -191,7 +197,7 @@ func (suite *HIEClientSuite) TestQueryRecordsWithEndDate() {
 	require := suite.Require()
 
 	end := time.Date(2016, time.June, 1, 10, 20, 30, 0, time.Local)
-	resp, err := suite.Client.QueryRecords("123", nil, &end)
+	resp, err := suite.Client.QueryRecords(context.Background(), "123", nil, &end)
 	require.NoError(err)
 	req := suite.LastRequest
 	params := req.Query()
@@ -213,7 +219,7 @@ func (suite *HIEClientSuite) TestQueryRecordsWithStartAndEndDate() {
 
 	start := time.Date(2016, time.May, 1, 10, 20, 30, 0, time.Local)
 	end := time.Date(2016, time.June, 1, 10, 20, 30, 0, time.Local)
-	resp, err := suite.Client.QueryRecords("123", &start, &end)
+	resp, err := suite.Client.QueryRecords(context.Background(), "123", &start, &end)
 	require.NoError(err)
 	req := suite.LastRequest
 	params := req.Query()
@@ -235,7 +241,7 @@ func (suite *HIEClientSuite) TestQueryRecordsError() {
 	require := suite.Require()
 
 	suite.Respond400 = true
-	resp, err := suite.Client.QueryRecords("-123", nil, nil)
+	resp, err := suite.Client.QueryRecords(context.Background(), "-123", nil, nil)
 	require.NotNil(err)
 	assert.Contains(err.Error(), "400")
 	assert.Contains(err.Error(), "Bad Request")
@@ -247,11 +253,26 @@ func (suite *HIEClientSuite) TestQueryRecordsError() {
 	assert.Empty(resp.Result)
 }
 
+func (suite *HIEClientSuite) TestQueryRecordsWithAuth() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Client = NewBasicAuthHttpClient(suite.Server.URL, "joe", "secret")
+	resp, err := suite.Client.QueryRecords(context.Background(), "123", nil, nil)
+	require.NoError(err)
+	assert.Equal("Basic am9lOnNlY3JldA==", suite.LastAuth)
+	assert.Len(resp.Result, 3)
+
+	_, _, err = suite.Client.DownloadRecord(context.Background(), suite.Server.URL+"/docs/123")
+	require.NoError(err)
+	assert.Equal("Basic am9lOnNlY3JldA==", suite.LastAuth)
+}
+
 func (suite *HIEClientSuite) TestDownloadRecord() {
 	assert := suite.Assert()
 	require := suite.Require()
 
-	content, cType, err := suite.Client.DownloadRecord(suite.Server.URL + "/docs/123")
+	content, cType, err := suite.Client.DownloadRecord(context.Background(), suite.Server.URL+"/docs/123")
 	require.NoError(err)
 
 	require.NotNil(content)
@@ -268,7 +289,7 @@ func (suite *HIEClientSuite) TestDownloadRecordError() {
 	require := suite.Require()
 
 	suite.Respond400 = true
-	content, cType, err := suite.Client.DownloadRecord(suite.Server.URL + "/docs/-123")
+	content, cType, err := suite.Client.DownloadRecord(context.Background(), suite.Server.URL+"/docs/-123")
 
 	require.NotNil(err)
 	assert.Equal("invalid document ID", err.Error())
@@ -297,3 +318,77 @@ func (suite *HIEClientSuite) TestLenientParse() {
 	require.Nil(err)
 	assert.Equal(time.Date(2016, 6, 8, 21, 13, 2, 123450000, time.UTC), t)
 }
+
+func (suite *HIEClientSuite) TestQueryRecordsWithMalformedEntries() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		http.ServeFile(w, r, "../fixtures/response_malformed.json")
+	}))
+	defer server.Close()
+
+	client := NewHttpClient(server.URL)
+	resp, err := client.QueryRecords(context.Background(), "123456789", nil, nil)
+	require.NoError(err)
+	assert.Len(resp.Result, 2)
+	assert.Len(resp.Invalid, 3)
+
+	client.StrictValidation = true
+	resp, err = client.QueryRecords(context.Background(), "123456789", nil, nil)
+	assert.Nil(resp)
+	require.Error(err)
+	assert.Contains(err.Error(), "result[1].retrieveURL is required")
+	assert.Contains(err.Error(), "result[4].mimeType is not an expected field")
+}
+
+func (suite *HIEClientSuite) TestQueryRecordsCancelled() {
+	assert := suite.Assert()
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hang until the test is over
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := NewHttpClient(server.URL).QueryRecords(ctx, "123", nil, nil)
+	assert.Error(err)
+	assert.Equal(context.DeadlineExceeded, ctx.Err())
+
+	// The client's timeout applies too
+	client := NewHttpClient(server.URL)
+	client.Client = &http.Client{Timeout: 50 * time.Millisecond}
+	_, _, err = client.DownloadRecord(context.Background(), server.URL+"/docs/123")
+	assert.Error(err)
+}
+
+// A production HIE sent malformed entries: the rest of the documents should still be copied.
+// Recorded with -record-cassettes and -cassette-redact ee,given,family,birthTime.
+func (suite *HIEClientSuite) TestQueryRecordsWithMalformedEntriesFromCassette() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	client := NewBasicAuthHttpClient("https://hie.example.org/query", "user", "password")
+	client.Client = &http.Client{}
+	require.NoError(transport.UseCassette(client.Client, "../fixtures/cassettes/malformed_query", true, transport.NewRedactor("ee", "given", "family", "birthTime")))
+
+	start := time.Date(2016, time.June, 1, 0, 0, 0, 0, time.Local)
+	resp, err := client.QueryRecords(context.Background(), "123456789", &start, nil)
+	require.NoError(err)
+	require.Len(resp.Result, 2)
+	assert.Len(resp.Invalid, 3)
+	assert.Equal("1.1.1.1.1.1", resp.Result[0].DocumentID)
+
+	rc, contentType, err := client.DownloadRecord(context.Background(), "https://hie.example.org/document/1.1.1.1.1.1")
+	require.NoError(err)
+	defer rc.Close()
+	assert.Equal("text/xml; charset=utf-8", contentType)
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(err)
+	assert.Contains(string(data), "<given>XXXX</given>")
+}
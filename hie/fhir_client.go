@@ -0,0 +1,461 @@
+package hie
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/integrator/transport"
+)
+
+const fhirTimeFormat = "2006-01-02T15:04:05-07:00"
+
+// FhirClient is a Client for HIEs that expose documents through a FHIR R4 server.  Documents
+// are found by searching DocumentReference resources by the patient's EE identifier and are
+// downloaded from the referenced Binary (or from the attachment data when it is inlined).
+type FhirClient struct {
+	BaseURL          string
+	IdentifierSystem string
+	Auth             transport.Authenticator
+	Client           *http.Client
+	Retry            *transport.RetryPolicy
+}
+
+// NewFhirClient creates a FHIR client.  The identifier system is the system URI of the EE
+// identifiers on the HIE's Patient resources.  If it's empty, EE numbers are searched without a system.
+func NewFhirClient(baseURL, identifierSystem string) *FhirClient {
+	return &FhirClient{
+		BaseURL:          strings.TrimSuffix(baseURL, "/"),
+		IdentifierSystem: identifierSystem,
+	}
+}
+
+func NewBasicAuthFhirClient(baseURL, identifierSystem, user, password string) *FhirClient {
+	c := NewFhirClient(baseURL, identifierSystem)
+	c.Auth = transport.NewBasicAuthenticator(user, password)
+	return c
+}
+
+// QueryRecords queries the FHIR server for an EE number's documents, following the search bundle's
+// next links until every page has been read
+func (c *FhirClient) QueryRecords(ctx context.Context, mrn string, start *time.Time, end *time.Time) (*QueryResponse, error) {
+	qr, err := c.QueryRecordsPage(ctx, mrn, start, end, "")
+	seen := make(map[string]bool)
+	for err == nil && qr.NextPage != "" {
+		if seen[qr.NextPage] {
+			return nil, fmt.Errorf("FHIR server returned a paging loop at %s", qr.NextPage)
+		}
+		seen[qr.NextPage] = true
+
+		page, pErr := c.QueryRecordsPage(ctx, mrn, start, end, qr.NextPage)
+		if pErr != nil {
+			return nil, pErr
+		}
+		offset := len(qr.Result) + len(qr.Invalid)
+		for _, invalid := range page.Invalid {
+			invalid.Index += offset
+			qr.Invalid = append(qr.Invalid, invalid)
+		}
+		qr.Result = append(qr.Result, page.Result...)
+		qr.NextPage = page.NextPage
+		qr.Query.QueryCompleteDateTime = page.Query.QueryCompleteDateTime
+	}
+	return qr, err
+}
+
+// QueryRecordsPage reads one bundle of search results.  An empty page starts the search; otherwise
+// the page is the previous bundle's next link.
+func (c *FhirClient) QueryRecordsPage(ctx context.Context, mrn string, start *time.Time, end *time.Time, page string) (*QueryResponse, error) {
+	qStart := time.Now()
+	if page == "" {
+		params := url.Values{}
+		if c.IdentifierSystem != "" {
+			params.Set("patient.identifier", c.IdentifierSystem+"|"+mrn)
+		} else {
+			params.Set("patient.identifier", mrn)
+		}
+		if start != nil {
+			params.Add("date", "ge"+start.Format(fhirTimeFormat))
+		}
+		if end != nil {
+			params.Add("date", "le"+end.Format(fhirTimeFormat))
+		}
+		page = c.BaseURL + "/DocumentReference?" + params.Encode()
+	}
+
+	qr := &QueryResponse{
+		Status: true,
+		Query: QueryRequest{
+			EE:                 mrn,
+			QueryStartDateTime: qStart.UTC(),
+		},
+	}
+	if u, err := url.Parse(c.BaseURL); err == nil {
+		qr.Query.Host = u.Host
+	}
+	if start != nil {
+		qr.Query.StartDateTime = *start
+	}
+	if end != nil {
+		qr.Query.EndDateTime = *end
+	} else {
+		qr.Query.EndDateTime = qStart
+	}
+
+	bundle := new(fhirBundle)
+	if err := c.getResource(ctx, page, bundle); err != nil {
+		return nil, err
+	}
+	for _, e := range bundle.Entry {
+		if e.Search.Mode == "outcome" {
+			continue
+		}
+		// Malformed DocumentReferences are left out of the result, so they don't block the patient's
+		// other documents
+		index := len(qr.Result) + len(qr.Invalid)
+		docRef := new(fhirDocumentReference)
+		if err := json.Unmarshal(e.Resource, docRef); err != nil {
+			qr.Invalid = append(qr.Invalid, EntryError{Index: index, Errors: []FieldError{{Problem: "is not a valid resource: " + err.Error()}}})
+			continue
+		}
+		if docRef.ResourceType != "DocumentReference" || docRef.Status == "entered-in-error" {
+			continue
+		}
+		entry, errs := c.toQueryResponseEntry(docRef, e.FullURL)
+		if len(errs) > 0 {
+			qr.Invalid = append(qr.Invalid, EntryError{Index: index, DocumentID: entry.DocumentID, Errors: errs})
+			continue
+		}
+		qr.Result = append(qr.Result, entry)
+	}
+	qr.NextPage = bundle.linkURL("next")
+	qr.Query.QueryCompleteDateTime = time.Now().UTC()
+
+	return qr, nil
+}
+
+// toQueryResponseEntry converts a DocumentReference, returning the problems with any of its fields
+func (c *FhirClient) toQueryResponseEntry(docRef *fhirDocumentReference, fullURL string) (QueryResponseEntry, []FieldError) {
+	entry := QueryResponseEntry{
+		Title:      docRef.Description,
+		DocumentID: docRef.ID,
+	}
+	if docRef.MasterIdentifier != nil && docRef.MasterIdentifier.Value != "" {
+		entry.DocumentID = docRef.MasterIdentifier.Value
+	}
+	if entry.DocumentID == "" {
+		return entry, []FieldError{{Field: "id", Problem: "or masterIdentifier is required"}}
+	}
+	if len(docRef.Content) == 0 {
+		return entry, []FieldError{{Field: "content", Problem: "is required"}}
+	}
+
+	var errs []FieldError
+	content := docRef.Content[0]
+	att := content.Attachment
+	if content.Format != nil {
+		entry.DocumentType = content.Format.Code
+	}
+	if entry.Title == "" {
+		entry.Title = att.Title
+	}
+	if entry.Title == "" {
+		entry.Title = docRef.Type.Text
+	}
+	entry.Size = att.Size
+	if att.Hash != "" {
+		h, err := base64.StdEncoding.DecodeString(att.Hash)
+		if err != nil {
+			errs = append(errs, FieldError{Field: "content[0].attachment.hash", Problem: fmt.Sprintf("must be base64: %q", att.Hash)})
+		}
+		// Store hashes as hex, the same as the other HIE clients do
+		entry.Hash = strings.ToUpper(hex.EncodeToString(h))
+	}
+	created, createdField := att.Creation, "content[0].attachment.creation"
+	if created == "" {
+		created, createdField = docRef.Date, "date"
+	}
+	if created != "" {
+		var err error
+		if entry.CreationTime, err = parseFhirDateTime(created); err != nil {
+			errs = append(errs, FieldError{Field: createdField, Problem: fmt.Sprintf("has an invalid date/time: %q", created)})
+		}
+	}
+
+	// Point at the referenced content, or at the DocumentReference itself if the content is inlined
+	ref := att.URL
+	if ref == "" {
+		ref = fullURL
+	}
+	if ref == "" {
+		ref = "DocumentReference/" + docRef.ID
+	}
+	retrieveURL, err := c.resolve(ref)
+	if err != nil {
+		errs = append(errs, FieldError{Field: "content[0].attachment.url", Problem: fmt.Sprintf("is not a valid URL: %q", ref)})
+	}
+	entry.RetrieveURL = retrieveURL
+	return entry, errs
+}
+
+// DownloadRecord fetches a document from a Binary URL, a DocumentReference URL (for inlined
+// attachment data) or any other attachment URL (which is passed through as-is).
+func (c *FhirClient) DownloadRecord(ctx context.Context, url string) (content io.ReadCloser, contentType string, err error) {
+	resp, err := c.get(ctx, url)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, "", readFhirError(resp)
+	}
+	if !isFhirJSON(resp.Header.Get("Content-Type")) {
+		// Not a FHIR resource, so it's the raw document
+		return resp.Body, resp.Header.Get("Content-Type"), nil
+	}
+
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	var res struct {
+		ResourceType string `json:"resourceType"`
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, "", err
+	}
+
+	switch res.ResourceType {
+	case "Binary":
+		bin := new(fhirBinary)
+		if err := json.Unmarshal(data, bin); err != nil {
+			return nil, "", err
+		}
+		return decodeFhirData(bin.Data, bin.ContentType)
+	case "DocumentReference":
+		docRef := new(fhirDocumentReference)
+		if err := json.Unmarshal(data, docRef); err != nil {
+			return nil, "", err
+		}
+		if len(docRef.Content) == 0 {
+			return nil, "", fmt.Errorf("DocumentReference %s has no content", docRef.ID)
+		}
+		att := docRef.Content[0].Attachment
+		if att.Data != "" {
+			return decodeFhirData(att.Data, att.ContentType)
+		} else if att.URL == "" {
+			return nil, "", fmt.Errorf("DocumentReference %s has no attachment data or URL", docRef.ID)
+		}
+		contentURL, err := c.resolve(att.URL)
+		if err != nil {
+			return nil, "", err
+		} else if contentURL == url {
+			return nil, "", fmt.Errorf("DocumentReference %s attachment refers to itself", docRef.ID)
+		}
+		return c.DownloadRecord(ctx, contentURL)
+	}
+
+	// Not a resource we know how to unwrap, so the JSON itself is the document
+	return ioutil.NopCloser(bytes.NewReader(data)), resp.Header.Get("Content-Type"), nil
+}
+
+// get fetches a URL.  The URLs of paging links and attachments come from the server's responses, so
+// only those on the same origin as the base URL are sent the credentials.
+func (c *FhirClient) get(ctx context.Context, url string) (*http.Response, error) {
+	auth := c.Auth
+	if !c.sameOrigin(url) {
+		auth = nil
+	}
+	return c.Retry.Do(ctx, "GET "+url, true, func() (*http.Response, error) {
+		return transport.DoAuthenticated(ctx, c.Client, auth, func() (*http.Request, error) {
+			req, err := http.NewRequest("GET", url, nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Accept", "application/fhir+json, application/json;q=0.9, */*;q=0.8")
+			return req, nil
+		})
+	})
+}
+
+func (c *FhirClient) getResource(ctx context.Context, url string, resource interface{}) error {
+	resp, err := c.get(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return readFhirError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(resource)
+}
+
+// sameOrigin reports whether the URL has the same scheme and host as the base URL
+func (c *FhirClient) sameOrigin(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	base, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, base.Scheme) && strings.EqualFold(u.Host, base.Host)
+}
+
+// resolve turns a (possibly relative) FHIR reference into an absolute URL against the base URL
+func (c *FhirClient) resolve(ref string) (string, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	if u.IsAbs() {
+		return ref, nil
+	}
+	base, err := url.Parse(c.BaseURL + "/")
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(u).String(), nil
+}
+
+func readFhirError(resp *http.Response) error {
+	err := transport.NewStatusError(resp.StatusCode, "Non-OK response from source server: %d (%s)", resp.StatusCode, resp.Status)
+	if !isFhirJSON(resp.Header.Get("Content-Type")) {
+		return err
+	}
+	oo := new(fhirOperationOutcome)
+	if json.NewDecoder(resp.Body).Decode(oo) != nil || oo.ResourceType != "OperationOutcome" {
+		return err
+	}
+	if msg := oo.message(); msg != "" {
+		err.Message += ": " + msg
+	}
+	return err
+}
+
+func isFhirJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/fhir+json" || mediaType == "application/json+fhir" || mediaType == "application/json")
+}
+
+func decodeFhirData(data, contentType string) (io.ReadCloser, string, error) {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, "", err
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), contentType, nil
+}
+
+// parseFhirDateTime parses FHIR instant and dateTime values, including partial dates
+func parseFhirDateTime(dt string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02", "2006-01", "2006"} {
+		if t, err := time.ParseInLocation(layout, dt, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid FHIR dateTime: %s", dt)
+}
+
+type fhirBundle struct {
+	ResourceType string `json:"resourceType"`
+	Link         []struct {
+		Relation string `json:"relation"`
+		URL      string `json:"url"`
+	} `json:"link"`
+	Entry []struct {
+		FullURL  string          `json:"fullUrl"`
+		Resource json.RawMessage `json:"resource"`
+		Search   struct {
+			Mode string `json:"mode"`
+		} `json:"search"`
+	} `json:"entry"`
+}
+
+func (b *fhirBundle) linkURL(relation string) string {
+	for _, l := range b.Link {
+		if l.Relation == relation {
+			return l.URL
+		}
+	}
+	return ""
+}
+
+type fhirAttachment struct {
+	ContentType string `json:"contentType,omitempty"`
+	Data        string `json:"data,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Size        int    `json:"size,omitempty"`
+	Hash        string `json:"hash,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Creation    string `json:"creation,omitempty"`
+}
+
+type fhirCoding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type fhirDocumentReference struct {
+	ResourceType     string `json:"resourceType"`
+	ID               string `json:"id,omitempty"`
+	MasterIdentifier *struct {
+		System string `json:"system,omitempty"`
+		Value  string `json:"value,omitempty"`
+	} `json:"masterIdentifier,omitempty"`
+	Status      string `json:"status,omitempty"`
+	Description string `json:"description,omitempty"`
+	Date        string `json:"date,omitempty"`
+	Type        struct {
+		Text string `json:"text,omitempty"`
+	} `json:"type"`
+	Content []struct {
+		Attachment fhirAttachment `json:"attachment"`
+		Format     *fhirCoding    `json:"format,omitempty"`
+	} `json:"content"`
+}
+
+type fhirBinary struct {
+	ResourceType string `json:"resourceType"`
+	ContentType  string `json:"contentType"`
+	Data         string `json:"data"`
+}
+
+type fhirOperationOutcome struct {
+	ResourceType string `json:"resourceType"`
+	Issue        []struct {
+		Severity    string `json:"severity"`
+		Code        string `json:"code"`
+		Diagnostics string `json:"diagnostics"`
+		Details     struct {
+			Text string `json:"text"`
+		} `json:"details"`
+	} `json:"issue"`
+}
+
+func (oo *fhirOperationOutcome) message() string {
+	msgs := make([]string, 0, len(oo.Issue))
+	for _, issue := range oo.Issue {
+		msg := issue.Diagnostics
+		if msg == "" {
+			msg = issue.Details.Text
+		}
+		if msg == "" {
+			msg = issue.Code
+		}
+		msgs = append(msgs, msg)
+	}
+	return strings.Join(msgs, "; ")
+}
@@ -0,0 +1,257 @@
+package hie
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/intervention-engine/integrator/transport"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestFhirClientSuite(t *testing.T) {
+	suite.Run(t, new(FhirClientSuite))
+}
+
+type FhirClientSuite struct {
+	suite.Suite
+	Client   *FhirClient
+	Server   *httptest.Server
+	Requests []*url.URL
+}
+
+const fhirTestDocument = "<document>\n    <foo>bar</foo>\n</document>"
+
+func (suite *FhirClientSuite) SetupTest() {
+	suite.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.Requests = append(suite.Requests, r.URL)
+		switch {
+		case r.URL.Path == "/fhir/DocumentReference" && r.URL.Query().Get("_getpages") != "":
+			suite.serveFixture(w, 200, "application/fhir+json", "../fixtures/fhir_bundle_page2.json")
+		case r.URL.Path == "/fhir/DocumentReference":
+			suite.serveFixture(w, 200, "application/fhir+json;charset=UTF-8", "../fixtures/fhir_bundle_page1.json")
+		case r.URL.Path == "/invalid/DocumentReference":
+			suite.serveFixture(w, 200, "application/fhir+json", "../fixtures/fhir_bundle_invalid.json")
+		case r.URL.Path == "/fhir/DocumentReference/2":
+			suite.serveFixture(w, 200, "application/fhir+json", "../fixtures/fhir_document_reference.json")
+		case r.URL.Path == "/fhir/Binary/b1":
+			suite.serveFixture(w, 200, "application/fhir+json", "../fixtures/fhir_binary.json")
+		case r.URL.Path == "/fhir/Binary/b3":
+			w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+			w.Write([]byte(fhirTestDocument))
+		default:
+			suite.serveFixture(w, 404, "application/fhir+json", "../fixtures/fhir_operation_outcome.json")
+		}
+	}))
+
+	suite.Client = NewFhirClient(suite.Server.URL+"/fhir/", "urn:oid:1.2.3.4.5")
+}
+
+func (suite *FhirClientSuite) serveFixture(w http.ResponseWriter, status int, contentType string, fixture string) {
+	b, err := ioutil.ReadFile(fixture)
+	suite.Require().NoError(err)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write([]byte(strings.Replace(string(b), "BASE_URL", suite.Server.URL+"/fhir", -1)))
+}
+
+func (suite *FhirClientSuite) TearDownTest() {
+	if suite.Server != nil {
+		suite.Server.Close()
+	}
+	suite.Requests = nil
+}
+
+func (suite *FhirClientSuite) TestQueryRecords() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	start := time.Date(2010, time.January, 1, 0, 0, 0, 0, time.UTC)
+	resp, err := suite.Client.QueryRecords(context.Background(), "123456789", &start, nil)
+	require.NoError(err)
+
+	// Both pages should have been requested
+	require.Len(suite.Requests, 2)
+	params := suite.Requests[0].Query()
+	assert.Equal("urn:oid:1.2.3.4.5|123456789", params.Get("patient.identifier"))
+	assert.Equal([]string{"ge2010-01-01T00:00:00+00:00"}, params["date"])
+	assert.Equal("abc", suite.Requests[1].Query().Get("_getpages"))
+
+	require.NotNil(resp)
+	assert.True(resp.Status)
+	assert.Equal("123456789", resp.Query.EE)
+	assert.Equal(start, resp.Query.StartDateTime)
+	assert.False(resp.Query.EndDateTime.IsZero())
+
+	// The entered-in-error document reference should be skipped
+	require.Len(resp.Result, 3)
+	sum := sha1.Sum([]byte(fhirTestDocument))
+	est := time.FixedZone("", -4*60*60)
+	assert.Equal(QueryResponseEntry{
+		RetrieveURL:  suite.Server.URL + "/fhir/Binary/b1",
+		CreationTime: time.Date(2014, 4, 25, 2, 51, 3, 0, est),
+		Title:        "Test Continuity of Care",
+		DocumentType: "urn:ihe:pcc:xphr:2007",
+		DocumentID:   "urn:oid:1.1.1.1.1.1",
+		Hash:         strings.ToUpper(hex.EncodeToString(sum[:])),
+		Size:         len(fhirTestDocument),
+	}, resp.Result[0])
+	assert.Equal(QueryResponseEntry{
+		RetrieveURL:  suite.Server.URL + "/fhir/DocumentReference/2",
+		CreationTime: time.Date(2014, 4, 25, 2, 14, 3, 0, est),
+		Title:        "Inline Continuity of Care",
+		DocumentType: "urn:ihe:pcc:xphr:2007",
+		DocumentID:   "urn:oid:1.1.1.1.1.2",
+	}, resp.Result[1])
+	assert.Equal(QueryResponseEntry{
+		RetrieveURL:  suite.Server.URL + "/fhir/Binary/b3",
+		CreationTime: time.Date(2013, 12, 9, 0, 0, 0, 0, time.Local),
+		Title:        "Test Clinical Summary",
+		DocumentType: "urn:hl7-org:sdwg:ccda-structuredBody:1.1",
+		DocumentID:   "3",
+	}, resp.Result[2])
+}
+
+func (suite *FhirClientSuite) TestQueryRecordsStartAndEnd() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Client.IdentifierSystem = ""
+	start := time.Date(2010, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2016, time.June, 8, 23, 59, 59, 0, time.UTC)
+	resp, err := suite.Client.QueryRecords(context.Background(), "123456789", &start, &end)
+	require.NoError(err)
+	params := suite.Requests[0].Query()
+	assert.Equal("123456789", params.Get("patient.identifier"))
+	assert.Equal([]string{"ge2010-01-01T00:00:00+00:00", "le2016-06-08T23:59:59+00:00"}, params["date"])
+	assert.Equal(end, resp.Query.EndDateTime)
+}
+
+func (suite *FhirClientSuite) TestQueryRecordsInvalidEntries() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Client.BaseURL = suite.Server.URL + "/invalid"
+	resp, err := suite.Client.QueryRecords(context.Background(), "123456789", nil, nil)
+	require.NoError(err)
+	require.NotNil(resp)
+	assert.True(resp.Status)
+
+	// The valid document reference is still returned
+	require.Len(resp.Result, 1)
+	assert.Equal("6", resp.Result[0].DocumentID)
+	assert.Equal(suite.Server.URL+"/invalid/Binary/b6", resp.Result[0].RetrieveURL)
+
+	require.Len(resp.Invalid, 2)
+	assert.Equal(EntryError{
+		Index:      0,
+		DocumentID: "5",
+		Errors:     []FieldError{{Field: "date", Problem: `has an invalid date/time: "last tuesday"`}},
+	}, resp.Invalid[0])
+	assert.Equal(EntryError{
+		Index:      2,
+		DocumentID: "7",
+		Errors:     []FieldError{{Field: "content", Problem: "is required"}},
+	}, resp.Invalid[1])
+}
+
+func (suite *FhirClientSuite) TestQueryRecordsError() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Client.BaseURL = suite.Server.URL + "/unknown"
+	resp, err := suite.Client.QueryRecords(context.Background(), "123456789", nil, nil)
+	require.Error(err)
+	assert.Nil(resp)
+	assert.Contains(err.Error(), "404")
+	assert.Contains(err.Error(), "Resource Binary/missing is not known")
+}
+
+func (suite *FhirClientSuite) TestDownloadRecordBinaryResource() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	content, cType, err := suite.Client.DownloadRecord(context.Background(), suite.Server.URL+"/fhir/Binary/b1")
+	require.NoError(err)
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	require.NoError(err)
+	assert.Equal(fhirTestDocument, string(data))
+	assert.Equal("text/xml", cType)
+}
+
+func (suite *FhirClientSuite) TestDownloadRecordRawBinary() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	content, cType, err := suite.Client.DownloadRecord(context.Background(), suite.Server.URL+"/fhir/Binary/b3")
+	require.NoError(err)
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	require.NoError(err)
+	assert.Equal(fhirTestDocument, string(data))
+	assert.Equal("text/xml; charset=utf-8", cType)
+}
+
+func (suite *FhirClientSuite) TestDownloadRecordInlineData() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	content, cType, err := suite.Client.DownloadRecord(context.Background(), suite.Server.URL+"/fhir/DocumentReference/2")
+	require.NoError(err)
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	require.NoError(err)
+	assert.Equal(fhirTestDocument, string(data))
+	assert.Equal("text/xml", cType)
+}
+
+func (suite *FhirClientSuite) TestCredentialsStayOnOrigin() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var authorization []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = append(authorization, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(fhirTestDocument))
+	}))
+	defer other.Close()
+	suite.Client.Auth = transport.NewBasicAuthenticator("user", "secret")
+
+	// A URL on another origin, such as an attachment's, isn't sent the credentials
+	content, _, err := suite.Client.DownloadRecord(context.Background(), other.URL+"/fhir/Binary/b3")
+	require.NoError(err)
+	content.Close()
+	require.Len(authorization, 1)
+	assert.Empty(authorization[0])
+
+	// Once it's the base URL's origin, it is
+	suite.Client.BaseURL = other.URL + "/fhir"
+	content, _, err = suite.Client.DownloadRecord(context.Background(), other.URL+"/fhir/Binary/b3")
+	require.NoError(err)
+	content.Close()
+	require.Len(authorization, 2)
+	assert.True(strings.HasPrefix(authorization[1], "Basic "))
+}
+
+func (suite *FhirClientSuite) TestDownloadRecordError() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	content, cType, err := suite.Client.DownloadRecord(context.Background(), suite.Server.URL+"/fhir/Binary/missing")
+	require.Error(err)
+	assert.Contains(err.Error(), "Resource Binary/missing is not known")
+	assert.Nil(content)
+	assert.Empty(cType)
+}
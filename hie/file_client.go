@@ -0,0 +1,280 @@
+package hie
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileURLPrefix starts the retrieve URLs of documents in a drop folder.  The rest of the URL is the
+// document's path relative to the folder.
+const fileURLPrefix = "file:"
+
+// FileClient is a Client for partners that deliver documents into a folder (e.g., by SFTP)
+// rather than through an API.  Each EE number's documents are XML files in a subfolder named after
+// the EE number: <root>/<ee>/*.xml.  The query details for each document are taken from a JSON
+// sidecar with the same name (e.g., doc1.json for doc1.xml) if there is one, then from the
+// document's own id, title and effectiveTime, and finally from the file itself.
+//
+// Files can arrive with any modification time, so every document in an EE number's folder is listed
+// regardless of the date range queried; the transaction history keeps documents from being copied
+// twice.  To keep the folder from growing, documents can be moved to an archive folder once they've
+// been ingested, and to an error folder when they can't be.  Documents in the error folder are
+// still found when failed copies are retried.
+type FileClient struct {
+	Root string
+	// ArchiveDir and ErrorDir, if set, are the folders that documents are moved to after they're
+	// ingested or fail to be.  Documents keep their <ee>/<name> path within them.
+	ArchiveDir string
+	ErrorDir   string
+	// DocumentType is the type reported for documents whose sidecar doesn't give one
+	DocumentType string
+}
+
+// FileSidecar holds the query details for a document in a drop folder.  Any details it leaves out
+// are taken from the document.
+type FileSidecar struct {
+	DocumentID   string     `json:"documentID"`
+	DocumentType string     `json:"documentType"`
+	Title        string     `json:"title"`
+	CreationTime *time.Time `json:"creationTime"`
+}
+
+// CdaHeader holds the parts of a CDA document's header used to describe it
+type CdaHeader struct {
+	ID struct {
+		Root      string `xml:"root,attr"`
+		Extension string `xml:"extension,attr"`
+	} `xml:"id"`
+	Title         string `xml:"title"`
+	EffectiveTime struct {
+		Value string `xml:"value,attr"`
+	} `xml:"effectiveTime"`
+}
+
+func NewFileClient(root string) *FileClient {
+	return &FileClient{
+		Root:         root,
+		DocumentType: "XML^HL7^231^CCD^C32",
+	}
+}
+
+// QueryRecords lists the documents in an EE number's folder
+func (c *FileClient) QueryRecords(ctx context.Context, mrn string, start *time.Time, end *time.Time) (*QueryResponse, error) {
+	qStart := time.Now()
+	if mrn == "" || strings.ContainsAny(mrn, `/\`) || mrn == "." || mrn == ".." {
+		return nil, fmt.Errorf("%s can't be used as a folder name", mrn)
+	}
+	qr := &QueryResponse{
+		Status: true,
+		Query: QueryRequest{
+			EE:                 mrn,
+			Host:               c.Root,
+			QueryStartDateTime: qStart.UTC(),
+		},
+	}
+	if start != nil {
+		qr.Query.StartDateTime = *start
+	}
+	if end != nil {
+		qr.Query.EndDateTime = *end
+	} else {
+		qr.Query.EndDateTime = qStart
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(c.Root, mrn))
+	if os.IsNotExist(err) {
+		// Nothing has been delivered for the EE number yet
+		files, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") || strings.ToLower(filepath.Ext(fi.Name())) != ".xml" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		entry, err := c.toQueryResponseEntry(path.Join(mrn, fi.Name()), fi)
+		if err != nil {
+			log.Printf("Skipping unreadable document %s: %s\n", fi.Name(), err)
+			continue
+		}
+		qr.Result = append(qr.Result, entry)
+	}
+	qr.Query.QueryCompleteDateTime = time.Now().UTC()
+
+	return qr, nil
+}
+
+func (c *FileClient) toQueryResponseEntry(rel string, fi os.FileInfo) (QueryResponseEntry, error) {
+	entry := QueryResponseEntry{
+		RetrieveURL:  fileURLPrefix + rel,
+		DocumentType: c.DocumentType,
+		CreationTime: fi.ModTime(),
+		Size:         int(fi.Size()),
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(c.Root, filepath.FromSlash(rel)))
+	if err != nil {
+		return entry, err
+	}
+	sum := sha1.Sum(data)
+	entry.Hash = strings.ToUpper(hex.EncodeToString(sum[:]))
+	entry.Size = len(data)
+
+	header := new(CdaHeader)
+	if err := xml.Unmarshal(data, header); err == nil {
+		entry.DocumentID = header.ID.Root
+		if header.ID.Extension != "" {
+			entry.DocumentID += "^" + header.ID.Extension
+		}
+		entry.Title = strings.TrimSpace(header.Title)
+		if header.EffectiveTime.Value != "" {
+			if t, err := ParseCdaTime(header.EffectiveTime.Value); err == nil {
+				entry.CreationTime = t
+			}
+		}
+	}
+
+	sidecarPath := strings.TrimSuffix(filepath.Join(c.Root, filepath.FromSlash(rel)), filepath.Ext(rel)) + ".json"
+	if data, err := ioutil.ReadFile(sidecarPath); err == nil {
+		sidecar := new(FileSidecar)
+		if err := json.Unmarshal(data, sidecar); err != nil {
+			return entry, fmt.Errorf("Invalid sidecar %s: %s", sidecarPath, err)
+		}
+		if sidecar.DocumentID != "" {
+			entry.DocumentID = sidecar.DocumentID
+		}
+		if sidecar.DocumentType != "" {
+			entry.DocumentType = sidecar.DocumentType
+		}
+		if sidecar.Title != "" {
+			entry.Title = sidecar.Title
+		}
+		if sidecar.CreationTime != nil {
+			entry.CreationTime = *sidecar.CreationTime
+		}
+	} else if !os.IsNotExist(err) {
+		return entry, err
+	}
+
+	// Documents that don't identify themselves are identified by their file name, so that local
+	// copies of them are stored alongside the others
+	if entry.DocumentID == "" {
+		entry.DocumentID = strings.TrimSuffix(path.Base(rel), path.Ext(rel))
+	}
+	return entry, nil
+}
+
+// DownloadRecord opens a document listed by QueryRecords, looking in the error folder if it has
+// been moved there
+func (c *FileClient) DownloadRecord(ctx context.Context, url string) (content io.ReadCloser, contentType string, err error) {
+	file, err := c.find(url)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, "text/xml", nil
+}
+
+// FinishRecord moves a document to the archive folder once it has been ingested, or to the error
+// folder if it couldn't be
+func (c *FileClient) FinishRecord(ctx context.Context, url string, copyErr error) error {
+	rel, err := c.relativePath(url)
+	if err != nil {
+		return err
+	}
+	dest := c.ArchiveDir
+	if copyErr != nil {
+		dest = c.ErrorDir
+	}
+	if dest == "" {
+		return nil
+	}
+	file, err := c.find(url)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(dest, rel)
+	if file == target {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		return err
+	}
+	log.Printf("Moving %s to %s\n", file, target)
+	if err := os.Rename(file, target); err != nil {
+		return err
+	}
+	// The sidecar goes with it
+	sidecar := strings.TrimSuffix(file, filepath.Ext(file)) + ".json"
+	if _, err := os.Stat(sidecar); err == nil {
+		return os.Rename(sidecar, strings.TrimSuffix(target, filepath.Ext(target))+".json")
+	}
+	return nil
+}
+
+// find returns the path of the document with the given retrieve URL, in the drop folder or the
+// error folder
+func (c *FileClient) find(url string) (string, error) {
+	rel, err := c.relativePath(url)
+	if err != nil {
+		return "", err
+	}
+	file := filepath.Join(c.Root, rel)
+	if _, err := os.Stat(file); os.IsNotExist(err) && c.ErrorDir != "" {
+		if _, err := os.Stat(filepath.Join(c.ErrorDir, rel)); err == nil {
+			return filepath.Join(c.ErrorDir, rel), nil
+		}
+	}
+	return file, nil
+}
+
+// relativePath returns a document's path relative to the folder, making sure that the retrieve URL
+// can't reach outside of it
+func (c *FileClient) relativePath(url string) (string, error) {
+	if !strings.HasPrefix(url, fileURLPrefix) {
+		return "", fmt.Errorf("Retrieve URL does not identify a file: %s", url)
+	}
+	rel := path.Clean(strings.TrimPrefix(url, fileURLPrefix))
+	if path.IsAbs(rel) || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("Retrieve URL is outside of the folder: %s", url)
+	}
+	return filepath.FromSlash(rel), nil
+}
+
+// ParseCdaTime parses an HL7 TS, which may be truncated to any precision down to the year and may
+// have fractional seconds and a UTC offset.  Times without an offset are taken to be local.
+func ParseCdaTime(ts string) (time.Time, error) {
+	value, zone := ts, ""
+	if i := strings.IndexAny(ts, "+-"); i >= 0 {
+		value, zone = ts[:i], ts[i:]
+	}
+	if i := strings.Index(value, "."); i >= 0 {
+		value = value[:i]
+	}
+	if len(value) > len(xdsTimeFormat) || len(value) < 4 {
+		return time.Time{}, fmt.Errorf("invalid HL7 time: %s", ts)
+	}
+	if zone == "" {
+		return time.ParseInLocation(xdsTimeFormat[:len(value)], value, time.Local)
+	}
+	return time.Parse(xdsTimeFormat[:len(value)]+"-0700", value+zone)
+}
@@ -0,0 +1,177 @@
+package hie
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestFileHieClientSuite(t *testing.T) {
+	suite.Run(t, new(FileHieClientSuite))
+}
+
+type FileHieClientSuite struct {
+	suite.Suite
+	TempDir string
+	Client  *FileClient
+}
+
+func (suite *FileHieClientSuite) SetupTest() {
+	require := suite.Require()
+
+	var err error
+	suite.TempDir, err = ioutil.TempDir("", "file_client_test")
+	require.NoError(err)
+
+	// Work on a copy of the drop folder, since documents are moved out of it
+	eeDir := filepath.Join(suite.TempDir, "drop", "123456789")
+	require.NoError(os.MkdirAll(eeDir, 0777))
+	files, err := ioutil.ReadDir("../fixtures/drop_folder/123456789")
+	require.NoError(err)
+	for _, fi := range files {
+		data, err := ioutil.ReadFile(filepath.Join("../fixtures/drop_folder/123456789", fi.Name()))
+		require.NoError(err)
+		require.NoError(ioutil.WriteFile(filepath.Join(eeDir, fi.Name()), data, 0644))
+	}
+	suite.Client = NewFileClient(filepath.Join(suite.TempDir, "drop"))
+}
+
+func (suite *FileHieClientSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDir)
+}
+
+func (suite *FileHieClientSuite) TestQueryRecords() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	start := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.Local)
+	qr, err := suite.Client.QueryRecords(context.Background(), "123456789", &start, nil)
+	require.NoError(err)
+	assert.True(qr.Status)
+	assert.Equal("123456789", qr.Query.EE)
+	assert.Equal(start, qr.Query.StartDateTime)
+	assert.False(qr.Query.EndDateTime.IsZero())
+
+	// Every XML document is listed, whatever its date
+	require.Len(qr.Result, 3)
+	ccd1 := qr.Result[0]
+	assert.Equal("file:123456789/ccd1.xml", ccd1.RetrieveURL)
+	assert.Equal("2.16.840.1.113883.19.5^ccd-1", ccd1.DocumentID)
+	assert.Equal("XML^HL7^231^CCD^C32", ccd1.DocumentType)
+	assert.Equal("Continuity of Care Document", ccd1.Title)
+	assert.True(ccd1.CreationTime.Equal(time.Date(2014, time.April, 25, 6, 51, 3, 0, time.UTC)))
+	data, err := ioutil.ReadFile("../fixtures/drop_folder/123456789/ccd1.xml")
+	require.NoError(err)
+	assert.Equal(len(data), ccd1.Size)
+
+	// The sidecar overrides the document's own details
+	ccd2 := qr.Result[1]
+	assert.Equal("summary-2", ccd2.DocumentID)
+	assert.Equal("XML^HL7^231^CCD^V1.1", ccd2.DocumentType)
+	assert.Equal("Clinical Summary", ccd2.Title)
+	assert.True(ccd2.CreationTime.Equal(time.Date(2013, time.December, 9, 5, 7, 3, 0, time.UTC)))
+
+	// Documents without an id are identified by their file name
+	assert.Equal("note", qr.Result[2].DocumentID)
+}
+
+func (suite *FileHieClientSuite) TestQueryRecordsWithoutFolder() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	qr, err := suite.Client.QueryRecords(context.Background(), "987654321", nil, nil)
+	require.NoError(err)
+	assert.True(qr.Status)
+	assert.Empty(qr.Result)
+
+	_, err = suite.Client.QueryRecords(context.Background(), "../123456789", nil, nil)
+	assert.Error(err)
+}
+
+func (suite *FileHieClientSuite) TestDownloadRecord() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	rc, ct, err := suite.Client.DownloadRecord(context.Background(), "file:123456789/ccd2.xml")
+	require.NoError(err)
+	defer rc.Close()
+	assert.Equal("text/xml", ct)
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(err)
+	expected, err := ioutil.ReadFile("../fixtures/drop_folder/123456789/ccd2.xml")
+	require.NoError(err)
+	assert.Equal(expected, data)
+
+	_, _, err = suite.Client.DownloadRecord(context.Background(), "file:123456789/missing.xml")
+	assert.Error(err)
+	_, _, err = suite.Client.DownloadRecord(context.Background(), "file:../../etc/passwd")
+	assert.Error(err)
+	_, _, err = suite.Client.DownloadRecord(context.Background(), "http://hie/123456789/ccd2.xml")
+	assert.Error(err)
+}
+
+func (suite *FileHieClientSuite) TestFinishRecordMovesDocuments() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Client.ArchiveDir = filepath.Join(suite.TempDir, "archive")
+	suite.Client.ErrorDir = filepath.Join(suite.TempDir, "error")
+
+	// A failed document moves to the error folder with its sidecar, where it can still be retried
+	ctx := context.Background()
+	require.NoError(suite.Client.FinishRecord(ctx, "file:123456789/ccd2.xml", errors.New("ingest failed")))
+	assert.True(suite.exists("error", "123456789", "ccd2.xml"))
+	assert.True(suite.exists("error", "123456789", "ccd2.json"))
+	assert.False(suite.exists("drop", "123456789", "ccd2.xml"))
+	rc, _, err := suite.Client.DownloadRecord(ctx, "file:123456789/ccd2.xml")
+	require.NoError(err)
+	rc.Close()
+
+	// Once it's ingested, it's archived
+	require.NoError(suite.Client.FinishRecord(ctx, "file:123456789/ccd2.xml", nil))
+	assert.True(suite.exists("archive", "123456789", "ccd2.xml"))
+	assert.True(suite.exists("archive", "123456789", "ccd2.json"))
+	assert.False(suite.exists("error", "123456789", "ccd2.xml"))
+
+	qr, err := suite.Client.QueryRecords(ctx, "123456789", nil, nil)
+	require.NoError(err)
+	assert.Len(qr.Result, 2)
+}
+
+func (suite *FileHieClientSuite) TestFinishRecordLeavesDocumentsByDefault() {
+	assert := suite.Assert()
+
+	assert.NoError(suite.Client.FinishRecord(context.Background(), "file:123456789/ccd1.xml", nil))
+	assert.NoError(suite.Client.FinishRecord(context.Background(), "file:123456789/note.xml", errors.New("ingest failed")))
+	assert.True(suite.exists("drop", "123456789", "ccd1.xml"))
+	assert.True(suite.exists("drop", "123456789", "note.xml"))
+}
+
+func (suite *FileHieClientSuite) TestParseCdaTime() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	t, err := ParseCdaTime("20140425025103.1234-0400")
+	require.NoError(err)
+	assert.True(t.Equal(time.Date(2014, time.April, 25, 6, 51, 3, 0, time.UTC)))
+	t, err = ParseCdaTime("201404")
+	require.NoError(err)
+	assert.Equal(time.Date(2014, time.April, 1, 0, 0, 0, 0, time.Local), t)
+	_, err = ParseCdaTime("14")
+	assert.Error(err)
+	_, err = ParseCdaTime("2014042502510300")
+	assert.Error(err)
+}
+
+func (suite *FileHieClientSuite) exists(elem ...string) bool {
+	_, err := os.Stat(filepath.Join(append([]string{suite.TempDir}, elem...)...))
+	return err == nil
+}
@@ -0,0 +1,223 @@
+package hie
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Protocol describes the conventions a JSON HIE uses for queries: how the query URL is built and
+// how dates are formatted in requests and responses.  HIEs that return the same JSON shape but use
+// different parameter names, date formats or timezones can be supported by configuring a protocol
+// rather than changing code.
+type Protocol struct {
+	// URLTemplate is the query URL.  "{base}" is replaced with the HIE URL and "{ee}" with the
+	// (escaped) EE number.
+	URLTemplate string `json:"urlTemplate"`
+	// EEParam, StartParam and EndParam are the names of the query parameters for the EE number and
+	// the date range.  If EEParam is empty, the EE number must be in the URL template instead.
+	EEParam    string `json:"eeParam"`
+	StartParam string `json:"startParam"`
+	EndParam   string `json:"endParam"`
+	// ExtraParams are static parameters sent with every query (e.g., an environment or facility code)
+	ExtraParams map[string]string `json:"extraParams"`
+	// RequestDateLayout is the layout of the start and end parameters
+	RequestDateLayout string `json:"requestDateLayout"`
+	// CreationTimeLayout is the layout of each result's creationTime
+	CreationTimeLayout string `json:"creationTimeLayout"`
+	// QueryDateLayout is the layout of the startDateTime and endDateTime echoed back in the response
+	QueryDateLayout string `json:"queryDateLayout"`
+	// Location is the HIE's timezone, used for dates in requests and for dates in responses that
+	// don't carry a zone of their own
+	Location *time.Location `json:"-"`
+	// HIEs that cap the size of query responses are paged through in one of two ways.  With
+	// NextPageField, each response names the next page in that (top-level) field, either as a link
+	// to follow or as a continuation token that is sent back in PageParam.  With OffsetParam and
+	// LimitParam, pages of PageSize results are requested by offset until a short page comes back.
+	NextPageField string `json:"nextPageField"`
+	PageParam     string `json:"pageParam"`
+	OffsetParam   string `json:"offsetParam"`
+	LimitParam    string `json:"limitParam"`
+	PageSize      int    `json:"pageSize"`
+}
+
+// DefaultProtocol returns the protocol that the integrator was originally written against
+func DefaultProtocol() *Protocol {
+	return &Protocol{
+		URLTemplate:        "{base}",
+		EEParam:            "ee",
+		StartParam:         "startDateTime",
+		EndParam:           "endDateTime",
+		RequestDateLayout:  "2006-01-02T15:04:05",
+		CreationTimeLayout: "20060102150405",
+		QueryDateLayout:    "2006-01-02T15:04:05",
+		Location:           time.Local,
+	}
+}
+
+// LoadProtocol reads a protocol from a JSON file.  Settings that aren't in the file keep their
+// default values.  The HIE's timezone is given as an IANA name (e.g., "America/New_York") in the
+// "timezone" setting.
+func LoadProtocol(path string) (*Protocol, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParseProtocol(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid HIE protocol in %s: %s", path, err)
+	}
+	return p, nil
+}
+
+// ParseProtocol parses a protocol from JSON (see LoadProtocol)
+func ParseProtocol(data []byte) (*Protocol, error) {
+	p := DefaultProtocol()
+	file := struct {
+		*Protocol
+		Timezone string `json:"timezone"`
+	}{Protocol: p}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if file.Timezone != "" {
+		loc, err := time.LoadLocation(file.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		p.Location = loc
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Validate checks that the protocol can be used to build queries and parse responses
+func (p *Protocol) Validate() error {
+	if p.URLTemplate == "" {
+		return errors.New("A URL template is required")
+	}
+	if p.EEParam == "" && !strings.Contains(p.URLTemplate, "{ee}") {
+		return errors.New("The EE number must be sent as a parameter or in the URL template")
+	}
+	if p.StartParam == "" || p.EndParam == "" {
+		return errors.New("Start and end parameter names are required")
+	}
+	if p.RequestDateLayout == "" || p.CreationTimeLayout == "" || p.QueryDateLayout == "" {
+		return errors.New("Request, creation time and query date layouts are required")
+	}
+	if p.NextPageField != "" && p.OffsetParam != "" {
+		return errors.New("Pages must be requested with either a next page field or an offset, not both")
+	}
+	if p.PageParam != "" && p.NextPageField == "" {
+		return errors.New("A page parameter requires a next page field")
+	}
+	if p.OffsetParam != "" && (p.LimitParam == "" || p.PageSize <= 0) {
+		return errors.New("Offset paging requires a limit parameter and a positive page size")
+	}
+	return nil
+}
+
+// Paged reports whether the HIE pages query responses
+func (p *Protocol) Paged() bool {
+	return p.NextPageField != "" || p.OffsetParam != ""
+}
+
+// QueryURL builds the URL to query the HIE at the given base URL for an EE number's records.  An
+// empty page requests the first page of results; otherwise it is the page named by the previous
+// response (see QueryResponse.NextPage).
+func (p *Protocol) QueryURL(baseURL, ee string, start, end *time.Time, page string) string {
+	if page != "" && p.NextPageField != "" && p.PageParam == "" {
+		// The page is a link, which may be relative to the HIE URL
+		return resolveLink(baseURL, page)
+	}
+
+	// Encode spaces as %20 so the EE number is safe in a path as well as in a query string
+	escaped := strings.Replace(url.QueryEscape(ee), "+", "%20", -1)
+	qURL := strings.Replace(p.URLTemplate, "{base}", baseURL, -1)
+	qURL = strings.Replace(qURL, "{ee}", escaped, -1)
+
+	params := url.Values{}
+	for name, val := range p.ExtraParams {
+		params.Set(name, val)
+	}
+	if p.EEParam != "" {
+		params.Set(p.EEParam, ee)
+	}
+	if start != nil {
+		params.Set(p.StartParam, start.In(p.Zone()).Format(p.RequestDateLayout))
+	}
+	if end != nil {
+		params.Set(p.EndParam, end.In(p.Zone()).Format(p.RequestDateLayout))
+	}
+	if p.OffsetParam != "" {
+		if page == "" {
+			page = "0"
+		}
+		params.Set(p.OffsetParam, page)
+		params.Set(p.LimitParam, strconv.Itoa(p.PageSize))
+	} else if page != "" {
+		params.Set(p.PageParam, page)
+	}
+	if len(params) == 0 {
+		return qURL
+	}
+	if strings.Contains(qURL, "?") {
+		return qURL + "&" + params.Encode()
+	}
+	return qURL + "?" + params.Encode()
+}
+
+// DecodeQueryResponse reads a query response using the protocol's date layouts and timezone (see
+// the DecodeQueryResponse function for how validation works)
+func (p *Protocol) DecodeQueryResponse(r io.Reader, strict bool) (*QueryResponse, error) {
+	var data json.RawMessage
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return nil, err
+	}
+	return decodeQueryResponse(data, p, strict)
+}
+
+// nextPage returns the page after the given one, or "" if the response is the last page
+func (p *Protocol) nextPage(page string, qr *QueryResponse) string {
+	if !qr.Status {
+		return ""
+	}
+	if p.OffsetParam == "" {
+		return qr.NextPage
+	}
+	count := len(qr.Result) + len(qr.Invalid)
+	if count < p.PageSize {
+		return ""
+	}
+	offset, _ := strconv.Atoi(page)
+	return strconv.Itoa(offset + count)
+}
+
+// Zone returns the HIE's timezone, which is local time unless the protocol sets one
+func (p *Protocol) Zone() *time.Location {
+	if p.Location == nil {
+		return time.Local
+	}
+	return p.Location
+}
+
+// resolveLink resolves a link in a query response against the HIE URL
+func resolveLink(baseURL, link string) string {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return link
+	}
+	ref, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	return base.ResolveReference(ref).String()
+}
@@ -0,0 +1,284 @@
+package hie
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestHieProtocolSuite(t *testing.T) {
+	suite.Run(t, new(HieProtocolSuite))
+}
+
+type HieProtocolSuite struct {
+	suite.Suite
+	Protocol *Protocol
+	Eastern  *time.Location
+}
+
+func (suite *HieProtocolSuite) SetupTest() {
+	require := suite.Require()
+
+	p, err := LoadProtocol("../fixtures/hie_protocol.json")
+	require.NoError(err)
+	suite.Protocol = p
+	suite.Eastern, err = time.LoadLocation("America/New_York")
+	require.NoError(err)
+}
+
+func (suite *HieProtocolSuite) TestLoadHieProtocol() {
+	assert := suite.Assert()
+
+	assert.Equal(&Protocol{
+		URLTemplate:        "{base}/patients/{ee}/documents?version=2",
+		EEParam:            "",
+		StartParam:         "from",
+		EndParam:           "to",
+		ExtraParams:        map[string]string{"facility": "IE01"},
+		RequestDateLayout:  "2006-01-02T15:04:05Z07:00",
+		CreationTimeLayout: "2006-01-02T15:04:05",
+		QueryDateLayout:    "2006-01-02 15:04:05",
+		Location:           suite.Eastern,
+	}, suite.Protocol)
+}
+
+func (suite *HieProtocolSuite) TestPartialProtocolKeepsDefaults() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	p, err := ParseProtocol([]byte(`{"eeParam": "mrn"}`))
+	require.NoError(err)
+	expected := DefaultProtocol()
+	expected.EEParam = "mrn"
+	assert.Equal(expected, p)
+}
+
+func (suite *HieProtocolSuite) TestInvalidProtocols() {
+	assert := suite.Assert()
+
+	_, err := ParseProtocol([]byte(`{"eeParam": ""}`))
+	assert.EqualError(err, "The EE number must be sent as a parameter or in the URL template")
+
+	_, err = ParseProtocol([]byte(`{"creationTimeLayout": ""}`))
+	assert.Error(err)
+
+	_, err = ParseProtocol([]byte(`{"timezone": "Mars/Olympus_Mons"}`))
+	assert.Error(err)
+
+	_, err = ParseProtocol([]byte(`{"nextPageField": "next", "offsetParam": "offset", "limitParam": "limit", "pageSize": 10}`))
+	assert.Error(err)
+
+	_, err = ParseProtocol([]byte(`{"pageParam": "cursor"}`))
+	assert.EqualError(err, "A page parameter requires a next page field")
+
+	_, err = ParseProtocol([]byte(`{"offsetParam": "offset", "limitParam": "limit"}`))
+	assert.EqualError(err, "Offset paging requires a limit parameter and a positive page size")
+
+	_, err = LoadProtocol("../fixtures/missing.json")
+	assert.Error(err)
+}
+
+func (suite *HieProtocolSuite) TestDefaultQueryURL() {
+	assert := suite.Assert()
+
+	start := time.Date(2016, time.May, 1, 10, 20, 30, 0, time.Local)
+	end := time.Date(2016, time.June, 1, 10, 20, 30, 0, time.Local)
+	assert.Equal("http://hie/query?ee=123&endDateTime=2016-06-01T10%3A20%3A30&startDateTime=2016-05-01T10%3A20%3A30",
+		DefaultProtocol().QueryURL("http://hie/query", "123", &start, &end, ""))
+	assert.Equal("http://hie/query?ee=123", DefaultProtocol().QueryURL("http://hie/query", "123", nil, nil, ""))
+}
+
+func (suite *HieProtocolSuite) TestCustomQueryURL() {
+	assert := suite.Assert()
+
+	// Dates are sent in the HIE's timezone
+	start := time.Date(2016, time.May, 1, 14, 20, 30, 0, time.UTC)
+	assert.Equal("http://hie/api/patients/ABC%20123/documents?version=2&facility=IE01&from=2016-05-01T10%3A20%3A30-04%3A00",
+		suite.Protocol.QueryURL("http://hie/api", "ABC 123", &start, nil, ""))
+}
+
+func (suite *HieProtocolSuite) TestPagedQueryURL() {
+	assert := suite.Assert()
+
+	// Next links are followed as-is, resolved against the HIE URL
+	p := DefaultProtocol()
+	p.NextPageField = "next"
+	assert.Equal("http://hie/query?ee=123", p.QueryURL("http://hie/query", "123", nil, nil, ""))
+	assert.Equal("http://other/query?page=2", p.QueryURL("http://hie/query", "123", nil, nil, "http://other/query?page=2"))
+	assert.Equal("http://hie/query?ee=123&page=2", p.QueryURL("http://hie/query", "123", nil, nil, "?ee=123&page=2"))
+
+	// Continuation tokens are sent back in the page parameter
+	p.PageParam = "cursor"
+	assert.Equal("http://hie/query?cursor=abc%3D&ee=123", p.QueryURL("http://hie/query", "123", nil, nil, "abc="))
+
+	// Offsets always go with the limit
+	p = DefaultProtocol()
+	p.OffsetParam, p.LimitParam, p.PageSize = "offset", "limit", 50
+	assert.Equal("http://hie/query?ee=123&limit=50&offset=0", p.QueryURL("http://hie/query", "123", nil, nil, ""))
+	assert.Equal("http://hie/query?ee=123&limit=50&offset=100", p.QueryURL("http://hie/query", "123", nil, nil, "100"))
+}
+
+func (suite *HieProtocolSuite) TestDecodeWithCustomLayouts() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	f, err := os.Open("../fixtures/response_success_protocol.json")
+	require.NoError(err)
+	defer f.Close()
+	qr, err := suite.Protocol.DecodeQueryResponse(f, true)
+	require.NoError(err)
+	require.Len(qr.Result, 1)
+	assert.True(qr.Result[0].CreationTime.Equal(time.Date(2014, 4, 25, 2, 51, 3, 0, suite.Eastern)))
+	assert.True(qr.Query.StartDateTime.Equal(time.Date(2010, 1, 1, 0, 0, 0, 0, suite.Eastern)))
+	assert.True(qr.Query.EndDateTime.Equal(time.Date(2016, 6, 8, 23, 59, 59, 0, suite.Eastern)))
+
+	// The default protocol can't read it
+	_, err = f.Seek(0, 0)
+	require.NoError(err)
+	_, err = DecodeQueryResponse(f, false)
+	assert.Error(err)
+}
+
+func (suite *HieProtocolSuite) TestHttpHieClientUsesProtocol() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var lastURL string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastURL = r.URL.String()
+		f, err := os.Open("../fixtures/response_success_protocol.json")
+		require.NoError(err)
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		io.Copy(w, f)
+	}))
+	defer server.Close()
+
+	client := NewHttpClient(server.URL)
+	client.Protocol = suite.Protocol
+	resp, err := client.QueryRecords(context.Background(), "123456789", nil, nil)
+	require.NoError(err)
+	assert.Equal("/patients/123456789/documents?version=2&facility=IE01", lastURL)
+	require.Len(resp.Result, 1)
+	assert.Equal("1.1.1.1.1.1", resp.Result[0].DocumentID)
+}
+
+func (suite *HieProtocolSuite) TestHttpHieClientFollowsNextLinks() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var urls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		urls = append(urls, r.URL.String())
+		switch r.URL.Query().Get("page") {
+		case "":
+			io.WriteString(w, pagedResponse("next", "/query?ee=123&page=2", "1.1", "1.2"))
+		case "2":
+			io.WriteString(w, pagedResponse("next", "/query?ee=123&page=3", "2.1"))
+		default:
+			io.WriteString(w, pagedResponse("next", "", "3.1"))
+		}
+	}))
+	defer server.Close()
+
+	client := NewHttpClient(server.URL + "/query")
+	client.Protocol = DefaultProtocol()
+	client.Protocol.NextPageField = "next"
+	client.StrictValidation = true
+
+	// One page at a time
+	resp, err := client.QueryRecordsPage(context.Background(), "123", nil, nil, "")
+	require.NoError(err)
+	require.Len(resp.Result, 2)
+	assert.Equal("/query?ee=123&page=2", resp.NextPage)
+	resp, err = client.QueryRecordsPage(context.Background(), "123", nil, nil, resp.NextPage)
+	require.NoError(err)
+	require.Len(resp.Result, 1)
+	assert.Equal("2.1", resp.Result[0].DocumentID)
+
+	// Or all at once
+	urls = nil
+	resp, err = client.QueryRecords(context.Background(), "123", nil, nil)
+	require.NoError(err)
+	assert.Equal([]string{"/query?ee=123", "/query?ee=123&page=2", "/query?ee=123&page=3"}, urls)
+	require.Len(resp.Result, 4)
+	assert.Equal("3.1", resp.Result[3].DocumentID)
+	assert.Equal("", resp.NextPage)
+}
+
+func (suite *HieProtocolSuite) TestHttpHieClientPagesByOffset() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var offsets []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offset := r.URL.Query().Get("offset")
+		offsets = append(offsets, offset)
+		assert.Equal("2", r.URL.Query().Get("limit"))
+		switch offset {
+		case "0":
+			io.WriteString(w, pagedResponse("", "", "1", "2"))
+		case "2":
+			io.WriteString(w, pagedResponse("", "", "3", "4"))
+		default:
+			io.WriteString(w, pagedResponse("", "", "5"))
+		}
+	}))
+	defer server.Close()
+
+	client := NewHttpClient(server.URL)
+	client.Protocol = DefaultProtocol()
+	client.Protocol.OffsetParam, client.Protocol.LimitParam, client.Protocol.PageSize = "offset", "limit", 2
+
+	resp, err := client.QueryRecordsPage(context.Background(), "123", nil, nil, "")
+	require.NoError(err)
+	assert.Equal("2", resp.NextPage)
+
+	// A short page is the last one
+	resp, err = client.QueryRecords(context.Background(), "123", nil, nil)
+	require.NoError(err)
+	assert.Equal([]string{"0", "0", "2", "4"}, offsets)
+	assert.Len(resp.Result, 5)
+	assert.Equal("", resp.NextPage)
+}
+
+func (suite *HieProtocolSuite) TestHttpHieClientDetectsPagingLoops() {
+	assert := suite.Assert()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, pagedResponse("next", "?ee=123&page=2", "1"))
+	}))
+	defer server.Close()
+
+	client := NewHttpClient(server.URL)
+	client.Protocol = DefaultProtocol()
+	client.Protocol.NextPageField = "next"
+	_, err := client.QueryRecords(context.Background(), "123", nil, nil)
+	assert.Error(err)
+}
+
+// pagedResponse builds a successful query response with the given document IDs, naming the next
+// page in nextField
+func pagedResponse(nextField, next string, ids ...string) string {
+	results := ""
+	for i, id := range ids {
+		if i > 0 {
+			results += ","
+		}
+		results += fmt.Sprintf(`{"retrieveURL": "http://hie/document/%s", "creationTime": "20140425025103", "documentType": "XML^HL7^231^CCD^C32", "documentID": "%s"}`, id, id)
+	}
+	nextPage := ""
+	if nextField != "" && next != "" {
+		nextPage = fmt.Sprintf(`, "%s": "%s"`, nextField, next)
+	}
+	return fmt.Sprintf(`{"status": true, "result": [%s], "query": {"ee": "123", "endDateTime": "2016-06-08T23:59:59"}%s}`, results, nextPage)
+}
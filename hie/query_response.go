@@ -0,0 +1,270 @@
+package hie
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FieldError describes a problem with one field in a query response
+type FieldError struct {
+	// Field is the path to the field, e.g. "result[2].creationTime"
+	Field   string
+	Problem string
+}
+
+func (e FieldError) Error() string {
+	if e.Field == "" {
+		return e.Problem
+	}
+	return e.Field + " " + e.Problem
+}
+
+// ValidationError lists the problems found in a query response
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	problems := make([]string, len(e))
+	for i := range e {
+		problems[i] = e[i].Error()
+	}
+	return "Invalid query response: " + strings.Join(problems, "; ")
+}
+
+// EntryError describes a query response entry that was skipped because it was invalid
+type EntryError struct {
+	// Index is the entry's position in the response's result list
+	Index int
+	// DocumentID is the entry's document ID, if it had a valid one
+	DocumentID string
+	Errors     []FieldError
+}
+
+func (e EntryError) Error() string {
+	problems := make([]string, len(e.Errors))
+	for i := range e.Errors {
+		problems[i] = e.Errors[i].Error()
+	}
+	id := ""
+	if e.DocumentID != "" {
+		id = " (document " + e.DocumentID + ")"
+	}
+	return fmt.Sprintf("Invalid entry %d%s: %s", e.Index, id, strings.Join(problems, "; "))
+}
+
+// DecodeQueryResponse reads a query response from the HIE, validating every field rather than
+// trusting the HIE to send the types we expect.  Normally, entries with invalid fields are skipped
+// and listed in the response's Invalid field; only problems with the response as a whole (or with
+// the query details that the data copier depends on) result in an error.  In strict mode, any
+// violation (including unexpected fields) results in a ValidationError listing all of them.
+// Dates are parsed using the default HIE protocol.
+func DecodeQueryResponse(r io.Reader, strict bool) (*QueryResponse, error) {
+	return DefaultProtocol().DecodeQueryResponse(r, strict)
+}
+
+func decodeQueryResponse(data []byte, p *Protocol, strict bool) (*QueryResponse, error) {
+	fr := newFieldReader("", data, strict)
+	qr := new(QueryResponse)
+	qr.Status = fr.bool("status", true)
+	qr.Error = fr.string("error", false)
+	known := []string{"status", "result", "error", "query"}
+	if p.NextPageField != "" {
+		qr.NextPage = fr.string(p.NextPageField, false)
+		known = append(known, p.NextPageField)
+	}
+	fr.unexpected(known...)
+
+	if raw, ok := fr.field("query", qr.Status); ok {
+		var qErrs []FieldError
+		qr.Query, qErrs = decodeQueryRequest("query", raw, p, strict)
+		// The details of failed queries don't matter, unless we're validating everything
+		if qr.Status || strict {
+			fr.errs = append(fr.errs, qErrs...)
+		}
+	}
+
+	if raw, ok := fr.field("result", false); ok {
+		var entries []json.RawMessage
+		if err := json.Unmarshal(raw, &entries); err != nil {
+			fr.fail("result", "must be an array")
+		}
+		for i := range entries {
+			entry, eErrs := decodeQueryResponseEntry(fmt.Sprintf("result[%d]", i), entries[i], p, strict)
+			if len(eErrs) == 0 {
+				qr.Result = append(qr.Result, entry)
+			} else if strict {
+				fr.errs = append(fr.errs, eErrs...)
+			} else {
+				qr.Invalid = append(qr.Invalid, EntryError{Index: i, DocumentID: entry.DocumentID, Errors: eErrs})
+			}
+		}
+	}
+
+	if len(fr.errs) > 0 {
+		return nil, ValidationError(fr.errs)
+	}
+	return qr, nil
+}
+
+func decodeQueryResponseEntry(path string, data []byte, p *Protocol, strict bool) (QueryResponseEntry, []FieldError) {
+	fr := newFieldReader(path, data, strict)
+	var q QueryResponseEntry
+	q.RetrieveURL = fr.string("retrieveURL", true)
+	q.Title = fr.string("title", false)
+	q.DocumentType = fr.string("documentType", true)
+	q.DocumentID = fr.string("documentID", true)
+	q.Hash = fr.string("hash", false)
+	if strict && q.Hash != "" {
+		if h, err := hex.DecodeString(q.Hash); err != nil || len(h) != 20 {
+			fr.fail("hash", "must be a hex-encoded SHA-1 hash")
+		}
+	}
+	q.Size = fr.int("size", false)
+	q.CreationTime = fr.time("creationTime", true, func(s string) (time.Time, error) {
+		return time.ParseInLocation(p.CreationTimeLayout, s, p.Zone())
+	})
+	fr.unexpected("retrieveURL", "creationTime", "title", "documentType", "documentID", "hash", "size")
+	return q, fr.errs
+}
+
+func decodeQueryRequest(path string, data []byte, p *Protocol, strict bool) (QueryRequest, []FieldError) {
+	fr := newFieldReader(path, data, strict)
+	var q QueryRequest
+	q.Env = fr.string("env", false)
+	q.Host = fr.string("host", false)
+	q.EE = fr.string("ee", true)
+	q.StartDateTime = fr.time("startDateTime", false, func(s string) (time.Time, error) {
+		return time.ParseInLocation(p.QueryDateLayout, s, p.Zone())
+	})
+	q.EndDateTime = fr.time("endDateTime", true, func(s string) (time.Time, error) {
+		return time.ParseInLocation(p.QueryDateLayout, s, p.Zone())
+	})
+	q.QueryStartDateTime = fr.time("queryStartDateTime", false, func(s string) (time.Time, error) {
+		return lenientParse("2006-01-02T15:04:05.000000000Z", s)
+	})
+	q.QueryCompleteDateTime = fr.time("queryCompleteDateTime", false, func(s string) (time.Time, error) {
+		return lenientParse("2006-01-02T15:04:05.000000000Z", s)
+	})
+	fr.unexpected("env", "host", "ee", "startDateTime", "endDateTime", "queryStartDateTime", "queryCompleteDateTime")
+	return q, fr.errs
+}
+
+// fieldReader reads the fields of a JSON object, collecting a FieldError for each missing or
+// invalid field rather than failing on the first one
+type fieldReader struct {
+	path   string
+	fields map[string]json.RawMessage
+	strict bool
+	errs   []FieldError
+}
+
+func newFieldReader(path string, data []byte, strict bool) *fieldReader {
+	fr := &fieldReader{path: path, strict: strict}
+	if err := json.Unmarshal(data, &fr.fields); err != nil || fr.fields == nil {
+		fr.errs = append(fr.errs, FieldError{Field: path, Problem: "must be an object"})
+	}
+	return fr
+}
+
+func (fr *fieldReader) fail(name, problem string) {
+	field := name
+	if fr.path != "" {
+		field = fr.path + "." + name
+	}
+	fr.errs = append(fr.errs, FieldError{Field: field, Problem: problem})
+}
+
+// field returns the raw value of a field, or false if it is missing or null
+func (fr *fieldReader) field(name string, required bool) (json.RawMessage, bool) {
+	raw, ok := fr.fields[name]
+	if !ok || string(raw) == "null" {
+		if required && fr.fields != nil {
+			fr.fail(name, "is required")
+		}
+		return nil, false
+	}
+	return raw, true
+}
+
+func (fr *fieldReader) string(name string, required bool) string {
+	raw, ok := fr.field(name, required)
+	if !ok {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		fr.fail(name, "must be a string")
+	} else if required && s == "" {
+		fr.fail(name, "must not be empty")
+	}
+	return s
+}
+
+func (fr *fieldReader) bool(name string, required bool) bool {
+	raw, ok := fr.field(name, required)
+	if !ok {
+		return false
+	}
+	var b bool
+	if err := json.Unmarshal(raw, &b); err != nil {
+		fr.fail(name, "must be true or false")
+	}
+	return b
+}
+
+func (fr *fieldReader) int(name string, required bool) int {
+	raw, ok := fr.field(name, required)
+	if !ok {
+		return 0
+	}
+	var f float64
+	if err := json.Unmarshal(raw, &f); err != nil || f < 0 || f != math.Trunc(f) || f > math.MaxInt32 {
+		fr.fail(name, "must be a non-negative integer")
+		return 0
+	}
+	return int(f)
+}
+
+func (fr *fieldReader) time(name string, required bool, parse func(string) (time.Time, error)) time.Time {
+	s := fr.string(name, required)
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := parse(s)
+	if err != nil {
+		fr.fail(name, fmt.Sprintf("has an invalid date/time: %q", s))
+	}
+	return t
+}
+
+// unexpected reports fields other than the known ones, but only in strict mode
+func (fr *fieldReader) unexpected(known ...string) {
+	if !fr.strict {
+		return
+	}
+	var names []string
+	for name := range fr.fields {
+		names = append(names, name)
+	}
+	// Report them in a consistent order
+	sort.Strings(names)
+	for _, name := range names {
+		if !containsString(known, name) {
+			fr.fail(name, "is not an expected field")
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
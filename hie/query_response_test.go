@@ -0,0 +1,157 @@
+package hie
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestQueryResponseSuite(t *testing.T) {
+	suite.Run(t, new(QueryResponseSuite))
+}
+
+type QueryResponseSuite struct {
+	suite.Suite
+	Malformed *os.File
+}
+
+func (suite *QueryResponseSuite) SetupTest() {
+	require := suite.Require()
+
+	f, err := os.Open("../fixtures/response_malformed.json")
+	require.NoError(err)
+	suite.Malformed = f
+}
+
+func (suite *QueryResponseSuite) TearDownTest() {
+	if suite.Malformed != nil {
+		suite.Malformed.Close()
+	}
+}
+
+func (suite *QueryResponseSuite) TestSkipsMalformedEntries() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	qr, err := DecodeQueryResponse(suite.Malformed, false)
+	require.NoError(err)
+	assert.True(qr.Status)
+	assert.Equal("123456789", qr.Query.EE)
+	assert.Equal(time.Date(2016, 6, 8, 23, 59, 59, 0, time.Local), qr.Query.EndDateTime)
+
+	// Hash format and unexpected fields are only checked in strict mode
+	require.Len(qr.Result, 2)
+	assert.Equal("1.1.1.1.1.1", qr.Result[0].DocumentID)
+	assert.Equal("1.1.1.1.1.5", qr.Result[1].DocumentID)
+	assert.Equal("", qr.Result[1].Title)
+
+	require.Len(qr.Invalid, 3)
+	assert.Equal(EntryError{
+		Index:      1,
+		DocumentID: "1.1.1.1.1.2",
+		Errors: []FieldError{
+			{Field: "result[1].retrieveURL", Problem: "is required"},
+			{Field: "result[1].size", Problem: "must be a non-negative integer"},
+		},
+	}, qr.Invalid[0])
+	assert.Equal(EntryError{
+		Index: 2,
+		Errors: []FieldError{
+			{Field: "result[2].documentID", Problem: "is required"},
+			{Field: "result[2].creationTime", Problem: "has an invalid date/time: \"2013-12-09\""},
+		},
+	}, qr.Invalid[1])
+	assert.Equal(EntryError{
+		Index:  3,
+		Errors: []FieldError{{Field: "result[3]", Problem: "must be an object"}},
+	}, qr.Invalid[2])
+	assert.Equal("Invalid entry 1 (document 1.1.1.1.1.2): result[1].retrieveURL is required; result[1].size must be a non-negative integer", qr.Invalid[0].Error())
+}
+
+func (suite *QueryResponseSuite) TestStrictReportsEveryViolation() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	qr, err := DecodeQueryResponse(suite.Malformed, true)
+	assert.Nil(qr)
+	require.Error(err)
+	vErr, ok := err.(ValidationError)
+	require.True(ok)
+	assert.Equal(ValidationError{
+		{Field: "result[1].retrieveURL", Problem: "is required"},
+		{Field: "result[1].size", Problem: "must be a non-negative integer"},
+		{Field: "result[2].documentID", Problem: "is required"},
+		{Field: "result[2].creationTime", Problem: "has an invalid date/time: \"2013-12-09\""},
+		{Field: "result[3]", Problem: "must be an object"},
+		{Field: "result[4].hash", Problem: "must be a hex-encoded SHA-1 hash"},
+		{Field: "result[4].mimeType", Problem: "is not an expected field"},
+	}, vErr)
+}
+
+func (suite *QueryResponseSuite) TestValidResponseInStrictMode() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	f, err := os.Open("../fixtures/response_success.json")
+	require.NoError(err)
+	defer f.Close()
+	qr, err := DecodeQueryResponse(f, true)
+	require.NoError(err)
+	assert.Len(qr.Result, 3)
+	assert.Empty(qr.Invalid)
+}
+
+func (suite *QueryResponseSuite) TestInvalidQueryDetails() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// A successful response must say which EE and end date it covers
+	_, err := DecodeQueryResponse(strings.NewReader(`{"status": true, "result": [], "query": {"ee": 123}}`), false)
+	require.Error(err)
+	assert.Equal("Invalid query response: query.ee must be a string; query.endDateTime is required", err.Error())
+
+	_, err = DecodeQueryResponse(strings.NewReader(`{"status": true, "result": []}`), false)
+	require.Error(err)
+	assert.Equal("Invalid query response: query is required", err.Error())
+
+	// But a failed one only needs to say what went wrong
+	qr, err := DecodeQueryResponse(strings.NewReader(`{"status": false, "error": "invalid ee", "query": {"ee": null}}`), false)
+	require.NoError(err)
+	assert.False(qr.Status)
+	assert.Equal("invalid ee", qr.Error)
+}
+
+func (suite *QueryResponseSuite) TestInvalidResponse() {
+	assert := suite.Assert()
+
+	_, err := DecodeQueryResponse(strings.NewReader(`[]`), false)
+	assert.EqualError(err, "Invalid query response: must be an object")
+
+	_, err = DecodeQueryResponse(strings.NewReader(`{"status": "yes", "result": {}}`), false)
+	assert.EqualError(err, "Invalid query response: status must be true or false; result must be an array")
+
+	_, err = DecodeQueryResponse(strings.NewReader(`{"status": tru`), false)
+	assert.Error(err)
+}
+
+func (suite *QueryResponseSuite) TestUnmarshalDoesNotPanic() {
+	assert := suite.Assert()
+
+	var entry QueryResponseEntry
+	err := json.Unmarshal([]byte(`{"retrieveURL": null, "documentID": 5, "size": -1}`), &entry)
+	assert.Error(err)
+
+	var r QueryResponse
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(suite.Malformed)
+	assert.NoError(json.Unmarshal(buf.Bytes(), &r))
+	assert.Len(r.Result, 2)
+	assert.Len(r.Invalid, 3)
+}
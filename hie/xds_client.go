@@ -0,0 +1,538 @@
+package hie
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/intervention-engine/integrator/transport"
+)
+
+// IHE and ebXML identifiers used by the ITI-18 and ITI-43 transactions
+const (
+	xdsFindDocumentsQueryID      = "urn:uuid:14d4debf-8f97-4251-9a74-a90016b0af0d"
+	xdsFormatCodeScheme          = "urn:uuid:a09d5840-386c-46f2-b5ad-9c3699a4309d"
+	xdsUniqueIDScheme            = "urn:uuid:2e82c1f6-a085-4c72-9da3-8640a32e42ab"
+	xdsApprovedStatus            = "urn:oasis:names:tc:ebxml-regrep:StatusType:Approved"
+	xdsSuccessStatus             = "urn:oasis:names:tc:ebxml-regrep:ResponseStatusType:Success"
+	xdsPartialSuccessStatus      = "urn:ihe:iti:2007:ResponseStatusType:PartialSuccess"
+	xdsRegistryStoredQueryAction = "urn:ihe:iti:2007:RegistryStoredQuery"
+	xdsRetrieveDocumentSetAction = "urn:ihe:iti:2007:RetrieveDocumentSet"
+	xdsTimeFormat                = "20060102150405"
+)
+
+// XdsClient is a Client for HIEs that speak IHE XDS.b.  Documents are found using the ITI-18
+// FindDocuments stored query against the document registry and downloaded using ITI-43 Retrieve
+// Document Set against the document repository.  Note that the FindDocuments query filters on the
+// document's creationTime, so the start and end times passed to QueryRecords are creation times.
+type XdsClient struct {
+	RegistryURL        string
+	RepositoryURL      string
+	AssigningAuthority string
+	HomeCommunityID    string
+	Auth               transport.Authenticator
+	Client             *http.Client
+	Retry              *transport.RetryPolicy
+	// Lookback moves the start of each query's creationTime range back, so that documents
+	// registered after the last query but created before it are still found (default: none)
+	Lookback time.Duration
+}
+
+// NewXdsClient creates an XDS.b client.  The assigning authority is the OID of the patient
+// identifier domain that EE numbers belong to.  If the repository URL is empty, the registry URL is
+// used for retrievals as well (as is common for combined registry/repository actors).
+func NewXdsClient(registryURL, repositoryURL, assigningAuthority string) *XdsClient {
+	if repositoryURL == "" {
+		repositoryURL = registryURL
+	}
+	return &XdsClient{
+		RegistryURL:        registryURL,
+		RepositoryURL:      repositoryURL,
+		AssigningAuthority: assigningAuthority,
+	}
+}
+
+func NewBasicAuthXdsClient(registryURL, repositoryURL, assigningAuthority, user, password string) *XdsClient {
+	c := NewXdsClient(registryURL, repositoryURL, assigningAuthority)
+	c.Auth = transport.NewBasicAuthenticator(user, password)
+	return c
+}
+
+// PatientID returns the XDS patient ID (in CX format) for the given EE number
+func (c *XdsClient) PatientID(mrn string) string {
+	return fmt.Sprintf("%s^^^&%s&ISO", mrn, c.AssigningAuthority)
+}
+
+func (c *XdsClient) QueryRecords(ctx context.Context, mrn string, start *time.Time, end *time.Time) (*QueryResponse, error) {
+	qStart := time.Now()
+	params := xdsQueryParams{
+		soapHeaderParams: newSoapHeaderParams(xdsRegistryStoredQueryAction, c.RegistryURL),
+		PatientID:        c.PatientID(mrn),
+	}
+	if start != nil {
+		params.CreationTimeFrom = start.Add(-c.Lookback).UTC().Format(xdsTimeFormat)
+	}
+	if end != nil {
+		params.CreationTimeTo = end.UTC().Format(xdsTimeFormat)
+	}
+	body := new(bytes.Buffer)
+	if err := xdsQueryTemplate.Execute(body, params); err != nil {
+		return nil, err
+	}
+
+	contentType := fmt.Sprintf("application/soap+xml; charset=UTF-8; action=\"%s\"", xdsRegistryStoredQueryAction)
+	envelope, _, err := c.post(ctx, c.RegistryURL, xdsRegistryStoredQueryAction, contentType, body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	env := new(xdsQueryEnvelope)
+	if err := xml.Unmarshal(envelope, env); err != nil {
+		return nil, err
+	}
+	if env.Body.Fault != nil {
+		return nil, env.Body.Fault
+	}
+
+	qr := &QueryResponse{
+		Query: QueryRequest{
+			EE:                    mrn,
+			QueryStartDateTime:    qStart.UTC(),
+			QueryCompleteDateTime: time.Now().UTC(),
+		},
+	}
+	if u, err := url.Parse(c.RegistryURL); err == nil {
+		qr.Query.Host = u.Host
+	}
+	if start != nil {
+		qr.Query.StartDateTime = *start
+	}
+	if end != nil {
+		qr.Query.EndDateTime = *end
+	} else {
+		qr.Query.EndDateTime = qStart
+	}
+
+	aqr := env.Body.AdhocQueryResponse
+	qr.Error = registryErrorMessage(aqr.Errors)
+	if aqr.Status != xdsSuccessStatus && aqr.Status != xdsPartialSuccessStatus {
+		if qr.Error == "" {
+			qr.Error = "Registry query failed with status " + aqr.Status
+		}
+		return qr, nil
+	}
+	qr.Status = true
+
+	repository, err := url.Parse(c.RepositoryURL)
+	if err != nil {
+		return nil, err
+	}
+	// Malformed entries are left out of the result, so they don't block the patient's other documents
+	for i, eo := range aqr.ExtrinsicObjects {
+		entry, errs := c.toQueryResponseEntry(eo, *repository)
+		if len(errs) > 0 {
+			qr.Invalid = append(qr.Invalid, EntryError{Index: i, DocumentID: entry.DocumentID, Errors: errs})
+			continue
+		}
+		qr.Result = append(qr.Result, entry)
+	}
+	return qr, nil
+}
+
+// toQueryResponseEntry converts a document entry from the registry, returning the problems with
+// any of its fields
+func (c *XdsClient) toQueryResponseEntry(eo xdsExtrinsicObject, u url.URL) (QueryResponseEntry, []FieldError) {
+	var errs []FieldError
+	entry := QueryResponseEntry{
+		Title: eo.Name.Value,
+		Hash:  strings.ToUpper(eo.slotValue("hash")),
+	}
+	for _, ei := range eo.ExternalIdentifiers {
+		if ei.IdentificationScheme == xdsUniqueIDScheme {
+			entry.DocumentID = ei.Value
+		}
+	}
+	if entry.DocumentID == "" {
+		errs = append(errs, FieldError{Field: "uniqueId", Problem: "is required"})
+	}
+	for _, cl := range eo.Classifications {
+		if cl.ClassificationScheme == xdsFormatCodeScheme {
+			entry.DocumentType = cl.NodeRepresentation
+		}
+	}
+	if size := eo.slotValue("size"); size != "" {
+		var err error
+		if entry.Size, err = strconv.Atoi(size); err != nil || entry.Size < 0 {
+			errs = append(errs, FieldError{Field: "size", Problem: "must be a non-negative integer"})
+		}
+	}
+	if ct := eo.slotValue("creationTime"); ct != "" {
+		var err error
+		if entry.CreationTime, err = parseXdsTime(ct); err != nil {
+			errs = append(errs, FieldError{Field: "creationTime", Problem: fmt.Sprintf("has an invalid date/time: %q", ct)})
+		}
+	}
+
+	// The retrieve URL tells DownloadRecord which repository endpoint to call and what to ask it for
+	q := u.Query()
+	q.Set("repositoryUniqueId", eo.slotValue("repositoryUniqueId"))
+	q.Set("documentUniqueId", entry.DocumentID)
+	if c.HomeCommunityID != "" {
+		q.Set("homeCommunityId", c.HomeCommunityID)
+	}
+	u.RawQuery = q.Encode()
+	entry.RetrieveURL = u.String()
+	return entry, errs
+}
+
+// DownloadRecord retrieves a document using ITI-43.  The URL must be a retrieve URL as produced
+// by QueryRecords: the repository endpoint with repositoryUniqueId and documentUniqueId parameters.
+func (c *XdsClient) DownloadRecord(ctx context.Context, retrieveURL string) (content io.ReadCloser, contentType string, err error) {
+	u, err := url.Parse(retrieveURL)
+	if err != nil {
+		return nil, "", err
+	}
+	q := u.Query()
+	params := xdsRetrieveParams{
+		RepositoryUniqueID: q.Get("repositoryUniqueId"),
+		DocumentUniqueID:   q.Get("documentUniqueId"),
+		HomeCommunityID:    q.Get("homeCommunityId"),
+	}
+	if params.DocumentUniqueID == "" {
+		return nil, "", fmt.Errorf("Retrieve URL does not identify a document: %s", retrieveURL)
+	}
+	q.Del("repositoryUniqueId")
+	q.Del("documentUniqueId")
+	q.Del("homeCommunityId")
+	u.RawQuery = q.Encode()
+	endpoint := u.String()
+	params.soapHeaderParams = newSoapHeaderParams(xdsRetrieveDocumentSetAction, endpoint)
+
+	body := new(bytes.Buffer)
+	if err := xdsRetrieveTemplate.Execute(body, params); err != nil {
+		return nil, "", err
+	}
+	// ITI-43 requests must be sent as MTOM/XOP, even though they have no attachments
+	contentType, request := xopRequest(xdsRetrieveDocumentSetAction, body.Bytes())
+	envelope, attachments, err := c.post(ctx, endpoint, xdsRetrieveDocumentSetAction, contentType, request)
+	if err != nil {
+		return nil, "", err
+	}
+	env := new(xdsRetrieveEnvelope)
+	if err := xml.Unmarshal(envelope, env); err != nil {
+		return nil, "", err
+	}
+	if env.Body.Fault != nil {
+		return nil, "", env.Body.Fault
+	}
+
+	rdsr := env.Body.RetrieveDocumentSetResponse
+	for _, dr := range rdsr.DocumentResponses {
+		if dr.DocumentUniqueID != params.DocumentUniqueID {
+			continue
+		}
+		var data []byte
+		if href := dr.Document.Include.Href; href != "" {
+			cid, _ := url.QueryUnescape(strings.TrimPrefix(href, "cid:"))
+			var ok bool
+			if data, ok = attachments[cid]; !ok {
+				return nil, "", fmt.Errorf("Repository response references missing attachment %s", href)
+			}
+		} else if data, err = base64.StdEncoding.DecodeString(strings.TrimSpace(dr.Document.Data)); err != nil {
+			return nil, "", err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), dr.MimeType, nil
+	}
+
+	if msg := registryErrorMessage(rdsr.RegistryResponse.Errors); msg != "" {
+		return nil, "", errors.New(msg)
+	}
+	return nil, "", fmt.Errorf("Repository did not return document %s (status: %s)", params.DocumentUniqueID, rdsr.RegistryResponse.Status)
+}
+
+// post sends a SOAP 1.2 request with the given content type and returns the SOAP envelope from the
+// response along with any MTOM/XOP attachments (keyed by Content-ID).  Both the stored query and the
+// retrieve are read-only, so they are safe to retry.
+func (c *XdsClient) post(ctx context.Context, endpoint, action, contentType string, body []byte) (envelope []byte, attachments map[string][]byte, err error) {
+	resp, err := c.Retry.Do(ctx, action+" to "+endpoint, true, func() (*http.Response, error) {
+		return transport.DoAuthenticated(ctx, c.Client, c.Auth, func() (*http.Request, error) {
+			req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", contentType)
+			return req, nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	envelope, attachments, err = readSoapResponse(resp)
+	// SOAP faults are returned with a 500, so only complain about the status if there's no envelope
+	if resp.StatusCode != http.StatusOK && (err != nil || !bytes.Contains(envelope, []byte("Envelope"))) {
+		return nil, nil, transport.NewStatusError(resp.StatusCode, "Non-OK response from source server: %d (%s)", resp.StatusCode, resp.Status)
+	}
+	return envelope, attachments, err
+}
+
+// xopRequest packages a SOAP 1.2 envelope as the root part of an MTOM/XOP multipart/related
+// request, returning the request's content type and body
+func xopRequest(action string, envelope []byte) (string, []byte) {
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	start := "<" + newUUID() + "@integrator>"
+	root, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {fmt.Sprintf("application/xop+xml; charset=UTF-8; type=\"application/soap+xml\"; action=\"%s\"", action)},
+		"Content-Transfer-Encoding": {"binary"},
+		"Content-Id":                {start},
+	})
+	root.Write(envelope)
+	mw.Close()
+
+	contentType := mime.FormatMediaType("multipart/related", map[string]string{
+		"boundary":   mw.Boundary(),
+		"type":       "application/xop+xml",
+		"start":      start,
+		"start-info": "application/soap+xml",
+		"action":     action,
+	})
+	return contentType, body.Bytes()
+}
+
+// readSoapResponse reads a plain SOAP response or an MTOM/XOP multipart/related response
+func readSoapResponse(resp *http.Response) (envelope []byte, attachments map[string][]byte, err error) {
+	attachments = make(map[string][]byte)
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		envelope, err = ioutil.ReadAll(resp.Body)
+		return envelope, attachments, err
+	}
+
+	start := strings.Trim(params["start"], "<>")
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		cid := strings.Trim(part.Header.Get("Content-ID"), "<>")
+		if envelope == nil && (cid == start || start == "") {
+			envelope = data
+		} else {
+			attachments[cid] = data
+		}
+	}
+	if envelope == nil {
+		return nil, nil, errors.New("MTOM response did not contain a SOAP envelope")
+	}
+	return envelope, attachments, nil
+}
+
+func registryErrorMessage(errs []xdsRegistryError) string {
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msg := e.CodeContext
+		if msg == "" {
+			msg = e.ErrorCode
+		}
+		msgs = append(msgs, msg)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// parseXdsTime parses an HL7 DTM in UTC, which may be truncated to any precision down to the year
+func parseXdsTime(dtm string) (time.Time, error) {
+	if len(dtm) > len(xdsTimeFormat) || len(dtm) < 4 {
+		return time.Time{}, fmt.Errorf("invalid XDS time: %s", dtm)
+	}
+	return time.Parse(xdsTimeFormat[:len(dtm)], dtm)
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+type soapFault struct {
+	Code   string `xml:"Code>Value"`
+	Reason string `xml:"Reason>Text"`
+}
+
+func (f *soapFault) Error() string {
+	return fmt.Sprintf("SOAP fault (%s): %s", f.Code, f.Reason)
+}
+
+type xdsRegistryError struct {
+	ErrorCode   string `xml:"errorCode,attr"`
+	CodeContext string `xml:"codeContext,attr"`
+	Severity    string `xml:"severity,attr"`
+}
+
+type xdsSlot struct {
+	Name   string   `xml:"name,attr"`
+	Values []string `xml:"ValueList>Value"`
+}
+
+type xdsExtrinsicObject struct {
+	ID       string    `xml:"id,attr"`
+	MimeType string    `xml:"mimeType,attr"`
+	Slots    []xdsSlot `xml:"Slot"`
+	Name     struct {
+		Value string `xml:"value,attr"`
+	} `xml:"Name>LocalizedString"`
+	Classifications []struct {
+		ClassificationScheme string `xml:"classificationScheme,attr"`
+		NodeRepresentation   string `xml:"nodeRepresentation,attr"`
+	} `xml:"Classification"`
+	ExternalIdentifiers []struct {
+		IdentificationScheme string `xml:"identificationScheme,attr"`
+		Value                string `xml:"value,attr"`
+	} `xml:"ExternalIdentifier"`
+}
+
+func (eo *xdsExtrinsicObject) slotValue(name string) string {
+	for _, s := range eo.Slots {
+		if s.Name == name && len(s.Values) > 0 {
+			return strings.TrimSpace(s.Values[0])
+		}
+	}
+	return ""
+}
+
+type xdsQueryEnvelope struct {
+	Body struct {
+		Fault              *soapFault `xml:"Fault"`
+		AdhocQueryResponse struct {
+			Status           string               `xml:"status,attr"`
+			Errors           []xdsRegistryError   `xml:"RegistryErrorList>RegistryError"`
+			ExtrinsicObjects []xdsExtrinsicObject `xml:"RegistryObjectList>ExtrinsicObject"`
+		} `xml:"AdhocQueryResponse"`
+	} `xml:"Body"`
+}
+
+type xdsRetrieveEnvelope struct {
+	Body struct {
+		Fault                       *soapFault `xml:"Fault"`
+		RetrieveDocumentSetResponse struct {
+			RegistryResponse struct {
+				Status string             `xml:"status,attr"`
+				Errors []xdsRegistryError `xml:"RegistryErrorList>RegistryError"`
+			} `xml:"RegistryResponse"`
+			DocumentResponses []struct {
+				RepositoryUniqueID string `xml:"RepositoryUniqueId"`
+				DocumentUniqueID   string `xml:"DocumentUniqueId"`
+				MimeType           string `xml:"mimeType"`
+				Document           struct {
+					Include struct {
+						Href string `xml:"href,attr"`
+					} `xml:"Include"`
+					Data string `xml:",chardata"`
+				} `xml:"Document"`
+			} `xml:"DocumentResponse"`
+		} `xml:"RetrieveDocumentSetResponse"`
+	} `xml:"Body"`
+}
+
+type soapHeaderParams struct {
+	Action    string
+	MessageID string
+	Endpoint  string
+}
+
+func newSoapHeaderParams(action, to string) soapHeaderParams {
+	return soapHeaderParams{
+		Action:    action,
+		MessageID: "urn:uuid:" + newUUID(),
+		Endpoint:  to,
+	}
+}
+
+type xdsQueryParams struct {
+	soapHeaderParams
+	PatientID        string
+	CreationTimeFrom string
+	CreationTimeTo   string
+}
+
+type xdsRetrieveParams struct {
+	soapHeaderParams
+	RepositoryUniqueID string
+	DocumentUniqueID   string
+	HomeCommunityID    string
+}
+
+func xmlEscape(s string) string {
+	buf := new(bytes.Buffer)
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+const soapHeaderTemplate = `<soap:Header>
+    <wsa:Action soap:mustUnderstand="1">{{.Action}}</wsa:Action>
+    <wsa:MessageID>{{.MessageID}}</wsa:MessageID>
+    <wsa:ReplyTo><wsa:Address>http://www.w3.org/2005/08/addressing/anonymous</wsa:Address></wsa:ReplyTo>
+    <wsa:To soap:mustUnderstand="1">{{xml .Endpoint}}</wsa:To>
+  </soap:Header>`
+
+var xdsQueryTemplate = template.Must(template.New("query").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://www.w3.org/2005/08/addressing">
+  ` + soapHeaderTemplate + `
+  <soap:Body>
+    <query:AdhocQueryRequest xmlns:query="urn:oasis:names:tc:ebxml-regrep:xsd:query:3.0" xmlns:rim="urn:oasis:names:tc:ebxml-regrep:xsd:rim:3.0">
+      <query:ResponseOption returnComposedObjects="true" returnType="LeafClass"/>
+      <rim:AdhocQuery id="` + xdsFindDocumentsQueryID + `">
+        <rim:Slot name="$XDSDocumentEntryPatientId"><rim:ValueList><rim:Value>'{{xml .PatientID}}'</rim:Value></rim:ValueList></rim:Slot>
+        <rim:Slot name="$XDSDocumentEntryStatus"><rim:ValueList><rim:Value>('` + xdsApprovedStatus + `')</rim:Value></rim:ValueList></rim:Slot>
+        {{- if .CreationTimeFrom}}
+        <rim:Slot name="$XDSDocumentEntryCreationTimeFrom"><rim:ValueList><rim:Value>{{.CreationTimeFrom}}</rim:Value></rim:ValueList></rim:Slot>
+        {{- end}}
+        {{- if .CreationTimeTo}}
+        <rim:Slot name="$XDSDocumentEntryCreationTimeTo"><rim:ValueList><rim:Value>{{.CreationTimeTo}}</rim:Value></rim:ValueList></rim:Slot>
+        {{- end}}
+      </rim:AdhocQuery>
+    </query:AdhocQueryRequest>
+  </soap:Body>
+</soap:Envelope>
+`))
+
+var xdsRetrieveTemplate = template.Must(template.New("retrieve").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://www.w3.org/2005/08/addressing">
+  ` + soapHeaderTemplate + `
+  <soap:Body>
+    <xdsb:RetrieveDocumentSetRequest xmlns:xdsb="urn:ihe:iti:xds-b:2007">
+      <xdsb:DocumentRequest>
+        {{- if .HomeCommunityID}}
+        <xdsb:HomeCommunityId>{{xml .HomeCommunityID}}</xdsb:HomeCommunityId>
+        {{- end}}
+        <xdsb:RepositoryUniqueId>{{xml .RepositoryUniqueID}}</xdsb:RepositoryUniqueId>
+        <xdsb:DocumentUniqueId>{{xml .DocumentUniqueID}}</xdsb:DocumentUniqueId>
+      </xdsb:DocumentRequest>
+    </xdsb:RetrieveDocumentSetRequest>
+  </soap:Body>
+</soap:Envelope>
+`))
@@ -0,0 +1,309 @@
+package hie
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestXdsClientSuite(t *testing.T) {
+	suite.Run(t, new(XdsClientSuite))
+}
+
+type XdsClientSuite struct {
+	suite.Suite
+	Client          *XdsClient
+	Server          *httptest.Server
+	LastRequestBody string
+	LastRequestType string
+	RespondFailure  bool
+	RespondInline   bool
+	RespondInvalid  bool
+}
+
+const xdsTestDocument = "<document>\n    <foo>bar</foo>\n</document>"
+
+func (suite *XdsClientSuite) SetupTest() {
+	suite.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		b, _ := ioutil.ReadAll(r.Body)
+		suite.LastRequestBody = string(b)
+		suite.LastRequestType = r.Header.Get("Content-Type")
+
+		switch {
+		case strings.Contains(suite.LastRequestType, xdsRegistryStoredQueryAction):
+			fixture := "../fixtures/xds_query_response.xml"
+			if suite.RespondFailure {
+				fixture = "../fixtures/xds_query_error.xml"
+			} else if suite.RespondInvalid {
+				fixture = "../fixtures/xds_query_invalid.xml"
+			}
+			f, err := os.Open(fixture)
+			suite.Require().NoError(err)
+			defer f.Close()
+			w.Header().Set("Content-Type", "application/soap+xml; charset=UTF-8")
+			io.Copy(w, f)
+		case strings.Contains(suite.LastRequestType, xdsRetrieveDocumentSetAction):
+			if suite.RespondFailure {
+				w.Header().Set("Content-Type", "application/soap+xml; charset=UTF-8")
+				w.WriteHeader(500)
+				fmt.Fprint(w, `<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope"><soap:Body><soap:Fault><soap:Code><soap:Value>soap:Receiver</soap:Value></soap:Code><soap:Reason><soap:Text xml:lang="en">Repository unavailable</soap:Text></soap:Reason></soap:Fault></soap:Body></soap:Envelope>`)
+				return
+			}
+			if suite.RespondInline {
+				w.Header().Set("Content-Type", "application/soap+xml; charset=UTF-8")
+				fmt.Fprint(w, xdsRetrieveResponse(`<xdsb:Document>`+base64.StdEncoding.EncodeToString([]byte(xdsTestDocument))+`</xdsb:Document>`))
+				return
+			}
+			writeMTOMResponse(w, xdsRetrieveResponse(`<xdsb:Document><xop:Include xmlns:xop="http://www.w3.org/2004/08/xop/include" href="cid:1.urn%3Auuid%3Adoc@example.org"/></xdsb:Document>`), "1.urn:uuid:doc@example.org", xdsTestDocument)
+		default:
+			w.WriteHeader(400)
+		}
+	}))
+
+	suite.Client = NewXdsClient(suite.Server.URL+"/registry", suite.Server.URL+"/repository", "1.2.3.4.5")
+}
+
+func (suite *XdsClientSuite) TearDownTest() {
+	if suite.Server != nil {
+		suite.Server.Close()
+	}
+	suite.LastRequestBody = ""
+	suite.LastRequestType = ""
+	suite.RespondFailure = false
+	suite.RespondInline = false
+	suite.RespondInvalid = false
+}
+
+func xdsRetrieveResponse(document string) string {
+	return `<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope"><soap:Body>
+<xdsb:RetrieveDocumentSetResponse xmlns:xdsb="urn:ihe:iti:xds-b:2007" xmlns:rs="urn:oasis:names:tc:ebxml-regrep:xsd:rs:3.0">
+  <rs:RegistryResponse status="urn:oasis:names:tc:ebxml-regrep:ResponseStatusType:Success"/>
+  <xdsb:DocumentResponse>
+    <xdsb:RepositoryUniqueId>1.3.6.1.4.1.21367.2010.1.2.1125</xdsb:RepositoryUniqueId>
+    <xdsb:DocumentUniqueId>1.1.1.1.1.1</xdsb:DocumentUniqueId>
+    <xdsb:mimeType>text/xml</xdsb:mimeType>
+    ` + document + `
+  </xdsb:DocumentResponse>
+</xdsb:RetrieveDocumentSetResponse>
+</soap:Body></soap:Envelope>`
+}
+
+func writeMTOMResponse(w http.ResponseWriter, envelope, cid, document string) {
+	buf := new(bytes.Buffer)
+	mw := multipart.NewWriter(buf)
+	root, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {`application/xop+xml; charset=UTF-8; type="application/soap+xml"`},
+		"Content-Id":   {"<root.message@example.org>"},
+	})
+	io.WriteString(root, envelope)
+	att, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/xml"},
+		"Content-Id":   {"<" + cid + ">"},
+	})
+	io.WriteString(att, document)
+	mw.Close()
+
+	w.Header().Set("Content-Type", fmt.Sprintf(`multipart/related; boundary=%s; type="application/xop+xml"; start="<root.message@example.org>"; start-info="application/soap+xml"`, mw.Boundary()))
+	io.Copy(w, buf)
+}
+
+func (suite *XdsClientSuite) TestQueryRecords() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	start := time.Date(2010, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2016, time.June, 8, 23, 59, 59, 0, time.UTC)
+	resp, err := suite.Client.QueryRecords(context.Background(), "123456789", &start, &end)
+	require.NoError(err)
+
+	assert.Contains(suite.LastRequestType, "application/soap+xml")
+	assert.Contains(suite.LastRequestBody, xdsFindDocumentsQueryID)
+	assert.Contains(suite.LastRequestBody, "<rim:Value>'123456789^^^&amp;1.2.3.4.5&amp;ISO'</rim:Value>")
+	assert.Contains(suite.LastRequestBody, "<rim:Value>20100101000000</rim:Value>")
+	assert.Contains(suite.LastRequestBody, "<rim:Value>20160608235959</rim:Value>")
+
+	require.NotNil(resp)
+	assert.True(resp.Status)
+	assert.Empty(resp.Error)
+	assert.Equal("123456789", resp.Query.EE)
+	assert.Equal(start, resp.Query.StartDateTime)
+	assert.Equal(end, resp.Query.EndDateTime)
+	require.Len(resp.Result, 2)
+
+	retrieveURL, err := url.Parse(resp.Result[0].RetrieveURL)
+	require.NoError(err)
+	assert.Equal("/repository", retrieveURL.Path)
+	assert.Equal("1.3.6.1.4.1.21367.2010.1.2.1125", retrieveURL.Query().Get("repositoryUniqueId"))
+	resp.Result[0].RetrieveURL = ""
+	assert.Equal(QueryResponseEntry{
+		CreationTime: time.Date(2014, 4, 25, 2, 51, 3, 0, time.UTC),
+		Title:        "Test Continuity of Care",
+		DocumentType: "urn:ihe:pcc:xphr:2007",
+		DocumentID:   "1.1.1.1.1.1",
+		Hash:         "4C167E7B7F006A18ABB2E4A1A9B2489936947E91",
+		Size:         28452,
+	}, resp.Result[0])
+
+	// The second entry has a creation time with only minute precision
+	assert.Equal(time.Date(2013, 12, 9, 5, 7, 0, 0, time.UTC), resp.Result[1].CreationTime)
+	assert.Equal("urn:hl7-org:sdwg:ccda-structuredBody:1.1", resp.Result[1].DocumentType)
+	assert.Equal("1.1.1.1.1.3", resp.Result[1].DocumentID)
+}
+
+func (suite *XdsClientSuite) TestQueryRecordsLookback() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// The first document was created on 2014-04-25, but registered after a query that ran the next day
+	suite.Client.Lookback = 7 * 24 * time.Hour
+	start := time.Date(2014, time.April, 26, 0, 0, 0, 0, time.UTC)
+	resp, err := suite.Client.QueryRecords(context.Background(), "123456789", &start, nil)
+	require.NoError(err)
+
+	assert.Contains(suite.LastRequestBody, "<rim:Value>20140419000000</rim:Value>")
+	require.NotNil(resp)
+	assert.Equal(start, resp.Query.StartDateTime)
+	require.Len(resp.Result, 2)
+	assert.Equal("1.1.1.1.1.1", resp.Result[0].DocumentID)
+	assert.True(resp.Result[0].CreationTime.Before(start))
+}
+
+func (suite *XdsClientSuite) TestQueryRecordsNoDates() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	resp, err := suite.Client.QueryRecords(context.Background(), "123456789", nil, nil)
+	require.NoError(err)
+	assert.NotContains(suite.LastRequestBody, "$XDSDocumentEntryCreationTimeFrom")
+	assert.NotContains(suite.LastRequestBody, "$XDSDocumentEntryCreationTimeTo")
+	require.NotNil(resp)
+	assert.False(resp.Query.EndDateTime.IsZero())
+	assert.Len(resp.Result, 2)
+}
+
+func (suite *XdsClientSuite) TestQueryRecordsInvalidEntries() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.RespondInvalid = true
+	resp, err := suite.Client.QueryRecords(context.Background(), "123456789", nil, nil)
+	require.NoError(err)
+	require.NotNil(resp)
+	assert.True(resp.Status)
+
+	// The valid entries are still returned
+	require.Len(resp.Result, 2)
+	assert.Equal("1.1.1.1.1.1", resp.Result[0].DocumentID)
+	assert.Equal("1.1.1.1.1.3", resp.Result[1].DocumentID)
+
+	require.Len(resp.Invalid, 2)
+	assert.Equal(EntryError{
+		Index:      1,
+		DocumentID: "1.1.1.1.1.4",
+		Errors:     []FieldError{{Field: "creationTime", Problem: `has an invalid date/time: "2013-12-09"`}},
+	}, resp.Invalid[0])
+	assert.Equal(EntryError{
+		Index:  3,
+		Errors: []FieldError{{Field: "uniqueId", Problem: "is required"}},
+	}, resp.Invalid[1])
+}
+
+func (suite *XdsClientSuite) TestQueryRecordsRegistryError() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.RespondFailure = true
+	resp, err := suite.Client.QueryRecords(context.Background(), "-123", nil, nil)
+	require.NoError(err)
+	require.NotNil(resp)
+	assert.False(resp.Status)
+	assert.Equal("Unknown patient ID", resp.Error)
+	assert.Empty(resp.Result)
+}
+
+func (suite *XdsClientSuite) TestDownloadRecordMTOM() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	resp, err := suite.Client.QueryRecords(context.Background(), "123456789", nil, nil)
+	require.NoError(err)
+	content, cType, err := suite.Client.DownloadRecord(context.Background(), resp.Result[0].RetrieveURL)
+	require.NoError(err)
+	defer content.Close()
+
+	assert.Contains(suite.LastRequestBody, "<xdsb:RepositoryUniqueId>1.3.6.1.4.1.21367.2010.1.2.1125</xdsb:RepositoryUniqueId>")
+	assert.Contains(suite.LastRequestBody, "<xdsb:DocumentUniqueId>1.1.1.1.1.1</xdsb:DocumentUniqueId>")
+	assert.Contains(suite.LastRequestBody, "<wsa:To soap:mustUnderstand=\"1\">"+suite.Server.URL+"/repository</wsa:To>")
+
+	// The request is sent as MTOM/XOP, with the envelope as the root part
+	mediaType, params, err := mime.ParseMediaType(suite.LastRequestType)
+	require.NoError(err)
+	assert.Equal("multipart/related", mediaType)
+	assert.Equal("application/xop+xml", params["type"])
+	assert.Equal("application/soap+xml", params["start-info"])
+	assert.Equal(xdsRetrieveDocumentSetAction, params["action"])
+	root, err := multipart.NewReader(strings.NewReader(suite.LastRequestBody), params["boundary"]).NextPart()
+	require.NoError(err)
+	assert.Equal(params["start"], root.Header.Get("Content-Id"))
+	assert.Contains(root.Header.Get("Content-Type"), `application/xop+xml; charset=UTF-8; type="application/soap+xml"`)
+	envelope, err := ioutil.ReadAll(root)
+	require.NoError(err)
+	assert.Contains(string(envelope), "<xdsb:RetrieveDocumentSetRequest")
+
+	data, err := ioutil.ReadAll(content)
+	require.NoError(err)
+	assert.Equal(xdsTestDocument, string(data))
+	assert.Equal("text/xml", cType)
+}
+
+func (suite *XdsClientSuite) TestDownloadRecordInline() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.RespondInline = true
+	content, cType, err := suite.Client.DownloadRecord(context.Background(), suite.Server.URL+"/repository?repositoryUniqueId=1.3.6.1.4.1.21367.2010.1.2.1125&documentUniqueId=1.1.1.1.1.1")
+	require.NoError(err)
+	defer content.Close()
+
+	data, err := ioutil.ReadAll(content)
+	require.NoError(err)
+	assert.Equal(xdsTestDocument, string(data))
+	assert.Equal("text/xml", cType)
+}
+
+func (suite *XdsClientSuite) TestDownloadRecordFault() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.RespondFailure = true
+	content, cType, err := suite.Client.DownloadRecord(context.Background(), suite.Server.URL+"/repository?repositoryUniqueId=1.3.6.1.4.1.21367.2010.1.2.1125&documentUniqueId=1.1.1.1.1.1")
+	require.Error(err)
+	assert.Contains(err.Error(), "Repository unavailable")
+	assert.Nil(content)
+	assert.Empty(cType)
+}
+
+func (suite *XdsClientSuite) TestDownloadRecordInvalidURL() {
+	require := suite.Require()
+
+	_, _, err := suite.Client.DownloadRecord(context.Background(), suite.Server.URL+"/repository")
+	require.Error(err)
+}
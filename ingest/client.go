@@ -0,0 +1,87 @@
+// Package ingest provides the client that posts downloaded documents to the ingest endpoint.
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/intervention-engine/integrator/hie"
+	"github.com/intervention-engine/integrator/transport"
+)
+
+type Client interface {
+	Ingest(ctx context.Context, contentType string, reader io.ReadCloser) (*Result, error)
+}
+
+// DocumentClient is implemented by ingest clients that need to know which document they're sent
+// and whose it is, not just its content.  The copier uses IngestDocument for these clients.
+type DocumentClient interface {
+	Client
+	IngestDocument(ctx context.Context, ee string, entry *hie.QueryResponseEntry, contentType string, reader io.ReadCloser) (*Result, error)
+}
+
+// Result describes what the ingest service made of a document, so that each HIE document can be
+// traced to what it created in IE
+type Result struct {
+	// Status is the HTTP status of the ingest service's response
+	Status int `bson:"status" json:"status"`
+	// Location is the URL in the response's Location header, if any
+	Location string `bson:"location,omitempty" json:"location,omitempty"`
+	// Created lists references (e.g., "DocumentReference/123") to the resources that were created
+	Created []string `bson:"created,omitempty" json:"created,omitempty"`
+	// Warnings lists the issues the ingest service reported without rejecting the document
+	Warnings []string `bson:"warnings,omitempty" json:"warnings,omitempty"`
+}
+
+type HttpClient struct {
+	BaseURL string
+	Auth    transport.Authenticator
+	Client  *http.Client
+	Retry   *transport.RetryPolicy
+	// Idempotent indicates that the ingest service safely handles receiving the same document more
+	// than once, so uploads may be retried even if they might have reached the service
+	Idempotent bool
+}
+
+func NewHttpClient(baseURL string) *HttpClient {
+	return &HttpClient{
+		BaseURL: baseURL,
+	}
+}
+
+func NewAuthHttpClient(baseURL string, auth transport.Authenticator) *HttpClient {
+	return &HttpClient{
+		BaseURL: baseURL,
+		Auth:    auth,
+	}
+}
+
+// Ingest posts the document to the ingest service.  The response's Location header and any FHIR
+// resource, Bundle or OperationOutcome in its body are read into the result.
+func (i *HttpClient) Ingest(ctx context.Context, contentType string, reader io.ReadCloser) (*Result, error) {
+	// Buffer the content so it can be sent again if the credentials need to be refreshed or the
+	// upload is retried
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := i.Retry.Do(ctx, "upload to "+i.BaseURL, i.Idempotent, func() (*http.Response, error) {
+		return transport.DoAuthenticated(ctx, i.Client, i.Auth, func() (*http.Request, error) {
+			req, err := http.NewRequest("POST", i.BaseURL, bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", contentType)
+			return req, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return readResult(resp, "post content")
+}
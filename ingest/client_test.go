@@ -0,0 +1,232 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/intervention-engine/integrator/transport"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestIngestClientSuite(t *testing.T) {
+	suite.Run(t, new(IngestClientSuite))
+}
+
+type IngestClientSuite struct {
+	suite.Suite
+	Client              *HttpClient
+	Server              *httptest.Server
+	ReceivedContentType string
+	ReceivedContent     string
+	ReceivedAuth        string
+	Respond500          bool
+	// RespondStatus, RespondLocation and RespondFixture, if set, make up the response
+	RespondStatus   int
+	RespondLocation string
+	RespondFixture  string
+}
+
+func (suite *IngestClientSuite) SetupTest() {
+	suite.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.ReceivedContentType = r.Header.Get("Content-Type")
+		suite.ReceivedAuth = r.Header.Get("Authorization")
+		defer r.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		suite.ReceivedContent = buf.String()
+		if suite.Respond500 {
+			w.WriteHeader(500)
+		}
+		if suite.RespondLocation != "" {
+			w.Header().Set("Location", suite.RespondLocation)
+		}
+		if suite.RespondFixture != "" {
+			w.Header().Set("Content-Type", "application/fhir+json")
+		}
+		if suite.RespondStatus != 0 {
+			w.WriteHeader(suite.RespondStatus)
+		}
+		if suite.RespondFixture != "" {
+			b, err := ioutil.ReadFile(suite.RespondFixture)
+			suite.Require().NoError(err)
+			w.Write(b)
+		}
+	}))
+
+	suite.Client = NewHttpClient(suite.Server.URL)
+}
+
+func (suite *IngestClientSuite) TearDownTest() {
+	if suite.Server != nil {
+		suite.Server.Close()
+	}
+	suite.ReceivedContentType = ""
+	suite.ReceivedContent = ""
+	suite.ReceivedAuth = ""
+	suite.Respond500 = false
+	suite.RespondStatus = 0
+	suite.RespondLocation = ""
+	suite.RespondFixture = ""
+}
+
+func (suite *IngestClientSuite) TestSuccessfulIngest() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	f, err := os.Open("../fixtures/document.xml")
+	require.NoError(err)
+	_, err = suite.Client.Ingest(context.Background(), "text/xml", f)
+	require.NoError(err)
+	assert.Equal("text/xml", suite.ReceivedContentType)
+	assert.Equal("<document>\n    <foo>bar</foo>\n</document>", suite.ReceivedContent)
+}
+
+func (suite *IngestClientSuite) TestErrorIngest() {
+	require := suite.Require()
+
+	suite.Respond500 = true
+	f, err := os.Open("../fixtures/document.xml")
+	require.NoError(err)
+	_, err = suite.Client.Ingest(context.Background(), "text/xml", f)
+	require.Error(err)
+}
+
+func (suite *IngestClientSuite) TestIngestResult() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	f, err := os.Open("../fixtures/document.xml")
+	require.NoError(err)
+	result, err := suite.Client.Ingest(context.Background(), "text/xml", f)
+	require.NoError(err)
+	assert.Equal(&Result{Status: 200}, result)
+
+	suite.RespondStatus = http.StatusCreated
+	suite.RespondLocation = "http://ie.example.org/Patient/p1/_history/1"
+	suite.RespondFixture = "../fixtures/ingest_created_patient.json"
+	f, err = os.Open("../fixtures/document.xml")
+	require.NoError(err)
+	result, err = suite.Client.Ingest(context.Background(), "text/xml", f)
+	require.NoError(err)
+	assert.Equal(&Result{
+		Status:   201,
+		Location: "http://ie.example.org/Patient/p1/_history/1",
+		Created:  []string{"Patient/p1"},
+	}, result)
+
+	suite.RespondStatus = http.StatusAccepted
+	suite.RespondLocation = "/jobs/42"
+	suite.RespondFixture = "../fixtures/ingest_warnings.json"
+	f, err = os.Open("../fixtures/document.xml")
+	require.NoError(err)
+	result, err = suite.Client.Ingest(context.Background(), "text/xml", f)
+	require.NoError(err)
+	assert.Equal(&Result{
+		Status:   202,
+		Location: "/jobs/42",
+		Warnings: []string{"warning: Unrecognized section 1.2.3 was skipped", "information: Medication code not found"},
+	}, result)
+}
+
+func (suite *IngestClientSuite) TestIngestTransactionResponse() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.RespondFixture = "../fixtures/fhir_transaction_response.json"
+	f, err := os.Open("../fixtures/document.xml")
+	require.NoError(err)
+	result, err := suite.Client.Ingest(context.Background(), "text/xml", f)
+	require.NoError(err)
+	assert.Equal([]string{"Binary/b42", "DocumentReference/d42"}, result.Created)
+	assert.Equal([]string{"warning: Attachment hash not verified"}, result.Warnings)
+}
+
+func (suite *IngestClientSuite) TestIngestRejectedWithOperationOutcome() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.RespondStatus = http.StatusBadRequest
+	suite.RespondFixture = "../fixtures/fhir_operation_outcome.json"
+	f, err := os.Open("../fixtures/document.xml")
+	require.NoError(err)
+	_, err = suite.Client.Ingest(context.Background(), "text/xml", f)
+	require.Error(err)
+	assert.Equal("Failed to post content.  Received 400: 400 Bad Request: Resource Binary/missing is not known", err.Error())
+}
+
+func (suite *IngestClientSuite) TestIngestWithAuth() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Client.Auth = transport.NewBasicAuthenticator("joe", "secret")
+	f, err := os.Open("../fixtures/document.xml")
+	require.NoError(err)
+	_, err = suite.Client.Ingest(context.Background(), "text/xml", f)
+	require.NoError(err)
+	assert.Equal("Basic am9lOnNlY3JldA==", suite.ReceivedAuth)
+	assert.Equal("<document>\n    <foo>bar</foo>\n</document>", suite.ReceivedContent)
+}
+
+func (suite *IngestClientSuite) TestIngestRetries() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	client := NewHttpClient(server.URL)
+	client.Retry = transport.NewRetryPolicy(3, time.Millisecond, time.Millisecond)
+	_, err := client.Ingest(context.Background(), "text/xml", ioutil.NopCloser(bytes.NewBufferString("<foo/>")))
+	assert.Error(err)
+	assert.Len(bodies, 1)
+
+	bodies = nil
+	client.Idempotent = true
+	_, err = client.Ingest(context.Background(), "text/xml", ioutil.NopCloser(bytes.NewBufferString("<foo/>")))
+	require.NoError(err)
+	assert.Equal([]string{"<foo/>", "<foo/>"}, bodies)
+}
+
+func (suite *IngestClientSuite) TestIngestWithCassette() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	dir, err := ioutil.TempDir("", "ingest_client_test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	suite.Client.Auth = transport.NewBasicAuthenticator("joe", "secret")
+	suite.Client.Client = &http.Client{}
+	require.NoError(transport.UseCassette(suite.Client.Client, dir, false, transport.NewRedactor("foo")))
+	f, err := os.Open("../fixtures/document.xml")
+	require.NoError(err)
+	_, err = suite.Client.Ingest(context.Background(), "text/xml", f)
+	require.NoError(err)
+	assert.Equal("<document>\n    <foo>bar</foo>\n</document>", suite.ReceivedContent)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	require.NoError(err)
+	require.Len(files, 1)
+	data, err := ioutil.ReadFile(files[0])
+	require.NoError(err)
+	assert.Contains(string(data), `"REDACTED"`)
+	assert.NotContains(string(data), "am9lOnNlY3JldA==")
+	assert.Contains(string(data), "<foo>XXX</foo>")
+}
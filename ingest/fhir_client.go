@@ -0,0 +1,234 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/intervention-engine/integrator/hie"
+	"github.com/intervention-engine/integrator/transport"
+)
+
+const fhirTimeFormat = "2006-01-02T15:04:05-07:00"
+
+// FhirClient ingests documents into a FHIR R4 server.  Each document is posted as a transaction
+// Bundle holding a Binary with the document's content and a DocumentReference that describes it
+// and refers to the patient by their EE identifier.
+type FhirClient struct {
+	BaseURL string
+	// IdentifierSystem is the system URI of the EE identifiers on the server's Patient resources
+	IdentifierSystem string
+	Auth             transport.Authenticator
+	Client           *http.Client
+	Retry            *transport.RetryPolicy
+	// Idempotent indicates that the server safely handles receiving the same document more than
+	// once, so uploads may be retried even if they might have reached the server
+	Idempotent bool
+}
+
+// NewFhirClient creates a FHIR ingest client.  If the identifier system is empty, patients are
+// referred to by EE number without a system.
+func NewFhirClient(baseURL, identifierSystem string) *FhirClient {
+	return &FhirClient{
+		BaseURL:          strings.TrimSuffix(baseURL, "/"),
+		IdentifierSystem: identifierSystem,
+	}
+}
+
+func NewAuthFhirClient(baseURL, identifierSystem string, auth transport.Authenticator) *FhirClient {
+	c := NewFhirClient(baseURL, identifierSystem)
+	c.Auth = auth
+	return c
+}
+
+// Ingest always fails, since a DocumentReference can't be built without knowing whose document it
+// is.  Use IngestDocument instead.
+func (c *FhirClient) Ingest(ctx context.Context, contentType string, reader io.ReadCloser) (*Result, error) {
+	reader.Close()
+	return nil, errors.New("FHIR ingest needs the document's EE number and metadata")
+}
+
+// IngestDocument posts the document and its DocumentReference to the server in one transaction.
+// The result lists the resources the server created.
+func (c *FhirClient) IngestDocument(ctx context.Context, ee string, entry *hie.QueryResponseEntry, contentType string, reader io.ReadCloser) (*Result, error) {
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := json.Marshal(c.transactionBundle(ee, entry, contentType, data))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Retry.Do(ctx, "transaction to "+c.BaseURL, c.Idempotent, func() (*http.Response, error) {
+		return transport.DoAuthenticated(ctx, c.Client, c.Auth, func() (*http.Request, error) {
+			req, err := http.NewRequest("POST", c.BaseURL, bytes.NewReader(bundle))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/fhir+json")
+			req.Header.Set("Accept", "application/fhir+json")
+			return req, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	result, err := readResult(resp, "post FHIR transaction")
+	if err != nil {
+		return nil, err
+	} else if result.Status != http.StatusOK {
+		return nil, fmt.Errorf("FHIR server responded to the transaction with %d instead of a transaction-response", result.Status)
+	}
+	return result, nil
+}
+
+// transactionBundle builds the Bundle that creates the Binary and the DocumentReference.  The
+// DocumentReference refers to the Binary by its temporary UUID, which the server replaces with the
+// Binary's new ID.
+func (c *FhirClient) transactionBundle(ee string, entry *hie.QueryResponseEntry, contentType string, data []byte) *fhirTransaction {
+	binaryURL := "urn:uuid:" + newUUID()
+	binary := &fhirBinary{
+		ResourceType: "Binary",
+		ContentType:  contentType,
+		Data:         base64.StdEncoding.EncodeToString(data),
+	}
+
+	attachment := fhirAttachment{
+		ContentType: contentType,
+		URL:         binaryURL,
+		Size:        len(data),
+		Hash:        attachmentHash(data),
+		Title:       entry.Title,
+	}
+	docRef := &fhirDocumentReference{
+		ResourceType: "DocumentReference",
+		Status:       "current",
+		Description:  entry.Title,
+		Subject: &fhirReference{
+			Identifier: &fhirIdentifier{System: c.IdentifierSystem, Value: ee},
+		},
+	}
+	if entry.DocumentID != "" {
+		docRef.MasterIdentifier = &fhirIdentifier{Value: entry.DocumentID}
+	}
+	if entry.DocumentType != "" {
+		docRef.Type = &fhirCodeableConcept{Text: entry.DocumentType}
+	}
+	if !entry.CreationTime.IsZero() {
+		attachment.Creation = entry.CreationTime.Format(fhirTimeFormat)
+		docRef.Date = attachment.Creation
+	}
+	content := fhirContent{Attachment: attachment}
+	if entry.DocumentType != "" {
+		// The HIE FHIR client reads the document type from the format code, so documents ingested
+		// here can be queried back the same way
+		content.Format = &fhirCoding{Code: entry.DocumentType}
+	}
+	docRef.Content = []fhirContent{content}
+
+	tx := &fhirTransaction{ResourceType: "Bundle", Type: "transaction"}
+	tx.Entry = append(tx.Entry, fhirTransactionEntry{
+		FullURL:  binaryURL,
+		Resource: binary,
+		Request:  fhirRequest{Method: "POST", URL: "Binary"},
+	})
+	tx.Entry = append(tx.Entry, fhirTransactionEntry{
+		FullURL:  "urn:uuid:" + newUUID(),
+		Resource: docRef,
+		Request:  fhirRequest{Method: "POST", URL: "DocumentReference"},
+	})
+	return tx
+}
+
+// attachmentHash returns the base64 SHA-1 hash that FHIR uses for the content.  It's always computed
+// from the content sent, since the HIE's hash may not match it when verification is lenient.
+func attachmentHash(data []byte) string {
+	h := sha1.Sum(data)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+type fhirTransaction struct {
+	ResourceType string                 `json:"resourceType"`
+	Type         string                 `json:"type"`
+	Entry        []fhirTransactionEntry `json:"entry"`
+}
+
+type fhirTransactionEntry struct {
+	FullURL  string      `json:"fullUrl"`
+	Resource interface{} `json:"resource"`
+	Request  fhirRequest `json:"request"`
+}
+
+type fhirRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+type fhirBinary struct {
+	ResourceType string `json:"resourceType"`
+	ContentType  string `json:"contentType"`
+	Data         string `json:"data"`
+}
+
+type fhirIdentifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value"`
+}
+
+type fhirReference struct {
+	Identifier *fhirIdentifier `json:"identifier,omitempty"`
+}
+
+type fhirCoding struct {
+	System string `json:"system,omitempty"`
+	Code   string `json:"code,omitempty"`
+}
+
+type fhirCodeableConcept struct {
+	Text string `json:"text,omitempty"`
+}
+
+type fhirAttachment struct {
+	ContentType string `json:"contentType,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Size        int    `json:"size,omitempty"`
+	Hash        string `json:"hash,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Creation    string `json:"creation,omitempty"`
+}
+
+type fhirContent struct {
+	Attachment fhirAttachment `json:"attachment"`
+	Format     *fhirCoding    `json:"format,omitempty"`
+}
+
+type fhirDocumentReference struct {
+	ResourceType     string               `json:"resourceType"`
+	MasterIdentifier *fhirIdentifier      `json:"masterIdentifier,omitempty"`
+	Status           string               `json:"status"`
+	Type             *fhirCodeableConcept `json:"type,omitempty"`
+	Subject          *fhirReference       `json:"subject,omitempty"`
+	Date             string               `json:"date,omitempty"`
+	Description      string               `json:"description,omitempty"`
+	Content          []fhirContent        `json:"content"`
+}
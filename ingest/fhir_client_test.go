@@ -0,0 +1,167 @@
+package ingest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/intervention-engine/integrator/hie"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestFhirClientSuite(t *testing.T) {
+	suite.Run(t, new(FhirClientSuite))
+}
+
+type FhirClientSuite struct {
+	suite.Suite
+	Client              *FhirClient
+	Server              *httptest.Server
+	ReceivedPath        string
+	ReceivedContentType string
+	ReceivedBundle      map[string]interface{}
+	Fixture             string
+	Status              int
+}
+
+func (suite *FhirClientSuite) SetupTest() {
+	suite.Fixture = "../fixtures/fhir_transaction_response.json"
+	suite.Status = http.StatusOK
+	suite.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.ReceivedPath = r.URL.Path
+		suite.ReceivedContentType = r.Header.Get("Content-Type")
+		suite.ReceivedBundle = nil
+		json.NewDecoder(r.Body).Decode(&suite.ReceivedBundle)
+		b, err := ioutil.ReadFile(suite.Fixture)
+		suite.Require().NoError(err)
+		w.Header().Set("Content-Type", "application/fhir+json")
+		w.WriteHeader(suite.Status)
+		w.Write(b)
+	}))
+
+	suite.Client = NewFhirClient(suite.Server.URL+"/fhir/", "urn:oid:1.2.3.4.5")
+}
+
+func (suite *FhirClientSuite) TearDownTest() {
+	if suite.Server != nil {
+		suite.Server.Close()
+	}
+	suite.ReceivedPath = ""
+	suite.ReceivedContentType = ""
+	suite.ReceivedBundle = nil
+}
+
+func (suite *FhirClientSuite) TestIngestDocument() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	entry := &hie.QueryResponseEntry{
+		DocumentID:   "1.2.3.4",
+		Title:        "Continuity of Care Document",
+		DocumentType: "XML^HL7^231^CCD^C32",
+		CreationTime: time.Date(2016, time.June, 1, 12, 30, 0, 0, time.UTC),
+		Hash:         "0A1B2C3D4E5F60718293A4B5C6D7E8F901234567",
+		Size:         47,
+	}
+	f, err := os.Open("../fixtures/document.xml")
+	require.NoError(err)
+	result, err := suite.Client.IngestDocument(context.Background(), "12345", entry, "text/xml", f)
+	require.NoError(err)
+	assert.Equal([]string{"Binary/b42", "DocumentReference/d42"}, result.Created)
+
+	assert.Equal("/fhir", suite.ReceivedPath)
+	assert.Equal("application/fhir+json", suite.ReceivedContentType)
+	require.Equal("transaction", suite.ReceivedBundle["type"])
+	entries := suite.ReceivedBundle["entry"].([]interface{})
+	require.Len(entries, 2)
+
+	binEntry := entries[0].(map[string]interface{})
+	binary := binEntry["resource"].(map[string]interface{})
+	assert.Equal("Binary", binary["resourceType"])
+	assert.Equal("text/xml", binary["contentType"])
+	data, err := base64.StdEncoding.DecodeString(binary["data"].(string))
+	require.NoError(err)
+	assert.Equal("<document>\n    <foo>bar</foo>\n</document>", string(data))
+	assert.Equal(map[string]interface{}{"method": "POST", "url": "Binary"}, binEntry["request"])
+
+	docEntry := entries[1].(map[string]interface{})
+	docRef := docEntry["resource"].(map[string]interface{})
+	assert.Equal("DocumentReference", docRef["resourceType"])
+	assert.Equal(map[string]interface{}{"method": "POST", "url": "DocumentReference"}, docEntry["request"])
+	assert.Equal(map[string]interface{}{"value": "1.2.3.4"}, docRef["masterIdentifier"])
+	assert.Equal("current", docRef["status"])
+	assert.Equal("Continuity of Care Document", docRef["description"])
+	assert.Equal(map[string]interface{}{"text": "XML^HL7^231^CCD^C32"}, docRef["type"])
+	assert.Equal("2016-06-01T12:30:00+00:00", docRef["date"])
+	assert.Equal(map[string]interface{}{
+		"identifier": map[string]interface{}{"system": "urn:oid:1.2.3.4.5", "value": "12345"},
+	}, docRef["subject"])
+
+	content := docRef["content"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(map[string]interface{}{"code": "XML^HL7^231^CCD^C32"}, content["format"])
+	attachment := content["attachment"].(map[string]interface{})
+	assert.Equal(binEntry["fullUrl"], attachment["url"])
+	assert.Equal("text/xml", attachment["contentType"])
+	// The size and hash are the content's, not the ones the HIE advertised
+	assert.Equal(float64(41), attachment["size"])
+	assert.Equal("r0XYvPIXl+3lCGHwVAqmIEiy0Ik=", attachment["hash"])
+	assert.Equal("Continuity of Care Document", attachment["title"])
+	assert.Equal("2016-06-01T12:30:00+00:00", attachment["creation"])
+}
+
+func (suite *FhirClientSuite) TestIngestDocumentWithoutMetadata() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Client.IdentifierSystem = ""
+	f, err := os.Open("../fixtures/document.xml")
+	require.NoError(err)
+	_, err = suite.Client.IngestDocument(context.Background(), "12345", &hie.QueryResponseEntry{}, "text/xml", f)
+	require.NoError(err)
+
+	docRef := suite.ReceivedBundle["entry"].([]interface{})[1].(map[string]interface{})["resource"].(map[string]interface{})
+	assert.NotContains(docRef, "masterIdentifier")
+	assert.NotContains(docRef, "type")
+	assert.NotContains(docRef, "date")
+	assert.Equal(map[string]interface{}{
+		"identifier": map[string]interface{}{"value": "12345"},
+	}, docRef["subject"])
+	// The size and hash come from the content
+	attachment := docRef["content"].([]interface{})[0].(map[string]interface{})["attachment"].(map[string]interface{})
+	assert.Equal(float64(41), attachment["size"])
+	assert.Equal("r0XYvPIXl+3lCGHwVAqmIEiy0Ik=", attachment["hash"])
+}
+
+func (suite *FhirClientSuite) TestIngestDocumentRejected() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Status = http.StatusBadRequest
+	suite.Fixture = "../fixtures/fhir_operation_outcome.json"
+	f, err := os.Open("../fixtures/document.xml")
+	require.NoError(err)
+	_, err = suite.Client.IngestDocument(context.Background(), "12345", &hie.QueryResponseEntry{DocumentID: "1.2.3.4"}, "text/xml", f)
+	require.Error(err)
+	assert.Contains(err.Error(), "Received 400")
+	assert.Contains(err.Error(), "Resource Binary/missing is not known")
+}
+
+func (suite *FhirClientSuite) TestIngestNeedsMetadata() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	f, err := os.Open("../fixtures/document.xml")
+	require.NoError(err)
+	_, err = suite.Client.Ingest(context.Background(), "text/xml", f)
+	require.Error(err)
+	assert.Nil(suite.ReceivedBundle)
+}
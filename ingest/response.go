@@ -0,0 +1,162 @@
+package ingest
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/intervention-engine/integrator/transport"
+)
+
+// maxResponseSize limits how much of a response body is read, so a misbehaving service can't
+// exhaust memory
+const maxResponseSize = 1 << 20
+
+// readResult reads the ingest service's response into a result.  200, 201 and 202 responses are
+// successful; any other status is an error that includes the messages from an OperationOutcome in
+// the body.
+func readResult(resp *http.Response, action string) (*Result, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	res := new(fhirResponseResource)
+	if !isJSON(resp.Header.Get("Content-Type")) || json.Unmarshal(body, res) != nil {
+		res = new(fhirResponseResource)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusAccepted:
+	default:
+		err := transport.NewStatusError(resp.StatusCode, "Failed to %s.  Received %d: %s", action, resp.StatusCode, resp.Status)
+		if res.ResourceType == "OperationOutcome" {
+			if msg := res.message(); msg != "" {
+				err.Message += ": " + msg
+			}
+		}
+		return nil, err
+	}
+
+	result := &Result{
+		Status:   resp.StatusCode,
+		Location: resp.Header.Get("Location"),
+	}
+	result.addCreated(resourceReference(result.Location))
+	switch res.ResourceType {
+	case "":
+	case "OperationOutcome":
+		result.Warnings = append(result.Warnings, res.warnings()...)
+	case "Bundle":
+		// A transaction-response lists where each entry was created, along with any issues
+		for _, e := range res.Entry {
+			result.addCreated(resourceReference(e.Response.Location))
+			if e.Response.Outcome != nil {
+				result.Warnings = append(result.Warnings, e.Response.Outcome.warnings()...)
+			}
+		}
+	default:
+		if res.ID != "" {
+			result.addCreated(res.ResourceType + "/" + res.ID)
+		}
+	}
+	return result, nil
+}
+
+// addCreated adds a reference to the created resources, unless it's empty or already listed
+func (r *Result) addCreated(ref string) {
+	if ref == "" {
+		return
+	}
+	for _, c := range r.Created {
+		if c == ref {
+			return
+		}
+	}
+	r.Created = append(r.Created, ref)
+}
+
+// resourceReference turns a FHIR location, such as "http://example.org/fhir/Binary/1/_history/1",
+// into a reference such as "Binary/1".  Locations that don't end in a resource type (which are
+// capitalized) and ID aren't references, so an empty string is returned for them.
+func resourceReference(location string) string {
+	if i := strings.Index(location, "/_history/"); i >= 0 {
+		location = location[:i]
+	}
+	if i := strings.IndexAny(location, "?#"); i >= 0 {
+		location = location[:i]
+	}
+	parts := strings.Split(strings.Trim(location, "/"), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	resourceType, id := parts[len(parts)-2], parts[len(parts)-1]
+	if resourceType == "" || id == "" || resourceType[0] < 'A' || resourceType[0] > 'Z' {
+		return ""
+	}
+	return resourceType + "/" + id
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") || mediaType == "application/json+fhir")
+}
+
+// fhirResponseResource holds the parts of a created resource, transaction-response Bundle or
+// OperationOutcome that a result is read from
+type fhirResponseResource struct {
+	ResourceType string      `json:"resourceType"`
+	ID           string      `json:"id"`
+	Issue        []fhirIssue `json:"issue"`
+	Entry        []struct {
+		Response struct {
+			Status   string                `json:"status"`
+			Location string                `json:"location"`
+			Outcome  *fhirResponseResource `json:"outcome"`
+		} `json:"response"`
+	} `json:"entry"`
+}
+
+type fhirIssue struct {
+	Severity    string `json:"severity"`
+	Code        string `json:"code"`
+	Diagnostics string `json:"diagnostics"`
+	Details     struct {
+		Text string `json:"text"`
+	} `json:"details"`
+}
+
+func (i *fhirIssue) message() string {
+	if i.Diagnostics != "" {
+		return i.Diagnostics
+	} else if i.Details.Text != "" {
+		return i.Details.Text
+	}
+	return i.Code
+}
+
+// message joins an OperationOutcome's issues into an error message
+func (oo *fhirResponseResource) message() string {
+	msgs := make([]string, 0, len(oo.Issue))
+	for _, issue := range oo.Issue {
+		msgs = append(msgs, issue.message())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// warnings lists an OperationOutcome's issues, prefixed by their severity, for a document that was
+// accepted anyway
+func (oo *fhirResponseResource) warnings() []string {
+	var warnings []string
+	for _, issue := range oo.Issue {
+		if msg := issue.message(); msg != "" {
+			if issue.Severity != "" {
+				msg = issue.Severity + ": " + msg
+			}
+			warnings = append(warnings, msg)
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,407 @@
+package testkit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intervention-engine/integrator/copier"
+	"github.com/intervention-engine/integrator/hie"
+	"github.com/intervention-engine/integrator/ingest"
+	"github.com/intervention-engine/integrator/txlog"
+)
+
+// Benchmark measures how fast the data copier copies documents, by running it against the mock HIE
+// (see MockHieServer) and a fake ingest service served in-process.  The real HTTP clients are used, so the measurements
+// include their costs, but the transaction log is kept in memory.  Latency, error rates and document
+// sizes can be set to match a production HIE.
+type Benchmark struct {
+	EEs            int
+	DocumentsPerEE int
+	// DocumentSize is the size in bytes of each document
+	DocumentSize int
+	// HieLatency and IngestLatency are added to each HIE and ingest request
+	HieLatency    time.Duration
+	IngestLatency time.Duration
+	// HieErrorRate and IngestErrorRate are the fractions of HIE and ingest requests that fail with a
+	// server error
+	HieErrorRate    float64
+	IngestErrorRate float64
+	// MemoryInterval is how often memory use is sampled (default: every 100ms)
+	MemoryInterval time.Duration
+	Seed           int64
+}
+
+// BenchmarkReport holds the results of a benchmark run
+type BenchmarkReport struct {
+	EEs        int           `json:"ees"`
+	Documents  int           `json:"documents"`
+	Failures   int           `json:"failures"`
+	Duration   time.Duration `json:"duration"`
+	PerSecond  float64       `json:"documentsPerSecond"`
+	PeakHeap   uint64        `json:"peakHeapBytes"`
+	PeakMemory uint64        `json:"peakSysBytes"`
+	// Latencies summarize the "query", "download", "ingest" and "store" operations
+	Latencies map[string]LatencySummary `json:"latencies"`
+}
+
+// LatencySummary summarizes the latencies of one kind of operation
+type LatencySummary struct {
+	Count int           `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P95   time.Duration `json:"p95"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// benchmarkOperations are the operations timed by a benchmark, in the order they're reported
+var benchmarkOperations = []string{"query", "download", "ingest", "store"}
+
+func NewBenchmark(ees, documentsPerEE int) *Benchmark {
+	return &Benchmark{
+		EEs:            ees,
+		DocumentsPerEE: documentsPerEE,
+		DocumentSize:   30000,
+		MemoryInterval: 100 * time.Millisecond,
+		Seed:           1,
+	}
+}
+
+// Validate checks that the benchmark can be run as configured
+func (b *Benchmark) Validate() error {
+	if b.EEs <= 0 || b.DocumentsPerEE < 0 || b.DocumentSize <= 0 {
+		return errors.New("The number of EE numbers and the document size must be positive")
+	}
+	if b.HieLatency < 0 || b.IngestLatency < 0 {
+		return errors.New("Latencies must not be negative")
+	}
+	if b.HieErrorRate < 0 || b.HieErrorRate > 1 || b.IngestErrorRate < 0 || b.IngestErrorRate > 1 {
+		return errors.New("Error rates must be between 0 and 1")
+	}
+	return nil
+}
+
+// Run copies every EE number's documents from the fake HIE, stopping early if the context is done
+func (b *Benchmark) Run(ctx context.Context) (*BenchmarkReport, error) {
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	timer := newLatencyRecorder()
+
+	mock := &MockHieServer{Faults: b.hieFaults(), Seed: b.Seed, content: newBenchmarkContent(b)}
+	hieServer := httptest.NewServer(mock)
+	defer hieServer.Close()
+	var mu sync.Mutex
+	rnd := rand.New(rand.NewSource(b.Seed))
+	ingestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		if !benchmarkSleep(r, b.IngestLatency) {
+			return
+		}
+		mu.Lock()
+		failed := rnd.Float64() < b.IngestErrorRate
+		mu.Unlock()
+		if failed {
+			http.Error(w, "Ingest failure", http.StatusInternalServerError)
+		}
+	}))
+	defer ingestServer.Close()
+
+	txLogMgr := txlog.NewMemoryManager()
+	dataCopier, err := copier.NewDataCopier(
+		&timedHieClient{HttpClient: hie.NewHttpClient(hieServer.URL + "/query"), timer: timer},
+		&timedIngestClient{client: ingest.NewHttpClient(ingestServer.URL), timer: timer},
+		&timedTransactionLogManager{Manager: txLogMgr, timer: timer},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	peakHeap, peakSys := b.sampleMemory()
+	report := &BenchmarkReport{Latencies: make(map[string]LatencySummary)}
+	start := time.Now()
+	for i := 0; i < b.EEs && ctx.Err() == nil; i++ {
+		ee := benchmarkEE(i)
+		// Failures are counted from the transaction log rather than reported here
+		dataCopier.CopyRecords(ctx, ee, "XML^HL7^231^CCD^C32")
+		report.EEs++
+	}
+	report.Duration = time.Since(start)
+	report.PeakHeap, report.PeakMemory = <-peakHeap, <-peakSys
+
+	for _, entry := range txLogMgr.Entries() {
+		if entry.Error == "" {
+			report.Documents++
+		} else {
+			report.Failures++
+		}
+	}
+	if report.Duration > 0 {
+		report.PerSecond = float64(report.Documents) / report.Duration.Seconds()
+	}
+	for _, op := range benchmarkOperations {
+		report.Latencies[op] = timer.summary(op)
+	}
+	return report, ctx.Err()
+}
+
+// sampleMemory tracks the peak heap and total memory obtained from the OS until the peaks are read
+func (b *Benchmark) sampleMemory() (<-chan uint64, <-chan uint64) {
+	interval := b.MemoryInterval
+	if interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+	heap, sys := make(chan uint64), make(chan uint64)
+	go func() {
+		var peakHeap, peakSys uint64
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		sample := func() {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			if m.HeapAlloc > peakHeap {
+				peakHeap = m.HeapAlloc
+			}
+			if m.Sys > peakSys {
+				peakSys = m.Sys
+			}
+		}
+		sample()
+		for {
+			select {
+			case <-ticker.C:
+				sample()
+			case heap <- peakHeap:
+				sample()
+				sys <- peakSys
+				return
+			}
+		}
+	}()
+	return heap, sys
+}
+
+// WriteTo writes the report in a form for people to read
+func (r *BenchmarkReport) WriteTo(w io.Writer) (int64, error) {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "Copied %d documents for %d EE numbers in %s (%d failed)\n", r.Documents, r.EEs, r.Duration, r.Failures)
+	fmt.Fprintf(buf, "Throughput: %.1f documents/second\n", r.PerSecond)
+	fmt.Fprintf(buf, "Peak memory: %.1f MB heap, %.1f MB from the OS\n", float64(r.PeakHeap)/(1<<20), float64(r.PeakMemory)/(1<<20))
+	fmt.Fprintf(buf, "%-10s %8s %12s %12s %12s %12s\n", "operation", "count", "p50", "p95", "p99", "max")
+	for _, op := range benchmarkOperations {
+		s := r.Latencies[op]
+		fmt.Fprintf(buf, "%-10s %8d %12s %12s %12s %12s\n", op, s.Count, s.P50, s.P95, s.P99, s.Max)
+	}
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+func benchmarkEE(i int) string {
+	return fmt.Sprintf("%09d", 100000000+i)
+}
+
+// hieFaults is the fault profile that gives the mock HIE the benchmark's latency and error rate
+func (b *Benchmark) hieFaults() []*MockHieFault {
+	delay := ""
+	if b.HieLatency > 0 {
+		delay = b.HieLatency.String()
+	}
+	var faults []*MockHieFault
+	for _, target := range []string{"query", "document"} {
+		if b.HieErrorRate > 0 {
+			faults = append(faults, &MockHieFault{Target: target, Delay: delay, Status: http.StatusInternalServerError, Error: "HIE failure", Rate: b.HieErrorRate})
+		}
+		if delay != "" {
+			faults = append(faults, &MockHieFault{Target: target, Delay: delay})
+		}
+	}
+	return faults
+}
+
+// benchmarkContent lists DocumentsPerEE documents for any EE number, for the mock HIE to serve.
+// Every document has the same content, so it's only hashed once.
+type benchmarkContent struct {
+	documents int
+	content   []byte
+	hash      string
+	created   time.Time
+}
+
+func newBenchmarkContent(b *Benchmark) *benchmarkContent {
+	document := bytes.Repeat([]byte("<ClinicalDocument/>\n"), b.DocumentSize/20+1)[:b.DocumentSize]
+	sum := sha1.Sum(document)
+	return &benchmarkContent{
+		documents: b.DocumentsPerEE,
+		content:   document,
+		hash:      strings.ToUpper(hex.EncodeToString(sum[:])),
+		created:   time.Date(2016, time.June, 1, 0, 0, 0, 0, time.Local),
+	}
+}
+
+func (c *benchmarkContent) response(ee string) (map[string]interface{}, error) {
+	p := hie.DefaultProtocol()
+	results := make([]interface{}, c.documents)
+	for i := range results {
+		results[i] = map[string]interface{}{
+			"creationTime": c.created.Add(time.Duration(i) * time.Minute).Format(p.CreationTimeLayout),
+			"title":        "Benchmark Document",
+			"documentType": "XML^HL7^231^CCD^C32",
+			"documentID":   ee + "." + strconv.Itoa(i+1),
+		}
+	}
+	return map[string]interface{}{"status": true, "result": results}, nil
+}
+
+func (c *benchmarkContent) document(id string) ([]byte, error) {
+	return c.content, nil
+}
+
+func (c *benchmarkContent) describe(id string) (string, int, bool) {
+	return c.hash, len(c.content), true
+}
+
+// benchmarkSleep waits out the latency, returning false if the client gave up first
+func benchmarkSleep(r *http.Request, latency time.Duration) bool {
+	if latency <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(latency):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// latencyRecorder collects the latencies of each kind of operation
+type latencyRecorder struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+}
+
+func newLatencyRecorder() *latencyRecorder {
+	return &latencyRecorder{latencies: make(map[string][]time.Duration)}
+}
+
+func (l *latencyRecorder) record(op string, start time.Time) {
+	d := time.Since(start)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.latencies[op] = append(l.latencies[op], d)
+}
+
+func (l *latencyRecorder) summary(op string) LatencySummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d := durations(append([]time.Duration{}, l.latencies[op]...))
+	if len(d) == 0 {
+		return LatencySummary{}
+	}
+	sort.Sort(d)
+	return LatencySummary{
+		Count: len(d),
+		P50:   d.percentile(50),
+		P95:   d.percentile(95),
+		P99:   d.percentile(99),
+		Max:   d[len(d)-1],
+	}
+}
+
+// durations sorts latencies from shortest to longest
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// percentile returns the nearest-rank percentile of sorted latencies
+func (d durations) percentile(p int) time.Duration {
+	rank := (p*len(d) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return d[rank-1]
+}
+
+// timedHieClient records the latency of queries and downloads.  A download is timed until its
+// content has been read (or closed, if it isn't read to the end).
+type timedHieClient struct {
+	*hie.HttpClient
+	timer *latencyRecorder
+}
+
+func (c *timedHieClient) QueryRecords(ctx context.Context, mrn string, start *time.Time, end *time.Time) (*hie.QueryResponse, error) {
+	defer c.timer.record("query", time.Now())
+	return c.HttpClient.QueryRecords(ctx, mrn, start, end)
+}
+
+func (c *timedHieClient) QueryRecordsPage(ctx context.Context, mrn string, start *time.Time, end *time.Time, page string) (*hie.QueryResponse, error) {
+	defer c.timer.record("query", time.Now())
+	return c.HttpClient.QueryRecordsPage(ctx, mrn, start, end, page)
+}
+
+func (c *timedHieClient) DownloadRecord(ctx context.Context, url string) (io.ReadCloser, string, error) {
+	start := time.Now()
+	content, contentType, err := c.HttpClient.DownloadRecord(ctx, url)
+	if err != nil {
+		c.timer.record("download", start)
+		return nil, "", err
+	}
+	return &timedReadCloser{ReadCloser: content, start: start, timer: c.timer}, contentType, nil
+}
+
+type timedReadCloser struct {
+	io.ReadCloser
+	start time.Time
+	timer *latencyRecorder
+	once  sync.Once
+}
+
+func (r *timedReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		r.once.Do(func() { r.timer.record("download", r.start) })
+	}
+	return n, err
+}
+
+func (r *timedReadCloser) Close() error {
+	r.once.Do(func() { r.timer.record("download", r.start) })
+	return r.ReadCloser.Close()
+}
+
+// timedIngestClient records the latency of ingest requests
+type timedIngestClient struct {
+	client ingest.Client
+	timer  *latencyRecorder
+}
+
+func (c *timedIngestClient) Ingest(ctx context.Context, contentType string, reader io.ReadCloser) (*ingest.Result, error) {
+	defer c.timer.record("ingest", time.Now())
+	return c.client.Ingest(ctx, contentType, reader)
+}
+
+// timedTransactionLogManager records the latency of storing transaction log entries
+type timedTransactionLogManager struct {
+	txlog.Manager
+	timer *latencyRecorder
+}
+
+func (m *timedTransactionLogManager) StoreEntry(ctx context.Context, entry *txlog.Entry) error {
+	defer m.timer.record("store", time.Now())
+	return m.Manager.StoreEntry(ctx, entry)
+}
@@ -0,0 +1,153 @@
+package testkit
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestBenchmarkSuite(t *testing.T) {
+	suite.Run(t, new(BenchmarkSuite))
+}
+
+type BenchmarkSuite struct {
+	suite.Suite
+	Benchmark *Benchmark
+}
+
+func (suite *BenchmarkSuite) SetupTest() {
+	suite.Benchmark = NewBenchmark(5, 3)
+	suite.Benchmark.DocumentSize = 1000
+	log.SetOutput(ioutil.Discard)
+}
+
+func (suite *BenchmarkSuite) TearDownTest() {
+	log.SetOutput(os.Stderr)
+}
+
+func (suite *BenchmarkSuite) TestRun() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	report, err := suite.Benchmark.Run(context.Background())
+	require.NoError(err)
+	assert.Equal(5, report.EEs)
+	assert.Equal(15, report.Documents)
+	assert.Equal(0, report.Failures)
+	assert.True(report.PerSecond > 0)
+	assert.True(report.PeakHeap > 0)
+	assert.True(report.PeakMemory >= report.PeakHeap)
+	assert.Equal(5, report.Latencies["query"].Count)
+	for _, op := range []string{"download", "ingest", "store"} {
+		s := report.Latencies[op]
+		assert.Equal(15, s.Count, op)
+		assert.True(s.P50 <= s.P95 && s.P95 <= s.P99 && s.P99 <= s.Max, op)
+	}
+
+	buf := new(bytes.Buffer)
+	_, err = report.WriteTo(buf)
+	require.NoError(err)
+	assert.Contains(buf.String(), "Copied 15 documents for 5 EE numbers")
+	assert.Contains(buf.String(), "documents/second")
+	assert.Contains(buf.String(), "download")
+}
+
+func (suite *BenchmarkSuite) TestLatency() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Benchmark.EEs = 2
+	suite.Benchmark.DocumentsPerEE = 1
+	suite.Benchmark.HieLatency = 20 * time.Millisecond
+	suite.Benchmark.IngestLatency = 10 * time.Millisecond
+	report, err := suite.Benchmark.Run(context.Background())
+	require.NoError(err)
+	assert.True(report.Latencies["query"].P50 >= 20*time.Millisecond)
+	assert.True(report.Latencies["download"].P50 >= 20*time.Millisecond)
+	assert.True(report.Latencies["ingest"].P50 >= 10*time.Millisecond)
+	assert.True(report.Latencies["store"].P50 < 10*time.Millisecond)
+}
+
+func (suite *BenchmarkSuite) TestErrorRates() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Benchmark.IngestErrorRate = 1
+	report, err := suite.Benchmark.Run(context.Background())
+	require.NoError(err)
+	assert.Equal(0, report.Documents)
+	assert.Equal(15, report.Failures)
+
+	// Failed queries don't list any documents
+	suite.Benchmark.IngestErrorRate = 0
+	suite.Benchmark.HieErrorRate = 1
+	report, err = suite.Benchmark.Run(context.Background())
+	require.NoError(err)
+	assert.Equal(0, report.Documents+report.Failures)
+	assert.Equal(5, report.Latencies["query"].Count)
+}
+
+func (suite *BenchmarkSuite) TestStopsWhenContextIsDone() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err := suite.Benchmark.Run(ctx)
+	assert.Equal(context.Canceled, err)
+	require.NotNil(report)
+	assert.Equal(0, report.EEs)
+}
+
+func (suite *BenchmarkSuite) TestValidate() {
+	assert := suite.Assert()
+
+	assert.NoError(suite.Benchmark.Validate())
+	b := *suite.Benchmark
+	b.EEs = 0
+	assert.Error(b.Validate())
+	b = *suite.Benchmark
+	b.HieErrorRate = 1.5
+	assert.Error(b.Validate())
+	b = *suite.Benchmark
+	b.IngestLatency = -time.Second
+	assert.Error(b.Validate())
+	_, err := b.Run(context.Background())
+	assert.Error(err)
+}
+
+func (suite *BenchmarkSuite) TestPercentiles() {
+	assert := suite.Assert()
+
+	var d durations
+	for i := 100; i > 0; i-- {
+		d = append(d, time.Duration(i)*time.Millisecond)
+	}
+	sort.Sort(d)
+	assert.Equal(50*time.Millisecond, d.percentile(50))
+	assert.Equal(95*time.Millisecond, d.percentile(95))
+	assert.Equal(99*time.Millisecond, d.percentile(99))
+	assert.Equal(time.Millisecond, durations{time.Millisecond}.percentile(99))
+}
+
+// BenchmarkCopyRecords measures the cost of copying an EE number's documents, without any latency,
+// to catch regressions in the data copier
+func BenchmarkCopyRecords(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	bench := NewBenchmark(b.N, 5)
+	b.ResetTimer()
+	if _, err := bench.Run(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+}
@@ -0,0 +1,384 @@
+package testkit
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/intervention-engine/integrator/hie"
+)
+
+// Generator writes synthetic patients and CCD documents for load and scenario testing.  None of the
+// data is real: names, birth dates and addresses are picked at random (from the seed, so the same
+// settings always generate the same data).
+//
+// The output is laid out for the mock HIE (see MockHieServer) or for a file HIE (see
+// hie.FileClient), along with an EE file listing the generated EE numbers.
+type Generator struct {
+	Patients            int
+	DocumentsPerPatient int
+	// Layout is "mock-hie" (<dir>/<ee>.json and <dir>/documents/<id>.xml) or "file"
+	// (<dir>/<ee>/<id>.xml, with a sidecar describing each document)
+	Layout string
+	// Formats are the document formats to generate, in turn: "XML^HL7^231^CCD^C32" for C32
+	// documents and "XML^HL7^231^CCD^V1.1" for C-CDA documents
+	Formats []string
+	// Start and End bound the documents' creation times (default: the year before the
+	// generator was created)
+	Start time.Time
+	End   time.Time
+	Seed  int64
+}
+
+// GeneratedDocument describes a generated document
+type GeneratedDocument struct {
+	EE           string
+	DocumentID   string
+	DocumentType string
+	Title        string
+	CreationTime time.Time
+	Hash         string
+	Size         int
+	Content      []byte
+}
+
+// generatorOID is the root of generated document IDs.  It's under the HL7 example OID, so it can't
+// be mistaken for a real organization's.
+const generatorOID = "2.16.840.1.113883.19.5.99"
+
+var (
+	generatorGivenNames  = []string{"Alex", "Jordan", "Taylor", "Morgan", "Casey", "Riley", "Jamie", "Avery", "Quinn", "Harper", "Rowan", "Emerson"}
+	generatorFamilyNames = []string{"Smith", "Johnson", "Brown", "Garcia", "Miller", "Davis", "Lopez", "Wilson", "Moore", "Clark", "Lewis", "Walker"}
+	generatorCities      = []string{"Bedford", "Burlington", "Lowell", "Salem", "Concord", "Lexington"}
+	generatorProblems    = []struct{ Code, Name string }{
+		{"44054006", "Diabetes mellitus type 2"},
+		{"38341003", "Hypertensive disorder"},
+		{"195967001", "Asthma"},
+		{"55822004", "Hyperlipidemia"},
+		{"35489007", "Depressive disorder"},
+		{"13645005", "Chronic obstructive lung disease"},
+	}
+)
+
+func NewGenerator(patients, documentsPerPatient int) *Generator {
+	end := time.Now().Truncate(time.Second)
+	return &Generator{
+		Patients:            patients,
+		DocumentsPerPatient: documentsPerPatient,
+		Layout:              "mock-hie",
+		Formats:             []string{"XML^HL7^231^CCD^C32", "XML^HL7^231^CCD^V1.1"},
+		Start:               end.AddDate(-1, 0, 0),
+		End:                 end,
+		Seed:                1,
+	}
+}
+
+// Validate checks that the generator can produce documents as configured
+func (g *Generator) Validate() error {
+	if g.Patients <= 0 || g.DocumentsPerPatient <= 0 {
+		return errors.New("The number of patients and documents per patient must be positive")
+	}
+	if g.Layout != "mock-hie" && g.Layout != "file" {
+		return fmt.Errorf("%s is not a supported layout", g.Layout)
+	}
+	if len(g.Formats) == 0 {
+		return errors.New("At least one document format is required")
+	}
+	for _, f := range g.Formats {
+		if _, ok := generatorTemplates[f]; !ok {
+			return fmt.Errorf("%s is not a format that can be generated", f)
+		}
+	}
+	if !g.Start.Before(g.End) {
+		return errors.New("The start of the creation times must be before the end")
+	}
+	return nil
+}
+
+// Generate writes the patients' documents and an EE file (ee.txt) to the directory, returning the
+// generated EE numbers
+func (g *Generator) Generate(dir string) ([]string, error) {
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	rnd := rand.New(rand.NewSource(g.Seed))
+	ees := make([]string, 0, g.Patients)
+	used := make(map[string]bool)
+	for i := 0; i < g.Patients; i++ {
+		ee := fmt.Sprintf("%09d", 100000000+rnd.Intn(900000000))
+		for used[ee] {
+			ee = fmt.Sprintf("%09d", 100000000+rnd.Intn(900000000))
+		}
+		used[ee] = true
+
+		docs, err := g.generatePatient(rnd, i, ee)
+		if err != nil {
+			return nil, err
+		}
+		if g.Layout == "file" {
+			err = writeFileHieDocuments(dir, ee, docs)
+		} else {
+			err = g.writeMockHieDocuments(dir, ee, docs)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ees = append(ees, ee)
+	}
+
+	eeFile := fmt.Sprintf("# %d synthetic patients (seed %d)\n%s\n", g.Patients, g.Seed, strings.Join(ees, "\n"))
+	if err := ioutil.WriteFile(filepath.Join(dir, "ee.txt"), []byte(eeFile), 0644); err != nil {
+		return nil, err
+	}
+	return ees, nil
+}
+
+// generatorPatient is the data rendered into a patient's documents
+type generatorPatient struct {
+	EE         string
+	Given      string
+	Family     string
+	Gender     string
+	BirthTime  string
+	Street     string
+	City       string
+	PostalCode string
+}
+
+// generatorDocument is the data rendered into a document
+type generatorDocument struct {
+	Patient  generatorPatient
+	ID       string
+	Title    string
+	Time     string
+	Problems []struct{ Code, Name string }
+}
+
+func (g *Generator) generatePatient(rnd *rand.Rand, index int, ee string) ([]*GeneratedDocument, error) {
+	birth := time.Date(1930+rnd.Intn(70), time.Month(1+rnd.Intn(12)), 1+rnd.Intn(28), 0, 0, 0, 0, time.UTC)
+	patient := generatorPatient{
+		EE:         ee,
+		Given:      generatorGivenNames[rnd.Intn(len(generatorGivenNames))],
+		Family:     generatorFamilyNames[rnd.Intn(len(generatorFamilyNames))],
+		Gender:     []string{"F", "M"}[rnd.Intn(2)],
+		BirthTime:  birth.Format("20060102"),
+		Street:     fmt.Sprintf("%d Main Street", 1+rnd.Intn(999)),
+		City:       generatorCities[rnd.Intn(len(generatorCities))],
+		PostalCode: fmt.Sprintf("0%04d", rnd.Intn(10000)),
+	}
+
+	span := int64(g.End.Sub(g.Start) / time.Second)
+	docs := make([]*GeneratedDocument, g.DocumentsPerPatient)
+	for j := range docs {
+		format := g.Formats[j%len(g.Formats)]
+		created := g.Start.Add(time.Duration(rnd.Int63n(span+1)) * time.Second)
+		doc := generatorDocument{
+			Patient: patient,
+			ID:      fmt.Sprintf("%s.%d.%d", generatorOID, index+1, j+1),
+			Title:   generatorTitles[format],
+			Time:    created.Format("20060102150405-0700"),
+		}
+		for _, k := range rnd.Perm(len(generatorProblems))[:1+rnd.Intn(3)] {
+			doc.Problems = append(doc.Problems, generatorProblems[k])
+		}
+
+		buf := new(bytes.Buffer)
+		if err := generatorTemplates[format].Execute(buf, doc); err != nil {
+			return nil, err
+		}
+		sum := sha1.Sum(buf.Bytes())
+		docs[j] = &GeneratedDocument{
+			EE:           ee,
+			DocumentID:   doc.ID,
+			DocumentType: format,
+			Title:        doc.Title,
+			CreationTime: created,
+			Hash:         strings.ToUpper(hex.EncodeToString(sum[:])),
+			Size:         buf.Len(),
+			Content:      buf.Bytes(),
+		}
+	}
+	return docs, nil
+}
+
+// writeMockHieDocuments writes a patient's query response and documents for the mock HIE
+func (g *Generator) writeMockHieDocuments(dir, ee string, docs []*GeneratedDocument) error {
+	if err := os.MkdirAll(filepath.Join(dir, "documents"), 0777); err != nil {
+		return err
+	}
+	p := hie.DefaultProtocol()
+	results := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		if err := ioutil.WriteFile(filepath.Join(dir, "documents", doc.DocumentID+".xml"), doc.Content, 0644); err != nil {
+			return err
+		}
+		results[i] = map[string]interface{}{
+			"retrieveURL":  "http://mock-hie/document/" + doc.DocumentID,
+			"creationTime": doc.CreationTime.In(p.Zone()).Format(p.CreationTimeLayout),
+			"title":        doc.Title,
+			"documentType": doc.DocumentType,
+			"documentID":   doc.DocumentID,
+			"hash":         doc.Hash,
+			"size":         doc.Size,
+		}
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"status": true,
+		"result": results,
+		"query": map[string]interface{}{
+			"env":           "synthetic",
+			"ee":            ee,
+			"startDateTime": g.Start.In(p.Zone()).Format(p.QueryDateLayout),
+			"endDateTime":   g.End.In(p.Zone()).Format(p.QueryDateLayout),
+		},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ee+".json"), data, 0644)
+}
+
+// writeFileHieDocuments writes a patient's documents, with their sidecars, for a file HIE
+func writeFileHieDocuments(dir, ee string, docs []*GeneratedDocument) error {
+	if err := os.MkdirAll(filepath.Join(dir, ee), 0777); err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		base := filepath.Join(dir, ee, doc.DocumentID)
+		if err := ioutil.WriteFile(base+".xml", doc.Content, 0644); err != nil {
+			return err
+		}
+		created := doc.CreationTime
+		sidecar, err := json.MarshalIndent(hie.FileSidecar{
+			DocumentID:   doc.DocumentID,
+			DocumentType: doc.DocumentType,
+			Title:        doc.Title,
+			CreationTime: &created,
+		}, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(base+".json", sidecar, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var generatorTitles = map[string]string{
+	"XML^HL7^231^CCD^C32":  "Continuity of Care Document",
+	"XML^HL7^231^CCD^V1.1": "Clinical Summary",
+}
+
+// generatorHeader is the CDA header shared by the generated formats.  Each format sets its own
+// templateIds.
+const generatorHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<ClinicalDocument xmlns="urn:hl7-org:v3" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <realmCode code="US"/>
+  <typeId root="2.16.840.1.113883.1.3" extension="POCD_HD000040"/>
+  {{template "templateIds"}}
+  <id root="{{.ID | xml}}"/>
+  <code code="34133-9" codeSystem="2.16.840.1.113883.6.1" codeSystemName="LOINC" displayName="Summarization of Episode Note"/>
+  <title>{{.Title | xml}}</title>
+  <effectiveTime value="{{.Time}}"/>
+  <confidentialityCode code="N" codeSystem="2.16.840.1.113883.5.25"/>
+  <languageCode code="en-US"/>
+  <recordTarget>
+    <patientRole>
+      <id root="2.16.840.1.113883.19.5" extension="{{.Patient.EE | xml}}"/>
+      <addr use="HP">
+        <streetAddressLine>{{.Patient.Street | xml}}</streetAddressLine>
+        <city>{{.Patient.City | xml}}</city>
+        <state>MA</state>
+        <postalCode>{{.Patient.PostalCode}}</postalCode>
+        <country>US</country>
+      </addr>
+      <patient>
+        <name use="L">
+          <given>{{.Patient.Given | xml}}</given>
+          <family>{{.Patient.Family | xml}}</family>
+        </name>
+        <administrativeGenderCode code="{{.Patient.Gender}}" codeSystem="2.16.840.1.113883.5.1"/>
+        <birthTime value="{{.Patient.BirthTime}}"/>
+      </patient>
+    </patientRole>
+  </recordTarget>
+  <author>
+    <time value="{{.Time}}"/>
+    <assignedAuthor>
+      <id root="2.16.840.1.113883.19.5"/>
+      <representedOrganization>
+        <name>Synthetic Health Information Exchange</name>
+      </representedOrganization>
+    </assignedAuthor>
+  </author>
+  <custodian>
+    <assignedCustodian>
+      <representedCustodianOrganization>
+        <id root="2.16.840.1.113883.19.5"/>
+        <name>Synthetic Health Information Exchange</name>
+      </representedCustodianOrganization>
+    </assignedCustodian>
+  </custodian>
+  <component>
+    <structuredBody>
+      <component>
+        <section>
+          {{template "problemTemplateIds"}}
+          <code code="11450-4" codeSystem="2.16.840.1.113883.6.1" displayName="Problem List"/>
+          <title>Problems</title>
+          <text>
+            <list>{{range .Problems}}
+              <item>{{.Name | xml}}</item>{{end}}
+            </list>
+          </text>{{range .Problems}}
+          <entry>
+            <observation classCode="OBS" moodCode="EVN">
+              <code code="55607006" codeSystem="2.16.840.1.113883.6.96" displayName="Problem"/>
+              <statusCode code="completed"/>
+              <value xsi:type="CD" code="{{.Code}}" codeSystem="2.16.840.1.113883.6.96" displayName="{{.Name | xml}}"/>
+            </observation>
+          </entry>{{end}}
+        </section>
+      </component>
+    </structuredBody>
+  </component>
+</ClinicalDocument>
+`
+
+var generatorTemplates = map[string]*template.Template{
+	"XML^HL7^231^CCD^C32": newGeneratorTemplate(`
+  <templateId root="2.16.840.1.113883.3.27.1776"/>
+  <templateId root="2.16.840.1.113883.10.20.1"/>
+  <templateId root="2.16.840.1.113883.3.88.11.32.1"/>`, `<templateId root="2.16.840.1.113883.10.20.1.11"/>`),
+	"XML^HL7^231^CCD^V1.1": newGeneratorTemplate(`
+  <templateId root="2.16.840.1.113883.10.20.22.1.1"/>
+  <templateId root="2.16.840.1.113883.10.20.22.1.2"/>`, `<templateId root="2.16.840.1.113883.10.20.22.2.5.1"/>`),
+}
+
+func newGeneratorTemplate(templateIds, problemTemplateIds string) *template.Template {
+	t := template.Must(template.New("document").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(generatorHeader))
+	template.Must(t.New("templateIds").Parse(strings.TrimSpace(templateIds)))
+	template.Must(t.New("problemTemplateIds").Parse(problemTemplateIds))
+	return t
+}
+
+func xmlEscape(s string) string {
+	buf := new(bytes.Buffer)
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
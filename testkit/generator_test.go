@@ -0,0 +1,191 @@
+package testkit
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/intervention-engine/integrator/config"
+	"github.com/intervention-engine/integrator/copier"
+	"github.com/intervention-engine/integrator/hie"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestGeneratorSuite(t *testing.T) {
+	suite.Run(t, new(GeneratorSuite))
+}
+
+type GeneratorSuite struct {
+	suite.Suite
+	TempDir   string
+	Generator *Generator
+}
+
+func (suite *GeneratorSuite) SetupTest() {
+	require := suite.Require()
+
+	var err error
+	suite.TempDir, err = ioutil.TempDir("", "generator_test")
+	require.NoError(err)
+	suite.Generator = NewGenerator(3, 4)
+	suite.Generator.Start = time.Date(2015, time.January, 1, 0, 0, 0, 0, time.Local)
+	suite.Generator.End = time.Date(2016, time.January, 1, 0, 0, 0, 0, time.Local)
+}
+
+func (suite *GeneratorSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDir)
+}
+
+func (suite *GeneratorSuite) TestMockHieLayout() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	ees, err := suite.Generator.Generate(suite.TempDir)
+	require.NoError(err)
+	require.Len(ees, 3)
+	eeFile, err := config.ParseEEFile(filepath.Join(suite.TempDir, "ee.txt"))
+	require.NoError(err)
+	assert.Equal(ees, eeFile)
+
+	mock, err := NewMockHieServer(suite.TempDir)
+	require.NoError(err)
+	server := httptest.NewServer(mock)
+	defer server.Close()
+	client := hie.NewHttpClient(server.URL + "/query")
+
+	for _, ee := range ees {
+		assert.Len(ee, 9)
+		qr, err := client.QueryRecords(context.Background(), ee, nil, nil)
+		require.NoError(err)
+		require.Len(qr.Result, 4)
+		assert.Empty(qr.Invalid)
+		assert.Equal("XML^HL7^231^CCD^C32", qr.Result[0].DocumentType)
+		assert.Equal("XML^HL7^231^CCD^V1.1", qr.Result[1].DocumentType)
+		for _, entry := range qr.Result {
+			assert.False(entry.CreationTime.Before(suite.Generator.Start))
+			assert.False(entry.CreationTime.After(suite.Generator.End))
+
+			rc, _, err := client.DownloadRecord(context.Background(), entry.RetrieveURL)
+			require.NoError(err)
+			data, err := ioutil.ReadAll(rc)
+			rc.Close()
+			require.NoError(err)
+			assert.NoError(copier.VerifyDocument(&entry, data, copier.VerifyStrict))
+			suite.assertValidDocument(data, ee, entry.DocumentID, entry.CreationTime)
+		}
+	}
+
+	// The advertised hashes are those of the documents
+	f, err := os.Open(filepath.Join(suite.TempDir, ees[0]+".json"))
+	require.NoError(err)
+	defer f.Close()
+	qr, err := hie.DecodeQueryResponse(f, false)
+	require.NoError(err)
+	for _, entry := range qr.Result {
+		data, err := ioutil.ReadFile(filepath.Join(suite.TempDir, "documents", entry.DocumentID+".xml"))
+		require.NoError(err)
+		assert.NoError(copier.VerifyDocument(&entry, data, copier.VerifyStrict))
+	}
+}
+
+func (suite *GeneratorSuite) TestFileLayout() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Generator.Layout = "file"
+	suite.Generator.Formats = []string{"XML^HL7^231^CCD^V1.1"}
+	ees, err := suite.Generator.Generate(suite.TempDir)
+	require.NoError(err)
+
+	client := hie.NewFileClient(suite.TempDir)
+	for _, ee := range ees {
+		qr, err := client.QueryRecords(context.Background(), ee, nil, nil)
+		require.NoError(err)
+		require.Len(qr.Result, 4)
+		for _, entry := range qr.Result {
+			assert.Equal("XML^HL7^231^CCD^V1.1", entry.DocumentType)
+			assert.Equal("Clinical Summary", entry.Title)
+			data, err := ioutil.ReadFile(filepath.Join(suite.TempDir, ee, entry.DocumentID+".xml"))
+			require.NoError(err)
+			assert.NoError(copier.VerifyDocument(&entry, data, copier.VerifyStrict))
+			suite.assertValidDocument(data, ee, entry.DocumentID, entry.CreationTime)
+		}
+	}
+}
+
+func (suite *GeneratorSuite) TestGenerationIsRepeatable() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	first, err := suite.Generator.Generate(filepath.Join(suite.TempDir, "first"))
+	require.NoError(err)
+	second, err := suite.Generator.Generate(filepath.Join(suite.TempDir, "second"))
+	require.NoError(err)
+	assert.Equal(first, second)
+	a, err := ioutil.ReadFile(filepath.Join(suite.TempDir, "first", first[0]+".json"))
+	require.NoError(err)
+	b, err := ioutil.ReadFile(filepath.Join(suite.TempDir, "second", second[0]+".json"))
+	require.NoError(err)
+	assert.Equal(a, b)
+
+	suite.Generator.Seed = 2
+	third, err := suite.Generator.Generate(filepath.Join(suite.TempDir, "third"))
+	require.NoError(err)
+	assert.NotEqual(first, third)
+}
+
+func (suite *GeneratorSuite) TestValidate() {
+	assert := suite.Assert()
+
+	assert.NoError(suite.Generator.Validate())
+	g := *suite.Generator
+	g.Patients = 0
+	assert.Error(g.Validate())
+	g = *suite.Generator
+	g.Layout = "zip"
+	assert.Error(g.Validate())
+	g = *suite.Generator
+	g.Formats = []string{"PDF"}
+	assert.Error(g.Validate())
+	g = *suite.Generator
+	g.End = g.Start
+	assert.Error(g.Validate())
+	_, err := g.Generate(suite.TempDir)
+	assert.Error(err)
+}
+
+// assertValidDocument checks the document's header against the entry describing it
+func (suite *GeneratorSuite) assertValidDocument(data []byte, ee, documentID string, created time.Time) {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	doc := struct {
+		hie.CdaHeader
+		TemplateIDs []struct {
+			Root string `xml:"root,attr"`
+		} `xml:"templateId"`
+		RecordTarget struct {
+			ID struct {
+				Extension string `xml:"extension,attr"`
+			} `xml:"patientRole>id"`
+			Family string `xml:"patientRole>patient>name>family"`
+		} `xml:"recordTarget"`
+	}{}
+	require.NoError(xml.Unmarshal(data, &doc))
+	assert.Equal(documentID, doc.ID.Root)
+	assert.NotEmpty(doc.Title)
+	assert.NotEmpty(doc.TemplateIDs)
+	assert.Equal(ee, doc.RecordTarget.ID.Extension)
+	assert.NotEmpty(doc.RecordTarget.Family)
+	t, err := hie.ParseCdaTime(doc.EffectiveTime.Value)
+	require.NoError(err)
+	assert.True(created.Equal(t), "effective time %s, created %s", t, created)
+}
@@ -0,0 +1,393 @@
+package testkit
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intervention-engine/integrator/hie"
+)
+
+// MockHieServer serves the JSON query API and document downloads that hie.HttpClient expects, from a
+// fixtures directory, so that the integrator can be run end-to-end without a real HIE.  Queries are
+// served at /query and documents at /document.
+//
+// The directory holds a query response for each EE number, in the HIE's JSON format (see
+// fixtures/response_success.json), named <ee>.json, and the documents it lists, named
+// documents/<documentID>.xml.  Results are filtered by the date range queried, and each result's
+// retrieveURL is pointed at the mock server.  The hash and size of results whose document is in
+// the directory are computed from it, so they don't need to be kept up to date by hand.  EE numbers
+// without a response have no documents.
+//
+// Faults can be scripted to exercise the integrator's error handling (see MockHieFault).
+type MockHieServer struct {
+	Dir    string
+	Faults []*MockHieFault
+	// Protocol is used to read the date range queried and the results' creation times (default:
+	// DefaultProtocol())
+	Protocol *hie.Protocol
+	// Seed seeds the choice of requests that faults with a rate apply to
+	Seed int64
+
+	// content, if set, serves the responses and documents instead of the directory
+	content mockHieContent
+	mu      sync.Mutex
+	rnd     *rand.Rand
+}
+
+// mockHieContent provides the query responses and documents the mock HIE serves
+type mockHieContent interface {
+	// response returns the query response for an EE number
+	response(ee string) (map[string]interface{}, error)
+	document(id string) ([]byte, error)
+	// describe returns a document's hash and size, or false if there's no such document
+	describe(id string) (hash string, size int, ok bool)
+}
+
+// MockHieFault describes how the mock HIE misbehaves for matching requests.  A fault with no EE
+// number or document ID matches every query or download.  Faults are checked in order, and the
+// first one that matches is used.
+type MockHieFault struct {
+	// Target is "query" or "document"
+	Target     string `json:"target"`
+	EE         string `json:"ee"`
+	DocumentID string `json:"documentID"`
+	// Times limits the fault to the first n matching requests (default: every request)
+	Times int `json:"times"`
+	// Delay is how long to wait before responding (e.g., "30s")
+	Delay string `json:"delay"`
+	// Status is the HTTP status to respond with, and Error is the error message to respond with, as
+	// in fixtures/document_error.json.  An error defaults to a 200 status for queries and a 404
+	// status for documents; an error status defaults to the status text as the message.
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+	// Malformed gives the query results a creation time and size of the wrong type, or truncates the
+	// document
+	Malformed bool `json:"malformed"`
+	// Rate is the fraction of matching requests, chosen at random, that the fault applies to
+	// (default: every one)
+	Rate float64 `json:"rate"`
+
+	count int
+}
+
+func NewMockHieServer(dir string) (*MockHieServer, error) {
+	if dir == "" {
+		return nil, errors.New("A path to the mock HIE fixtures must be provided")
+	}
+	if fi, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &MockHieServer{Dir: dir}, nil
+}
+
+// LoadMockHieFaults reads a JSON array of faults
+func LoadMockHieFaults(path string) ([]*MockHieFault, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var faults []*MockHieFault
+	if err := json.Unmarshal(data, &faults); err != nil {
+		return nil, fmt.Errorf("Invalid faults in %s: %s", path, err)
+	}
+	for i, f := range faults {
+		if err := f.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid fault %d in %s: %s", i, path, err)
+		}
+	}
+	return faults, nil
+}
+
+// Validate checks that the fault can be applied
+func (f *MockHieFault) Validate() error {
+	if f.Target != "query" && f.Target != "document" {
+		return fmt.Errorf("%s is not a supported fault target", f.Target)
+	}
+	if f.Delay != "" {
+		if d, err := time.ParseDuration(f.Delay); err != nil || d < 0 {
+			return fmt.Errorf("%s is not a valid delay", f.Delay)
+		}
+	}
+	if f.Status != 0 && (f.Status < 100 || f.Status > 599) {
+		return fmt.Errorf("%d is not a valid HTTP status", f.Status)
+	}
+	if f.Rate < 0 || f.Rate > 1 {
+		return fmt.Errorf("%g is not a valid rate; it must be between 0 and 1", f.Rate)
+	}
+	return nil
+}
+
+func (s *MockHieServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case "/query":
+		s.serveQuery(w, r)
+	case "/document":
+		s.serveDocument(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *MockHieServer) serveQuery(w http.ResponseWriter, r *http.Request) {
+	qStart := time.Now()
+	p := s.protocol()
+	params := r.URL.Query()
+	ee := params.Get(p.EEParam)
+	log.Printf("Mock HIE query for %s\n", ee)
+
+	fault := s.fault("query", ee, "")
+	if !s.delay(r, fault) || s.fail(w, fault, http.StatusOK) {
+		return
+	}
+	if ee == "" {
+		writeMockHieError(w, http.StatusBadRequest, "invalid ee")
+		return
+	}
+
+	var start, end *time.Time
+	for _, param := range []struct {
+		name string
+		t    **time.Time
+	}{{p.StartParam, &start}, {p.EndParam, &end}} {
+		if val := params.Get(param.name); val != "" {
+			t, err := time.ParseInLocation(p.RequestDateLayout, val, p.Zone())
+			if err != nil {
+				writeMockHieError(w, http.StatusBadRequest, "invalid "+param.name)
+				return
+			}
+			*param.t = &t
+		}
+	}
+
+	resp, err := s.contents().response(ee)
+	if err != nil {
+		log.Printf("Mock HIE couldn't load the response for %s: %s\n", ee, err)
+		writeMockHieError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var results []interface{}
+	entries, _ := resp["result"].([]interface{})
+	for _, e := range entries {
+		entry, ok := e.(map[string]interface{})
+		if !ok {
+			// Malformed entries are passed along as they are
+			results = append(results, e)
+			continue
+		}
+		if ct, ok := entry["creationTime"].(string); ok {
+			t, err := time.ParseInLocation(p.CreationTimeLayout, ct, p.Zone())
+			if err == nil && ((start != nil && t.Before(*start)) || (end != nil && t.After(*end))) {
+				continue
+			}
+		}
+		s.describeDocument(r, entry)
+		if fault != nil && fault.Malformed {
+			entry["creationTime"] = 20140425025103
+			entry["size"] = "unknown"
+		}
+		results = append(results, entry)
+	}
+	if results == nil {
+		results = []interface{}{}
+	}
+	resp["result"] = results
+
+	query, _ := resp["query"].(map[string]interface{})
+	if query == nil {
+		query = make(map[string]interface{})
+	}
+	query["ee"] = ee
+	query["host"] = r.Host
+	if start != nil {
+		query["startDateTime"] = start.In(p.Zone()).Format(p.QueryDateLayout)
+	} else {
+		delete(query, "startDateTime")
+	}
+	if end == nil {
+		end = &qStart
+	}
+	query["endDateTime"] = end.In(p.Zone()).Format(p.QueryDateLayout)
+	query["queryStartDateTime"] = qStart.UTC().Format("2006-01-02T15:04:05.000000000Z")
+	query["queryCompleteDateTime"] = time.Now().UTC().Format("2006-01-02T15:04:05.000000000Z")
+	resp["query"] = query
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// contents returns the server's content, which is the directory's unless it's been replaced
+func (s *MockHieServer) contents() mockHieContent {
+	if s.content == nil {
+		return mockHieDir(s.Dir)
+	}
+	return s.content
+}
+
+// mockHieDir serves a fixtures directory's responses and documents
+type mockHieDir string
+
+// response reads the query response for an EE number.  Numbers are kept as they are in the
+// fixture, so that malformed values are passed along unchanged.
+func (dir mockHieDir) response(ee string) (map[string]interface{}, error) {
+	if strings.ContainsAny(ee, `/\`) || ee == "." || ee == ".." {
+		return nil, fmt.Errorf("%s can't be used as a file name", ee)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(string(dir), ee+".json"))
+	if os.IsNotExist(err) {
+		return map[string]interface{}{"status": true}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var resp map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&resp); err != nil {
+		return nil, fmt.Errorf("Invalid response in %s.json: %s", ee, err)
+	}
+	return resp, nil
+}
+
+// describeDocument points an entry's retrieveURL at the mock server and, if its document is in the
+// fixtures, fills in its hash and size
+func (s *MockHieServer) describeDocument(r *http.Request, entry map[string]interface{}) {
+	id, ok := entry["documentID"].(string)
+	if !ok {
+		return
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	entry["retrieveURL"] = scheme + "://" + r.Host + "/document?" + url.Values{"id": {id}}.Encode()
+	if hash, size, ok := s.contents().describe(id); ok {
+		entry["hash"] = hash
+		entry["size"] = size
+	}
+}
+
+func (s *MockHieServer) serveDocument(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	log.Printf("Mock HIE download of %s\n", id)
+
+	fault := s.fault("document", "", id)
+	if !s.delay(r, fault) || s.fail(w, fault, http.StatusNotFound) {
+		return
+	}
+	data, err := s.contents().document(id)
+	if err != nil {
+		writeMockHieError(w, http.StatusNotFound, "invalid document ID")
+		return
+	}
+	if fault != nil && fault.Malformed {
+		data = data[:len(data)/2]
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(data)
+}
+
+func (dir mockHieDir) document(id string) ([]byte, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return nil, fmt.Errorf("%s can't be used as a file name", id)
+	}
+	return ioutil.ReadFile(filepath.Join(string(dir), "documents", id+".xml"))
+}
+
+// describe hashes the document, if it's in the directory
+func (dir mockHieDir) describe(id string) (string, int, bool) {
+	data, err := dir.document(id)
+	if err != nil {
+		return "", 0, false
+	}
+	sum := sha1.Sum(data)
+	return strings.ToUpper(hex.EncodeToString(sum[:])), len(data), true
+}
+
+// fault returns the first fault that matches the request, counting it against the fault's limit
+func (s *MockHieServer) fault(target, ee, documentID string) *MockHieFault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.Faults {
+		if f.Target != target || (f.EE != "" && f.EE != ee) || (f.DocumentID != "" && f.DocumentID != documentID) {
+			continue
+		}
+		if f.Times > 0 && f.count >= f.Times {
+			continue
+		}
+		if f.Rate > 0 {
+			if s.rnd == nil {
+				s.rnd = rand.New(rand.NewSource(s.Seed))
+			}
+			if s.rnd.Float64() >= f.Rate {
+				continue
+			}
+		}
+		f.count++
+		return f
+	}
+	return nil
+}
+
+// delay waits out the fault's delay, returning false if the client gave up first
+func (s *MockHieServer) delay(r *http.Request, f *MockHieFault) bool {
+	if f == nil || f.Delay == "" {
+		return true
+	}
+	d, _ := time.ParseDuration(f.Delay)
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// fail responds with the fault's error, if it has one, returning true if it did
+func (s *MockHieServer) fail(w http.ResponseWriter, f *MockHieFault, errStatus int) bool {
+	if f == nil || (f.Status == 0 && f.Error == "") {
+		return false
+	}
+	status, msg := f.Status, f.Error
+	if status == 0 {
+		status = errStatus
+	}
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+	writeMockHieError(w, status, msg)
+	return true
+}
+
+func (s *MockHieServer) protocol() *hie.Protocol {
+	if s.Protocol == nil {
+		return hie.DefaultProtocol()
+	}
+	return s.Protocol
+}
+
+// writeMockHieError responds with an error in the HIE's format (see fixtures/document_error.json)
+func writeMockHieError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": false, "error": msg})
+}
@@ -0,0 +1,237 @@
+package testkit
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/intervention-engine/integrator/copier"
+	"github.com/intervention-engine/integrator/hie"
+	"github.com/intervention-engine/integrator/ingest"
+	"github.com/intervention-engine/integrator/transport"
+	"github.com/intervention-engine/integrator/txlog"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestMockHieSuite(t *testing.T) {
+	suite.Run(t, new(MockHieSuite))
+}
+
+type MockHieSuite struct {
+	suite.Suite
+	Mock   *MockHieServer
+	Server *httptest.Server
+	Client *hie.HttpClient
+}
+
+func (suite *MockHieSuite) SetupTest() {
+	require := suite.Require()
+
+	var err error
+	suite.Mock, err = NewMockHieServer("../fixtures/mock_hie")
+	require.NoError(err)
+	suite.Server = httptest.NewServer(suite.Mock)
+	suite.Client = hie.NewHttpClient(suite.Server.URL + "/query")
+}
+
+func (suite *MockHieSuite) TearDownTest() {
+	suite.Server.Close()
+}
+
+func (suite *MockHieSuite) TestQueryRecords() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	qr, err := suite.Client.QueryRecords(context.Background(), "123456789", nil, nil)
+	require.NoError(err)
+	assert.True(qr.Status)
+	assert.Equal("123456789", qr.Query.EE)
+	assert.Equal("mock", qr.Query.Env)
+	assert.False(qr.Query.EndDateTime.IsZero())
+	require.Len(qr.Result, 3)
+	assert.Empty(qr.Invalid)
+
+	// Retrieve URLs point at the mock, and hashes and sizes describe the documents it serves
+	entry := qr.Result[0]
+	assert.Equal(suite.Server.URL+"/document?id=1.1.1.1.1.1", entry.RetrieveURL)
+	assert.Equal("1.1.1.1.1.1", entry.DocumentID)
+	assert.Equal(time.Date(2014, time.April, 25, 2, 51, 3, 0, time.Local), entry.CreationTime)
+	rc, ct, err := suite.Client.DownloadRecord(context.Background(), entry.RetrieveURL)
+	require.NoError(err)
+	defer rc.Close()
+	assert.Equal("text/xml", ct)
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(err)
+	expected, err := ioutil.ReadFile("../fixtures/mock_hie/documents/1.1.1.1.1.1.xml")
+	require.NoError(err)
+	assert.Equal(expected, data)
+	assert.NoError(copier.VerifyDocument(&entry, data, copier.VerifyStrict))
+
+	// EE numbers without a response have no documents
+	qr, err = suite.Client.QueryRecords(context.Background(), "987654321", nil, nil)
+	require.NoError(err)
+	assert.True(qr.Status)
+	assert.Empty(qr.Result)
+}
+
+func (suite *MockHieSuite) TestQueryRecordsFiltersByDate() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.Local)
+	end := time.Date(2014, time.April, 25, 2, 30, 0, 0, time.Local)
+	qr, err := suite.Client.QueryRecords(context.Background(), "123456789", &start, &end)
+	require.NoError(err)
+	require.Len(qr.Result, 1)
+	assert.Equal("1.1.1.1.1.2", qr.Result[0].DocumentID)
+	assert.Equal(start, qr.Query.StartDateTime)
+	assert.Equal(end, qr.Query.EndDateTime)
+
+	qr, err = suite.Client.QueryRecords(context.Background(), "123456789", &end, nil)
+	require.NoError(err)
+	require.Len(qr.Result, 1)
+	assert.Equal("1.1.1.1.1.1", qr.Result[0].DocumentID)
+}
+
+func (suite *MockHieSuite) TestDownloadMissingDocument() {
+	assert := suite.Assert()
+
+	_, _, err := suite.Client.DownloadRecord(context.Background(), suite.Server.URL+"/document?id=1.2.3")
+	assert.EqualError(err, "invalid document ID")
+	_, _, err = suite.Client.DownloadRecord(context.Background(), suite.Server.URL+"/document?id=../123456789.json")
+	assert.EqualError(err, "invalid document ID")
+}
+
+func (suite *MockHieSuite) TestErrorFaults() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Mock.Faults = []*MockHieFault{
+		{Target: "query", EE: "123456789", Status: http.StatusServiceUnavailable, Times: 1},
+		{Target: "query", EE: "987654321", Error: "invalid ee"},
+		{Target: "document", DocumentID: "1.1.1.1.1.2", Error: "invalid document ID"},
+	}
+
+	// Faults can be limited to the first few requests, so retries succeed
+	suite.Client.Retry = transport.NewRetryPolicy(1, time.Millisecond, time.Millisecond)
+	qr, err := suite.Client.QueryRecords(context.Background(), "123456789", nil, nil)
+	require.NoError(err)
+	assert.Len(qr.Result, 3)
+
+	qr, err = suite.Client.QueryRecords(context.Background(), "987654321", nil, nil)
+	require.NoError(err)
+	assert.False(qr.Status)
+	assert.Equal("invalid ee", qr.Error)
+
+	_, _, err = suite.Client.DownloadRecord(context.Background(), suite.Server.URL+"/document?id=1.1.1.1.1.2")
+	assert.EqualError(err, "invalid document ID")
+	rc, _, err := suite.Client.DownloadRecord(context.Background(), suite.Server.URL+"/document?id=1.1.1.1.1.1")
+	require.NoError(err)
+	rc.Close()
+}
+
+func (suite *MockHieSuite) TestFaultRates() {
+	assert := suite.Assert()
+
+	suite.Mock.Faults = []*MockHieFault{{Target: "document", Status: http.StatusInternalServerError, Rate: 0.5}}
+	failed := 0
+	for i := 0; i < 100; i++ {
+		rc, _, err := suite.Client.DownloadRecord(context.Background(), suite.Server.URL+"/document?id=1.1.1.1.1.1")
+		if err != nil {
+			failed++
+		} else {
+			rc.Close()
+		}
+	}
+	// Only some requests fail, chosen at random
+	assert.True(failed > 20 && failed < 80, "%d of 100 requests failed", failed)
+}
+
+func (suite *MockHieSuite) TestMalformedFaults() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Mock.Faults = []*MockHieFault{
+		{Target: "query", Malformed: true},
+		{Target: "document", DocumentID: "1.1.1.1.1.3", Malformed: true},
+	}
+
+	qr, err := suite.Client.QueryRecords(context.Background(), "123456789", nil, nil)
+	require.NoError(err)
+	assert.Empty(qr.Result)
+	assert.Len(qr.Invalid, 3)
+
+	suite.Mock.Faults = suite.Mock.Faults[1:]
+	qr, err = suite.Client.QueryRecords(context.Background(), "123456789", nil, nil)
+	require.NoError(err)
+	require.Len(qr.Result, 3)
+	rc, _, err := suite.Client.DownloadRecord(context.Background(), qr.Result[2].RetrieveURL)
+	require.NoError(err)
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(err)
+	assert.Error(copier.VerifyDocument(&qr.Result[2], data, copier.VerifyLenient))
+}
+
+func (suite *MockHieSuite) TestDelayFaults() {
+	assert := suite.Assert()
+
+	suite.Mock.Faults = []*MockHieFault{{Target: "query", Delay: "1h"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := suite.Client.QueryRecords(ctx, "123456789", nil, nil)
+	assert.Error(err)
+	assert.True(time.Since(start) < time.Minute)
+}
+
+func (suite *MockHieSuite) TestCopyRecords() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Mock.Faults = []*MockHieFault{{Target: "document", DocumentID: "1.1.1.1.1.2", Status: http.StatusInternalServerError}}
+	fakeIngest := NewFakeIngest()
+	ingestServer := httptest.NewServer(fakeIngest)
+	defer ingestServer.Close()
+	txLogMgr := txlog.NewMemoryManager()
+
+	dataCopier, err := copier.NewDataCopier(suite.Client, ingest.NewHttpClient(ingestServer.URL), txLogMgr)
+	require.NoError(err)
+	dataCopier.Verify = copier.VerifyStrict
+	require.NoError(dataCopier.CopyRecords(context.Background(), "123456789", "XML^HL7^231^CCD^C32"))
+	assert.Len(fakeIngest.Documents(), 1)
+	entries := txLogMgr.Entries()
+	require.Len(entries, 2)
+	assert.Equal("1.1.1.1.1.1", entries[0].DocumentID)
+	assert.Empty(entries[0].Error)
+	assert.Equal("1.1.1.1.1.2", entries[1].DocumentID)
+	assert.NotEmpty(entries[1].Error)
+}
+
+func (suite *MockHieSuite) TestLoadFaults() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	faults, err := LoadMockHieFaults("../fixtures/mock_hie_faults.json")
+	require.NoError(err)
+	require.Len(faults, 4)
+	assert.Equal(&MockHieFault{Target: "query", EE: "123456789", Status: 503, Times: 1}, faults[0])
+	assert.Equal("50ms", faults[1].Delay)
+	assert.True(faults[1].Malformed)
+
+	assert.Error((&MockHieFault{Target: "ingest"}).Validate())
+	assert.Error((&MockHieFault{Target: "query", Delay: "soon"}).Validate())
+	assert.Error((&MockHieFault{Target: "query", Status: 1000}).Validate())
+	assert.Error((&MockHieFault{Target: "query", Rate: 1.5}).Validate())
+
+	_, err = NewMockHieServer("../fixtures/missing")
+	assert.Error(err)
+	_, err = NewMockHieServer("../fixtures/document.xml")
+	assert.Error(err)
+}
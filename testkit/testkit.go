@@ -0,0 +1,429 @@
+// Package testkit provides fakes, fixtures and load tools for exercising the integrator without a
+// real HIE, ingest endpoint or database.
+package testkit
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intervention-engine/integrator/copier"
+	"github.com/intervention-engine/integrator/hie"
+	"github.com/intervention-engine/integrator/ingest"
+	"github.com/intervention-engine/integrator/txlog"
+)
+
+// The test kit runs the data copier end-to-end against a fake HIE and a fake ingest service served
+// in-process, with the transaction log kept in memory, so copy behavior (retries, dedupe,
+// incremental sync) can be tested without MongoDB or hand-rolled mocks.  The real HTTP clients are
+// used, so their behavior is covered too.
+
+// FakeHie is a stateful fake HIE serving the default query protocol at /query and documents at
+// /document?id=<documentID>.  Documents can be added and failures injected between runs, so a test
+// can change what the HIE returns as it goes.
+type FakeHie struct {
+	mu        sync.Mutex
+	documents map[string][]*FakeDocument
+	failures  map[string]int
+	queries   map[string]int
+	downloads map[string]int
+}
+
+// FakeDocument is a document held by a fake HIE
+type FakeDocument struct {
+	DocumentID   string
+	DocumentType string
+	Title        string
+	CreationTime time.Time
+	// Content is the document served by the HIE (default: a minimal CDA header describing it)
+	Content []byte
+}
+
+// IngestedDocument is a document posted to a fake ingest service.  The document ID is read from the
+// CDA header, so it's empty for content that isn't a CDA document.
+type IngestedDocument struct {
+	DocumentID  string
+	ContentType string
+	Content     []byte
+}
+
+// FakeIngest is a fake ingest service that records the documents posted to it
+type FakeIngest struct {
+	mu        sync.Mutex
+	documents []IngestedDocument
+	failures  []int
+}
+
+// Scenario wires a data copier to a fake HIE, a fake ingest service and an in-memory transaction
+// log.  Tests describe the HIE with GivenPatient, copy with WhenRunCopies and check the outcome with
+// ThenIngested and ThenFailed, which report failures to the test like testify's assertions.
+type Scenario struct {
+	Hie    *FakeHie
+	Ingest *FakeIngest
+	TxLog  *txlog.MemoryManager
+	Copier *copier.DataCopier
+	// Formats are the document formats copied (default: C32 and C-CDA)
+	Formats []string
+
+	t            TestingT
+	hieServer    *httptest.Server
+	ingestServer *httptest.Server
+	checked      int
+}
+
+// fakeDocumentType is the type of fake documents that don't set their own
+const fakeDocumentType = "XML^HL7^231^CCD^C32"
+
+func NewFakeHie() *FakeHie {
+	return &FakeHie{
+		documents: make(map[string][]*FakeDocument),
+		failures:  make(map[string]int),
+		queries:   make(map[string]int),
+		downloads: make(map[string]int),
+	}
+}
+
+// NewFakeDocument returns a C32 document created at the given time
+func NewFakeDocument(documentID string, created time.Time) *FakeDocument {
+	return &FakeDocument{
+		DocumentID:   documentID,
+		DocumentType: fakeDocumentType,
+		Title:        "Continuity of Care Document",
+		CreationTime: created,
+	}
+}
+
+// AddDocuments adds documents to an EE number's records.  Documents without content are given a
+// minimal CDA header describing them.
+func (h *FakeHie) AddDocuments(ee string, docs ...*FakeDocument) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, doc := range docs {
+		if doc.DocumentType == "" {
+			doc.DocumentType = fakeDocumentType
+		}
+		if doc.Content == nil {
+			doc.Content = []byte(fmt.Sprintf("<ClinicalDocument xmlns=\"urn:hl7-org:v3\">\n"+
+				"  <id root=\"%s\"/>\n  <title>%s</title>\n  <effectiveTime value=\"%s\"/>\n"+
+				"  <recordTarget><patientRole><id extension=\"%s\"/></patientRole></recordTarget>\n"+
+				"</ClinicalDocument>\n", xmlEscape(doc.DocumentID), xmlEscape(doc.Title),
+				doc.CreationTime.Format("20060102150405-0700"), xmlEscape(ee)))
+		}
+		h.documents[ee] = append(h.documents[ee], doc)
+	}
+}
+
+// EEs returns the EE numbers that have documents, in order
+func (h *FakeHie) EEs() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var ees []string
+	for ee := range h.documents {
+		ees = append(ees, ee)
+	}
+	sort.Strings(ees)
+	return ees
+}
+
+// FailQueries makes the next n queries for an EE number fail with a server error
+func (h *FakeHie) FailQueries(ee string, n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures["query "+ee] += n
+}
+
+// FailDownloads makes the next n downloads of a document fail with a server error
+func (h *FakeHie) FailDownloads(documentID string, n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures["document "+documentID] += n
+}
+
+// Queries returns the number of queries made for an EE number
+func (h *FakeHie) Queries(ee string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.queries[ee]
+}
+
+// Downloads returns the number of times a document was downloaded, including failed attempts
+func (h *FakeHie) Downloads(documentID string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.downloads[documentID]
+}
+
+func (h *FakeHie) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/query":
+		h.serveQuery(w, r)
+	case "/document":
+		h.serveDocument(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *FakeHie) serveQuery(w http.ResponseWriter, r *http.Request) {
+	p := hie.DefaultProtocol()
+	params := r.URL.Query()
+	ee := params.Get(p.EEParam)
+	var start, end *time.Time
+	for _, param := range []struct {
+		name string
+		t    **time.Time
+	}{{p.StartParam, &start}, {p.EndParam, &end}} {
+		if val := params.Get(param.name); val != "" {
+			t, err := time.ParseInLocation(p.RequestDateLayout, val, p.Zone())
+			if err != nil {
+				writeMockHieError(w, http.StatusBadRequest, "invalid "+param.name)
+				return
+			}
+			*param.t = &t
+		}
+	}
+
+	h.mu.Lock()
+	h.queries[ee]++
+	if h.fail("query " + ee) {
+		h.mu.Unlock()
+		writeMockHieError(w, http.StatusInternalServerError, "HIE failure")
+		return
+	}
+	results := []map[string]interface{}{}
+	for _, doc := range h.documents[ee] {
+		created := doc.CreationTime.Truncate(time.Second)
+		if (start != nil && created.Before(*start)) || (end != nil && created.After(*end)) {
+			continue
+		}
+		sum := sha1.Sum(doc.Content)
+		results = append(results, map[string]interface{}{
+			"retrieveURL":  "http://" + r.Host + "/document?" + url.Values{"id": {doc.DocumentID}}.Encode(),
+			"creationTime": created.In(p.Zone()).Format(p.CreationTimeLayout),
+			"title":        doc.Title,
+			"documentType": doc.DocumentType,
+			"documentID":   doc.DocumentID,
+			"hash":         strings.ToUpper(hex.EncodeToString(sum[:])),
+			"size":         len(doc.Content),
+		})
+	}
+	h.mu.Unlock()
+
+	if end == nil {
+		now := time.Now()
+		end = &now
+	}
+	query := map[string]interface{}{
+		"ee":          ee,
+		"host":        r.Host,
+		"endDateTime": end.In(p.Zone()).Format(p.QueryDateLayout),
+	}
+	if start != nil {
+		query["startDateTime"] = start.In(p.Zone()).Format(p.QueryDateLayout)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": true,
+		"result": results,
+		"query":  query,
+	})
+}
+
+func (h *FakeHie) serveDocument(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	h.mu.Lock()
+	h.downloads[id]++
+	failed := h.fail("document " + id)
+	var content []byte
+	for _, docs := range h.documents {
+		for _, doc := range docs {
+			if doc.DocumentID == id {
+				content = doc.Content
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	if failed {
+		http.Error(w, "HIE failure", http.StatusInternalServerError)
+	} else if content == nil {
+		http.NotFound(w, r)
+	} else {
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write(content)
+	}
+}
+
+// fail reports whether an injected failure is due, using it up.  The caller must hold the lock.
+func (h *FakeHie) fail(key string) bool {
+	if h.failures[key] <= 0 {
+		return false
+	}
+	h.failures[key]--
+	return true
+}
+
+func NewFakeIngest() *FakeIngest {
+	return &FakeIngest{}
+}
+
+// FailNext makes the next posts fail with the given statuses, in order
+func (i *FakeIngest) FailNext(statuses ...int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.failures = append(i.failures, statuses...)
+}
+
+// Documents returns the documents that were accepted, in the order they were posted
+func (i *FakeIngest) Documents() []IngestedDocument {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return append([]IngestedDocument{}, i.documents...)
+}
+
+func (i *FakeIngest) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if len(i.failures) > 0 {
+		status := i.failures[0]
+		i.failures = i.failures[1:]
+		http.Error(w, "Ingest failure", status)
+		return
+	}
+	doc := IngestedDocument{ContentType: r.Header.Get("Content-Type"), Content: data}
+	header := new(hie.CdaHeader)
+	if xml.Unmarshal(data, header) == nil {
+		doc.DocumentID = header.ID.Root
+	}
+	i.documents = append(i.documents, doc)
+}
+
+// TestingT is the part of *testing.T that scenarios report failures to.  It's declared here so the
+// test kit doesn't depend on the testing packages, since the integrator command uses it too.
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+	FailNow()
+}
+
+// NewScenario starts the fake HIE and ingest service.  Close must be called to stop them.
+func NewScenario(t TestingT) *Scenario {
+	s := &Scenario{
+		Hie:     NewFakeHie(),
+		Ingest:  NewFakeIngest(),
+		TxLog:   txlog.NewMemoryManager(),
+		Formats: []string{"XML^HL7^231^CCD^C32", "XML^HL7^231^CCD^V1.1"},
+		t:       t,
+	}
+	s.hieServer = httptest.NewServer(s.Hie)
+	s.ingestServer = httptest.NewServer(s.Ingest)
+	// The clients and transaction log are always set, so this can't fail
+	s.Copier, _ = copier.NewDataCopier(hie.NewHttpClient(s.hieServer.URL+"/query"), ingest.NewHttpClient(s.ingestServer.URL), s.TxLog)
+	return s
+}
+
+// HieURL returns the URL of the fake HIE's query API
+func (s *Scenario) HieURL() string {
+	return s.hieServer.URL + "/query"
+}
+
+// IngestURL returns the URL of the fake ingest service
+func (s *Scenario) IngestURL() string {
+	return s.ingestServer.URL
+}
+
+func (s *Scenario) Close() {
+	s.hieServer.Close()
+	s.ingestServer.Close()
+}
+
+// GivenPatient adds documents to an EE number's records in the HIE
+func (s *Scenario) GivenPatient(ee string, docs ...*FakeDocument) {
+	s.Hie.AddDocuments(ee, docs...)
+}
+
+// WhenRunCopies runs the data copier for each EE number, as a scheduled run would.  With no EE
+// numbers, it copies every patient in the HIE.  It returns the first error.
+func (s *Scenario) WhenRunCopies(ees ...string) error {
+	if len(ees) == 0 {
+		ees = s.Hie.EEs()
+	}
+	var firstErr error
+	for _, ee := range ees {
+		if err := s.Copier.CopyRecords(context.Background(), ee, s.Formats...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ThenIngested asserts that exactly these documents were ingested, in order, since the last call
+func (s *Scenario) ThenIngested(documentIDs ...string) bool {
+	docs := s.Ingest.Documents()
+	ingested := []string{}
+	for _, doc := range docs[s.checked:] {
+		ingested = append(ingested, doc.DocumentID)
+	}
+	s.checked = len(docs)
+	if documentIDs == nil {
+		documentIDs = []string{}
+	}
+	return s.equal("Ingested documents", documentIDs, ingested)
+}
+
+// ThenFailed asserts that exactly these documents are logged as failed, in document ID order
+func (s *Scenario) ThenFailed(documentIDs ...string) bool {
+	failed := []string{}
+	for _, entry := range s.TxLog.Entries() {
+		if entry.FailureCount > 0 {
+			failed = append(failed, entry.DocumentID)
+		}
+	}
+	expected := append([]string{}, documentIDs...)
+	sort.Strings(expected)
+	return s.equal("Failed documents", expected, failed)
+}
+
+// ThenDeadLettered asserts that exactly these documents are dead-lettered, in document ID order
+func (s *Scenario) ThenDeadLettered(documentIDs ...string) bool {
+	deadLettered := []string{}
+	for _, entry := range s.TxLog.Entries() {
+		if entry.DeadLetter {
+			deadLettered = append(deadLettered, entry.DocumentID)
+		}
+	}
+	expected := append([]string{}, documentIDs...)
+	sort.Strings(expected)
+	return s.equal("Dead-lettered documents", expected, deadLettered)
+}
+
+// equal reports whether the document IDs are the expected ones, reporting a failure to the test if
+// they aren't
+func (s *Scenario) equal(what string, expected, actual []string) bool {
+	if reflect.DeepEqual(expected, actual) {
+		return true
+	}
+	s.t.Errorf("%s: expected %q, but got %q", what, expected, actual)
+	return false
+}
@@ -0,0 +1,203 @@
+package testkit
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/intervention-engine/integrator/copier"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestTestKitSuite(t *testing.T) {
+	suite.Run(t, new(TestKitSuite))
+}
+
+type TestKitSuite struct {
+	suite.Suite
+	Scenario *Scenario
+	Past     time.Time
+	Future   time.Time
+}
+
+func (suite *TestKitSuite) SetupTest() {
+	suite.Scenario = NewScenario(suite.T())
+	suite.Past = time.Date(2016, time.June, 1, 0, 0, 0, 0, time.Local)
+	// Documents from the future are returned by every query, until a query starts after them
+	suite.Future = time.Now().Add(time.Hour)
+	log.SetOutput(ioutil.Discard)
+}
+
+func (suite *TestKitSuite) TearDownTest() {
+	suite.Scenario.Close()
+	log.SetOutput(os.Stderr)
+}
+
+func (suite *TestKitSuite) TestCopiesEveryPatient() {
+	assert := suite.Assert()
+	require := suite.Require()
+	s := suite.Scenario
+
+	s.GivenPatient("123456789", NewFakeDocument("1.1", suite.Past), NewFakeDocument("1.2", suite.Past.Add(time.Hour)))
+	s.GivenPatient("987654321", NewFakeDocument("2.1", suite.Past))
+	require.NoError(s.WhenRunCopies())
+	s.ThenIngested("1.1", "1.2", "2.1")
+	s.ThenFailed()
+
+	entries := s.TxLog.Entries()
+	require.Len(entries, 3)
+	assert.Equal("123456789", entries[0].EE)
+	assert.Equal("987654321", entries[2].EE)
+	assert.Equal("text/xml", s.Ingest.Documents()[0].ContentType)
+}
+
+func (suite *TestKitSuite) TestFailedDownloadsAreRetried() {
+	assert := suite.Assert()
+	require := suite.Require()
+	s := suite.Scenario
+
+	s.GivenPatient("123456789", NewFakeDocument("1.1", suite.Past), NewFakeDocument("1.2", suite.Past))
+	s.Hie.FailDownloads("1.1", 1)
+	require.NoError(s.WhenRunCopies())
+	s.ThenIngested("1.2")
+	s.ThenFailed("1.1")
+
+	require.NoError(s.WhenRunCopies())
+	s.ThenIngested("1.1")
+	s.ThenFailed()
+	assert.Equal(2, s.Hie.Downloads("1.1"))
+	assert.Equal(1, s.Hie.Downloads("1.2"))
+}
+
+func (suite *TestKitSuite) TestUnavailableIngestsAreRetried() {
+	require := suite.Require()
+	s := suite.Scenario
+
+	s.GivenPatient("123456789", NewFakeDocument("1.1", suite.Past))
+	s.Ingest.FailNext(http.StatusInternalServerError, http.StatusServiceUnavailable)
+	require.NoError(s.WhenRunCopies())
+	s.ThenIngested()
+	s.ThenFailed("1.1")
+	require.NoError(s.WhenRunCopies())
+	s.ThenIngested()
+	require.NoError(s.WhenRunCopies())
+	s.ThenIngested("1.1")
+	s.ThenFailed()
+}
+
+func (suite *TestKitSuite) TestRejectedIngestsAreDeadLettered() {
+	require := suite.Require()
+	s := suite.Scenario
+
+	s.GivenPatient("123456789", NewFakeDocument("1.1", suite.Past), NewFakeDocument("1.2", suite.Past))
+	s.Ingest.FailNext(http.StatusBadRequest)
+	require.NoError(s.WhenRunCopies())
+	s.ThenIngested("1.2")
+	s.ThenDeadLettered("1.1")
+
+	// Dead-lettered documents are skipped until they're released
+	require.NoError(s.WhenRunCopies())
+	s.ThenIngested()
+	s.ThenDeadLettered("1.1")
+	for _, entry := range s.TxLog.Entries() {
+		if entry.DeadLetter {
+			entry.Release()
+			require.NoError(s.TxLog.StoreEntry(context.Background(), entry))
+		}
+	}
+	require.NoError(s.WhenRunCopies())
+	s.ThenIngested("1.1")
+	s.ThenDeadLettered()
+	s.ThenFailed()
+}
+
+func (suite *TestKitSuite) TestDocumentsAreOnlyCopiedOnce() {
+	assert := suite.Assert()
+	require := suite.Require()
+	s := suite.Scenario
+
+	s.GivenPatient("123456789", NewFakeDocument("1.1", suite.Future))
+	require.NoError(s.WhenRunCopies())
+	require.NoError(s.WhenRunCopies())
+	s.ThenIngested("1.1")
+	assert.Equal(2, s.Hie.Queries("123456789"))
+	assert.Equal(1, s.Hie.Downloads("1.1"))
+}
+
+func (suite *TestKitSuite) TestIncrementalSync() {
+	require := suite.Require()
+	s := suite.Scenario
+
+	s.GivenPatient("123456789", NewFakeDocument("1.1", suite.Past))
+	require.NoError(s.WhenRunCopies())
+	s.ThenIngested("1.1")
+
+	// The next query starts where the last one ended, so only documents created since then are found
+	s.GivenPatient("123456789", NewFakeDocument("1.2", suite.Past.Add(time.Hour)), NewFakeDocument("1.3", suite.Future))
+	require.NoError(s.WhenRunCopies())
+	s.ThenIngested("1.3")
+}
+
+func (suite *TestKitSuite) TestFailedQueries() {
+	require := suite.Require()
+	s := suite.Scenario
+
+	s.GivenPatient("123456789", NewFakeDocument("1.1", suite.Past))
+	s.GivenPatient("987654321", NewFakeDocument("2.1", suite.Past))
+	s.Hie.FailQueries("123456789", 1)
+	require.Error(s.WhenRunCopies())
+	s.ThenIngested("2.1")
+	require.NoError(s.WhenRunCopies("123456789"))
+	s.ThenIngested("1.1")
+}
+
+func (suite *TestKitSuite) TestVerifiedDocuments() {
+	require := suite.Require()
+	s := suite.Scenario
+
+	// The fake HIE advertises each document's hash and size
+	s.Copier.Verify = copier.VerifyStrict
+	s.GivenPatient("123456789", NewFakeDocument("1.1", suite.Past), &FakeDocument{
+		DocumentID:   "1.2",
+		DocumentType: "XML^HL7^231^CCD^V1.1",
+		CreationTime: suite.Past,
+		Content:      []byte("<ClinicalDocument><id root=\"1.2\"/></ClinicalDocument>"),
+	}, &FakeDocument{DocumentID: "1.3", DocumentType: "PDF", CreationTime: suite.Past})
+	require.NoError(s.WhenRunCopies())
+	s.ThenIngested("1.1", "1.2")
+	s.ThenFailed()
+}
+
+func (suite *TestKitSuite) TestMismatchesAreReported() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	t := new(recordingT)
+	s := NewScenario(t)
+	defer s.Close()
+	s.GivenPatient("123456789", NewFakeDocument("1.1", suite.Past))
+	require.NoError(s.WhenRunCopies())
+	assert.False(s.ThenIngested("1.2"))
+	assert.True(s.ThenFailed())
+	require.Len(t.errors, 1)
+	assert.Equal(`Ingested documents: expected ["1.2"], but got ["1.1"]`, t.errors[0])
+}
+
+// recordingT records the failures reported to it
+type recordingT struct {
+	errors []string
+}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func (t *recordingT) FailNow() {}
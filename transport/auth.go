@@ -0,0 +1,415 @@
+// Package transport holds the HTTP plumbing shared by the HIE and ingest clients: authentication,
+// TLS settings, retries and cassette recording.
+package transport
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator adds credentials to requests sent to the HIE or the ingest service
+type Authenticator interface {
+	// Authenticate adds credentials (usually an Authorization header) to the request.  Any requests
+	// needed to obtain credentials use the request's context.
+	Authenticate(req *http.Request) error
+	// Invalidate discards any cached credentials so that fresh ones are obtained for the next request.
+	// It reports whether anything was discarded (and so whether retrying a rejected request could help).
+	Invalidate() bool
+}
+
+// BasicAuthenticator authenticates using HTTP basic authentication
+type BasicAuthenticator struct {
+	User     string
+	Password string
+}
+
+func NewBasicAuthenticator(user, password string) *BasicAuthenticator {
+	return &BasicAuthenticator{
+		User:     user,
+		Password: password,
+	}
+}
+
+func (a *BasicAuthenticator) Authenticate(req *http.Request) error {
+	req.SetBasicAuth(a.User, a.Password)
+	return nil
+}
+
+func (a *BasicAuthenticator) Invalidate() bool { return false }
+
+// ClientCredentialsAuthenticator authenticates using bearer tokens obtained with the OAuth2
+// client_credentials grant, authenticating to the token endpoint with a shared client secret.
+type ClientCredentialsAuthenticator struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scope        string
+	Client       *http.Client
+	cache        tokenCache
+}
+
+func NewClientCredentialsAuthenticator(tokenURL, clientID, clientSecret, scope string) *ClientCredentialsAuthenticator {
+	return &ClientCredentialsAuthenticator{
+		TokenURL:     tokenURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scope:        scope,
+	}
+}
+
+func (a *ClientCredentialsAuthenticator) Authenticate(req *http.Request) error {
+	token, err := a.cache.get(req.Context(), a.Client, func() (*http.Request, error) {
+		form := url.Values{}
+		form.Set("grant_type", "client_credentials")
+		if a.Scope != "" {
+			form.Set("scope", a.Scope)
+		}
+		tReq, err := newTokenRequest(a.TokenURL, form)
+		if err != nil {
+			return nil, err
+		}
+		tReq.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+		return tReq, nil
+	})
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (a *ClientCredentialsAuthenticator) Invalidate() bool {
+	return a.cache.invalidate()
+}
+
+// SmartBackendAuthenticator authenticates using bearer tokens obtained with the SMART Backend
+// Services profile: the client_credentials grant with a JWT client assertion signed by a private
+// key whose public key is registered with the authorization server.  RSA keys sign with RS384 and
+// ECDSA keys sign with ES384.
+type SmartBackendAuthenticator struct {
+	TokenURL   string
+	ClientID   string
+	KeyID      string
+	Scope      string
+	PrivateKey crypto.Signer
+	Client     *http.Client
+	cache      tokenCache
+}
+
+func NewSmartBackendAuthenticator(tokenURL, clientID, keyID, scope string, privateKey crypto.Signer) *SmartBackendAuthenticator {
+	return &SmartBackendAuthenticator{
+		TokenURL:   tokenURL,
+		ClientID:   clientID,
+		KeyID:      keyID,
+		Scope:      scope,
+		PrivateKey: privateKey,
+	}
+}
+
+func (a *SmartBackendAuthenticator) Authenticate(req *http.Request) error {
+	token, err := a.cache.get(req.Context(), a.Client, func() (*http.Request, error) {
+		assertion, err := a.clientAssertion()
+		if err != nil {
+			return nil, err
+		}
+		form := url.Values{}
+		form.Set("grant_type", "client_credentials")
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", assertion)
+		if a.Scope != "" {
+			form.Set("scope", a.Scope)
+		}
+		return newTokenRequest(a.TokenURL, form)
+	})
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (a *SmartBackendAuthenticator) Invalidate() bool {
+	return a.cache.invalidate()
+}
+
+// clientAssertion builds the signed JWT that the SMART Backend Services profile uses in place of a
+// client secret
+func (a *SmartBackendAuthenticator) clientAssertion() (string, error) {
+	var alg string
+	switch key := a.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		alg = "RS384"
+	case *ecdsa.PrivateKey:
+		if key.Curve.Params().BitSize != 384 {
+			return "", errors.New("ES384 signatures require an ECDSA key on the P-384 curve")
+		}
+		alg = "ES384"
+	default:
+		return "", errors.New("Private key must be an RSA or ECDSA key")
+	}
+
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if a.KeyID != "" {
+		header["kid"] = a.KeyID
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": a.ClientID,
+		"sub": a.ClientID,
+		"aud": a.TokenURL,
+		"exp": now.Add(5 * time.Minute).Unix(),
+		"iat": now.Unix(),
+		"jti": fmt.Sprintf("%x", jti),
+	}
+
+	hb, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+
+	digest := sha512.Sum384([]byte(signingInput))
+	sig, err := a.PrivateKey.Sign(rand.Reader, digest[:], crypto.SHA384)
+	if err != nil {
+		return "", err
+	}
+	if alg == "ES384" {
+		// JWS wants the raw r||s values rather than the ASN.1 encoding that Sign produces
+		if sig, err = ecdsaRawSignature(sig, 48); err != nil {
+			return "", err
+		}
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func ecdsaRawSignature(der []byte, size int) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, 2*size)
+	rb, sb := sig.R.Bytes(), sig.S.Bytes()
+	copy(raw[size-len(rb):size], rb)
+	copy(raw[2*size-len(sb):], sb)
+	return raw, nil
+}
+
+// LoadPrivateKey loads a PEM-encoded RSA or ECDSA private key (in PKCS#1, SEC 1 or PKCS#8 form)
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse private key in %s: %s", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key type in %s", path)
+	}
+	return signer, nil
+}
+
+// AuthOptions describes how to authenticate to a service
+type AuthOptions struct {
+	// Mode is "none", "basic", "client-credentials" or "smart" (default: "basic" if a user is
+	// given, otherwise "none")
+	Mode     string `json:"mode"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	// TokenURL, ClientID and Scope configure the OAuth2 modes.  ClientSecret is used by
+	// client-credentials auth, and PrivateKey (the path to a PEM key) and KeyID by smart auth.
+	TokenURL     string `json:"tokenURL"`
+	ClientID     string `json:"clientID"`
+	ClientSecret string `json:"clientSecret"`
+	Scope        string `json:"scope"`
+	PrivateKey   string `json:"privateKey"`
+	KeyID        string `json:"keyID"`
+}
+
+// NewAuthenticator builds the Authenticator described by the options, or nil if no authentication
+// is configured.  Token requests are sent using the given client (or the default).
+func NewAuthenticator(opts AuthOptions, client *http.Client) (Authenticator, error) {
+	mode := opts.Mode
+	if mode == "" {
+		mode = "none"
+		if opts.User != "" {
+			mode = "basic"
+		}
+	}
+	switch mode {
+	case "none":
+		return nil, nil
+	case "basic":
+		return NewBasicAuthenticator(opts.User, opts.Password), nil
+	case "client-credentials", "smart":
+		if opts.TokenURL == "" || opts.ClientID == "" {
+			return nil, fmt.Errorf("%s auth requires a token URL and client ID", mode)
+		}
+	default:
+		return nil, fmt.Errorf("%s is not a supported authentication type", mode)
+	}
+
+	if mode == "client-credentials" {
+		if opts.ClientSecret == "" {
+			return nil, fmt.Errorf("%s auth requires a client secret", mode)
+		}
+		auth := NewClientCredentialsAuthenticator(opts.TokenURL, opts.ClientID, opts.ClientSecret, opts.Scope)
+		auth.Client = client
+		return auth, nil
+	}
+	if opts.PrivateKey == "" {
+		return nil, fmt.Errorf("%s auth requires a private key", mode)
+	}
+	key, err := LoadPrivateKey(opts.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	auth := NewSmartBackendAuthenticator(opts.TokenURL, opts.ClientID, opts.KeyID, opts.Scope, key)
+	auth.Client = client
+	return auth, nil
+}
+
+// tokenCache holds an OAuth2 access token until shortly before it expires
+type tokenCache struct {
+	mutex  sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// tokenExpiryMargin is how long before the advertised expiry a cached token is refreshed
+const tokenExpiryMargin = 30 * time.Second
+
+func (c *tokenCache) get(ctx context.Context, client *http.Client, newRequest func() (*http.Request, error)) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.token != "" && (c.expiry.IsZero() || time.Now().Before(c.expiry)) {
+		return c.token, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient(client).Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	tr := new(struct {
+		AccessToken      string `json:"access_token"`
+		TokenType        string `json:"token_type"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	})
+	if err := json.NewDecoder(resp.Body).Decode(tr); err != nil && resp.StatusCode == http.StatusOK {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK || tr.AccessToken == "" {
+		msg := tr.Error
+		if tr.ErrorDescription != "" {
+			msg += ": " + tr.ErrorDescription
+		}
+		return "", fmt.Errorf("Failed to obtain access token.  Received %d: %s %s", resp.StatusCode, resp.Status, msg)
+	}
+	if tr.TokenType != "" && !strings.EqualFold(tr.TokenType, "bearer") {
+		return "", fmt.Errorf("Unsupported access token type: %s", tr.TokenType)
+	}
+
+	c.token = tr.AccessToken
+	c.expiry = time.Time{}
+	if tr.ExpiresIn > 0 {
+		lifetime := time.Duration(tr.ExpiresIn) * time.Second
+		margin := tokenExpiryMargin
+		if margin > lifetime/2 {
+			margin = lifetime / 2
+		}
+		c.expiry = time.Now().Add(lifetime - margin)
+	}
+	return c.token, nil
+}
+
+func (c *tokenCache) invalidate() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	hadToken := c.token != ""
+	c.token = ""
+	c.expiry = time.Time{}
+	return hadToken
+}
+
+func newTokenRequest(tokenURL string, form url.Values) (*http.Request, error) {
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// DoAuthenticated sends the request built by newRequest with the given context, using the given
+// client and authenticator (either of which may be nil).  If the server responds with a 401, cached
+// credentials are discarded and the request is built and sent once more, so newRequest must be able
+// to produce a fresh copy of the request body.
+func DoAuthenticated(ctx context.Context, client *http.Client, auth Authenticator, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if auth != nil {
+			if err := auth.Authenticate(req); err != nil {
+				return nil, &AuthError{Err: err}
+			}
+		}
+		resp, err := httpClient(client).Do(req)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized || auth == nil || attempt > 1 || !auth.Invalidate() {
+			return resp, err
+		}
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,358 @@
+package transport
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestAuthSuite(t *testing.T) {
+	suite.Run(t, new(AuthSuite))
+}
+
+type AuthSuite struct {
+	suite.Suite
+	TokenServer   *httptest.Server
+	TokenRequests []*http.Request
+	TokenForms    []url.Values
+	TokenStatus   int
+	ExpiresIn     int
+}
+
+func (suite *AuthSuite) SetupTest() {
+	suite.TokenStatus = http.StatusOK
+	suite.ExpiresIn = 300
+	suite.TokenServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		suite.TokenRequests = append(suite.TokenRequests, r)
+		suite.TokenForms = append(suite.TokenForms, r.PostForm)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(suite.TokenStatus)
+		if suite.TokenStatus != http.StatusOK {
+			fmt.Fprint(w, `{"error":"invalid_client","error_description":"Unknown client"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":%d}`, len(suite.TokenRequests), suite.ExpiresIn)
+	}))
+}
+
+func (suite *AuthSuite) TearDownTest() {
+	if suite.TokenServer != nil {
+		suite.TokenServer.Close()
+	}
+	suite.TokenRequests = nil
+	suite.TokenForms = nil
+}
+
+func (suite *AuthSuite) TestBasicAuthenticator() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	auth := NewBasicAuthenticator("joe", "secret")
+	req, _ := http.NewRequest("GET", "http://example.org", nil)
+	require.NoError(auth.Authenticate(req))
+	user, password, ok := req.BasicAuth()
+	assert.True(ok)
+	assert.Equal("joe", user)
+	assert.Equal("secret", password)
+	assert.False(auth.Invalidate())
+}
+
+func (suite *AuthSuite) TestClientCredentialsCachesToken() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	auth := NewClientCredentialsAuthenticator(suite.TokenServer.URL, "integrator", "s3cret", "system/*.read")
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "http://example.org", nil)
+		require.NoError(auth.Authenticate(req))
+		assert.Equal("Bearer token-1", req.Header.Get("Authorization"))
+	}
+
+	require.Len(suite.TokenRequests, 1)
+	user, password, ok := suite.TokenRequests[0].BasicAuth()
+	assert.True(ok)
+	assert.Equal("integrator", user)
+	assert.Equal("s3cret", password)
+	assert.Equal("client_credentials", suite.TokenForms[0].Get("grant_type"))
+	assert.Equal("system/*.read", suite.TokenForms[0].Get("scope"))
+}
+
+func (suite *AuthSuite) TestClientCredentialsRefreshesExpiredToken() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	auth := NewClientCredentialsAuthenticator(suite.TokenServer.URL, "integrator", "s3cret", "")
+	req, _ := http.NewRequest("GET", "http://example.org", nil)
+	require.NoError(auth.Authenticate(req))
+	assert.Equal("Bearer token-1", req.Header.Get("Authorization"))
+	assert.Empty(suite.TokenForms[0].Get("scope"))
+
+	// The token should be refreshed a little before it actually expires
+	assert.True(auth.cache.expiry.Before(time.Now().Add(300 * time.Second)))
+	auth.cache.expiry = time.Now().Add(-1 * time.Second)
+	require.NoError(auth.Authenticate(req))
+	assert.Equal("Bearer token-2", req.Header.Get("Authorization"))
+	assert.Len(suite.TokenRequests, 2)
+}
+
+func (suite *AuthSuite) TestClientCredentialsTokenError() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.TokenStatus = http.StatusUnauthorized
+	auth := NewClientCredentialsAuthenticator(suite.TokenServer.URL, "integrator", "wrong", "")
+	req, _ := http.NewRequest("GET", "http://example.org", nil)
+	err := auth.Authenticate(req)
+	require.Error(err)
+	assert.Contains(err.Error(), "401")
+	assert.Contains(err.Error(), "Unknown client")
+	assert.Empty(req.Header.Get("Authorization"))
+}
+
+func (suite *AuthSuite) TestSmartBackendRS384() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	auth := NewSmartBackendAuthenticator(suite.TokenServer.URL, "integrator", "key-1", "system/DocumentReference.read", key)
+	req, _ := http.NewRequest("GET", "http://example.org", nil)
+	require.NoError(auth.Authenticate(req))
+	assert.Equal("Bearer token-1", req.Header.Get("Authorization"))
+
+	require.Len(suite.TokenForms, 1)
+	form := suite.TokenForms[0]
+	assert.Equal("client_credentials", form.Get("grant_type"))
+	assert.Equal("urn:ietf:params:oauth:client-assertion-type:jwt-bearer", form.Get("client_assertion_type"))
+	assert.Equal("system/DocumentReference.read", form.Get("scope"))
+
+	header, claims, signingInput, sig := suite.parseJWT(form.Get("client_assertion"))
+	assert.Equal("RS384", header["alg"])
+	assert.Equal("key-1", header["kid"])
+	suite.assertClaims(claims)
+	digest := sha512.Sum384([]byte(signingInput))
+	assert.NoError(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA384, digest[:], sig))
+}
+
+func (suite *AuthSuite) TestSmartBackendES384() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(err)
+	auth := NewSmartBackendAuthenticator(suite.TokenServer.URL, "integrator", "", "", key)
+	req, _ := http.NewRequest("GET", "http://example.org", nil)
+	require.NoError(auth.Authenticate(req))
+
+	header, claims, signingInput, sig := suite.parseJWT(suite.TokenForms[0].Get("client_assertion"))
+	assert.Equal("ES384", header["alg"])
+	assert.NotContains(header, "kid")
+	suite.assertClaims(claims)
+	require.Len(sig, 96)
+	digest := sha512.Sum384([]byte(signingInput))
+	r, s := new(big.Int).SetBytes(sig[:48]), new(big.Int).SetBytes(sig[48:])
+	assert.True(ecdsa.Verify(&key.PublicKey, digest[:], r, s))
+}
+
+func (suite *AuthSuite) TestSmartBackendWrongCurve() {
+	require := suite.Require()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	auth := NewSmartBackendAuthenticator(suite.TokenServer.URL, "integrator", "", "", key)
+	req, _ := http.NewRequest("GET", "http://example.org", nil)
+	require.Error(auth.Authenticate(req))
+	require.Empty(suite.TokenRequests)
+}
+
+func (suite *AuthSuite) parseJWT(jwt string) (header map[string]interface{}, claims map[string]interface{}, signingInput string, sig []byte) {
+	require := suite.Require()
+
+	parts := strings.Split(jwt, ".")
+	require.Len(parts, 3)
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	require.NoError(err)
+	require.NoError(json.Unmarshal(hb, &header))
+	cb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(err)
+	require.NoError(json.Unmarshal(cb, &claims))
+	sig, err = base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(err)
+	return header, claims, parts[0] + "." + parts[1], sig
+}
+
+func (suite *AuthSuite) assertClaims(claims map[string]interface{}) {
+	assert := suite.Assert()
+
+	assert.Equal("integrator", claims["iss"])
+	assert.Equal("integrator", claims["sub"])
+	assert.Equal(suite.TokenServer.URL, claims["aud"])
+	assert.NotEmpty(claims["jti"])
+	exp := time.Unix(int64(claims["exp"].(float64)), 0)
+	assert.True(exp.After(time.Now()))
+	assert.True(exp.Before(time.Now().Add(6 * time.Minute)))
+}
+
+func (suite *AuthSuite) TestDoAuthenticatedRefreshesOn401() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var authHeaders []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeaders = append(authHeaders, r.Header.Get("Authorization"))
+		// Pretend the first token was revoked
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	auth := NewClientCredentialsAuthenticator(suite.TokenServer.URL, "integrator", "s3cret", "")
+	resp, err := DoAuthenticated(context.Background(), nil, auth, func() (*http.Request, error) {
+		return http.NewRequest("GET", server.URL, nil)
+	})
+	require.NoError(err)
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal([]string{"Bearer token-1", "Bearer token-2"}, authHeaders)
+	assert.Len(suite.TokenRequests, 2)
+}
+
+func (suite *AuthSuite) TestDoAuthenticatedGivesUpAfterOneRefresh() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	auth := NewClientCredentialsAuthenticator(suite.TokenServer.URL, "integrator", "s3cret", "")
+	resp, err := DoAuthenticated(context.Background(), nil, auth, func() (*http.Request, error) {
+		return http.NewRequest("GET", server.URL, nil)
+	})
+	require.NoError(err)
+	defer resp.Body.Close()
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(2, requests)
+
+	// Basic auth credentials can't be refreshed, so there's no point in trying again
+	requests = 0
+	resp, err = DoAuthenticated(context.Background(), nil, NewBasicAuthenticator("joe", "wrong"), func() (*http.Request, error) {
+		return http.NewRequest("GET", server.URL, nil)
+	})
+	require.NoError(err)
+	defer resp.Body.Close()
+	assert.Equal(1, requests)
+}
+
+func (suite *AuthSuite) TestDoAuthenticatedReportsAuthErrors() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.TokenStatus = http.StatusUnauthorized
+	auth := NewClientCredentialsAuthenticator(suite.TokenServer.URL, "integrator", "wrong", "")
+	_, err := DoAuthenticated(context.Background(), nil, auth, func() (*http.Request, error) {
+		return http.NewRequest("GET", "http://example.org", nil)
+	})
+	require.Error(err)
+	require.IsType(&AuthError{}, err)
+	assert.Contains(err.Error(), "Unknown client")
+}
+
+func (suite *AuthSuite) TestLoadPrivateKey() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	tempDir, err := ioutil.TempDir("", "auth_test")
+	require.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(err)
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(err)
+	pkcs8DER, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	require.NoError(err)
+
+	for name, block := range map[string]*pem.Block{
+		"rsa.pem":   {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+		"ec.pem":    {Type: "EC PRIVATE KEY", Bytes: ecDER},
+		"pkcs8.pem": {Type: "PRIVATE KEY", Bytes: pkcs8DER},
+	} {
+		require.NoError(ioutil.WriteFile(path.Join(tempDir, name), pem.EncodeToMemory(block), 0600))
+	}
+
+	key, err := LoadPrivateKey(path.Join(tempDir, "rsa.pem"))
+	require.NoError(err)
+	assert.IsType(&rsa.PrivateKey{}, key)
+	key, err = LoadPrivateKey(path.Join(tempDir, "ec.pem"))
+	require.NoError(err)
+	assert.IsType(&ecdsa.PrivateKey{}, key)
+	key, err = LoadPrivateKey(path.Join(tempDir, "pkcs8.pem"))
+	require.NoError(err)
+	assert.IsType(&ecdsa.PrivateKey{}, key)
+
+	require.NoError(ioutil.WriteFile(path.Join(tempDir, "junk.pem"), []byte("not a key"), 0600))
+	_, err = LoadPrivateKey(path.Join(tempDir, "junk.pem"))
+	assert.Error(err)
+}
+
+func (suite *AuthSuite) TestNewAuthenticator() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	auth, err := NewAuthenticator(AuthOptions{}, nil)
+	require.NoError(err)
+	assert.Nil(auth)
+
+	// Basic auth is the default when there's a user
+	auth, err = NewAuthenticator(AuthOptions{User: "user", Password: "secret"}, nil)
+	require.NoError(err)
+	assert.Equal(NewBasicAuthenticator("user", "secret"), auth)
+
+	client := &http.Client{}
+	auth, err = NewAuthenticator(AuthOptions{Mode: "client-credentials", TokenURL: suite.TokenServer.URL, ClientID: "id", ClientSecret: "secret", Scope: "read"}, client)
+	require.NoError(err)
+	ccAuth, ok := auth.(*ClientCredentialsAuthenticator)
+	require.True(ok)
+	assert.Equal("read", ccAuth.Scope)
+	assert.Equal(client, ccAuth.Client)
+
+	_, err = NewAuthenticator(AuthOptions{Mode: "client-credentials", ClientID: "id", ClientSecret: "secret"}, nil)
+	assert.EqualError(err, "client-credentials auth requires a token URL and client ID")
+	_, err = NewAuthenticator(AuthOptions{Mode: "client-credentials", TokenURL: suite.TokenServer.URL, ClientID: "id"}, nil)
+	assert.EqualError(err, "client-credentials auth requires a client secret")
+	_, err = NewAuthenticator(AuthOptions{Mode: "smart", TokenURL: suite.TokenServer.URL, ClientID: "id"}, nil)
+	assert.EqualError(err, "smart auth requires a private key")
+	_, err = NewAuthenticator(AuthOptions{Mode: "kerberos"}, nil)
+	assert.EqualError(err, "kerberos is not a supported authentication type")
+}
@@ -0,0 +1,402 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// A cassette is a directory of recorded HTTP exchanges, one JSON file per exchange, numbered in the
+// order they were made.  Recording the integrator's traffic with an HIE (see CassetteRecorder)
+// allows an incident to be reproduced later, without the HIE, by playing the cassette back (see
+// CassettePlayer).  Cassettes can be checked into fixtures/cassettes for regression tests.
+//
+// Credentials are always redacted from cassettes, as are any PHI fields that are configured (see
+// Redactor), so cassettes can be shared.
+
+// CassetteInteraction is one recorded exchange.  If the request failed without a response, Error
+// holds the error instead.
+type CassetteInteraction struct {
+	Request  CassetteRequest   `json:"request"`
+	Response *CassetteResponse `json:"response,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+type CassetteRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	CassetteBody
+}
+
+type CassetteResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	CassetteBody
+}
+
+// CassetteBody holds a request or response body, as text if it's UTF-8 and otherwise base64 encoded
+type CassetteBody struct {
+	Body         string `json:"body"`
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+}
+
+func newCassetteBody(data []byte) CassetteBody {
+	if utf8.Valid(data) {
+		return CassetteBody{Body: string(data)}
+	}
+	return CassetteBody{Body: base64.StdEncoding.EncodeToString(data), BodyEncoding: "base64"}
+}
+
+func (b CassetteBody) bytes() ([]byte, error) {
+	if b.BodyEncoding == "base64" {
+		return base64.StdEncoding.DecodeString(b.Body)
+	}
+	return []byte(b.Body), nil
+}
+
+// credentialHeaders and credentialFields are always redacted
+var (
+	credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+	credentialFields  = []string{"access_token", "refresh_token", "id_token", "client_secret", "client_assertion", "assertion", "password", "Password"}
+)
+
+// Redactor masks credentials and PHI in recorded exchanges.  Fields are matched by name in URL query
+// parameters, form bodies, JSON objects and XML elements and attributes.  Values are masked with
+// an "X" for each byte rather than removed, so that documents keep their size and can still be
+// verified against it, and so that masked URLs can still be matched when a cassette is played.
+// Credentials in a URL's user info are removed.
+type Redactor struct {
+	// Fields are the names of the PHI fields to mask, e.g., "ee", "given", "family" and "birthTime"
+	Fields []string
+	// Values are PHI values to mask wherever they appear in a URL, e.g., the EE numbers being copied,
+	// which may be in the path (from an "{ee}" URL template) or in a parameter that isn't a field
+	Values []string
+
+	once     sync.Once
+	params   *regexp.Regexp
+	json     *regexp.Regexp
+	xmlText  *regexp.Regexp
+	xmlTags  *regexp.Regexp
+	xmlAttrs *regexp.Regexp
+}
+
+func NewRedactor(fields ...string) *Redactor {
+	return &Redactor{Fields: fields}
+}
+
+func (r *Redactor) compile() {
+	var names []string
+	for _, f := range append(append([]string{}, credentialFields...), r.Fields...) {
+		if f = strings.TrimSpace(f); f != "" {
+			names = append(names, regexp.QuoteMeta(f))
+		}
+	}
+	alt := "(?:" + strings.Join(names, "|") + ")"
+	r.params = regexp.MustCompile(`(?:^|[?&])` + alt + `=([^&#]*)`)
+	r.json = regexp.MustCompile(`"` + alt + `"\s*:\s*"((?:[^"\\]|\\.)*)"`)
+	// Self-closing elements have no text to mask
+	r.xmlText = regexp.MustCompile(`<(?:[\w.-]+:)?` + alt + `(?:\s[^<>]*[^/<>]|\s)?>([^<]*)<`)
+	// CDA often keeps values in attributes, e.g., <birthTime value="19700101"/>
+	r.xmlTags = regexp.MustCompile(`<(?:[\w.-]+:)?` + alt + `(\s[^<>]*)>`)
+	r.xmlAttrs = regexp.MustCompile(`\s(?:[\w.-]+:)?` + alt + `\s*=\s*"([^"]*)"`)
+}
+
+// userInfo matches the user info in a URL, e.g., "user:password@"
+var userInfo = regexp.MustCompile(`^([a-zA-Z][\w+.-]*://)[^/?#@]*@`)
+
+// URL masks fields in a URL's query and values anywhere in the URL, and removes its user info
+func (r *Redactor) URL(u string) string {
+	r.once.Do(r.compile)
+	u = userInfo.ReplaceAllString(u, "$1")
+	if i := strings.Index(u, "?"); i >= 0 {
+		u = u[:i] + mask(r.params, u[i:])
+	}
+	for _, v := range r.Values {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		for _, form := range []string{v, url.QueryEscape(v)} {
+			u = strings.Replace(u, form, strings.Repeat("X", len(form)), -1)
+		}
+	}
+	return u
+}
+
+// Header masks credentials in headers
+func (r *Redactor) Header(h http.Header) http.Header {
+	redacted := make(http.Header, len(h))
+	for name, vals := range h {
+		redacted[name] = append([]string{}, vals...)
+	}
+	for _, name := range credentialHeaders {
+		if _, ok := redacted[name]; ok {
+			redacted.Set(name, "REDACTED")
+		}
+	}
+	return redacted
+}
+
+// Body masks fields in a form, JSON or XML body
+func (r *Redactor) Body(contentType string, body []byte) []byte {
+	r.once.Do(r.compile)
+	trimmed := bytes.TrimSpace(body)
+	switch {
+	case len(trimmed) == 0:
+		return body
+	case strings.Contains(contentType, "x-www-form-urlencoded"):
+		return []byte(mask(r.params, string(body)))
+	case trimmed[0] == '{' || trimmed[0] == '[':
+		return []byte(mask(r.json, string(body)))
+	case trimmed[0] == '<':
+		masked := mask(r.xmlAttrs, mask(r.xmlText, string(body)))
+		return []byte(maskQuoted(r.xmlTags, masked))
+	}
+	return body
+}
+
+// mask replaces each byte of the text matched by the regular expression's first group with an "X"
+func mask(re *regexp.Regexp, s string) string {
+	matches := re.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s
+	}
+	masked := []byte(s)
+	for _, m := range matches {
+		for i := m[2]; i < m[3]; i++ {
+			masked[i] = 'X'
+		}
+	}
+	return string(masked)
+}
+
+// maskQuoted replaces each byte of the quoted values in the text matched by the regular expression's
+// first group with an "X"
+func maskQuoted(re *regexp.Regexp, s string) string {
+	masked := []byte(s)
+	for _, m := range re.FindAllStringSubmatchIndex(s, -1) {
+		quoted := false
+		for i := m[2]; i < m[3]; i++ {
+			if masked[i] == '"' {
+				quoted = !quoted
+			} else if quoted {
+				masked[i] = 'X'
+			}
+		}
+	}
+	return string(masked)
+}
+
+// CassetteRecorder is an http.RoundTripper that records every exchange to a cassette
+type CassetteRecorder struct {
+	Dir       string
+	Transport http.RoundTripper
+	Redactor  *Redactor
+
+	mu    sync.Mutex
+	count int
+}
+
+// NewCassetteRecorder records the exchanges made through the transport (default:
+// http.DefaultTransport) to the directory, redacting them with the redactor (default: credentials
+// only).  Recording continues the numbering of any exchanges already in the directory.
+func NewCassetteRecorder(dir string, transport http.RoundTripper, redactor *Redactor) (*CassetteRecorder, error) {
+	if dir == "" {
+		return nil, errors.New("A path to the cassette must be provided")
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	files, err := cassetteFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if redactor == nil {
+		redactor = NewRedactor()
+	}
+	return &CassetteRecorder{Dir: dir, Transport: transport, Redactor: redactor, count: len(files)}, nil
+}
+
+func (c *CassetteRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		r := *req
+		r.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+		req = &r
+	}
+	interaction := &CassetteInteraction{
+		Request: CassetteRequest{
+			Method:       req.Method,
+			URL:          c.Redactor.URL(req.URL.String()),
+			Header:       c.Redactor.Header(req.Header),
+			CassetteBody: newCassetteBody(c.Redactor.Body(req.Header.Get("Content-Type"), reqBody)),
+		},
+	}
+
+	resp, err := c.Transport.RoundTrip(req)
+	if err != nil {
+		interaction.Error = err.Error()
+		c.write(interaction)
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		interaction.Error = err.Error()
+		c.write(interaction)
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	interaction.Response = &CassetteResponse{
+		Status:       resp.StatusCode,
+		Header:       c.Redactor.Header(resp.Header),
+		CassetteBody: newCassetteBody(c.Redactor.Body(resp.Header.Get("Content-Type"), respBody)),
+	}
+	if err := c.write(interaction); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Error recording to cassette: %s", err)
+	}
+	return resp, nil
+}
+
+func (c *CassetteRecorder) write(interaction *CassetteInteraction) error {
+	// Leave markup unescaped so that the cassette is easy to read
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(interaction); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count++
+	return ioutil.WriteFile(filepath.Join(c.Dir, fmt.Sprintf("%06d.json", c.count)), buf.Bytes(), 0644)
+}
+
+// CassettePlayer is an http.RoundTripper that answers requests from a cassette rather than sending
+// them.  Requests are matched by method and (redacted) URL.  When the same request was recorded
+// more than once, the recorded responses are played in order, and the last one is repeated.
+type CassettePlayer struct {
+	Redactor *Redactor
+
+	mu           sync.Mutex
+	interactions map[string][]*CassetteInteraction
+}
+
+// NewCassettePlayer loads a cassette.  The redactor must mask the same fields as the one the
+// cassette was recorded with, so that requests can be matched.
+func NewCassettePlayer(dir string, redactor *Redactor) (*CassettePlayer, error) {
+	files, err := cassetteFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No recorded exchanges in %s", dir)
+	}
+	if redactor == nil {
+		redactor = NewRedactor()
+	}
+	p := &CassettePlayer{Redactor: redactor, interactions: make(map[string][]*CassetteInteraction)}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		interaction := new(CassetteInteraction)
+		if err := json.Unmarshal(data, interaction); err != nil {
+			return nil, fmt.Errorf("Invalid exchange in %s: %s", file, err)
+		}
+		key := interaction.Request.Method + " " + interaction.Request.URL
+		p.interactions[key] = append(p.interactions[key], interaction)
+	}
+	return p, nil
+}
+
+func (p *CassettePlayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	key := req.Method + " " + p.Redactor.URL(req.URL.String())
+	p.mu.Lock()
+	recorded := p.interactions[key]
+	if len(recorded) == 0 {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("No recorded exchange for %s", key)
+	}
+	interaction := recorded[0]
+	if len(recorded) > 1 {
+		p.interactions[key] = recorded[1:]
+	}
+	p.mu.Unlock()
+
+	if interaction.Response == nil {
+		return nil, errors.New(interaction.Error)
+	}
+	body, err := interaction.Response.bytes()
+	if err != nil {
+		return nil, err
+	}
+	status := interaction.Response.Status
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        interaction.Response.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// cassetteFiles lists the exchanges in a cassette in the order they were recorded
+func cassetteFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// UseCassette makes a client record its exchanges to the cassette in the directory, or, if playing,
+// answer its requests from the cassette instead of sending them
+func UseCassette(client *http.Client, dir string, play bool, redactor *Redactor) error {
+	if play {
+		player, err := NewCassettePlayer(dir, redactor)
+		if err != nil {
+			return err
+		}
+		client.Transport = player
+		return nil
+	}
+	recorder, err := NewCassetteRecorder(dir, client.Transport, redactor)
+	if err != nil {
+		return err
+	}
+	client.Transport = recorder
+	return nil
+}
@@ -0,0 +1,32 @@
+package transport
+
+import "fmt"
+
+// StatusError is returned when a server responds with an unsuccessful HTTP status, so that callers
+// can tell what kind of failure it was from the status
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+// NewStatusError creates a status error with a formatted message
+func NewStatusError(statusCode int, format string, a ...interface{}) *StatusError {
+	return &StatusError{
+		StatusCode: statusCode,
+		Message:    fmt.Sprintf(format, a...),
+	}
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+// AuthError is returned when a request couldn't be authenticated, e.g., because an access token
+// couldn't be obtained
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return e.Err.Error()
+}
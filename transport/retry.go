@@ -0,0 +1,140 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy describes how requests that fail for transient reasons (connection problems, or a
+// 408, 429, 502, 503 or 504 response) are retried.  Retries are delayed with exponential backoff
+// and jitter, or by the server's Retry-After header when it sends one.
+type RetryPolicy struct {
+	// MaxRetries is the number of times a request is retried after the first attempt
+	MaxRetries int
+	// InitialBackoff is the delay before the first retry.  It doubles for each subsequent retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts (zero means no cap).  If the server asks for a
+	// longer delay with Retry-After, the request is not retried.
+	MaxBackoff time.Duration
+	sleep      func(time.Duration)
+}
+
+func NewRetryPolicy(maxRetries int, initialBackoff, maxBackoff time.Duration) *RetryPolicy {
+	return &RetryPolicy{
+		MaxRetries:     maxRetries,
+		InitialBackoff: initialBackoff,
+		MaxBackoff:     maxBackoff,
+	}
+}
+
+// Do sends a request using send, retrying it according to the policy.  If safe is true, the
+// request may be repeated even when it might already have reached the server (e.g., a GET or a
+// query).  Otherwise it is only retried when the server certainly did not process it: the
+// connection could not be established, or the server responded with a 429 or 503.  A nil policy
+// sends the request once.  Retries stop as soon as the context is done.
+func (p *RetryPolicy) Do(ctx context.Context, desc string, safe bool, send func() (*http.Response, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := send()
+		if p == nil || attempt > p.MaxRetries || ctx.Err() != nil || !shouldRetry(resp, err, safe) {
+			return resp, err
+		}
+
+		wait := p.backoff(attempt)
+		var reason string
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			if after, ok := retryAfter(resp); ok {
+				if p.MaxBackoff > 0 && after > p.MaxBackoff {
+					log.Printf("Attempt %d of %s failed: %s.  Server asked to wait %s before retrying, which exceeds the maximum backoff.\n", attempt, desc, reason, after)
+					return resp, err
+				}
+				wait = after
+			}
+			// Drain the body so the connection can be reused
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		log.Printf("Attempt %d of %s failed: %s.  Retrying in %s.\n", attempt, desc, reason, wait)
+		if p.sleep != nil {
+			p.sleep(wait)
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// backoff returns the delay before the given retry: the initial backoff doubled for each previous
+// retry (up to the maximum), with jitter so that clients don't retry in lockstep
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	// Wait somewhere between half and all of the backoff
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func shouldRetry(resp *http.Response, err error, safe bool) bool {
+	if err != nil {
+		return safe || isDialError(err)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusRequestTimeout, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return safe
+	}
+	return false
+}
+
+// isDialError reports whether the error occurred while establishing a connection, in which case
+// nothing was sent to the server
+func isDialError(err error) bool {
+	if uErr, ok := err.(*url.Error); ok {
+		err = uErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// retryAfter parses the response's Retry-After header, which may be a number of seconds or an
+// HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	val := resp.Header.Get("Retry-After")
+	if val == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(val); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		d := t.Sub(time.Now())
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
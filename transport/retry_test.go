@@ -0,0 +1,240 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestRetrySuite(t *testing.T) {
+	suite.Run(t, new(RetrySuite))
+}
+
+type RetrySuite struct {
+	suite.Suite
+	Server *httptest.Server
+	// Statuses are the status codes to respond with, in order.  Once they're used up, respond 200.
+	Statuses   []int
+	RetryAfter string
+	Attempts   int
+	Sleeps     []time.Duration
+	Policy     *RetryPolicy
+}
+
+func (suite *RetrySuite) SetupTest() {
+	suite.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.Attempts++
+		if len(suite.Statuses) > 0 {
+			status := suite.Statuses[0]
+			suite.Statuses = suite.Statuses[1:]
+			if suite.RetryAfter != "" {
+				w.Header().Set("Retry-After", suite.RetryAfter)
+			}
+			w.WriteHeader(status)
+		}
+	}))
+
+	suite.Policy = NewRetryPolicy(3, 100*time.Millisecond, time.Second)
+	suite.Policy.sleep = func(d time.Duration) {
+		suite.Sleeps = append(suite.Sleeps, d)
+	}
+}
+
+func (suite *RetrySuite) TearDownTest() {
+	if suite.Server != nil {
+		suite.Server.Close()
+	}
+	suite.Statuses = nil
+	suite.RetryAfter = ""
+	suite.Attempts = 0
+	suite.Sleeps = nil
+}
+
+func (suite *RetrySuite) get(safe bool) (*http.Response, error) {
+	return suite.Policy.Do(context.Background(), "test", safe, func() (*http.Response, error) {
+		return http.Get(suite.Server.URL)
+	})
+}
+
+func (suite *RetrySuite) TestRetriesTransientFailures() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Statuses = []int{http.StatusServiceUnavailable, http.StatusBadGateway}
+	resp, err := suite.get(true)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal(3, suite.Attempts)
+	require.Len(suite.Sleeps, 2)
+	assert.True(suite.Sleeps[0] >= 50*time.Millisecond && suite.Sleeps[0] <= 100*time.Millisecond, "first backoff was %s", suite.Sleeps[0])
+	assert.True(suite.Sleeps[1] >= 100*time.Millisecond && suite.Sleeps[1] <= 200*time.Millisecond, "second backoff was %s", suite.Sleeps[1])
+}
+
+func (suite *RetrySuite) TestGivesUpAfterMaxRetries() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Statuses = []int{503, 503, 503, 503, 503}
+	resp, err := suite.get(true)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(4, suite.Attempts)
+	assert.Len(suite.Sleeps, 3)
+}
+
+func (suite *RetrySuite) TestDoesNotRetryPermanentFailures() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Statuses = []int{http.StatusNotFound}
+	resp, err := suite.get(true)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+	assert.Equal(1, suite.Attempts)
+
+	suite.Attempts = 0
+	suite.Statuses = []int{http.StatusInternalServerError}
+	resp, err = suite.get(true)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(1, suite.Attempts)
+}
+
+func (suite *RetrySuite) TestHonorsRetryAfter() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Statuses = []int{http.StatusTooManyRequests}
+	suite.RetryAfter = "1"
+	resp, err := suite.get(true)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal([]time.Duration{time.Second}, suite.Sleeps)
+}
+
+func (suite *RetrySuite) TestRetryAfterBeyondMaxBackoff() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Statuses = []int{http.StatusServiceUnavailable}
+	suite.RetryAfter = time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	resp, err := suite.get(true)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(1, suite.Attempts)
+	assert.Empty(suite.Sleeps)
+}
+
+func (suite *RetrySuite) TestUnsafeRequestsOnlyRetryUnambiguousFailures() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// A 502 may have come after the upstream server processed the request
+	suite.Statuses = []int{http.StatusBadGateway}
+	resp, err := suite.get(false)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(1, suite.Attempts)
+
+	// A 503 means the server didn't process it
+	suite.Attempts = 0
+	suite.Statuses = []int{http.StatusServiceUnavailable}
+	resp, err = suite.get(false)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal(2, suite.Attempts)
+}
+
+func (suite *RetrySuite) TestConnectionErrors() {
+	assert := suite.Assert()
+
+	// Dropping the connection mid-request is ambiguous, so only safe requests are retried
+	dropped := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.Attempts++
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer dropped.Close()
+	post := func(url string, safe bool) error {
+		resp, err := suite.Policy.Do(context.Background(), "test", safe, func() (*http.Response, error) {
+			return http.Post(url, "text/plain", bytes.NewBufferString("data"))
+		})
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	assert.Error(post(dropped.URL, false))
+	assert.Equal(1, suite.Attempts)
+
+	suite.Attempts = 0
+	assert.Error(post(dropped.URL, true))
+	assert.Equal(4, suite.Attempts)
+
+	// Failing to connect at all is never ambiguous
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Require().NoError(err)
+	closedURL := "http://" + l.Addr().String()
+	l.Close()
+	suite.Sleeps = nil
+	assert.Error(post(closedURL, false))
+	assert.Len(suite.Sleeps, 3)
+}
+
+func (suite *RetrySuite) TestNilPolicySendsOnce() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Statuses = []int{http.StatusServiceUnavailable}
+	var policy *RetryPolicy
+	resp, err := policy.Do(context.Background(), "test", true, func() (*http.Response, error) {
+		return http.Get(suite.Server.URL)
+	})
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(1, suite.Attempts)
+}
+
+func (suite *RetrySuite) TestBackoffIsCapped() {
+	assert := suite.Assert()
+
+	for retry := 1; retry <= 100; retry++ {
+		d := suite.Policy.backoff(retry)
+		assert.True(d <= time.Second, "backoff for retry %d was %s", retry, d)
+	}
+	assert.True(suite.Policy.backoff(10) >= 500*time.Millisecond)
+}
+
+func (suite *RetrySuite) TestStopsWhenContextIsDone() {
+	assert := suite.Assert()
+
+	suite.Statuses = []int{503, 503}
+	policy := NewRetryPolicy(3, time.Hour, time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := policy.Do(ctx, "test", true, func() (*http.Response, error) {
+		return http.Get(suite.Server.URL)
+	})
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.Equal(1, suite.Attempts)
+	assert.True(time.Since(start) < time.Minute)
+}
@@ -0,0 +1,148 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// TLSOptions describes the TLS settings to use when connecting to a service
+type TLSOptions struct {
+	// CertFile and KeyFile are the PEM-encoded client certificate and key for mutual TLS
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// CAFile is a PEM bundle of CA certificates to trust instead of the system roots
+	CAFile string `json:"caFile"`
+	// MinVersion is the minimum TLS version to accept: "1.0", "1.1" or "1.2" (default: Go's default)
+	MinVersion string `json:"minVersion"`
+	// Renegotiate allows the server to request renegotiation, which some HIEs use to ask for a
+	// client certificate after the initial handshake
+	Renegotiate bool `json:"renegotiate"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+// NewTLSConfig builds a tls.Config from the given options
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	config := new(tls.Config)
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return nil, errors.New("Both a client certificate and key must be provided for mutual TLS")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No CA certificates found in %s", opts.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if opts.MinVersion != "" {
+		v, ok := tlsVersions[opts.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("%s is not a supported TLS version", opts.MinVersion)
+		}
+		config.MinVersion = v
+	}
+
+	if opts.Renegotiate {
+		config.Renegotiation = tls.RenegotiateFreelyAsClient
+	}
+
+	return config, nil
+}
+
+// ServerTLSOptions configure TLS for a server that the integrator serves, such as the admin API
+type ServerTLSOptions struct {
+	// CertFile and KeyFile are the server's PEM-encoded certificate and key
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, if set, is a PEM bundle of CA certificates, one of which must have signed the
+	// certificate each client presents
+	ClientCAFile string
+	// MinVersion is the minimum TLS version to accept: "1.0", "1.1" or "1.2" (default: Go's default)
+	MinVersion string
+}
+
+// NewServerTLSConfig builds a server's tls.Config from the given options
+func NewServerTLSConfig(opts ServerTLSOptions) (*tls.Config, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, errors.New("Both a server certificate and key must be provided for TLS")
+	}
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if opts.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No CA certificates found in %s", opts.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if opts.MinVersion != "" {
+		v, ok := tlsVersions[opts.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("%s is not a supported TLS version", opts.MinVersion)
+		}
+		config.MinVersion = v
+	}
+
+	return config, nil
+}
+
+// NewHttpClient creates an HTTP client that uses the given TLS configuration but otherwise behaves
+// like http.DefaultClient.
+func NewHttpClient(tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			TLSClientConfig:       tlsConfig,
+		},
+	}
+}
+
+// httpClient returns the client to use for requests, falling back to http.DefaultClient
+func httpClient(client *http.Client) *http.Client {
+	if client == nil {
+		return http.DefaultClient
+	}
+	return client
+}
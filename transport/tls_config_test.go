@@ -0,0 +1,211 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestTLSConfigSuite(t *testing.T) {
+	suite.Run(t, new(TLSConfigSuite))
+}
+
+type TLSConfigSuite struct {
+	suite.Suite
+	Dir      string
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	Server   *httptest.Server
+}
+
+func (suite *TLSConfigSuite) SetupTest() {
+	require := suite.Require()
+
+	dir, err := ioutil.TempDir("", "integrator-tls")
+	require.NoError(err)
+	suite.Dir = dir
+
+	clientCert, clientKey := suite.selfSignedCert("integrator")
+	suite.CertFile = filepath.Join(dir, "client.pem")
+	suite.KeyFile = filepath.Join(dir, "client-key.pem")
+	require.NoError(ioutil.WriteFile(suite.CertFile, clientCert, 0600))
+	require.NoError(ioutil.WriteFile(suite.KeyFile, clientKey, 0600))
+
+	clientPool := x509.NewCertPool()
+	require.True(clientPool.AppendCertsFromPEM(clientCert))
+
+	suite.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	suite.Server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientPool,
+	}
+	suite.Server.StartTLS()
+
+	// The test server's certificate is self-signed, so it can serve as its own CA
+	der := suite.Server.TLS.Certificates[0].Certificate[0]
+	suite.CAFile = filepath.Join(dir, "ca.pem")
+	require.NoError(ioutil.WriteFile(suite.CAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+}
+
+func (suite *TLSConfigSuite) TearDownTest() {
+	if suite.Server != nil {
+		suite.Server.Close()
+	}
+	os.RemoveAll(suite.Dir)
+}
+
+func (suite *TLSConfigSuite) TestMutualTLS() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	config, err := NewTLSConfig(TLSOptions{CertFile: suite.CertFile, KeyFile: suite.KeyFile, CAFile: suite.CAFile})
+	require.NoError(err)
+	resp, err := NewHttpClient(config).Get(suite.Server.URL)
+	require.NoError(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(err)
+	assert.Equal("integrator", string(body))
+}
+
+func (suite *TLSConfigSuite) TestMissingClientCertificate() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	config, err := NewTLSConfig(TLSOptions{CAFile: suite.CAFile})
+	require.NoError(err)
+	_, err = NewHttpClient(config).Get(suite.Server.URL)
+	assert.Error(err)
+}
+
+func (suite *TLSConfigSuite) TestUntrustedServer() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	config, err := NewTLSConfig(TLSOptions{CertFile: suite.CertFile, KeyFile: suite.KeyFile})
+	require.NoError(err)
+	_, err = NewHttpClient(config).Get(suite.Server.URL)
+	assert.Error(err)
+}
+
+func (suite *TLSConfigSuite) TestMinVersionAndRenegotiation() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	config, err := NewTLSConfig(TLSOptions{})
+	require.NoError(err)
+	assert.Equal(uint16(0), config.MinVersion)
+	assert.Equal(tls.RenegotiateNever, config.Renegotiation)
+
+	config, err = NewTLSConfig(TLSOptions{MinVersion: "1.2", Renegotiate: true})
+	require.NoError(err)
+	assert.Equal(uint16(tls.VersionTLS12), config.MinVersion)
+	assert.Equal(tls.RenegotiateFreelyAsClient, config.Renegotiation)
+
+	_, err = NewTLSConfig(TLSOptions{MinVersion: "1.9"})
+	assert.Error(err)
+}
+
+func (suite *TLSConfigSuite) TestInvalidOptions() {
+	assert := suite.Assert()
+
+	_, err := NewTLSConfig(TLSOptions{CertFile: suite.CertFile})
+	assert.Error(err)
+
+	_, err = NewTLSConfig(TLSOptions{CAFile: filepath.Join(suite.Dir, "missing.pem")})
+	assert.Error(err)
+
+	_, err = NewTLSConfig(TLSOptions{CAFile: suite.KeyFile})
+	assert.Error(err)
+}
+
+func (suite *TLSConfigSuite) TestServerRequiresClientCertificate() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// The client's certificate is self-signed, so it can serve as the server's certificate and the
+	// CA for client certificates
+	serverConfig, err := NewServerTLSConfig(ServerTLSOptions{CertFile: suite.CertFile, KeyFile: suite.KeyFile, ClientCAFile: suite.CertFile})
+	require.NoError(err)
+	assert.Equal(tls.RequireAndVerifyClientCert, serverConfig.ClientAuth)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = serverConfig
+	server.StartTLS()
+	defer server.Close()
+
+	config, err := NewTLSConfig(TLSOptions{CertFile: suite.CertFile, KeyFile: suite.KeyFile, CAFile: suite.CertFile})
+	require.NoError(err)
+	resp, err := NewHttpClient(config).Get(server.URL)
+	require.NoError(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(err)
+	assert.Equal("integrator", string(body))
+
+	config, err = NewTLSConfig(TLSOptions{CAFile: suite.CertFile})
+	require.NoError(err)
+	_, err = NewHttpClient(config).Get(server.URL)
+	assert.Error(err)
+}
+
+func (suite *TLSConfigSuite) TestInvalidServerOptions() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	_, err := NewServerTLSConfig(ServerTLSOptions{CertFile: suite.CertFile})
+	assert.Error(err)
+
+	_, err = NewServerTLSConfig(ServerTLSOptions{CertFile: suite.CertFile, KeyFile: suite.KeyFile, ClientCAFile: suite.KeyFile})
+	assert.Error(err)
+
+	config, err := NewServerTLSConfig(ServerTLSOptions{CertFile: suite.CertFile, KeyFile: suite.KeyFile, MinVersion: "1.2"})
+	require.NoError(err)
+	assert.Equal(tls.NoClientCert, config.ClientAuth)
+	assert.Equal(uint16(tls.VersionTLS12), config.MinVersion)
+}
+
+func (suite *TLSConfigSuite) selfSignedCert(cn string) (certPEM, keyPEM []byte) {
+	require := suite.Require()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
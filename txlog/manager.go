@@ -0,0 +1,330 @@
+// Package txlog records the outcome of every document transfer, and each HIE's query checkpoints,
+// so that documents are only copied once.
+package txlog
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/intervention-engine/integrator/hie"
+	"github.com/intervention-engine/integrator/ingest"
+)
+
+type Entry struct {
+	hie.QueryResponseEntry `bson:",inline"`
+	// Source is the name of the source the document was copied from
+	Source        string        `bson:"source,omitempty" json:"source,omitempty"`
+	EE            string        `bson:"ee" json:"ee"`
+	Error         string        `bson:"error,omitempty" json:"error,omitempty"`
+	FailureReason FailureReason `bson:"failureReason,omitempty" json:"failureReason,omitempty"`
+	FailureCount  int           `bson:"failureCount" json:"failureCount"`
+	// NextAttemptAt, if set, is the earliest time a failed copy is attempted again
+	NextAttemptAt time.Time `bson:"nextAttemptAt,omitempty" json:"nextAttemptAt"`
+	// DeadLetter indicates that a failed copy isn't attempted again until an operator releases it
+	DeadLetter bool      `bson:"deadLetter,omitempty" json:"deadLetter,omitempty"`
+	Date       time.Time `bson:"date" json:"date"`
+	// Ingest records the ingest service's response to a successful copy
+	Ingest *ingest.Result `bson:"ingest,omitempty" json:"ingest,omitempty"`
+}
+
+// FailureReason classifies failures, so that failures that need different follow-up can be told
+// apart.  Failures that can't be classified have an empty reason.
+type FailureReason string
+
+const (
+	// FailureNetwork indicates the HIE or ingest service couldn't be reached, or the connection failed
+	FailureNetwork FailureReason = "network"
+	// FailureAuth indicates the HIE or ingest service didn't accept the integrator's credentials
+	FailureAuth FailureReason = "auth"
+	// FailureHieNotFound indicates the HIE no longer has the document
+	FailureHieNotFound FailureReason = "hie-not-found"
+	// FailureSizeMismatch indicates the downloaded document's size didn't match the HIE's
+	FailureSizeMismatch FailureReason = "size-mismatch"
+	// FailureHashMismatch indicates the downloaded document's SHA-1 hash didn't match the HIE's
+	FailureHashMismatch FailureReason = "hash-mismatch"
+	// FailureIngestRejected indicates the ingest service rejected the document (e.g., with a 400)
+	FailureIngestRejected FailureReason = "ingest-rejected"
+	// FailureIngestUnavailable indicates the ingest service was down, overloaded or failed internally
+	FailureIngestUnavailable FailureReason = "ingest-unavailable"
+	// FailureInvalidEntry indicates the HIE's query response described the document with missing or
+	// malformed fields, so it couldn't be attempted.  Releasing it doesn't help; it's attempted when a
+	// query returns it intact.
+	FailureInvalidEntry FailureReason = "invalid-entry"
+)
+
+// Permanent reports whether failures of this kind will keep failing however often they're retried,
+// so they should be dead-lettered right away
+func (r FailureReason) Permanent() bool {
+	return r == FailureHieNotFound || r == FailureIngestRejected || r == FailureInvalidEntry
+}
+
+// Failed reports whether the document's last copy attempt failed, so it hasn't been copied yet
+func (e *Entry) Failed() bool {
+	return e.FailureCount > 0
+}
+
+// Release takes a dead-lettered entry out of the dead-letter state, so that it's attempted again on
+// the next run.  Its failure count is kept, so if a maximum attempt count is configured and the
+// copy fails again, it goes straight back to the dead-letter state.
+func (e *Entry) Release() {
+	e.DeadLetter = false
+	e.NextAttemptAt = time.Time{}
+}
+
+// Checkpoint records how far windowed and paged queries for an EE number have progressed
+type Checkpoint struct {
+	Source string `bson:"source,omitempty"`
+	EE     string `bson:"ee"`
+	// Through is the end of the last window that was fully processed
+	Through time.Time `bson:"through"`
+	// Page, if set, is the next page of a paged query that was interrupted.  The query covered
+	// PageStart to PageEnd (or was open-ended if PageEnd is nil).
+	Page      string     `bson:"page,omitempty"`
+	PageStart time.Time  `bson:"pageStart,omitempty"`
+	PageEnd   *time.Time `bson:"pageEnd,omitempty"`
+}
+
+type Manager interface {
+	FindEntriesByEE(ctx context.Context, ee string) (entries []*Entry, err error)
+	StoreEntry(ctx context.Context, entry *Entry) error
+	// FindCheckpoint returns the EE number's checkpoint for a source, or nil if it doesn't have one
+	FindCheckpoint(ctx context.Context, source, ee string) (*Checkpoint, error)
+	StoreCheckpoint(ctx context.Context, cp *Checkpoint) error
+}
+
+// AdminManager is implemented by transaction logs that operators can search and correct, in
+// addition to the queries the data copier needs
+type AdminManager interface {
+	Manager
+	// FindEntriesByDocumentID finds the transactions for a document ID from every source
+	FindEntriesByDocumentID(ctx context.Context, documentID string) (entries []*Entry, err error)
+	// FindFailures finds the failed transactions from every source that are dated on or after
+	// since.  If since is zero, every failed transaction is found.
+	FindFailures(ctx context.Context, since time.Time) (entries []*Entry, err error)
+	// RemoveEntry removes a source's transaction for a document ID, returning ErrNotFound if there
+	// isn't one
+	RemoveEntry(ctx context.Context, source, documentID string) error
+}
+
+// ReleaseEntries releases each failed entry from the dead-letter state or its backoff and stores
+// it, so that it's attempted on the next run.  Entries that haven't failed are skipped.  The
+// released entries are returned.
+func ReleaseEntries(ctx context.Context, m Manager, entries []*Entry) ([]*Entry, error) {
+	var released []*Entry
+	for _, e := range entries {
+		if !e.Failed() {
+			continue
+		}
+		e.Release()
+		if err := m.StoreEntry(ctx, e); err != nil {
+			return released, err
+		}
+		released = append(released, e)
+	}
+	return released, nil
+}
+
+// ErrNotFound is returned when removing a transaction that isn't in the log
+var ErrNotFound = errors.New("The transaction log has no entry for the document")
+
+type MgoManager struct {
+	txCollection *mgo.Collection
+	cpCollection *mgo.Collection
+}
+
+func NewMgoManager(db *mgo.Database) (*MgoManager, error) {
+	if db == nil || db.Session == nil {
+		return nil, errors.New("The Mongo DB must be configured")
+	}
+
+	return &MgoManager{
+		txCollection: db.C("transactions"),
+		cpCollection: db.C("checkpoints"),
+	}, nil
+}
+
+// FindEntriesByEE finds the transactions for an EE number from every source.  mgo doesn't support contexts, so the
+// context is only checked before the query is sent.
+func (t *MgoManager) FindEntriesByEE(ctx context.Context, ee string) (entries []*Entry, err error) {
+	if t.txCollection == nil {
+		return nil, errors.New("The transaction database collection is not configured")
+	} else if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entries = []*Entry{}
+	if err := t.txCollection.Find(bson.M{"ee": ee}).All(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// StoreEntry inserts or updates a transaction.  As with FindEntriesByEE, the context is only checked
+// before the update is sent.
+func (t *MgoManager) StoreEntry(ctx context.Context, entry *Entry) error {
+	if t.txCollection == nil {
+		return errors.New("The transaction database collection is not configured")
+	} else if entry.DocumentID == "" {
+		return errors.New("Cannot store a transaction without a valid document ID")
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := t.txCollection.UpsertId(sourceKey(entry.Source, entry.DocumentID), entry)
+	return err
+}
+
+// FindEntriesByDocumentID finds the transactions for a document ID from every source.  As with
+// FindEntriesByEE, the context is only checked before the query is sent.
+func (t *MgoManager) FindEntriesByDocumentID(ctx context.Context, documentID string) (entries []*Entry, err error) {
+	if t.txCollection == nil {
+		return nil, errors.New("The transaction database collection is not configured")
+	} else if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entries = []*Entry{}
+	if err := t.txCollection.Find(bson.M{"documentid": documentID}).All(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// FindFailures finds the failed transactions dated on or after since.  As with FindEntriesByEE, the
+// context is only checked before the query is sent.
+func (t *MgoManager) FindFailures(ctx context.Context, since time.Time) (entries []*Entry, err error) {
+	if t.txCollection == nil {
+		return nil, errors.New("The transaction database collection is not configured")
+	} else if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	query := bson.M{"failureCount": bson.M{"$gt": 0}}
+	if !since.IsZero() {
+		query["date"] = bson.M{"$gte": since}
+	}
+	entries = []*Entry{}
+	if err := t.txCollection.Find(query).All(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// RemoveEntry removes a source's transaction for a document ID.  As with FindEntriesByEE, the
+// context is only checked before the removal is sent.
+func (t *MgoManager) RemoveEntry(ctx context.Context, source, documentID string) error {
+	if t.txCollection == nil {
+		return errors.New("The transaction database collection is not configured")
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := t.txCollection.RemoveId(sourceKey(source, documentID)); err == mgo.ErrNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *MgoManager) FindCheckpoint(ctx context.Context, source, ee string) (*Checkpoint, error) {
+	if t.cpCollection == nil {
+		return nil, errors.New("The checkpoint database collection is not configured")
+	} else if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cp := new(Checkpoint)
+	if err := t.cpCollection.FindId(sourceKey(source, ee)).One(cp); err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+func (t *MgoManager) StoreCheckpoint(ctx context.Context, cp *Checkpoint) error {
+	if t.cpCollection == nil {
+		return errors.New("The checkpoint database collection is not configured")
+	} else if cp.EE == "" {
+		return errors.New("Cannot store a checkpoint without an EE number")
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := t.cpCollection.UpsertId(sourceKey(cp.Source, cp.EE), cp)
+	return err
+}
+
+// AdoptUnnamedSource moves the transactions and checkpoints recorded for the unnamed source (a single
+// HIE configured without a sources file) to the named source, so that switching to named sources
+// doesn't lose their history.  Where the named source already has a transaction or checkpoint of
+// its own, that one is kept and the unnamed source's is dropped.  It returns the number of
+// transactions moved and the transactions dropped.  As with FindEntriesByEE, the context is only
+// checked before the queries are sent.
+func (t *MgoManager) AdoptUnnamedSource(ctx context.Context, source string) (int, []*Entry, error) {
+	if t.txCollection == nil || t.cpCollection == nil {
+		return 0, nil, errors.New("The transaction and checkpoint database collections are not configured")
+	} else if source == "" {
+		return 0, nil, errors.New("Transactions can only be moved to a named source")
+	} else if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	unnamed := bson.M{"source": bson.M{"$in": []interface{}{nil, ""}}}
+
+	var entries []*Entry
+	if err := t.txCollection.Find(unnamed).All(&entries); err != nil {
+		return 0, nil, err
+	}
+	moved := 0
+	var dropped []*Entry
+	for _, e := range entries {
+		legacyID := sourceKey("", e.DocumentID)
+		e.Source = source
+		ok, err := adopt(t.txCollection, legacyID, sourceKey(source, e.DocumentID), e)
+		if err != nil {
+			return moved, dropped, err
+		} else if ok {
+			moved++
+		} else {
+			e.Source = ""
+			dropped = append(dropped, e)
+		}
+	}
+
+	var checkpoints []*Checkpoint
+	if err := t.cpCollection.Find(unnamed).All(&checkpoints); err != nil {
+		return moved, dropped, err
+	}
+	for _, cp := range checkpoints {
+		legacyID := sourceKey("", cp.EE)
+		cp.Source = source
+		if _, err := adopt(t.cpCollection, legacyID, sourceKey(source, cp.EE), cp); err != nil {
+			return moved, dropped, err
+		}
+	}
+	return moved, dropped, nil
+}
+
+// adopt stores the document under its new ID, unless there's already one with that ID, and removes
+// it from its legacy ID.  It reports whether the document was stored under its new ID.
+func adopt(c *mgo.Collection, legacyID, id string, doc interface{}) (bool, error) {
+	n, err := c.FindId(id).Count()
+	if err != nil {
+		return false, err
+	} else if n == 0 {
+		if _, err := c.UpsertId(id, doc); err != nil {
+			return false, err
+		}
+	}
+	if err := c.RemoveId(legacyID); err != nil && err != mgo.ErrNotFound {
+		return false, err
+	}
+	return n == 0, nil
+}
+
+// sourceKey namespaces a document ID or EE number by source.  The unnamed source's keys aren't
+// namespaced, so they match those stored before sources were introduced.
+func sourceKey(source, key string) string {
+	if source == "" {
+		return key
+	}
+	return source + "/" + key
+}
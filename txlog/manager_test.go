@@ -0,0 +1,400 @@
+package txlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/dbtest"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/intervention-engine/integrator/hie"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestTxLogManagerSuite(t *testing.T) {
+	suite.Run(t, new(TxLogManagerSuite))
+}
+
+type TxLogManagerSuite struct {
+	suite.Suite
+	DBServer         *dbtest.DBServer
+	DBServerPath     string
+	Session          *mgo.Session
+	Database         *mgo.Database
+	TxLogMgr         *MgoManager
+	HIEResultEntries []hie.QueryResponseEntry
+}
+
+func (suite *TxLogManagerSuite) SetupSuite() {
+	require := suite.Require()
+
+	suite.DBServer = &dbtest.DBServer{}
+	var err error
+	suite.DBServerPath, err = ioutil.TempDir("", "mongotestdb")
+	require.NoError(err)
+	suite.DBServer.SetPath(suite.DBServerPath)
+}
+
+func (suite *TxLogManagerSuite) SetupTest() {
+	require := suite.Require()
+
+	suite.Session = suite.DBServer.Session()
+	suite.Database = suite.Session.DB("redcap-riskservice-test")
+	var err error
+	suite.TxLogMgr, err = NewMgoManager(suite.Database)
+	require.NoError(err)
+
+	b, err := ioutil.ReadFile("../fixtures/response_success.json")
+	require.NoError(err)
+	var r hie.QueryResponse
+	err = json.Unmarshal(b, &r)
+	require.NoError(err)
+	suite.HIEResultEntries = r.Result
+}
+
+func (suite *TxLogManagerSuite) TearDownTest() {
+	suite.Session.Close()
+	suite.DBServer.Wipe()
+	suite.HIEResultEntries = []hie.QueryResponseEntry{}
+}
+
+func (suite *TxLogManagerSuite) TearDownSuite() {
+	suite.DBServer.Stop()
+	if err := os.RemoveAll(suite.DBServerPath); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: Error cleaning up temp directory: %s", err.Error())
+	}
+}
+
+func (suite *TxLogManagerSuite) TestStoreEntry() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// First store an error
+	entry := &Entry{
+		QueryResponseEntry: suite.HIEResultEntries[0],
+		EE:                 "123456789",
+		Error:              "Not Found",
+		FailureCount:       1,
+		Date:               time.Date(2016, time.June, 12, 3, 0, 14, 0, time.Local),
+	}
+
+	err := suite.TxLogMgr.StoreEntry(context.Background(), entry)
+	require.NoError(err)
+
+	// Now look into the DB and ensure it's what we think
+	var actual Entry
+	suite.Database.C("transactions").FindId("1.1.1.1.1.1").One(&actual)
+	assert.Equal(Entry{
+		QueryResponseEntry: hie.QueryResponseEntry{
+			RetrieveURL:  "http://test.foo.net/document/1.1.1.1.1.1",
+			CreationTime: time.Date(2014, 4, 25, 2, 51, 3, 0, time.Local),
+			Title:        "Test Continuity of Care",
+			DocumentType: "XML^HL7^231^CCD^C32",
+			DocumentID:   "1.1.1.1.1.1",
+			Hash:         "4C167E7B7F006A18ABB2E4A1A9B2489936947E91",
+			Size:         28452,
+		},
+		EE:           "123456789",
+		Error:        "Not Found",
+		FailureCount: 1,
+		Date:         time.Date(2016, time.June, 12, 3, 0, 14, 0, time.Local),
+	}, actual)
+
+	// And now lets update it with a success!
+	actual.Error = ""
+	actual.FailureCount = 0
+
+	err = suite.TxLogMgr.StoreEntry(context.Background(), &actual)
+	require.NoError(err)
+
+	var actual2 Entry
+	suite.Database.C("transactions").FindId("1.1.1.1.1.1").One(&actual2)
+	assert.Equal(Entry{
+		QueryResponseEntry: hie.QueryResponseEntry{
+			RetrieveURL:  "http://test.foo.net/document/1.1.1.1.1.1",
+			CreationTime: time.Date(2014, 4, 25, 2, 51, 3, 0, time.Local),
+			Title:        "Test Continuity of Care",
+			DocumentType: "XML^HL7^231^CCD^C32",
+			DocumentID:   "1.1.1.1.1.1",
+			Hash:         "4C167E7B7F006A18ABB2E4A1A9B2489936947E91",
+			Size:         28452,
+		},
+		EE:           "123456789",
+		Error:        "",
+		FailureCount: 0,
+		Date:         time.Date(2016, time.June, 12, 3, 0, 14, 0, time.Local),
+	}, actual2)
+}
+
+func (suite *TxLogManagerSuite) TestStoreEntryWithNoDocumentID() {
+	assert := suite.Assert()
+
+	entry := &Entry{
+		QueryResponseEntry: suite.HIEResultEntries[0],
+		EE:                 "123456789",
+		Error:              "Not Found",
+		FailureCount:       1,
+		Date:               time.Date(2016, time.June, 12, 3, 0, 14, 0, time.Local),
+	}
+	entry.DocumentID = ""
+
+	err := suite.TxLogMgr.StoreEntry(context.Background(), entry)
+	assert.Error(err)
+}
+
+func (suite *TxLogManagerSuite) TestFindEntriesByEE() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// Assume that store works (since we test it elsewhere) to setup the test
+	for i, result := range suite.HIEResultEntries {
+		entry := Entry{
+			QueryResponseEntry: result,
+			EE:                 "123456789",
+			Error:              "Not Found",
+			FailureCount:       i + 1,
+			Date:               time.Date(2016, time.June, 12, 3, 0, 14, 0, time.Local),
+		}
+		err := suite.TxLogMgr.StoreEntry(context.Background(), &entry)
+		require.NoError(err)
+	}
+
+	// Throw in one more w/ different EE just to make sure the filtering on EE is happening
+	entry := Entry{
+		QueryResponseEntry: hie.QueryResponseEntry{
+			RetrieveURL:  "http://test.foo.net/document/2.2.2.2.2.2",
+			CreationTime: time.Date(2014, 4, 26, 3, 15, 0, 0, time.Local),
+			Title:        "Test Continuity of Care",
+			DocumentType: "XML^HL7^231^CCD^C32",
+			DocumentID:   "2.2.2.2.2.2",
+			Hash:         "928371EDF671AB03CD40912DE83F7AE7888DDEF",
+			Size:         36589,
+		},
+		EE:           "987654321",
+		Error:        "",
+		FailureCount: 0,
+		Date:         time.Date(2016, time.June, 12, 3, 0, 14, 0, time.Local),
+	}
+	err := suite.TxLogMgr.StoreEntry(context.Background(), &entry)
+	require.NoError(err)
+
+	// First just test the one
+	entries, err := suite.TxLogMgr.FindEntriesByEE(context.Background(), "987654321")
+	require.NoError(err)
+	assert.Len(entries, 1)
+	assert.Equal(&entry, entries[0])
+
+	// Then test the three
+	entries, err = suite.TxLogMgr.FindEntriesByEE(context.Background(), "123456789")
+	require.NoError(err)
+	assert.Len(entries, 3)
+
+	// Just check the middle one
+	assert.Equal(&Entry{
+		QueryResponseEntry: hie.QueryResponseEntry{
+			RetrieveURL:  "http://test.foo.net/document/1.1.1.1.1.2",
+			CreationTime: time.Date(2014, 4, 25, 2, 14, 3, 0, time.Local),
+			Title:        "Test Continuity of Care",
+			DocumentType: "XML^HL7^231^CCD^C32",
+			DocumentID:   "1.1.1.1.1.2",
+			Hash:         "5B885732FE2D9D33AAEBBDA3CCE01A2F1D279E13",
+			Size:         27869,
+		},
+		EE:           "123456789",
+		Error:        "Not Found",
+		FailureCount: 2,
+		Date:         time.Date(2016, time.June, 12, 3, 0, 14, 0, time.Local),
+	}, entries[1])
+}
+
+func (suite *TxLogManagerSuite) TestFindEntriesByInvalidEE() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// Assume that store works (since we test it elsewhere) to setup the test
+	for i, result := range suite.HIEResultEntries {
+		entry := Entry{
+			QueryResponseEntry: result,
+			EE:                 "123456789",
+			Error:              "Not Found",
+			FailureCount:       i + 1,
+			Date:               time.Date(2016, time.June, 12, 3, 0, 14, 0, time.Local),
+		}
+		err := suite.TxLogMgr.StoreEntry(context.Background(), &entry)
+		require.NoError(err)
+	}
+
+	entries, err := suite.TxLogMgr.FindEntriesByEE(context.Background(), "ABCDEFGHIJK")
+	require.NoError(err)
+	assert.Empty(entries)
+}
+
+func (suite *TxLogManagerSuite) TestCheckpoints() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	cp, err := suite.TxLogMgr.FindCheckpoint(context.Background(), "", "123456789")
+	require.NoError(err)
+	assert.Nil(cp)
+
+	through := time.Date(1999, time.December, 31, 23, 59, 59, 0, time.Local)
+	require.NoError(suite.TxLogMgr.StoreCheckpoint(context.Background(), &Checkpoint{EE: "123456789", Through: through}))
+	cp, err = suite.TxLogMgr.FindCheckpoint(context.Background(), "", "123456789")
+	require.NoError(err)
+	assert.Equal(&Checkpoint{EE: "123456789", Through: through}, cp)
+
+	// Storing it again moves it forward
+	through = through.AddDate(1, 0, 0)
+	require.NoError(suite.TxLogMgr.StoreCheckpoint(context.Background(), &Checkpoint{EE: "123456789", Through: through}))
+	cp, err = suite.TxLogMgr.FindCheckpoint(context.Background(), "", "123456789")
+	require.NoError(err)
+	assert.Equal(through, cp.Through)
+
+	assert.Error(suite.TxLogMgr.StoreCheckpoint(context.Background(), &Checkpoint{Through: through}))
+}
+
+func (suite *TxLogManagerSuite) TestEntriesAreNamespacedBySource() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// The same document ID from two HIEs is two different transactions
+	for _, source := range []string{"", "hie-a", "hie-b"} {
+		entry := &Entry{
+			QueryResponseEntry: suite.HIEResultEntries[0],
+			Source:             source,
+			EE:                 "123456789",
+			Date:               time.Date(2016, time.June, 12, 3, 0, 14, 0, time.Local),
+		}
+		require.NoError(suite.TxLogMgr.StoreEntry(context.Background(), entry))
+	}
+	entries, err := suite.TxLogMgr.FindEntriesByEE(context.Background(), "123456789")
+	require.NoError(err)
+	require.Len(entries, 3)
+	sources := make(map[string]bool)
+	for _, e := range entries {
+		sources[e.Source] = true
+	}
+	assert.Equal(map[string]bool{"": true, "hie-a": true, "hie-b": true}, sources)
+
+	// And so are checkpoints
+	through := time.Date(1999, time.December, 31, 23, 59, 59, 0, time.Local)
+	require.NoError(suite.TxLogMgr.StoreCheckpoint(context.Background(), &Checkpoint{Source: "hie-a", EE: "123456789", Through: through}))
+	cp, err := suite.TxLogMgr.FindCheckpoint(context.Background(), "hie-a", "123456789")
+	require.NoError(err)
+	assert.Equal(&Checkpoint{Source: "hie-a", EE: "123456789", Through: through}, cp)
+	cp, err = suite.TxLogMgr.FindCheckpoint(context.Background(), "", "123456789")
+	require.NoError(err)
+	assert.Nil(cp)
+}
+
+func (suite *TxLogManagerSuite) TestAdoptUnnamedSource() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	ctx := context.Background()
+	date := time.Date(2016, time.June, 12, 3, 0, 14, 0, time.Local)
+	for i, source := range []string{"", "", "hie-a"} {
+		entry := &Entry{
+			QueryResponseEntry: suite.HIEResultEntries[i%2],
+			Source:             source,
+			EE:                 "123456789",
+			Date:               date,
+		}
+		require.NoError(suite.TxLogMgr.StoreEntry(ctx, entry))
+	}
+	require.NoError(suite.TxLogMgr.StoreCheckpoint(ctx, &Checkpoint{EE: "123456789", Through: date}))
+
+	moved, dropped, err := suite.TxLogMgr.AdoptUnnamedSource(ctx, "hie-a")
+	require.NoError(err)
+	// The unnamed source's transaction for the document hie-a already has is dropped
+	assert.Equal(1, moved)
+	require.Len(dropped, 1)
+	assert.Equal(suite.HIEResultEntries[0].DocumentID, dropped[0].DocumentID)
+	entries, err := suite.TxLogMgr.FindEntriesByEE(ctx, "123456789")
+	require.NoError(err)
+	require.Len(entries, 2)
+	for _, e := range entries {
+		assert.Equal("hie-a", e.Source)
+	}
+	cp, err := suite.TxLogMgr.FindCheckpoint(ctx, "hie-a", "123456789")
+	require.NoError(err)
+	require.NotNil(cp)
+	assert.True(date.Equal(cp.Through))
+	cp, err = suite.TxLogMgr.FindCheckpoint(ctx, "", "123456789")
+	require.NoError(err)
+	assert.Nil(cp)
+
+	// Adopting again finds nothing left to move
+	moved, dropped, err = suite.TxLogMgr.AdoptUnnamedSource(ctx, "hie-a")
+	require.NoError(err)
+	assert.Equal(0, moved)
+	assert.Empty(dropped)
+}
+
+func (suite *TxLogManagerSuite) TestFindEntriesByDocumentID() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	entry := &Entry{QueryResponseEntry: suite.HIEResultEntries[0], EE: "123456789", Date: time.Date(2016, time.June, 12, 3, 0, 14, 0, time.Local)}
+	require.NoError(suite.TxLogMgr.StoreEntry(context.Background(), entry))
+	entry.Source = "other"
+	require.NoError(suite.TxLogMgr.StoreEntry(context.Background(), entry))
+	require.NoError(suite.TxLogMgr.StoreEntry(context.Background(), &Entry{QueryResponseEntry: suite.HIEResultEntries[1], EE: "123456789"}))
+
+	entries, err := suite.TxLogMgr.FindEntriesByDocumentID(context.Background(), "1.1.1.1.1.1")
+	require.NoError(err)
+	require.Len(entries, 2)
+	for _, e := range entries {
+		assert.Equal("1.1.1.1.1.1", e.DocumentID)
+	}
+
+	entries, err = suite.TxLogMgr.FindEntriesByDocumentID(context.Background(), "9.9.9.9.9.9")
+	require.NoError(err)
+	assert.Empty(entries)
+}
+
+func (suite *TxLogManagerSuite) TestFindFailures() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	for i, result := range suite.HIEResultEntries {
+		entry := Entry{
+			QueryResponseEntry: result,
+			EE:                 "123456789",
+			FailureCount:       i,
+			Date:               time.Date(2016, time.June, 10+i, 3, 0, 14, 0, time.Local),
+		}
+		require.NoError(suite.TxLogMgr.StoreEntry(context.Background(), &entry))
+	}
+
+	entries, err := suite.TxLogMgr.FindFailures(context.Background(), time.Time{})
+	require.NoError(err)
+	assert.Len(entries, 2)
+
+	entries, err = suite.TxLogMgr.FindFailures(context.Background(), time.Date(2016, time.June, 12, 0, 0, 0, 0, time.Local))
+	require.NoError(err)
+	require.Len(entries, 1)
+	assert.Equal("1.1.1.1.1.3", entries[0].DocumentID)
+}
+
+func (suite *TxLogManagerSuite) TestRemoveEntry() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	entry := &Entry{QueryResponseEntry: suite.HIEResultEntries[0], EE: "123456789", Source: "other"}
+	require.NoError(suite.TxLogMgr.StoreEntry(context.Background(), entry))
+
+	assert.Equal(ErrNotFound, suite.TxLogMgr.RemoveEntry(context.Background(), "", "1.1.1.1.1.1"))
+	require.NoError(suite.TxLogMgr.RemoveEntry(context.Background(), "other", "1.1.1.1.1.1"))
+	entries, err := suite.TxLogMgr.FindEntriesByEE(context.Background(), "123456789")
+	require.NoError(err)
+	assert.Empty(entries)
+}
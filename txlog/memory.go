@@ -0,0 +1,142 @@
+package txlog
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryManager keeps the transaction log in memory
+type MemoryManager struct {
+	mu          sync.Mutex
+	entries     map[string]*Entry
+	checkpoints map[string]*Checkpoint
+}
+
+func NewMemoryManager() *MemoryManager {
+	return &MemoryManager{
+		entries:     make(map[string]*Entry),
+		checkpoints: make(map[string]*Checkpoint),
+	}
+}
+
+// Entries returns copies of every entry in the log, ordered by source and document ID
+func (m *MemoryManager) Entries() []*Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for key := range m.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	entries := make([]*Entry, len(keys))
+	for i, key := range keys {
+		e := *m.entries[key]
+		entries[i] = &e
+	}
+	return entries
+}
+
+func (m *MemoryManager) FindEntriesByEE(ctx context.Context, ee string) ([]*Entry, error) {
+	return m.find(func(e *Entry) bool { return e.EE == ee }), nil
+}
+
+func (m *MemoryManager) StoreEntry(ctx context.Context, entry *Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := *entry
+	m.entries[sourceKey(entry.Source, entry.DocumentID)] = &e
+	return nil
+}
+
+func (m *MemoryManager) FindEntriesByDocumentID(ctx context.Context, documentID string) ([]*Entry, error) {
+	return m.find(func(e *Entry) bool { return e.DocumentID == documentID }), nil
+}
+
+func (m *MemoryManager) FindFailures(ctx context.Context, since time.Time) ([]*Entry, error) {
+	return m.find(func(e *Entry) bool { return e.Failed() && !e.Date.Before(since) }), nil
+}
+
+func (m *MemoryManager) RemoveEntry(ctx context.Context, source, documentID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := sourceKey(source, documentID)
+	if _, ok := m.entries[key]; !ok {
+		return ErrNotFound
+	}
+	delete(m.entries, key)
+	return nil
+}
+
+// find returns copies of the entries that match
+func (m *MemoryManager) find(match func(e *Entry) bool) []*Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []*Entry
+	for _, entry := range m.entries {
+		if match(entry) {
+			e := *entry
+			entries = append(entries, &e)
+		}
+	}
+	return entries
+}
+
+func (m *MemoryManager) FindCheckpoint(ctx context.Context, source, ee string) (*Checkpoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cp, ok := m.checkpoints[sourceKey(source, ee)]
+	if !ok {
+		return nil, nil
+	}
+	c := *cp
+	return &c, nil
+}
+
+func (m *MemoryManager) StoreCheckpoint(ctx context.Context, cp *Checkpoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *cp
+	m.checkpoints[sourceKey(cp.Source, cp.EE)] = &c
+	return nil
+}
+
+// AdoptUnnamedSource moves the unnamed source's transactions and checkpoints to the named source,
+// like MgoManager's does
+func (m *MemoryManager) AdoptUnnamedSource(ctx context.Context, source string) (int, []*Entry, error) {
+	if source == "" {
+		return 0, nil, errors.New("Transactions can only be moved to a named source")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	moved := 0
+	var dropped []*Entry
+	for key, e := range m.entries {
+		if e.Source != "" {
+			continue
+		}
+		delete(m.entries, key)
+		if _, ok := m.entries[sourceKey(source, e.DocumentID)]; ok {
+			d := *e
+			dropped = append(dropped, &d)
+			continue
+		}
+		e.Source = source
+		m.entries[sourceKey(source, e.DocumentID)] = e
+		moved++
+	}
+	for key, cp := range m.checkpoints {
+		if cp.Source != "" {
+			continue
+		}
+		if _, ok := m.checkpoints[sourceKey(source, cp.EE)]; !ok {
+			cp.Source = source
+			m.checkpoints[sourceKey(source, cp.EE)] = cp
+		}
+		delete(m.checkpoints, key)
+	}
+	SortByDate(dropped)
+	return moved, dropped, nil
+}
@@ -0,0 +1,151 @@
+package txlog
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/intervention-engine/integrator/hie"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestMemoryManagerSuite(t *testing.T) {
+	suite.Run(t, new(MemoryManagerSuite))
+}
+
+type MemoryManagerSuite struct {
+	suite.Suite
+}
+
+func (suite *MemoryManagerSuite) TestStoreAndFind() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	m := NewMemoryManager()
+	ctx := context.Background()
+	entry := &Entry{QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "1.1"}, EE: "123456789"}
+	require.NoError(m.StoreEntry(ctx, entry))
+	entry.Source = "other"
+	require.NoError(m.StoreEntry(ctx, entry))
+	entry.FailureCount = 1
+	require.NoError(m.StoreEntry(ctx, entry))
+
+	entries, err := m.FindEntriesByEE(ctx, "123456789")
+	require.NoError(err)
+	assert.Len(entries, 2)
+	entries = m.Entries()
+	require.Len(entries, 2)
+	assert.Equal("", entries[0].Source)
+	assert.Equal(1, entries[1].FailureCount)
+	// Stored entries are copies
+	entries[1].FailureCount = 5
+	assert.Equal(1, m.Entries()[1].FailureCount)
+
+	cp, err := m.FindCheckpoint(ctx, "", "123456789")
+	require.NoError(err)
+	assert.Nil(cp)
+	require.NoError(m.StoreCheckpoint(ctx, &Checkpoint{EE: "123456789", Page: "2"}))
+	cp, err = m.FindCheckpoint(ctx, "", "123456789")
+	require.NoError(err)
+	assert.Equal("2", cp.Page)
+}
+
+func (suite *MemoryManagerSuite) TestAdminQueries() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	m := NewMemoryManager()
+	ctx := context.Background()
+	june := func(day int) time.Time { return time.Date(2016, time.June, day, 0, 0, 0, 0, time.UTC) }
+	require.NoError(m.StoreEntry(ctx, &Entry{QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "1.1"}, EE: "1", Date: june(1)}))
+	require.NoError(m.StoreEntry(ctx, &Entry{QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "1.1"}, Source: "other", EE: "1", FailureCount: 1, Date: june(2)}))
+	require.NoError(m.StoreEntry(ctx, &Entry{QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "1.2"}, EE: "1", FailureCount: 3, DeadLetter: true, Date: june(3)}))
+
+	entries, err := m.FindEntriesByDocumentID(ctx, "1.1")
+	require.NoError(err)
+	assert.Len(entries, 2)
+
+	entries, err = m.FindFailures(ctx, time.Time{})
+	require.NoError(err)
+	assert.Len(entries, 2)
+	entries, err = m.FindFailures(ctx, june(3))
+	require.NoError(err)
+	require.Len(entries, 1)
+	assert.Equal("1.2", entries[0].DocumentID)
+
+	assert.Equal(ErrNotFound, m.RemoveEntry(ctx, "missing", "1.1"))
+	require.NoError(m.RemoveEntry(ctx, "other", "1.1"))
+	entries, err = m.FindEntriesByDocumentID(ctx, "1.1")
+	require.NoError(err)
+	require.Len(entries, 1)
+	assert.Equal("", entries[0].Source)
+}
+
+func (suite *MemoryManagerSuite) TestReleaseEntries() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	m := NewMemoryManager()
+	ctx := context.Background()
+	entries := []*Entry{
+		{QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "1.1"}, EE: "1"},
+		{QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "1.2"}, EE: "1", FailureCount: 3, DeadLetter: true},
+		{QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "1.3"}, EE: "1", FailureCount: 1, NextAttemptAt: time.Now().Add(time.Hour)},
+	}
+	for _, e := range entries {
+		require.NoError(m.StoreEntry(ctx, e))
+	}
+
+	released, err := ReleaseEntries(ctx, m, entries)
+	require.NoError(err)
+	require.Len(released, 2)
+	assert.Equal("1.2", released[0].DocumentID)
+	assert.Equal("1.3", released[1].DocumentID)
+
+	stored := m.Entries()
+	assert.False(stored[1].DeadLetter)
+	assert.Equal(3, stored[1].FailureCount)
+	assert.True(stored[2].NextAttemptAt.IsZero())
+	assert.Equal("failed", stored[2].Status())
+}
+
+func (suite *MemoryManagerSuite) TestAdoptUnnamedSource() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	m := NewMemoryManager()
+	ctx := context.Background()
+	require.NoError(m.StoreEntry(ctx, &Entry{QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "1.1"}, EE: "1"}))
+	require.NoError(m.StoreEntry(ctx, &Entry{QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "1.2"}, EE: "1", FailureCount: 1}))
+	require.NoError(m.StoreEntry(ctx, &Entry{QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "1.2"}, Source: "north", EE: "1"}))
+	require.NoError(m.StoreCheckpoint(ctx, &Checkpoint{EE: "1", Page: "2"}))
+
+	moved, dropped, err := m.AdoptUnnamedSource(ctx, "north")
+	require.NoError(err)
+	assert.Equal(1, moved)
+	// The unnamed source's transaction for a document the named source already has is dropped
+	require.Len(dropped, 1)
+	assert.Equal("1.2", dropped[0].DocumentID)
+	assert.Equal("", dropped[0].Source)
+	assert.Equal(1, dropped[0].FailureCount)
+	entries := m.Entries()
+	require.Len(entries, 2)
+	assert.Equal("north", entries[0].Source)
+	assert.Equal("1.1", entries[0].DocumentID)
+	// The named source's own transaction is kept
+	assert.Equal("1.2", entries[1].DocumentID)
+	assert.False(entries[1].Failed())
+	cp, err := m.FindCheckpoint(ctx, "north", "1")
+	require.NoError(err)
+	require.NotNil(cp)
+	assert.Equal("2", cp.Page)
+	cp, err = m.FindCheckpoint(ctx, "", "1")
+	require.NoError(err)
+	assert.Nil(cp)
+
+	_, _, err = m.AdoptUnnamedSource(ctx, "")
+	assert.Error(err)
+}
@@ -0,0 +1,129 @@
+package txlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Status summarizes the entry's state: "copied", "failed" (to be attempted again) or
+// "dead-lettered" (not attempted again until an operator releases it)
+func (e *Entry) Status() string {
+	switch {
+	case !e.Failed():
+		return "copied"
+	case e.DeadLetter:
+		return "dead-lettered"
+	}
+	return "failed"
+}
+
+// SortByDate sorts entries by date, then by source and document ID
+func SortByDate(entries []*Entry) {
+	sort.Sort(byDate(entries))
+}
+
+type byDate []*Entry
+
+func (b byDate) Len() int      { return len(b) }
+func (b byDate) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byDate) Less(i, j int) bool {
+	if !b[i].Date.Equal(b[j].Date) {
+		return b[i].Date.Before(b[j].Date)
+	} else if b[i].Source != b[j].Source {
+		return b[i].Source < b[j].Source
+	}
+	return b[i].DocumentID < b[j].DocumentID
+}
+
+// WriteTable writes a row for each entry, with its status and, if it failed, why and when it's
+// attempted next
+func WriteTable(w io.Writer, entries []*Entry) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOCUMENT ID\tSOURCE\tEE\tDATE\tSTATUS\tFAILURES\tREASON\tNEXT ATTEMPT")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", e.DocumentID, orDash(e.Source), e.EE, formatTime(e.Date),
+			e.Status(), e.FailureCount, orDash(string(e.FailureReason)), nextAttempt(e))
+	}
+	return tw.Flush()
+}
+
+// WriteDetails writes every field of each entry, for a closer look at a document's transactions
+func WriteDetails(w io.Writer, entries []*Entry) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for i, e := range entries {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "Document ID:\t%s\n", e.DocumentID)
+		fmt.Fprintf(tw, "Source:\t%s\n", orDash(e.Source))
+		fmt.Fprintf(tw, "EE:\t%s\n", e.EE)
+		fmt.Fprintf(tw, "Title:\t%s\n", orDash(e.Title))
+		fmt.Fprintf(tw, "Type:\t%s\n", orDash(e.DocumentType))
+		fmt.Fprintf(tw, "Created:\t%s\n", formatTime(e.CreationTime))
+		fmt.Fprintf(tw, "Size:\t%d\n", e.Size)
+		fmt.Fprintf(tw, "Hash:\t%s\n", orDash(e.Hash))
+		fmt.Fprintf(tw, "Retrieve URL:\t%s\n", orDash(e.RetrieveURL))
+		fmt.Fprintf(tw, "Date:\t%s\n", formatTime(e.Date))
+		fmt.Fprintf(tw, "Status:\t%s\n", e.Status())
+		if e.Failed() {
+			fmt.Fprintf(tw, "Failures:\t%d\n", e.FailureCount)
+			fmt.Fprintf(tw, "Reason:\t%s\n", orDash(string(e.FailureReason)))
+			fmt.Fprintf(tw, "Error:\t%s\n", orDash(e.Error))
+			fmt.Fprintf(tw, "Next attempt:\t%s\n", nextAttempt(e))
+		}
+		if e.Ingest != nil {
+			fmt.Fprintf(tw, "Ingest status:\t%d\n", e.Ingest.Status)
+			fmt.Fprintf(tw, "Ingest location:\t%s\n", orDash(e.Ingest.Location))
+			fmt.Fprintf(tw, "Ingest created:\t%s\n", orDash(strings.Join(e.Ingest.Created, ", ")))
+			for _, warning := range e.Ingest.Warnings {
+				fmt.Fprintf(tw, "Ingest warning:\t%s\n", warning)
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+// WriteJSON writes the entries as an indented JSON array
+func WriteJSON(w io.Writer, entries []*Entry) error {
+	if entries == nil {
+		entries = []*Entry{}
+	}
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// nextAttempt describes when a failed entry is attempted again
+func nextAttempt(e *Entry) string {
+	switch {
+	case !e.Failed():
+		return "-"
+	case e.DeadLetter:
+		return "when released"
+	case e.NextAttemptAt.After(time.Now()):
+		return formatTime(e.NextAttemptAt)
+	}
+	return "next run"
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,117 @@
+package txlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/intervention-engine/integrator/hie"
+	"github.com/intervention-engine/integrator/ingest"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestReportSuite(t *testing.T) {
+	suite.Run(t, new(ReportSuite))
+}
+
+type ReportSuite struct {
+	suite.Suite
+	Entries []*Entry
+}
+
+func (suite *ReportSuite) SetupTest() {
+	suite.Entries = []*Entry{
+		{
+			QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "1.2", Title: "Discharge Summary"},
+			EE:                 "123456789",
+			Error:              "Failed to post document.  Received 400: 400 Bad Request",
+			FailureReason:      FailureIngestRejected,
+			FailureCount:       1,
+			DeadLetter:         true,
+			Date:               time.Date(2016, time.June, 2, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			QueryResponseEntry: hie.QueryResponseEntry{DocumentID: "1.1", Title: "Continuity of Care"},
+			Source:             "north",
+			EE:                 "123456789",
+			Date:               time.Date(2016, time.June, 1, 12, 0, 0, 0, time.UTC),
+			Ingest:             &ingest.Result{Status: 201, Created: []string{"Binary/b1", "DocumentReference/d1"}, Warnings: []string{"warning: Unknown code"}},
+		},
+	}
+}
+
+func (suite *ReportSuite) TearDownTest() {
+	suite.Entries = nil
+}
+
+func (suite *ReportSuite) TestSortByDate() {
+	assert := suite.Assert()
+
+	SortByDate(suite.Entries)
+	assert.Equal("1.1", suite.Entries[0].DocumentID)
+	assert.Equal("1.2", suite.Entries[1].DocumentID)
+}
+
+func (suite *ReportSuite) TestStatus() {
+	assert := suite.Assert()
+
+	assert.Equal("dead-lettered", suite.Entries[0].Status())
+	assert.Equal("copied", suite.Entries[1].Status())
+	suite.Entries[0].DeadLetter = false
+	assert.Equal("failed", suite.Entries[0].Status())
+}
+
+func (suite *ReportSuite) TestWriteTable() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var b bytes.Buffer
+	require.NoError(WriteTable(&b, suite.Entries))
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	require.Len(lines, 3)
+	assert.Equal([]string{"DOCUMENT", "ID", "SOURCE", "EE", "DATE", "STATUS", "FAILURES", "REASON", "NEXT", "ATTEMPT"}, strings.Fields(lines[0]))
+	assert.Equal([]string{"1.2", "-", "123456789", "2016-06-02T12:00:00Z", "dead-lettered", "1", "ingest-rejected", "when", "released"}, strings.Fields(lines[1]))
+	assert.Equal([]string{"1.1", "north", "123456789", "2016-06-01T12:00:00Z", "copied", "0", "-", "-"}, strings.Fields(lines[2]))
+}
+
+func (suite *ReportSuite) TestWriteDetails() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var b bytes.Buffer
+	require.NoError(WriteDetails(&b, suite.Entries))
+	out := b.String()
+	// Each entry's fields are aligned separately
+	assert.Contains(out, "Title:         Discharge Summary\n")
+	assert.Contains(out, "Error:         Failed to post document.  Received 400: 400 Bad Request\n")
+	assert.Contains(out, "Next attempt:  when released\n\n")
+	assert.Contains(out, "Ingest created:   Binary/b1, DocumentReference/d1\n")
+	assert.Contains(out, "Ingest warning:   warning: Unknown code\n")
+	// Copied documents don't list failure details
+	assert.Equal(1, strings.Count(out, "Reason:"))
+}
+
+func (suite *ReportSuite) TestWriteJSON() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var b bytes.Buffer
+	require.NoError(WriteJSON(&b, suite.Entries))
+	var entries []map[string]interface{}
+	require.NoError(json.Unmarshal(b.Bytes(), &entries))
+	require.Len(entries, 2)
+	assert.Equal("1.2", entries[0]["documentID"])
+	assert.Equal("ingest-rejected", entries[0]["failureReason"])
+	assert.Equal(true, entries[0]["deadLetter"])
+	assert.Equal("north", entries[1]["source"])
+	assert.Equal(float64(201), entries[1]["ingest"].(map[string]interface{})["status"])
+
+	b.Reset()
+	require.NoError(WriteJSON(&b, nil))
+	assert.Equal("[]\n", b.String())
+}